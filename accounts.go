@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// accountDeletion lists data and Catapult resources of a user which are removed with the account
+type accountDeletion struct {
+	DryRun        bool     `json:"dryRun"`
+	UserID        uint     `json:"userId"`
+	UserName      string   `json:"userName"`
+	PhoneNumber   string   `json:"phoneNumber"`
+	EndpointID    string   `json:"endpointId"`
+	MediaFiles    []string `json:"mediaFiles"` // voice messages and greetings
+	VoiceMessages int      `json:"voiceMessages"`
+	CallRecords   int      `json:"callRecords"`
+}
+
+func newAccountDeletion(user *User, db *gorm.DB) (*accountDeletion, error) {
+	deletion := &accountDeletion{
+		UserID:      user.ID,
+		UserName:    user.UserName,
+		PhoneNumber: user.PhoneNumber,
+		EndpointID:  user.EndpointID,
+		MediaFiles:  []string{},
+	}
+	messages := []VoiceMailMessage{}
+	if err := db.Where("user_id = ?", user.ID).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	deletion.VoiceMessages = len(messages)
+	for _, message := range messages {
+		if message.MediaURL != "" {
+			deletion.MediaFiles = append(deletion.MediaFiles, getMediaName(message.MediaURL))
+		}
+	}
+	for _, greetingType := range GreetingTypes {
+		// greetings which aren't stored by the app for the user are skipped
+		if name := getGreetingMediaName(user, user.GetGreetingURL(greetingType), db); name != "" {
+			deletion.MediaFiles = append(deletion.MediaFiles, name)
+		}
+	}
+	if err := db.Model(&CallRecord{}).Where("user_id = ?", user.ID).Count(&deletion.CallRecords).Error; err != nil {
+		return nil, err
+	}
+	return deletion, nil
+}
+
+// run removes Catapult resources and then all data of the user. Resources which have been removed already are
+// ignored by Catapult API so failed deletion can be repeated.
+func (d *accountDeletion) run(api catapultAPIInterface, db *gorm.DB) error {
+	for _, name := range d.MediaFiles {
+		debugf("Removing media file %s\n", name)
+		if err := api.DeleteMediaFile(name); err != nil {
+			return err
+		}
+	}
+	if d.EndpointID != "" {
+		debugf("Removing SIP account %s\n", d.EndpointID)
+		if err := api.DeleteSIPAccount(d.EndpointID); err != nil {
+			return err
+		}
+	}
+	if d.PhoneNumber != "" {
+		debugf("Releasing phone number %s\n", d.PhoneNumber)
+		if err := api.ReleasePhoneNumber(d.PhoneNumber); err != nil {
+			return err
+		}
+	}
+	tx := db.Begin().Unscoped()
+	deletions := []*gorm.DB{
+		tx.Where("voice_mail_message_id IN (SELECT id FROM voice_mail_messages WHERE user_id = ?)", d.UserID).
+			Delete(&EmailDelivery{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&VoiceMailMessage{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&RingStep{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&WorkingHours{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&Holiday{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&CallRecord{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&ActiveCall{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&VoiceMailSession{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&GreetingSession{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&Registration{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&PasswordResetCode{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&Session{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&StreamTicket{}),
+		tx.Where("user_id = ?", d.UserID).Delete(&GreetingMedia{}),
+		tx.Where("id = ?", d.UserID).Delete(&User{}),
+	}
+	for _, result := range deletions {
+		if result.Error != nil {
+			tx.Rollback()
+			return result.Error
+		}
+	}
+	return tx.Commit().Error
+}
+
+// handleAccountDeletion removes account of the user. Removal should be confirmed by user name in parameter confirm,
+// parameter dryRun=true returns list of removed data without removing it.
+func handleAccountDeletion(c *gin.Context, user *User, db *gorm.DB) {
+	api := c.MustGet("catapultAPI").(catapultAPIInterface)
+	deletion, err := newAccountDeletion(user, db)
+	if err != nil {
+		setError(c, http.StatusBadGateway, err, "Error on getting user's data")
+		return
+	}
+	if c.Query("dryRun") == "true" {
+		deletion.DryRun = true
+		c.JSON(http.StatusOK, deletion)
+		return
+	}
+	if c.Query("confirm") != user.UserName {
+		setErrorMessage(c, http.StatusBadRequest, "Removal of the account should be confirmed by user name in parameter confirm")
+		return
+	}
+	debugf("Removing account of user %s\n", user.UserName)
+	if err = deletion.run(api, db); err != nil {
+		setCatapultError(c, err, "Error on removing the account: "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, deletion)
+}
+
+// adminAuthMiddleware allows requests with token from environment variable ADMIN_TOKEN in header X-Admin-Token.
+// Admin routes are disabled if the variable is not set.
+func adminAuthMiddleware(c *gin.Context) {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" || subtle.ConstantTimeCompare([]byte(c.Request.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+		debugf("Rejected admin request %s from %s\n", c.Request.URL.Path, c.ClientIP())
+		setErrorMessage(c, http.StatusUnauthorized, "Invalid admin token")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+// createVoiceMailData adds greetings, voice message and call record to the user. Only uploaded and recorded greetings
+// are owned by the user.
+func createVoiceMailData(t *testing.T, db *gorm.DB) *User {
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.NoError(t, addRecordedGreeting(user, NoAnswerGreeting,
+		"https://api.catapult.inetwork.com/v1/users/userID/media/recording.wav", db))
+	user.SetGreetingURL(BusyGreeting, fmt.Sprintf("https://api.catapult.inetwork.com/v1/users/userID/media/greeting-%d-busy-1.wav", user.ID))
+	user.SetGreetingURL(AfterHoursGreeting, "https://api.catapult.inetwork.com/v1/users/userID/media/greeting-999-busy-1.wav")
+	user.SetGreetingURL(AbsenceGreeting, "https://example.com/v1/users/userID/media/greeting.wav")
+	assert.NoError(t, db.Save(user).Error)
+	message := &VoiceMailMessage{UserID: user.ID, MediaURL: "https://api.catapult.inetwork.com/v1/users/userID/media/message.wav"}
+	assert.NoError(t, db.Create(message).Error)
+	assert.NoError(t, db.Create(&EmailDelivery{VoiceMailMessageID: message.ID, Email: "user1@test.net"}).Error)
+	assert.NoError(t, db.Create(&CallRecord{UserID: user.ID, CallID: "callID"}).Error)
+	return user
+}
+
+func TestRouteDeleteAccountDryRun(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := createVoiceMailData(t, db)
+	api := &fakeCatapultAPI{}
+	result := map[string]interface{}{}
+	w := makeRequest(t, api, nil, db, http.MethodDelete, "/account?dryRun=true", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, result["dryRun"])
+	assert.Equal(t, "+1234567890", result["phoneNumber"])
+	assert.Equal(t, "789", result["endpointId"])
+	assert.Equal(t, []interface{}{"message.wav", "recording.wav", fmt.Sprintf("greeting-%d-busy-1.wav", user.ID)},
+		result["mediaFiles"])
+	assert.Equal(t, float64(1), result["voiceMessages"])
+	assert.Equal(t, float64(1), result["callRecords"])
+	api.AssertNotCalled(t, "DeleteSIPAccount", "789")
+	assert.NoError(t, db.First(&User{}, user.ID).Error)
+}
+
+func TestRouteDeleteAccount(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := createVoiceMailData(t, db)
+	api := &fakeCatapultAPI{}
+	api.On("DeleteMediaFile", "message.wav").Return(nil)
+	api.On("DeleteMediaFile", "recording.wav").Return(nil)
+	api.On("DeleteMediaFile", fmt.Sprintf("greeting-%d-busy-1.wav", user.ID)).Return(nil)
+	api.On("DeleteSIPAccount", "789").Return(nil)
+	api.On("ReleasePhoneNumber", "+1234567890").Return(nil)
+	w := makeRequest(t, api, nil, db, http.MethodDelete, "/account?confirm=user1", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+	assert.True(t, db.Unscoped().First(&User{}, user.ID).RecordNotFound())
+	count := 0
+	db.Unscoped().Model(&VoiceMailMessage{}).Where("user_id = ?", user.ID).Count(&count)
+	assert.Equal(t, 0, count)
+	db.Unscoped().Model(&EmailDelivery{}).Count(&count)
+	assert.Equal(t, 0, count)
+	db.Unscoped().Model(&CallRecord{}).Where("user_id = ?", user.ID).Count(&count)
+	assert.Equal(t, 0, count)
+	db.Unscoped().Model(&GreetingMedia{}).Where("user_id = ?", user.ID).Count(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestRouteDeleteAccountFailWithoutConfirmation(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	api := &fakeCatapultAPI{}
+	w := makeRequest(t, api, nil, db, http.MethodDelete, "/account?confirm=user2", token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	api.AssertNotCalled(t, "ReleasePhoneNumber", "+1234567890")
+	assert.NoError(t, db.First(&User{}, "user_name = ?", "user1").Error)
+}
+
+func TestRouteDeleteAccountFailWithCatapultError(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	api := &fakeCatapultAPI{}
+	api.On("DeleteSIPAccount", "789").Return(errors.New("Http code 500"))
+	w := makeRequest(t, api, nil, db, http.MethodDelete, "/account?confirm=user1", token)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	api.AssertNotCalled(t, "ReleasePhoneNumber", "+1234567890")
+	// deletion can be repeated
+	assert.NoError(t, db.First(&User{}, "user_name = ?", "user1").Error)
+}
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	router := gin.New()
+	router.GET("/admin", adminAuthMiddleware, func(c *gin.Context) {
+		c.String(http.StatusOK, "")
+	})
+	request := func(token string) int {
+		req, _ := http.NewRequest(http.MethodGet, "/admin", nil)
+		req.Header.Set("X-Admin-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	defer os.Setenv("ADMIN_TOKEN", os.Getenv("ADMIN_TOKEN"))
+	os.Setenv("ADMIN_TOKEN", "")
+	assert.Equal(t, http.StatusUnauthorized, request(""))
+	os.Setenv("ADMIN_TOKEN", "adminToken")
+	assert.Equal(t, http.StatusUnauthorized, request("wrong"))
+	assert.Equal(t, http.StatusOK, request("adminToken"))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appleboy/gin-jwt"
+	j "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	errInvalidAuthToken = errors.New("Invalid auth token")
+	errAuthTokenRevoked = errors.New("Auth token has been revoked")
+)
+
+// jwtMiddleware is gin-jwt middleware which accepts tokens signed by any of verification keys. New and refreshed
+// tokens are signed by the first key. Each login creates a session (see sessions.go), tokens of closed sessions
+// are rejected.
+type jwtMiddleware struct {
+	*jwt.GinJWTMiddleware
+	keys [][]byte
+	db   *gorm.DB
+}
+
+// authToken is a validated auth token
+type authToken struct {
+	claims  map[string]interface{}
+	user    *User
+	session *Session
+}
+
+func newJWTMiddleware(middleware *jwt.GinJWTMiddleware, cfg *appConfig, db *gorm.DB) (*jwtMiddleware, error) {
+	middleware.Key = cfg.signingKey()
+	if err := middleware.MiddlewareInit(); err != nil {
+		return nil, err
+	}
+	return &jwtMiddleware{middleware, cfg.verificationKeys(), db}, nil
+}
+
+// MiddlewareFunc checks auth token from header Authorization and makes the user and the session available as
+// "user" and "session"
+func (mw *jwtMiddleware) MiddlewareFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parts := strings.SplitN(c.Request.Header.Get("Authorization"), " ", 2)
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			mw.unauthorized(c, http.StatusUnauthorized, "Invalid auth header")
+			return
+		}
+		token, err := mw.validateToken(parts[1])
+		if err != nil {
+			mw.unauthorized(c, http.StatusUnauthorized, err.Error())
+			return
+		}
+		id := strconv.FormatUint(uint64(token.user.ID), 10)
+		c.Set("JWT_PAYLOAD", token.claims)
+		c.Set("userID", id)
+		c.Set("user", token.user)
+		c.Set("session", token.session)
+		if !mw.Authorizator(id, c) {
+			mw.unauthorized(c, http.StatusForbidden, "You don't have permission to access.")
+			return
+		}
+		c.Next()
+	}
+}
+
+// validateToken checks signature and expiration of auth token, its session and version. All routes which accept
+// auth tokens use it.
+func (mw *jwtMiddleware) validateToken(tokenString string) (*authToken, error) {
+	token, err := parseJWT(tokenString, mw.keys)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := parseAuthClaims(token.Claims)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{}
+	if err = mw.db.First(user, claims.userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errInvalidAuthToken
+		}
+		return nil, err
+	}
+	if claims.version != user.TokenVersion {
+		return nil, errAuthTokenRevoked // password has been changed
+	}
+	session, err := getSession(user, claims.tokenID, time.Now(), mw.db)
+	if err != nil {
+		return nil, err
+	}
+	return &authToken{token.Claims, user, session}, nil
+}
+
+// LoginHandler checks user name and password and responds with auth token of new session
+func (mw *jwtMiddleware) LoginHandler(c *gin.Context) {
+	form := &jwt.Login{}
+	if c.BindJSON(form) != nil {
+		mw.unauthorized(c, http.StatusBadRequest, "Missing Username or Password")
+		return
+	}
+	userID, ok := mw.Authenticator(form.Username, form.Password, c)
+	if !ok {
+		mw.unauthorized(c, http.StatusUnauthorized, "Incorrect Username / Password")
+		return
+	}
+	user := &User{}
+	if err := mw.db.First(user, userID).Error; err != nil {
+		setError(c, http.StatusBadGateway, err, "Error on getting user's data")
+		return
+	}
+	session, err := createSession(user, c.Request.UserAgent(), c.ClientIP(), mw.MaxRefresh, time.Now(), mw.db)
+	if err != nil {
+		setError(c, http.StatusBadGateway, err, "Error on creating session")
+		return
+	}
+	mw.respondWithToken(c, user, session)
+}
+
+// respondWithToken sends new auth token of the session
+func (mw *jwtMiddleware) respondWithToken(c *gin.Context, user *User, session *Session) {
+	token, expire, err := mw.createToken(user, session)
+	if err != nil {
+		setError(c, http.StatusInternalServerError, err, "Error on creating auth token")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":  token,
+		"expire": expire.Format(time.RFC3339),
+	})
+}
+
+func (mw *jwtMiddleware) unauthorized(c *gin.Context, code int, message string) {
+	c.Header("WWW-Authenticate", "JWT realm="+mw.Realm)
+	c.Abort()
+	mw.Unauthorized(c, code, message)
+}
+
+// parseJWT validates token signed by HS256 with any of given keys
+func parseJWT(tokenString string, keys [][]byte) (*j.Token, error) {
+	err := errors.New("No keys to verify auth token")
+	for _, key := range keys {
+		key := key
+		var token *j.Token
+		token, err = j.Parse(tokenString, func(token *j.Token) (interface{}, error) {
+			if j.GetSigningMethod("HS256") != token.Method {
+				return nil, errors.New("Invalid signing algorithm")
+			}
+			return key, nil
+		})
+		if err == nil {
+			return token, nil
+		}
+		if validationError, ok := err.(*j.ValidationError); !ok || validationError.Errors&j.ValidationErrorSignatureInvalid == 0 {
+			// other errors (malformed or expired token, etc) don't depend on the key
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// createToken returns new auth token of the user's session
+func (mw *jwtMiddleware) createToken(user *User, session *Session) (string, time.Time, error) {
+	token := j.New(j.GetSigningMethod(mw.SigningAlgorithm))
+	now := time.Now()
+	expire := now.Add(mw.Timeout)
+	token.Claims["id"] = strconv.FormatUint(uint64(user.ID), 10)
+	token.Claims["exp"] = expire.Unix()
+	token.Claims["orig_iat"] = now.Unix()
+	token.Claims["ver"] = user.TokenVersion
+	token.Claims["jti"] = session.TokenID
+	tokenString, err := token.SignedString(mw.Key)
+	return tokenString, expire, err
+}
+
+// authClaims are claims of auth token which are used by the app
+type authClaims struct {
+	userID  uint
+	tokenID string // session of the token
+	version int    // token version of the user
+}
+
+// parseAuthClaims checks presence and types of claims, malformed tokens are rejected instead of breaking handlers.
+// jwt-go checks expiration only if claim exp exists and RefreshHandler of gin-jwt expects orig_iat, so both are
+// required.
+func parseAuthClaims(claims map[string]interface{}) (*authClaims, error) {
+	id, ok := claims["id"].(string)
+	if !ok {
+		return nil, errInvalidAuthToken
+	}
+	userID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil || userID == 0 {
+		return nil, errInvalidAuthToken
+	}
+	tokenID, ok := claims["jti"].(string)
+	if !ok || tokenID == "" {
+		return nil, errInvalidAuthToken
+	}
+	for _, name := range []string{"exp", "orig_iat"} {
+		if _, ok = claims[name].(float64); !ok {
+			return nil, errInvalidAuthToken
+		}
+	}
+	version := 0.0 // tokens issued before versioning have no version
+	if value, exists := claims["ver"]; exists {
+		if version, ok = value.(float64); !ok || version < 0 || version != math.Trunc(version) {
+			return nil, errInvalidAuthToken
+		}
+	}
+	return &authClaims{uint(userID), tokenID, int(version)}, nil
+}
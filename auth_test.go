@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	j "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"id":       "1",
+		"jti":      "abc",
+		"ver":      float64(2),
+		"exp":      float64(time.Now().Add(time.Hour).Unix()),
+		"orig_iat": float64(time.Now().Unix()),
+	}
+}
+
+func TestParseAuthClaims(t *testing.T) {
+	claims, err := parseAuthClaims(validClaims())
+	require.NoError(t, err)
+	assert.Equal(t, &authClaims{userID: 1, tokenID: "abc", version: 2}, claims)
+	withoutVersion := validClaims()
+	delete(withoutVersion, "ver")
+	claims, err = parseAuthClaims(withoutVersion)
+	require.NoError(t, err)
+	assert.Equal(t, 0, claims.version)
+}
+
+func TestParseAuthClaimsFail(t *testing.T) {
+	changes := []map[string]interface{}{
+		{"id": nil},
+		{"id": float64(1)},
+		{"id": "abc"},
+		{"id": "0"},
+		{"id": "-1"},
+		{"id": "99999999999"},
+		{"jti": nil},
+		{"jti": ""},
+		{"jti": float64(1)},
+		{"exp": nil},
+		{"exp": "tomorrow"},
+		{"orig_iat": nil},
+		{"orig_iat": true},
+		{"ver": "1"},
+		{"ver": float64(1.5)},
+		{"ver": float64(-1)},
+	}
+	for _, change := range changes {
+		claims := validClaims()
+		for name, value := range change {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		_, err := parseAuthClaims(claims)
+		assert.Equal(t, errInvalidAuthToken, err, "%v", change)
+	}
+}
+
+func createTokenWithClaims(t *testing.T, method j.SigningMethod, key interface{}, claims map[string]interface{}) string {
+	token := j.New(method)
+	token.Claims = claims
+	tokenString, err := token.SignedString(key)
+	require.NoError(t, err)
+	return tokenString
+}
+
+func TestValidateTokenWithMalformedInput(t *testing.T) {
+	mw := &jwtMiddleware{keys: [][]byte{[]byte(testJWTKey1)}} // db is not reached
+	claims := validClaims()
+	claims["id"] = float64(1)
+	expired := validClaims()
+	expired["exp"] = float64(time.Now().Add(-time.Minute).Unix())
+	withoutExpiration := validClaims()
+	delete(withoutExpiration, "exp")
+	tokens := []string{
+		"",
+		"invalid",
+		"a.b.c",
+		createTokenWithClaims(t, j.SigningMethodHS256, []byte(testJWTKey1), claims),
+		createTokenWithClaims(t, j.SigningMethodHS256, []byte(testJWTKey1), expired),
+		createTokenWithClaims(t, j.SigningMethodHS256, []byte(testJWTKey1), withoutExpiration),
+		createTokenWithClaims(t, j.SigningMethodHS256, []byte(testJWTKey2), validClaims()),
+		createTokenWithClaims(t, j.SigningMethodHS512, []byte(testJWTKey1), validClaims()),
+		createTokenWithClaims(t, j.SigningMethodNone, j.UnsafeAllowNoneSignatureType, validClaims()),
+	}
+	for i, token := range tokens {
+		assert.NotPanics(t, func() {
+			_, err := mw.validateToken(token)
+			assert.Error(t, err, "token %d", i)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// getCallbackSecret returns secret which is passed by Catapult back to the application in callback urls.
+// It is taken from CALLBACK_SECRET or derived from Catapult credentials if this variable is not set. It returns
+// empty string if both are missing (the secret would be predictable then, so all callbacks are rejected).
+func getCallbackSecret() string {
+	if secret := os.Getenv("CALLBACK_SECRET"); secret != "" {
+		return secret
+	}
+	apiSecret := os.Getenv("CATAPULT_API_SECRET")
+	if apiSecret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(apiSecret))
+	mac.Write([]byte("callbacks of " + os.Getenv("CATAPULT_USER_ID")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// buildCallbackURL returns url of callback handler (like /callCallback) with callback secret
+func buildCallbackURL(host string, path string) string {
+	return fmt.Sprintf("http://%s%s?secret=%s", host, path, url.QueryEscape(getCallbackSecret()))
+}
+
+// callbackAuthMiddleware rejects callbacks without valid secret (they are not sent by Catapult)
+func callbackAuthMiddleware(c *gin.Context) {
+	secret, expectedSecret := c.Query("secret"), getCallbackSecret()
+	if expectedSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(expectedSecret)) != 1 {
+		debugf("Rejected callback %s from %s\n", c.Request.URL.Path, c.ClientIP())
+		setErrorMessage(c, http.StatusUnauthorized, "Invalid callback secret")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// getCallbackEventKey returns identity of callback event (the same for all retries of the callback)
+func getCallbackEventKey(path string, form *CallbackForm) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{path, form.CallID, form.EventType, form.State, form.Tag,
+		form.RecordingID, form.TranscriptionID, form.GatherID, form.Digits}, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// handleCallbackOnce marks callback event as processed and runs its handler in one transaction. The event is inserted
+// first, so a concurrent retry of Catapult waits for the unique key and is skipped before its handler makes any
+// requests. Already processed events are skipped too. If handler fails the event stays unprocessed, so the error
+// should be returned to Catapult to retry the callback later.
+func handleCallbackOnce(path string, form *CallbackForm, db *gorm.DB, handler func(tx *gorm.DB) error) error {
+	event := &ProcessedEvent{
+		EventKey:  getCallbackEventKey(path, form),
+		CallID:    form.CallID,
+		EventType: form.EventType,
+	}
+	if !db.First(&ProcessedEvent{}, "event_key = ?", event.EventKey).RecordNotFound() {
+		debugf("Callback %s %s of call %s has been processed already\n", path, form.EventType, form.CallID)
+		return nil
+	}
+	tx := db.Begin()
+	if err := tx.Create(event).Error; err != nil {
+		tx.Rollback()
+		if !db.First(&ProcessedEvent{}, "event_key = ?", event.EventKey).RecordNotFound() {
+			debugf("Callback %s %s of call %s has been processed concurrently\n", path, form.EventType, form.CallID)
+			return nil
+		}
+		return err
+	}
+	if err := handler(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
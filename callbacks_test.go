@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCallbackSecret(t *testing.T) {
+	assert.Equal(t, "callbackSecret", getCallbackSecret())
+	os.Unsetenv("CALLBACK_SECRET")
+	defer os.Setenv("CALLBACK_SECRET", "callbackSecret")
+	os.Setenv("CATAPULT_USER_ID", "userID")
+	os.Setenv("CATAPULT_API_SECRET", "secret")
+	secret := getCallbackSecret()
+	assert.Equal(t, 64, len(secret))
+	assert.Equal(t, secret, getCallbackSecret())
+	os.Setenv("CATAPULT_API_SECRET", "secret1")
+	assert.NotEqual(t, secret, getCallbackSecret())
+	// secret derived from empty key would be predictable
+	os.Setenv("CATAPULT_API_SECRET", "")
+	assert.Equal(t, "", getCallbackSecret())
+}
+
+func TestCallbackAuthMiddlewareWithoutSecret(t *testing.T) {
+	router := gin.New()
+	router.POST("/callCallback", callbackAuthMiddleware, func(c *gin.Context) {
+		c.String(http.StatusOK, "")
+	})
+	request := func(secret string) int {
+		req, _ := http.NewRequest(http.MethodPost, "/callCallback?secret="+secret, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, request("callbackSecret"))
+	defer os.Setenv("CATAPULT_API_SECRET", os.Getenv("CATAPULT_API_SECRET"))
+	defer os.Setenv("CALLBACK_SECRET", "callbackSecret")
+	os.Unsetenv("CALLBACK_SECRET")
+	os.Unsetenv("CATAPULT_API_SECRET")
+	assert.Equal(t, http.StatusUnauthorized, request(""))
+	mac := hmac.New(sha256.New, []byte(""))
+	mac.Write([]byte("callbacks of " + os.Getenv("CATAPULT_USER_ID")))
+	assert.Equal(t, http.StatusUnauthorized, request(hex.EncodeToString(mac.Sum(nil))))
+}
+
+func TestBuildCallbackURL(t *testing.T) {
+	assert.Equal(t, "http://localhost/callCallback?secret=callbackSecret", buildCallbackURL("localhost", "/callCallback"))
+	os.Setenv("CALLBACK_SECRET", "a&b")
+	defer os.Setenv("CALLBACK_SECRET", "callbackSecret")
+	assert.Equal(t, "http://localhost/callCallback?secret=a%26b", buildCallbackURL("localhost", "/callCallback"))
+}
+
+func TestGetCallbackEventKey(t *testing.T) {
+	form := &CallbackForm{CallID: "callID", EventType: "recording", State: "complete", RecordingID: "recordingID"}
+	key := getCallbackEventKey("/transferCallback", form)
+	assert.Equal(t, 64, len(key))
+	assert.Equal(t, key, getCallbackEventKey("/transferCallback", &CallbackForm{CallID: "callID", EventType: "recording",
+		State: "complete", RecordingID: "recordingID", From: "+1472583688"}))
+	assert.NotEqual(t, key, getCallbackEventKey("/callCallback", form))
+	assert.NotEqual(t, key, getCallbackEventKey("/transferCallback", &CallbackForm{CallID: "callID", EventType: "recording",
+		State: "complete", RecordingID: "recordingID1"}))
+	assert.NotEqual(t, getCallbackEventKey("/recordCallback", &CallbackForm{CallID: "callID", EventType: "gather", GatherID: "1"}),
+		getCallbackEventKey("/recordCallback", &CallbackForm{CallID: "callID", EventType: "gather", GatherID: "2"}))
+}
+
+func TestHandleCallbackOnce(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	form := &CallbackForm{CallID: "callID", EventType: "answer"}
+	count := 0
+	handler := func(tx *gorm.DB) error {
+		count++
+		return nil
+	}
+	assert.NoError(t, handleCallbackOnce("/callCallback", form, db, handler))
+	assert.NoError(t, handleCallbackOnce("/callCallback", form, db, handler))
+	assert.NoError(t, handleCallbackOnce("/transferCallback", form, db, handler))
+	assert.Equal(t, 2, count)
+	event := &ProcessedEvent{}
+	assert.NoError(t, db.First(event, "event_key = ?", getCallbackEventKey("/callCallback", form)).Error)
+	assert.Equal(t, "callID", event.CallID)
+	assert.Equal(t, "answer", event.EventType)
+}
+
+func TestHandleCallbackOnceFail(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&ActiveCall{}, "call_id = ?", "onceCallID")
+	form := &CallbackForm{CallID: "onceCallID", EventType: "hangup"}
+	err := handleCallbackOnce("/callCallback", form, db, func(tx *gorm.DB) error {
+		require.NoError(t, tx.Create(&ActiveCall{CallID: "onceCallID"}).Error)
+		return errors.New("error")
+	})
+	assert.Error(t, err)
+	// changes of failed handler are rolled back and the event can be handled again
+	count := 0
+	db.Model(&ActiveCall{}).Where("call_id = ?", "onceCallID").Count(&count)
+	assert.Equal(t, 0, count)
+	assert.True(t, db.First(&ProcessedEvent{}, "event_key = ?", getCallbackEventKey("/callCallback", form)).RecordNotFound())
+	assert.NoError(t, handleCallbackOnce("/callCallback", form, db, func(tx *gorm.DB) error {
+		count++
+		return nil
+	}))
+	assert.Equal(t, 1, count)
+}
+
+func TestHandleCallbackOnceConcurrently(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	api := &fakeCatapultAPI{}
+	api.On("CreateMessage", mock.Anything).Return("id", nil)
+	form := &CallbackForm{CallID: "callID", EventType: "hangup"}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, handleCallbackOnce("/callCallback", form, db, func(tx *gorm.DB) error {
+				_, err := api.CreateMessage(&bandwidth.CreateMessageData{From: "+1234567890", To: "+1234567891"})
+				time.Sleep(50 * time.Millisecond)
+				return err
+			}))
+		}()
+	}
+	wg.Wait()
+	api.AssertNumberOfCalls(t, "CreateMessage", 1)
+}
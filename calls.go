@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DefaultCallsPageSize and MaxCallsPageSize limit size of a page of call history
+const (
+	DefaultCallsPageSize = 20
+	MaxCallsPageSize     = 100
+)
+
+func createCallRecord(form *CallbackForm, user *User, direction string, now time.Time, db *gorm.DB) *CallRecord {
+	record := &CallRecord{
+		CallID:    form.CallID,
+		UserID:    user.ID,
+		Direction: direction,
+		From:      form.From,
+		To:        form.To,
+		StartTime: now,
+	}
+	if err := db.Create(record).Error; err != nil {
+		debugf("Error on saving call record: %s\n", err.Error())
+		return nil
+	}
+	return record
+}
+
+// findCallRecord returns call record by id of the call or id of the call it was transferred to
+func findCallRecord(callID string, db *gorm.DB) *CallRecord {
+	record := &CallRecord{}
+	if callID == "" || db.First(record, "call_id = ? OR transferred_call_id = ?", callID, callID).RecordNotFound() {
+		return nil
+	}
+	return record
+}
+
+func setCallRecordTransferredCallID(callID string, transferredCallID string, db *gorm.DB) {
+	if record := findCallRecord(callID, db); record != nil && transferredCallID != "" {
+		db.Model(record).Update("transferred_call_id", transferredCallID)
+	}
+}
+
+func markCallRecordAnswered(callID string, now time.Time, db *gorm.DB) {
+	record := findCallRecord(callID, db)
+	if record == nil || record.AnswerTime != nil {
+		return
+	}
+	db.Model(record).Updates(map[string]interface{}{
+		"answer_time": now,
+		"disposition": AnsweredCall,
+	})
+}
+
+// markCallRecordVoiceMail is called when caller has left a voice message
+// (it can happen after hang up because recording is completed later)
+func markCallRecordVoiceMail(callID string, db *gorm.DB) {
+	if record := findCallRecord(callID, db); record != nil {
+		db.Model(record).Update("disposition", VoiceMailCall)
+	}
+}
+
+func completeCallRecord(callID string, now time.Time, db *gorm.DB) {
+	record := findCallRecord(callID, db)
+	if record == nil || record.EndTime != nil {
+		return
+	}
+	updates := map[string]interface{}{"end_time": now}
+	if record.AnswerTime != nil {
+		updates["duration"] = int(now.Sub(*record.AnswerTime) / time.Second)
+	}
+	if record.Disposition == "" {
+		updates["disposition"] = MissedCall
+	}
+	db.Model(record).Updates(updates)
+}
+
+// CallRecordsQuery contains filters of call history
+type CallRecordsQuery struct {
+	Page        int
+	Size        int
+	Direction   string
+	Disposition string
+	Number      string // calls from or to this number (or SIP URI)
+	Since       *time.Time
+	Until       *time.Time
+}
+
+// parseCallRecordsQuery converts query parameters of GET /calls to CallRecordsQuery
+func parseCallRecordsQuery(query func(string) string) (*CallRecordsQuery, error) {
+	result := &CallRecordsQuery{
+		Page:        1,
+		Size:        DefaultCallsPageSize,
+		Direction:   query("direction"),
+		Disposition: query("disposition"),
+		Number:      query("number"),
+	}
+	var err error
+	if value := query("page"); value != "" {
+		if result.Page, err = strconv.Atoi(value); err != nil || result.Page < 1 {
+			return nil, errors.New("Page should be positive number")
+		}
+	}
+	if value := query("size"); value != "" {
+		if result.Size, err = strconv.Atoi(value); err != nil || result.Size < 1 || result.Size > MaxCallsPageSize {
+			return nil, fmt.Errorf("Page size should be between 1 and %d", MaxCallsPageSize)
+		}
+	}
+	if result.Direction != "" && result.Direction != IncomingCall && result.Direction != OutgoingCall && result.Direction != GreetingCall {
+		return nil, fmt.Errorf("Unknown direction %q", result.Direction)
+	}
+	if result.Disposition != "" && result.Disposition != AnsweredCall && result.Disposition != VoiceMailCall && result.Disposition != MissedCall {
+		return nil, fmt.Errorf("Unknown disposition %q", result.Disposition)
+	}
+	for name, field := range map[string]**time.Time{"since": &result.Since, "until": &result.Until} {
+		if value := query(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid time %q (use RFC3339 format like 2016-12-25T10:00:00Z)", value)
+			}
+			*field = &t
+		}
+	}
+	return result, nil
+}
+
+// Apply adds filters (but not pagination) to database query
+func (q *CallRecordsQuery) Apply(db *gorm.DB) *gorm.DB {
+	if q.Direction != "" {
+		db = db.Where("direction = ?", q.Direction)
+	}
+	if q.Disposition != "" {
+		db = db.Where("disposition = ?", q.Disposition)
+	}
+	if q.Number != "" {
+		db = db.Where(`"from" = ? OR "to" = ?`, q.Number, q.Number)
+	}
+	if q.Since != nil {
+		db = db.Where("start_time >= ?", *q.Since)
+	}
+	if q.Until != nil {
+		db = db.Where("start_time < ?", *q.Until)
+	}
+	return db
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCallRecordsQuery(t *testing.T) {
+	values, _ := url.ParseQuery("page=2&size=50&direction=incoming&disposition=missed&number=%2B1234567890&since=2016-12-01T00:00:00Z")
+	query, err := parseCallRecordsQuery(values.Get)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, query.Page)
+	assert.Equal(t, 50, query.Size)
+	assert.Equal(t, IncomingCall, query.Direction)
+	assert.Equal(t, MissedCall, query.Disposition)
+	assert.Equal(t, "+1234567890", query.Number)
+	assert.True(t, time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC).Equal(*query.Since))
+	assert.Nil(t, query.Until)
+}
+
+func TestParseCallRecordsQueryDefaults(t *testing.T) {
+	query, err := parseCallRecordsQuery(url.Values{}.Get)
+	assert.NoError(t, err)
+	assert.Equal(t, &CallRecordsQuery{Page: 1, Size: DefaultCallsPageSize}, query)
+}
+
+func TestParseCallRecordsQueryFail(t *testing.T) {
+	for _, rawQuery := range []string{"page=0", "page=a", "size=0", "size=101", "direction=unknown", "disposition=unknown", "since=yesterday", "until=2016-12-01"} {
+		values, _ := url.ParseQuery(rawQuery)
+		_, err := parseCallRecordsQuery(values.Get)
+		assert.Error(t, err, rawQuery)
+	}
+}
+
+func TestCallRecordLifecycle(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Unscoped().Delete(&CallRecord{}, "call_id = ?", "crCallID1")
+	user := &User{}
+	user.ID = 1
+	startTime := time.Date(2016, 12, 20, 12, 0, 0, 0, time.UTC)
+	record := createCallRecord(&CallbackForm{CallID: "crCallID1", From: "+1472583688", To: "+1234567890"}, user, IncomingCall, startTime, db)
+	assert.NotNil(t, record)
+	setCallRecordTransferredCallID("crCallID1", "crCallID2", db)
+	markCallRecordAnswered("crCallID2", startTime.Add(10*time.Second), db)
+	completeCallRecord("crCallID1", startTime.Add(70*time.Second), db)
+	completeCallRecord("crCallID2", startTime.Add(80*time.Second), db) // second leg of the call is ignored
+	record = findCallRecord("crCallID1", db)
+	assert.Equal(t, AnsweredCall, record.Disposition)
+	assert.Equal(t, 60, record.Duration)
+	assert.True(t, startTime.Add(70*time.Second).Equal(*record.EndTime))
+}
+
+func TestCallRecordMissedAndVoiceMail(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Unscoped().Delete(&CallRecord{}, "call_id = ?", "crCallID3")
+	user := &User{}
+	user.ID = 1
+	now := time.Now()
+	createCallRecord(&CallbackForm{CallID: "crCallID3", From: "+1472583688", To: "+1234567890"}, user, IncomingCall, now, db)
+	completeCallRecord("crCallID3", now, db)
+	record := findCallRecord("crCallID3", db)
+	assert.Equal(t, MissedCall, record.Disposition)
+	assert.Equal(t, 0, record.Duration)
+	markCallRecordVoiceMail("crCallID3", db)
+	record = findCallRecord("crCallID3", db)
+	assert.Equal(t, VoiceMailCall, record.Disposition)
+}
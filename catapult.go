@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
-	"net/http"
 	"os"
 	"time"
 
@@ -17,17 +16,21 @@ const applicationName = "GolangVoiceReferenceApp"
 type catapultAPI struct {
 	client  *bandwidth.Client
 	context *gin.Context
+	cache   *provisioningCache
 }
 
-var applicationIDs map[string]string
-var domainID string
-var domainName string
+// provisioning is shared cache of ids of application and domain (main replaces it by cache persisted in db)
+var provisioning = newProvisioningCache(nil)
 
 type catapultAPIInterface interface {
 	GetApplicationID() (string, error)
 	GetDomain() (string, string, error)
-	CreatePhoneNumber(areaCode string) (string, error)
-	CreateSIPAccount() (*sipAccount, error)
+	CreatePhoneNumber(areaCode string, name string) (string, error)
+	FindPhoneNumber(name string) (string, error)
+	ReleasePhoneNumber(number string) error
+	CreateSIPAccount(userName string) (*sipAccount, error)
+	FindSIPAccount(userName string) (string, error)
+	DeleteSIPAccount(endpointID string) error
 	CreateSIPAuthToken(endpointID string) (*bandwidth.DomainEndpointToken, error)
 	UpdateCall(callID string, data *bandwidth.UpdateCallData) (string, error)
 	GetCall(callID string) (*bandwidth.Call, error)
@@ -37,73 +40,117 @@ type catapultAPIInterface interface {
 	GetRecording(recordingID string) (*bandwidth.Recording, error)
 	CreateCall(data *bandwidth.CreateCallData) (string, error)
 	DownloadMediaFile(name string) (io.ReadCloser, string, error)
+	DeleteMediaFile(name string) error
+	CreateRecordingTranscription(recordingID string) (string, error)
+	GetRecordingTranscription(recordingID string, transcriptionID string) (*bandwidth.Transcription, error)
+	CreateMessage(data *bandwidth.CreateMessageData) (string, error)
+	CreateBridge(data *bandwidth.BridgeData) (string, error)
+	UploadMediaFile(name string, content io.ReadCloser, contentType string) (string, error)
 }
 
+// endpoint of Catapult API (urls of media files of the account start with it too)
+const (
+	catapultAPIEndPoint = "https://api.catapult.inetwork.com"
+	catapultAPIVersion  = "v1"
+)
+
 func newCatapultAPI(context *gin.Context) (*catapultAPI, error) {
-	client, err := bandwidth.New(os.Getenv("CATAPULT_USER_ID"), os.Getenv("CATAPULT_API_TOKEN"), os.Getenv("CATAPULT_API_SECRET"))
-	return &catapultAPI{client: client, context: context}, err
+	client, err := bandwidth.New(os.Getenv("CATAPULT_USER_ID"), os.Getenv("CATAPULT_API_TOKEN"), os.Getenv("CATAPULT_API_SECRET"),
+		catapultAPIVersion, catapultAPIEndPoint)
+	return &catapultAPI{client: client, context: context, cache: provisioning}, err
 }
 
 func (api *catapultAPI) GetApplicationID() (string, error) {
 	host := api.context.Request.Host
+	id, _, err := api.cache.resolve(applicationKey(host), func() (string, string, error) {
+		return api.provisionApplication(host)
+	})
+	return id, err
+}
+
+// provisionApplication finds or creates Catapult application for the host
+func (api *catapultAPI) provisionApplication(host string) (string, string, error) {
 	appName := fmt.Sprintf("%s on %s", applicationName, host)
-	if applicationIDs == nil {
-		applicationIDs = make(map[string]string, 0)
-	}
-	applicationID := applicationIDs[host]
-	if applicationID != "" {
-		return applicationID, nil
-	}
 	applications, err := api.client.GetApplications(&bandwidth.GetApplicationsQuery{Size: 1000})
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	var application *bandwidth.Application
-	for _, application = range applications {
+	incomingCallURL := buildCallbackURL(host, "/callCallback")
+	for _, application := range applications {
 		if application.Name == appName {
-			applicationID = application.ID
-			applicationIDs[host] = applicationID
-			return applicationID, nil
+			if application.IncomingCallURL != incomingCallURL {
+				// callback url has been created without secret or the secret has been changed
+				err = api.client.UpdateApplication(application.ID, &bandwidth.ApplicationData{
+					IncomingCallURL:    incomingCallURL,
+					CallbackHTTPMethod: "POST",
+				})
+				if err != nil {
+					return "", "", err
+				}
+			}
+			return application.ID, appName, nil
 		}
 	}
-	applicationID, err = api.client.CreateApplication(&bandwidth.ApplicationData{
+	applicationID, err := api.client.CreateApplication(&bandwidth.ApplicationData{
 		Name:               appName,
 		AutoAnswer:         true,
 		CallbackHTTPMethod: "POST",
-		IncomingCallURL:    fmt.Sprintf("http://%s/callCallback", host),
+		IncomingCallURL:    incomingCallURL,
 	})
-	if applicationID != "" {
-		applicationIDs[host] = applicationID
-	}
-	return applicationID, err
+	return applicationID, appName, err
 }
 
 func (api *catapultAPI) GetDomain() (string, string, error) {
-	if domainID != "" {
-		return domainID, domainName, nil
-	}
+	return api.cache.resolve(domainKey, api.provisionDomain)
+}
+
+// provisionDomain finds or creates SIP domain of the app
+func (api *catapultAPI) provisionDomain() (string, string, error) {
 	domains, err := api.client.GetDomains(&bandwidth.GetDomainsQuery{Size: 100})
 	if err != nil {
 		return "", "", err
 	}
-	var domain *bandwidth.Domain
 	const description = applicationName + "'s domain"
-	for _, domain = range domains {
+	for _, domain := range domains {
 		if domain.Description == description {
-			domainID = domain.ID
-			domainName = domain.Name
-			return domainID, domainName, nil
+			return domain.ID, domain.Name, nil
 		}
 	}
-	domainName = randomString(15)
-	domainID, err = api.client.CreateDomain(&bandwidth.CreateDomainData{
-		Name:        domainName,
+	name := randomString(15)
+	id, err := api.client.CreateDomain(&bandwidth.CreateDomainData{
+		Name:        name,
 		Description: description,
 	})
-	return domainID, domainName, err
+	if err != nil {
+		return "", "", err
+	}
+	return id, name, nil
+}
+
+// refreshApplicationID removes application id from cache if Catapult has reported that it is not found.
+// It returns true if the application has been found again with another id (so the failed request can be repeated).
+func (api *catapultAPI) refreshApplicationID(oldID string, err error) bool {
+	if !isNotFoundError(err) {
+		return false
+	}
+	api.cache.invalidate(applicationKey(api.context.Request.Host))
+	id, err := api.GetApplicationID()
+	return err == nil && id != oldID
+}
+
+// refreshDomain works like refreshApplicationID for SIP domain
+func (api *catapultAPI) refreshDomain(oldID string, err error) bool {
+	if !isNotFoundError(err) {
+		return false
+	}
+	api.cache.invalidate(domainKey)
+	id, _, err := api.GetDomain()
+	return err == nil && id != oldID
 }
 
-func (api *catapultAPI) CreatePhoneNumber(areaCode string) (string, error) {
+// CreatePhoneNumber orders a number in the area and assigns it to the application. The name allows to find the number
+// if result of this request is lost.
+func (api *catapultAPI) CreatePhoneNumber(areaCode string, name string) (string, error) {
 	applicationID, err := api.GetApplicationID()
 	if err != nil {
 		return "", err
@@ -113,20 +160,81 @@ func (api *catapultAPI) CreatePhoneNumber(areaCode string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	err = api.client.UpdatePhoneNumber(numbers[0].ID, &bandwidth.UpdatePhoneNumberData{ApplicationID: applicationID})
+	err = api.client.UpdatePhoneNumber(numbers[0].ID, &bandwidth.UpdatePhoneNumberData{Name: name, ApplicationID: applicationID})
+	if err != nil && api.refreshApplicationID(applicationID, err) {
+		applicationID, _ = api.GetApplicationID()
+		err = api.client.UpdatePhoneNumber(numbers[0].ID, &bandwidth.UpdatePhoneNumberData{Name: name, ApplicationID: applicationID})
+	}
 	if err != nil {
+		// don't keep ordered number which can't be used
+		if releaseErr := api.client.DeletePhoneNumber(numbers[0].ID); releaseErr != nil {
+			debugf("Error on releasing phone number %s: %s\n", numbers[0].Number, releaseErr.Error())
+		}
 		return "", err
 	}
 	return numbers[0].Number, nil
 }
 
+// FindPhoneNumber returns number created by CreatePhoneNumber with given name (empty string if it doesn't exist)
+func (api *catapultAPI) FindPhoneNumber(name string) (string, error) {
+	numbers, err := api.client.GetPhoneNumbers(&bandwidth.GetPhoneNumbersQuery{Name: name})
+	if err != nil {
+		return "", err
+	}
+	for _, number := range numbers {
+		if number.Name == name {
+			return number.Number, nil
+		}
+	}
+	return "", nil
+}
+
+// error codes of Catapult which mean that the deleted resource doesn't exist already
+var (
+	phoneNumberNotFoundCodes = []string{"number-not-found", "phone-number-not-found"}
+	endpointNotFoundCodes    = []string{"endpoint-not-found", "domain-endpoint-not-found"}
+	mediaFileNotFoundCodes   = []string{"media-not-found", "media-file-not-found"}
+)
+
+// ReleasePhoneNumber removes the number from the account. Number which has been removed already is ignored.
+func (api *catapultAPI) ReleasePhoneNumber(number string) error {
+	phoneNumber, err := api.client.GetPhoneNumber(number)
+	if isTargetNotFoundError(err, phoneNumberNotFoundCodes...) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = api.client.DeletePhoneNumber(phoneNumber.ID)
+	if isTargetNotFoundError(err, phoneNumberNotFoundCodes...) {
+		return nil
+	}
+	return err
+}
+
 type sipAccount struct {
 	EndpointID string
 	URI        string
 	Password   string
 }
 
-func (api *catapultAPI) CreateSIPAccount() (*sipAccount, error) {
+// CreateSIPAccount creates endpoint with given SIP user name in the domain
+func (api *catapultAPI) CreateSIPAccount(userName string) (*sipAccount, error) {
+	account, err := api.createSIPAccount(userName)
+	if err == nil || !isNotFoundError(err) {
+		return account, err
+	}
+	// application or domain could be removed
+	applicationID, _ := api.GetApplicationID()
+	domainID, _, _ := api.GetDomain()
+	refreshed := api.refreshApplicationID(applicationID, err)
+	if api.refreshDomain(domainID, err) || refreshed {
+		return api.createSIPAccount(userName)
+	}
+	return nil, err
+}
+
+func (api *catapultAPI) createSIPAccount(sipUserName string) (*sipAccount, error) {
 	applicationID, err := api.GetApplicationID()
 	if err != nil {
 		return nil, err
@@ -135,7 +243,6 @@ func (api *catapultAPI) CreateSIPAccount() (*sipAccount, error) {
 	if err != nil {
 		return nil, err
 	}
-	sipUserName := randomString(16)
 	sipPassword := randomString(10)
 	id, err := api.client.CreateDomainEndpoint(domainID, &bandwidth.DomainEndpointData{
 		ApplicationID: applicationID,
@@ -151,12 +258,53 @@ func (api *catapultAPI) CreateSIPAccount() (*sipAccount, error) {
 	return &sipAccount{id, sipURI, sipPassword}, nil
 }
 
+// FindSIPAccount returns id of endpoint with given SIP user name (empty string if it doesn't exist)
+func (api *catapultAPI) FindSIPAccount(userName string) (string, error) {
+	domainID, _, err := api.GetDomain()
+	if err != nil {
+		return "", err
+	}
+	endpoints, err := api.client.GetDomainEndpoints(domainID)
+	if err != nil {
+		return "", err
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Name == userName {
+			return endpoint.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// DeleteSIPAccount removes endpoint from the domain. Endpoint which has been removed already is ignored.
+func (api *catapultAPI) DeleteSIPAccount(endpointID string) error {
+	domainID, _, err := api.GetDomain()
+	if err != nil {
+		return err
+	}
+	err = api.client.DeleteDomainEndpoint(domainID, endpointID)
+	if err != nil && err.Error() == "domain-not-found" && api.refreshDomain(domainID, err) {
+		// cached domain is stale
+		domainID, _, _ = api.GetDomain()
+		err = api.client.DeleteDomainEndpoint(domainID, endpointID)
+	}
+	if isTargetNotFoundError(err, endpointNotFoundCodes...) {
+		return nil
+	}
+	return err
+}
+
 func (api *catapultAPI) CreateSIPAuthToken(endpointID string) (*bandwidth.DomainEndpointToken, error) {
 	domainID, _, err := api.GetDomain()
 	if err != nil {
 		return nil, err
 	}
-	return api.client.CreateDomainEndpointToken(domainID, endpointID)
+	token, err := api.client.CreateDomainEndpointToken(domainID, endpointID)
+	if err != nil && api.refreshDomain(domainID, err) {
+		domainID, _, _ = api.GetDomain()
+		return api.client.CreateDomainEndpointToken(domainID, endpointID)
+	}
+	return token, err
 }
 
 func (api *catapultAPI) UpdateCall(callID string, data *bandwidth.UpdateCallData) (string, error) {
@@ -196,14 +344,51 @@ func (api *catapultAPI) DownloadMediaFile(name string) (io.ReadCloser, string, e
 	return api.client.DownloadMediaFile(name)
 }
 
-func catapultMiddleware(c *gin.Context) {
-	api, err := newCatapultAPI(c)
+// DeleteMediaFile removes the file from Catapult storage. File which has been removed already is ignored.
+func (api *catapultAPI) DeleteMediaFile(name string) error {
+	err := api.client.DeleteMediaFile(name)
+	if isTargetNotFoundError(err, mediaFileNotFoundCodes...) {
+		return nil
+	}
+	return err
+}
+
+func (api *catapultAPI) CreateRecordingTranscription(recordingID string) (string, error) {
+	return api.client.CreateRecordingTranscription(recordingID)
+}
+
+func (api *catapultAPI) GetRecordingTranscription(recordingID string, transcriptionID string) (*bandwidth.Transcription, error) {
+	return api.client.GetRecordingTranscription(recordingID, transcriptionID)
+}
+
+func (api *catapultAPI) CreateMessage(data *bandwidth.CreateMessageData) (string, error) {
+	return api.client.CreateMessage(data)
+}
+
+func (api *catapultAPI) CreateBridge(data *bandwidth.BridgeData) (string, error) {
+	return api.client.CreateBridge(data)
+}
+
+// getMediaURLPrefix returns url of media storage of the Catapult account
+func getMediaURLPrefix() string {
+	return fmt.Sprintf("%s/%s/users/%s/media/", catapultAPIEndPoint, catapultAPIVersion, os.Getenv("CATAPULT_USER_ID"))
+}
+
+// UploadMediaFile stores a file on Catapult and returns its url
+func (api *catapultAPI) UploadMediaFile(name string, content io.ReadCloser, contentType string) (string, error) {
+	err := api.client.UploadMediaFile(name, content, contentType)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/users/%s/media/%s", api.client.APIEndPoint, api.client.APIVersion, api.client.UserID, name), nil
+}
+
+// newCatapultMiddleware makes Catapult API available for all routes. Client and circuit breaker of api are shared by requests.
+func newCatapultMiddleware(api *resilientCatapultAPI) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("catapultAPI", api.withContext(c))
+		c.Next()
 	}
-	c.Set("catapultAPI", api)
-	c.Next()
 }
 
 var randomString = func(strlen int) string {
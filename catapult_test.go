@@ -3,12 +3,13 @@ package main
 import (
 	"net/http"
 	"os"
+	"sync"
 	"testing"
 
 	"io/ioutil"
+	"strings"
 
 	"github.com/bandwidthcom/go-bandwidth"
-	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,7 +32,6 @@ func TestGetCatapultApiFail(t *testing.T) {
 }
 
 func TestGetApplicationIDWithNewApplication(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": ""}
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:  "/v1/users/userID/applications?size=1000",
@@ -41,7 +41,7 @@ func TestGetApplicationIDWithNewApplication(t *testing.T) {
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/applications",
 			Method:           http.MethodPost,
-			EstimatedContent: `{"name":"GolangVoiceReferenceApp on localhost","incomingCallUrl":"http://localhost/callCallback","callbackHttpMethod":"POST","autoAnswer":true}`,
+			EstimatedContent: `{"name":"GolangVoiceReferenceApp on localhost","incomingCallUrl":"http://localhost/callCallback?secret=callbackSecret","callbackHttpMethod":"POST","autoAnswer":true}`,
 			HeadersToSend:    map[string]string{"Location": "/v1/users/userID/applications/123"},
 		},
 	})
@@ -51,12 +51,11 @@ func TestGetApplicationIDWithNewApplication(t *testing.T) {
 }
 
 func TestGetApplicationIDWithExistingApplication(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": ""}
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:  "/v1/users/userID/applications?size=1000",
 			Method:        http.MethodGet,
-			ContentToSend: `[{"name": "GolangVoiceReferenceApp on localhost", "id": "0123"}]`,
+			ContentToSend: `[{"name": "GolangVoiceReferenceApp on localhost", "id": "0123", "incomingCallUrl": "http://localhost/callCallback?secret=callbackSecret"}]`,
 		},
 	})
 	defer server.Close()
@@ -64,13 +63,31 @@ func TestGetApplicationIDWithExistingApplication(t *testing.T) {
 	assert.Equal(t, "0123", id)
 }
 
+func TestGetApplicationIDWithExistingApplicationWithoutCallbackSecret(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/applications?size=1000",
+			Method:        http.MethodGet,
+			ContentToSend: `[{"name": "GolangVoiceReferenceApp on localhost", "id": "0123", "incomingCallUrl": "http://localhost/callCallback"}]`,
+		},
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/applications/0123",
+			Method:           http.MethodPost,
+			EstimatedContent: `{"incomingCallUrl":"http://localhost/callCallback?secret=callbackSecret","callbackHttpMethod":"POST"}`,
+		},
+	})
+	defer server.Close()
+	id, err := api.GetApplicationID()
+	assert.NoError(t, err)
+	assert.Equal(t, "0123", id)
+}
+
 func TestGetApplicationIDRepeating(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": ""}
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:  "/v1/users/userID/applications?size=1000",
 			Method:        http.MethodGet,
-			ContentToSend: `[{"name": "GolangVoiceReferenceApp on localhost", "id": "1234"}]`,
+			ContentToSend: `[{"name": "GolangVoiceReferenceApp on localhost", "id": "1234", "incomingCallUrl": "http://localhost/callCallback?secret=callbackSecret"}]`,
 		},
 	})
 	id, _ := api.GetApplicationID()
@@ -83,7 +100,6 @@ func TestGetApplicationIDRepeating(t *testing.T) {
 }
 
 func TestGetApplicationIDFail(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": ""}
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/applications?size=1000",
@@ -97,7 +113,6 @@ func TestGetApplicationIDFail(t *testing.T) {
 }
 
 func TestGetDomainWithNewDomain(t *testing.T) {
-	domainID = ""
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:  "/v1/users/userID/domains?size=100",
@@ -120,7 +135,6 @@ func TestGetDomainWithNewDomain(t *testing.T) {
 }
 
 func TestGetDomainWithExistingDomain(t *testing.T) {
-	domainID = ""
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:  "/v1/users/userID/domains?size=100",
@@ -135,7 +149,6 @@ func TestGetDomainWithExistingDomain(t *testing.T) {
 }
 
 func TestGetDomainRepeating(t *testing.T) {
-	domainID = ""
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:  "/v1/users/userID/domains?size=100",
@@ -154,7 +167,6 @@ func TestGetDomainRepeating(t *testing.T) {
 }
 
 func TestGetDomainFail(t *testing.T) {
-	domainID = ""
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/domains?size=100",
@@ -168,7 +180,6 @@ func TestGetDomainFail(t *testing.T) {
 }
 
 func TestCreatePhoneNumber(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": "123"}
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:  "/v1/availableNumbers/local?areaCode=910&quantity=1",
@@ -178,16 +189,16 @@ func TestCreatePhoneNumber(t *testing.T) {
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/phoneNumbers/1234",
 			Method:           http.MethodPost,
-			EstimatedContent: `{"applicationId":"123"}`,
+			EstimatedContent: `{"name":"name","applicationId":"123"}`,
 		},
 	})
+	api.cache.set(applicationKey("localhost"), "123", "")
 	defer server.Close()
-	phoneNumber, _ := api.CreatePhoneNumber("910")
+	phoneNumber, _ := api.CreatePhoneNumber("910", "name")
 	assert.Equal(t, "+1234567890", phoneNumber)
 }
 
 func TestCreatePhoneNumberFail(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": ""}
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/applications?size=1000",
@@ -196,12 +207,11 @@ func TestCreatePhoneNumberFail(t *testing.T) {
 		},
 	})
 	defer server.Close()
-	_, err := api.CreatePhoneNumber("910")
+	_, err := api.CreatePhoneNumber("910", "name")
 	assert.Error(t, err)
 }
 
 func TestCreatePhoneNumberFail2(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": "123"}
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/availableNumbers/local?areaCode=910&quantity=1",
@@ -209,13 +219,13 @@ func TestCreatePhoneNumberFail2(t *testing.T) {
 			StatusCodeToSend: http.StatusBadRequest,
 		},
 	})
+	api.cache.set(applicationKey("localhost"), "123", "")
 	defer server.Close()
-	_, err := api.CreatePhoneNumber("910")
+	_, err := api.CreatePhoneNumber("910", "name")
 	assert.Error(t, err)
 }
 
 func TestCreatePhoneNumberFail3(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": "123"}
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:  "/v1/availableNumbers/local?areaCode=910&quantity=1",
@@ -228,15 +238,13 @@ func TestCreatePhoneNumberFail3(t *testing.T) {
 			StatusCodeToSend: http.StatusBadRequest,
 		},
 	})
+	api.cache.set(applicationKey("localhost"), "123", "")
 	defer server.Close()
-	_, err := api.CreatePhoneNumber("910")
+	_, err := api.CreatePhoneNumber("910", "name")
 	assert.Error(t, err)
 }
 
 func TestCreateSIPAccount(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": "123"}
-	domainID = "456"
-	domainName = "domain1"
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/domains/456/endpoints",
@@ -245,10 +253,12 @@ func TestCreateSIPAccount(t *testing.T) {
 			HeadersToSend:    map[string]string{"Location": "/v1/users/userID/domains/456/endpoints/567"},
 		},
 	})
+	api.cache.set(applicationKey("localhost"), "123", "")
+	api.cache.set(domainKey, "456", "domain1")
 	useMockRandomString()
 	defer server.Close()
 	defer restoreRandomString()
-	account, _ := api.CreateSIPAccount()
+	account, _ := api.CreateSIPAccount("random")
 	assert.EqualValues(t, &sipAccount{
 		EndpointID: "567",
 		URI:        "sip:random@domain1.bwapp.bwsip.io",
@@ -257,9 +267,6 @@ func TestCreateSIPAccount(t *testing.T) {
 }
 
 func TestCreateSIPAccountFail(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": "123"}
-	domainID = "456"
-	domainName = "domain2"
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/domains/456/endpoints",
@@ -267,17 +274,16 @@ func TestCreateSIPAccountFail(t *testing.T) {
 			StatusCodeToSend: http.StatusBadRequest,
 		},
 	})
+	api.cache.set(applicationKey("localhost"), "123", "")
+	api.cache.set(domainKey, "456", "domain2")
 	useMockRandomString()
 	defer server.Close()
 	defer restoreRandomString()
-	_, err := api.CreateSIPAccount()
+	_, err := api.CreateSIPAccount("random")
 	assert.Error(t, err)
 }
 
 func TestCreateSIPAccountFail2(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": "123"}
-	domainID = ""
-	domainName = ""
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/domains",
@@ -285,15 +291,13 @@ func TestCreateSIPAccountFail2(t *testing.T) {
 			StatusCodeToSend: http.StatusBadRequest,
 		},
 	})
+	api.cache.set(applicationKey("localhost"), "123", "")
 	defer server.Close()
-	_, err := api.CreateSIPAccount()
+	_, err := api.CreateSIPAccount("random")
 	assert.Error(t, err)
 }
 
 func TestCreateSIPAccountFail3(t *testing.T) {
-	applicationIDs = map[string]string{"localhost": ""}
-	domainID = ""
-	domainName = ""
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/applications",
@@ -302,12 +306,11 @@ func TestCreateSIPAccountFail3(t *testing.T) {
 		},
 	})
 	defer server.Close()
-	_, err := api.CreateSIPAccount()
+	_, err := api.CreateSIPAccount("random")
 	assert.Error(t, err)
 }
 
 func TestCreateSIPAuthToken(t *testing.T) {
-	domainID = "123"
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:  "/v1/users/userID/domains/123/endpoints/456/tokens",
@@ -315,13 +318,13 @@ func TestCreateSIPAuthToken(t *testing.T) {
 			ContentToSend: `{"token": "token"}`,
 		},
 	})
+	api.cache.set(domainKey, "123", "")
 	defer server.Close()
 	token, _ := api.CreateSIPAuthToken("456")
 	assert.Equal(t, "token", token.Token)
 }
 
 func TestCreateSIPAuthTokenFail(t *testing.T) {
-	domainID = "123"
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/domains/123/endpoints/456/tokens",
@@ -329,13 +332,13 @@ func TestCreateSIPAuthTokenFail(t *testing.T) {
 			StatusCodeToSend: http.StatusBadRequest,
 		},
 	})
+	api.cache.set(domainKey, "123", "")
 	defer server.Close()
 	_, err := api.CreateSIPAuthToken("456")
 	assert.Error(t, err)
 }
 
 func TestCreateSIPAuthTokenFail2(t *testing.T) {
-	domainID = ""
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
 			PathAndQuery:     "/v1/users/userID/domains",
@@ -348,6 +351,215 @@ func TestCreateSIPAuthTokenFail2(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestCreateSIPAuthTokenWithRemovedDomain(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/domains/123/endpoints/456/tokens",
+			Method:           http.MethodPost,
+			StatusCodeToSend: http.StatusNotFound,
+		},
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/domains?size=100",
+			Method:        http.MethodGet,
+			ContentToSend: `[{"name": "domain", "id": "789", "description": "GolangVoiceReferenceApp's domain"}]`,
+		},
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/domains/789/endpoints/456/tokens",
+			Method:        http.MethodPost,
+			ContentToSend: `{"token": "token"}`,
+		},
+	})
+	api.cache.set(domainKey, "123", "")
+	defer server.Close()
+	token, err := api.CreateSIPAuthToken("456")
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token.Token)
+	id, _, _ := api.GetDomain()
+	assert.Equal(t, "789", id)
+}
+
+func TestFindPhoneNumber(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/phoneNumbers?name=name",
+			Method:        http.MethodGet,
+			ContentToSend: `[{"id": "123", "name": "name", "number": "+1234567890"}]`,
+		},
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/phoneNumbers?name=name1",
+			Method:        http.MethodGet,
+			ContentToSend: `[]`,
+		},
+	})
+	defer server.Close()
+	number, err := api.FindPhoneNumber("name")
+	assert.NoError(t, err)
+	assert.Equal(t, "+1234567890", number)
+	number, err = api.FindPhoneNumber("name1")
+	assert.NoError(t, err)
+	assert.Equal(t, "", number)
+}
+
+func TestReleasePhoneNumber(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/phoneNumbers/%2B1234567890",
+			Method:        http.MethodGet,
+			ContentToSend: `{"id": "123", "number": "+1234567890"}`,
+		},
+		RequestHandler{
+			PathAndQuery: "/v1/users/userID/phoneNumbers/123",
+			Method:       http.MethodDelete,
+		},
+	})
+	defer server.Close()
+	assert.NoError(t, api.ReleasePhoneNumber("+1234567890"))
+	// released number is ignored
+	assert.NoError(t, api.ReleasePhoneNumber("+1234567891"))
+}
+
+func TestReleasePhoneNumberFail(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/phoneNumbers/%2B1234567890",
+			Method:           http.MethodGet,
+			StatusCodeToSend: http.StatusInternalServerError,
+		},
+	})
+	defer server.Close()
+	assert.Error(t, api.ReleasePhoneNumber("+1234567890"))
+}
+
+func TestFindSIPAccount(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/domains/123/endpoints",
+			Method:        http.MethodGet,
+			ContentToSend: `[{"id": "456", "name": "user1"}, {"id": "789", "name": "user2"}]`,
+		},
+	})
+	defer server.Close()
+	api.cache.set(domainKey, "123", "domain")
+	id, err := api.FindSIPAccount("user2")
+	assert.NoError(t, err)
+	assert.Equal(t, "789", id)
+	id, err = api.FindSIPAccount("user3")
+	assert.NoError(t, err)
+	assert.Equal(t, "", id)
+}
+
+func TestDeleteSIPAccount(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery: "/v1/users/userID/domains/123/endpoints/456",
+			Method:       http.MethodDelete,
+		},
+	})
+	defer server.Close()
+	api.cache.set(domainKey, "123", "domain")
+	assert.NoError(t, api.DeleteSIPAccount("456"))
+	// removed endpoint is ignored
+	assert.NoError(t, api.DeleteSIPAccount("789"))
+}
+
+func TestDeleteSIPAccountWithErrorResponse(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/domains/123/endpoints/456",
+			Method:           http.MethodDelete,
+			StatusCodeToSend: http.StatusNotFound,
+			ContentToSend:    `{"code": "domain-endpoint-not-found"}`,
+		},
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/domains/123/endpoints/789",
+			Method:           http.MethodDelete,
+			StatusCodeToSend: http.StatusBadRequest,
+			ContentToSend:    `{"code": "endpoint-in-use", "message": "Endpoint is in use"}`,
+		},
+	})
+	defer server.Close()
+	api.cache.set(domainKey, "123", "domain")
+	assert.NoError(t, api.DeleteSIPAccount("456"))
+	assert.EqualError(t, api.DeleteSIPAccount("789"), "Endpoint is in use")
+}
+
+func TestDeleteSIPAccountWithStaleDomain(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/domains/123/endpoints/456",
+			Method:           http.MethodDelete,
+			StatusCodeToSend: http.StatusNotFound,
+			ContentToSend:    `{"code": "domain-not-found"}`,
+		},
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/domains?size=100",
+			Method:        http.MethodGet,
+			ContentToSend: `[{"name": "domain", "id": "789", "description": "GolangVoiceReferenceApp's domain"}]`,
+		},
+		RequestHandler{
+			PathAndQuery: "/v1/users/userID/domains/789/endpoints/456",
+			Method:       http.MethodDelete,
+		},
+	})
+	defer server.Close()
+	api.cache.set(domainKey, "123", "domain")
+	assert.NoError(t, api.DeleteSIPAccount("456"))
+	id, _, _ := api.GetDomain()
+	assert.Equal(t, "789", id)
+}
+
+func TestDeleteSIPAccountWithMissingDomain(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/domains/123/endpoints/456",
+			Method:           http.MethodDelete,
+			StatusCodeToSend: http.StatusNotFound,
+			ContentToSend:    `{"code": "domain-not-found"}`,
+		},
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/domains?size=100",
+			Method:        http.MethodGet,
+			ContentToSend: `[{"name": "domain", "id": "123", "description": "GolangVoiceReferenceApp's domain"}]`,
+		},
+	})
+	defer server.Close()
+	api.cache.set(domainKey, "123", "domain")
+	// the endpoint is not reported as removed
+	assert.EqualError(t, api.DeleteSIPAccount("456"), "domain-not-found")
+}
+
+func TestGetApplicationIDConcurrently(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/applications?size=1000",
+			Method:        http.MethodGet,
+			ContentToSend: `[{"name": "GolangVoiceReferenceApp on localhost", "id": "1234", "incomingCallUrl": "http://localhost/callCallback?secret=callbackSecret"}]`,
+		},
+	})
+	defer server.Close()
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		handler.ServeHTTP(w, r)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := api.GetApplicationID()
+			assert.NoError(t, err)
+			assert.Equal(t, "1234", id)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, requests)
+}
+
 func TestUpdateCall(t *testing.T) {
 	server, api := startMockCatapultServer(t, []RequestHandler{
 		RequestHandler{
@@ -581,30 +793,171 @@ func TestDownloadMediaFileFail(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestUploadMediaFile(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/media/test.wav",
+			Method:           http.MethodPut,
+			EstimatedContent: "123",
+			EstimatedHeaders: map[string]string{"Content-Type": "audio/wav"},
+		},
+	})
+	defer server.Close()
+	url, err := api.UploadMediaFile("test.wav", ioutil.NopCloser(strings.NewReader("123")), "audio/wav")
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/v1/users/userID/media/test.wav", url)
+}
+
+func TestUploadMediaFileFail(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/media/test.wav",
+			Method:           http.MethodPut,
+			StatusCodeToSend: http.StatusBadRequest,
+		},
+	})
+	defer server.Close()
+	_, err := api.UploadMediaFile("test.wav", ioutil.NopCloser(strings.NewReader("123")), "audio/wav")
+	assert.Error(t, err)
+}
+
+func TestCreateRecordingTranscription(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/recordings/123/transcriptions",
+			Method:        http.MethodPost,
+			HeadersToSend: map[string]string{"Location": "/v1/users/userID/recordings/123/transcriptions/456"},
+		},
+	})
+	defer server.Close()
+	id, err := api.CreateRecordingTranscription("123")
+	assert.NoError(t, err)
+	assert.Equal(t, "456", id)
+}
+
+func TestCreateRecordingTranscriptionFail(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/recordings/123/transcriptions",
+			Method:           http.MethodPost,
+			StatusCodeToSend: http.StatusBadRequest,
+		},
+	})
+	defer server.Close()
+	_, err := api.CreateRecordingTranscription("123")
+	assert.Error(t, err)
+}
+
+func TestGetRecordingTranscription(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/recordings/123/transcriptions/456",
+			Method:        http.MethodGet,
+			ContentToSend: `{"id": "456", "text": "Hello"}`,
+		},
+	})
+	defer server.Close()
+	transcription, err := api.GetRecordingTranscription("123", "456")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", transcription.Text)
+}
+
+func TestGetRecordingTranscriptionFail(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/recordings/123/transcriptions/456",
+			Method:           http.MethodGet,
+			StatusCodeToSend: http.StatusNotFound,
+		},
+	})
+	defer server.Close()
+	_, err := api.GetRecordingTranscription("123", "456")
+	assert.Error(t, err)
+}
+
+func TestCreateMessage(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/messages",
+			Method:           http.MethodPost,
+			EstimatedContent: `{"from":"111","to":"222","text":"Hello"}`,
+			HeadersToSend:    map[string]string{"Location": "/v1/users/userID/messages/123"},
+		},
+	})
+	defer server.Close()
+	id, err := api.CreateMessage(&bandwidth.CreateMessageData{
+		From: "111",
+		To:   "222",
+		Text: "Hello",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "123", id)
+}
+
+func TestCreateMessageFail(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/messages",
+			Method:           http.MethodPost,
+			StatusCodeToSend: http.StatusBadRequest,
+		},
+	})
+	defer server.Close()
+	_, err := api.CreateMessage(&bandwidth.CreateMessageData{
+		From: "111",
+		To:   "222",
+		Text: "Hello",
+	})
+	assert.Error(t, err)
+}
+
+func TestCreateBridge(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/bridges",
+			Method:           http.MethodPost,
+			EstimatedContent: `{"bridgeAudio":"true","callIds":["111","222"]}`,
+			HeadersToSend:    map[string]string{"Location": "/v1/users/userID/bridges/123"},
+		},
+	})
+	defer server.Close()
+	id, err := api.CreateBridge(&bandwidth.BridgeData{
+		BridgeAudio: true,
+		CallIDs:     []string{"111", "222"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "123", id)
+}
+
+func TestCreateBridgeFail(t *testing.T) {
+	server, api := startMockCatapultServer(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:     "/v1/users/userID/bridges",
+			Method:           http.MethodPost,
+			StatusCodeToSend: http.StatusBadRequest,
+		},
+	})
+	defer server.Close()
+	_, err := api.CreateBridge(&bandwidth.BridgeData{
+		BridgeAudio: true,
+		CallIDs:     []string{"111", "222"},
+	})
+	assert.Error(t, err)
+}
+
 func TestCatapultMiddleware(t *testing.T) {
-	os.Setenv("CATAPULT_USER_ID", "UserID")
-	os.Setenv("CATAPULT_API_TOKEN", "Token")
-	os.Setenv("CATAPULT_API_SECRET", "Secret")
+	server, client := startMockCatapultServer(t, []RequestHandler{})
+	defer server.Close()
+	api := newResilientCatapultAPI(client, &timer{})
 	context := createFakeGinContext()
-	catapultMiddleware(context)
+	newCatapultMiddleware(api)(context)
 	instance := context.MustGet("catapultAPI")
 	assert.NotNil(t, instance)
-	assert.NotNil(t, instance.(catapultAPIInterface))
-}
-
-func TestCatapultMiddlewareFail(t *testing.T) {
-	os.Unsetenv("CATAPULT_USER_ID")
-	os.Unsetenv("CATAPULT_API_TOKEN")
-	os.Unsetenv("CATAPULT_API_SECRET")
-	context := createFakeGinContext()
-	gin.SetMode(gin.TestMode)
-	defer func() {
-		_, ok := context.Get("catapultAPI")
-		assert.False(t, ok)
-		r := recover()
-		assert.NotNil(t, r)
-	}()
-	catapultMiddleware(context)
+	requestAPI := instance.(*resilientCatapultAPI)
+	assert.Equal(t, context, requestAPI.api.context)
+	assert.Equal(t, api.api.client, requestAPI.api.client)
+	assert.True(t, api.breaker == requestAPI.breaker)
+	assert.False(t, api.api == requestAPI.api) // shared api is not changed
 }
 
 func TestRandomString(t *testing.T) {
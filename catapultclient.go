@@ -0,0 +1,461 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/gin-gonic/gin"
+)
+
+// errCatapultUnavailable is returned without calling Catapult while circuit breaker is open
+var errCatapultUnavailable = errors.New("Catapult API is unavailable now, please try again later")
+
+// errCatapultTimeout is returned when Catapult has not responded in time
+var errCatapultTimeout = errors.New("Catapult API request has timed out")
+
+// go-bandwidth returns status code in error message only if response has no error message
+// ("Http code 404", or "Http code 404: <body>" for downloads of media files)
+var statusCodeRegexp = regexp.MustCompile(`^Http code (\d{3})(:|$)`)
+
+// catapultRetryOptions defines how requests to Catapult are repeated
+type catapultRetryOptions struct {
+	maxAttempts    int           // for idempotent requests
+	initialBackoff time.Duration // it is doubled after each attempt
+	maxBackoff     time.Duration
+	timeout        time.Duration // of each attempt
+}
+
+var defaultCatapultRetryOptions = catapultRetryOptions{
+	maxAttempts:    3,
+	initialBackoff: 200 * time.Millisecond,
+	maxBackoff:     2 * time.Second,
+	timeout:        15 * time.Second,
+}
+
+// isRetryableCatapultError checks if error is caused by Catapult outage (timeouts, network errors, 429 and 5xx responses)
+func isRetryableCatapultError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == errCatapultTimeout {
+		return true
+	}
+	switch err.(type) {
+	case *url.Error, net.Error:
+		return true
+	}
+	code := getCatapultStatusCode(err)
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// getCatapultStatusCode returns status code of Catapult response from error of go-bandwidth (0 if it is unknown)
+func getCatapultStatusCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	match := statusCodeRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+	code, _ := strconv.Atoi(match[1])
+	return code
+}
+
+// circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "halfOpen" // one trial request is allowed
+)
+
+// circuitBreaker stops requests to Catapult for openTimeout after failureThreshold failures in a row
+type circuitBreaker struct {
+	failureThreshold int
+	openTimeout      time.Duration
+	timerAPI         timerInterface
+
+	lock     sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(failureThreshold int, openTimeout time.Duration, timerAPI timerInterface) *circuitBreaker {
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		timerAPI:         timerAPI,
+		state:            circuitClosed,
+	}
+}
+
+// allow checks if a request can be sent now
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.timerAPI.Now().Sub(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false // trial request is running
+	}
+	return true
+}
+
+// report updates state of the breaker by result of a request
+func (b *circuitBreaker) report(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !isRetryableCatapultError(err) {
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.failureThreshold {
+		if b.state != circuitOpen {
+			debugf("Catapult API is unavailable (%s), circuit breaker is open\n", err.Error())
+		}
+		b.state = circuitOpen
+		b.openedAt = b.timerAPI.Now()
+	}
+}
+
+func (b *circuitBreaker) getState() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// resilientCatapultAPI is catapultAPIInterface which repeats idempotent requests with exponential backoff,
+// limits time of each request and stops sending requests while Catapult is down
+type resilientCatapultAPI struct {
+	api     *catapultAPI
+	breaker *circuitBreaker
+	options catapultRetryOptions
+}
+
+func newResilientCatapultAPI(api *catapultAPI, timerAPI timerInterface) *resilientCatapultAPI {
+	return &resilientCatapultAPI{
+		api:     api,
+		breaker: newCircuitBreaker(5, 30*time.Second, timerAPI),
+		options: defaultCatapultRetryOptions,
+	}
+}
+
+// withContext returns API for given request. Client, cache and circuit breaker are shared.
+func (r *resilientCatapultAPI) withContext(context *gin.Context) *resilientCatapultAPI {
+	api := *r.api
+	api.context = context
+	return &resilientCatapultAPI{api: &api, breaker: r.breaker, options: r.options}
+}
+
+// catapultResult is result of one attempt of a request
+type catapultResult struct {
+	value interface{}
+	err   error
+}
+
+// attempt runs a request with timeout. Request which has timed out is not cancelled (go-bandwidth doesn't allow it)
+// but its result is ignored: it is passed to release (if set) to free its resources.
+func (r *resilientCatapultAPI) attempt(request func() (interface{}, error), release func(value interface{})) (interface{}, error) {
+	if !r.breaker.allow() {
+		return nil, errCatapultUnavailable
+	}
+	done := make(chan catapultResult, 1)
+	go func() {
+		value, err := request()
+		done <- catapultResult{value, err}
+	}()
+	select {
+	case result := <-done:
+		r.breaker.report(result.err)
+		return result.value, result.err
+	case <-time.After(r.options.timeout):
+		r.breaker.report(errCatapultTimeout)
+		if release != nil {
+			go func() {
+				if result := <-done; result.err == nil {
+					release(result.value)
+				}
+			}()
+		}
+		return nil, errCatapultTimeout
+	}
+}
+
+// call runs a request. Idempotent requests are repeated on retryable errors.
+func (r *resilientCatapultAPI) call(idempotent bool, request func() (interface{}, error)) (interface{}, error) {
+	return r.callWithRelease(idempotent, request, nil)
+}
+
+// callWithRelease runs a request like call, results of timed out attempts are passed to release
+func (r *resilientCatapultAPI) callWithRelease(idempotent bool, request func() (interface{}, error),
+	release func(value interface{})) (interface{}, error) {
+	backoff := r.options.initialBackoff
+	for attempt := 1; ; attempt++ {
+		value, err := r.attempt(request, release)
+		if !idempotent || attempt >= r.options.maxAttempts || !isRetryableCatapultError(err) {
+			return value, err
+		}
+		debugf("Repeating request to Catapult after error: %s\n", err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > r.options.maxBackoff {
+			backoff = r.options.maxBackoff
+		}
+	}
+}
+
+func (r *resilientCatapultAPI) GetApplicationID() (string, error) {
+	value, err := r.call(true, func() (interface{}, error) {
+		return r.api.GetApplicationID()
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+// catapultDomain is result of GetDomain
+type catapultDomain struct {
+	id   string
+	name string
+}
+
+func (r *resilientCatapultAPI) GetDomain() (string, string, error) {
+	value, err := r.call(true, func() (interface{}, error) {
+		id, name, err := r.api.GetDomain()
+		return &catapultDomain{id, name}, err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	domain := value.(*catapultDomain)
+	return domain.id, domain.name, nil
+}
+
+func (r *resilientCatapultAPI) CreatePhoneNumber(areaCode string, name string) (string, error) {
+	value, err := r.call(false, func() (interface{}, error) {
+		return r.api.CreatePhoneNumber(areaCode, name)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (r *resilientCatapultAPI) FindPhoneNumber(name string) (string, error) {
+	value, err := r.call(true, func() (interface{}, error) {
+		return r.api.FindPhoneNumber(name)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (r *resilientCatapultAPI) ReleasePhoneNumber(number string) error {
+	_, err := r.call(true, func() (interface{}, error) {
+		return nil, r.api.ReleasePhoneNumber(number)
+	})
+	return err
+}
+
+func (r *resilientCatapultAPI) CreateSIPAccount(userName string) (*sipAccount, error) {
+	value, err := r.call(false, func() (interface{}, error) {
+		return r.api.CreateSIPAccount(userName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*sipAccount), nil
+}
+
+func (r *resilientCatapultAPI) FindSIPAccount(userName string) (string, error) {
+	value, err := r.call(true, func() (interface{}, error) {
+		return r.api.FindSIPAccount(userName)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (r *resilientCatapultAPI) DeleteSIPAccount(endpointID string) error {
+	_, err := r.call(true, func() (interface{}, error) {
+		return nil, r.api.DeleteSIPAccount(endpointID)
+	})
+	return err
+}
+
+func (r *resilientCatapultAPI) CreateSIPAuthToken(endpointID string) (*bandwidth.DomainEndpointToken, error) {
+	// repeated request creates another token which is harmless
+	value, err := r.call(true, func() (interface{}, error) {
+		return r.api.CreateSIPAuthToken(endpointID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*bandwidth.DomainEndpointToken), nil
+}
+
+func (r *resilientCatapultAPI) UpdateCall(callID string, data *bandwidth.UpdateCallData) (string, error) {
+	// transferring creates a new call, other changes can be repeated
+	value, err := r.call(data.State != "transferring", func() (interface{}, error) {
+		return r.api.UpdateCall(callID, data)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (r *resilientCatapultAPI) GetCall(callID string) (*bandwidth.Call, error) {
+	value, err := r.call(true, func() (interface{}, error) {
+		return r.api.GetCall(callID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*bandwidth.Call), nil
+}
+
+func (r *resilientCatapultAPI) PlayAudioToCall(callID string, url string) error {
+	_, err := r.call(false, func() (interface{}, error) {
+		return nil, r.api.PlayAudioToCall(callID, url)
+	})
+	return err
+}
+
+func (r *resilientCatapultAPI) SpeakSentenceToCall(callID string, text string) error {
+	_, err := r.call(false, func() (interface{}, error) {
+		return nil, r.api.SpeakSentenceToCall(callID, text)
+	})
+	return err
+}
+
+func (r *resilientCatapultAPI) CreateGather(callID string, data *bandwidth.CreateGatherData) (string, error) {
+	value, err := r.call(false, func() (interface{}, error) {
+		return r.api.CreateGather(callID, data)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (r *resilientCatapultAPI) GetRecording(recordingID string) (*bandwidth.Recording, error) {
+	value, err := r.call(true, func() (interface{}, error) {
+		return r.api.GetRecording(recordingID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*bandwidth.Recording), nil
+}
+
+func (r *resilientCatapultAPI) CreateCall(data *bandwidth.CreateCallData) (string, error) {
+	value, err := r.call(false, func() (interface{}, error) {
+		return r.api.CreateCall(data)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+// catapultMediaFile is result of DownloadMediaFile
+type catapultMediaFile struct {
+	content     io.ReadCloser
+	contentType string
+}
+
+// releaseCatapultMediaFile closes content of abandoned download (nobody reads it)
+func releaseCatapultMediaFile(value interface{}) {
+	if file := value.(*catapultMediaFile); file.content != nil {
+		file.content.Close()
+	}
+}
+
+func (r *resilientCatapultAPI) DownloadMediaFile(name string) (io.ReadCloser, string, error) {
+	value, err := r.callWithRelease(true, func() (interface{}, error) {
+		content, contentType, err := r.api.DownloadMediaFile(name)
+		return &catapultMediaFile{content, contentType}, err
+	}, releaseCatapultMediaFile)
+	if err != nil {
+		return nil, "", err
+	}
+	file := value.(*catapultMediaFile)
+	return file.content, file.contentType, nil
+}
+
+func (r *resilientCatapultAPI) DeleteMediaFile(name string) error {
+	_, err := r.call(true, func() (interface{}, error) {
+		return nil, r.api.DeleteMediaFile(name)
+	})
+	return err
+}
+
+func (r *resilientCatapultAPI) CreateRecordingTranscription(recordingID string) (string, error) {
+	value, err := r.call(false, func() (interface{}, error) {
+		return r.api.CreateRecordingTranscription(recordingID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (r *resilientCatapultAPI) GetRecordingTranscription(recordingID string, transcriptionID string) (*bandwidth.Transcription, error) {
+	value, err := r.call(true, func() (interface{}, error) {
+		return r.api.GetRecordingTranscription(recordingID, transcriptionID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*bandwidth.Transcription), nil
+}
+
+func (r *resilientCatapultAPI) CreateMessage(data *bandwidth.CreateMessageData) (string, error) {
+	value, err := r.call(false, func() (interface{}, error) {
+		return r.api.CreateMessage(data)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (r *resilientCatapultAPI) CreateBridge(data *bandwidth.BridgeData) (string, error) {
+	value, err := r.call(false, func() (interface{}, error) {
+		return r.api.CreateBridge(data)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (r *resilientCatapultAPI) UploadMediaFile(name string, content io.ReadCloser, contentType string) (string, error) {
+	// content can't be read again
+	value, err := r.call(false, func() (interface{}, error) {
+		return r.api.UploadMediaFile(name, content, contentType)
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
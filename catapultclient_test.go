@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// startMockResilientCatapultAPI starts mock Catapult server. First failedRequests requests fail with given status.
+func startMockResilientCatapultAPI(t *testing.T, handlers []RequestHandler, failedRequests int, status int) (*httptest.Server, *resilientCatapultAPI, *int32) {
+	server, client := startMockCatapultServer(t, handlers)
+	handler := server.Config.Handler
+	var requests int32
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= int32(failedRequests) {
+			w.WriteHeader(status)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	api := newResilientCatapultAPI(client, &fakeTimerAPI{CurrentTime: time.Now()})
+	api.options = catapultRetryOptions{maxAttempts: 3, initialBackoff: time.Millisecond, maxBackoff: 2 * time.Millisecond, timeout: time.Second}
+	return server, api, &requests
+}
+
+var getCallHandlers = []RequestHandler{
+	RequestHandler{
+		PathAndQuery:  "/v1/users/userID/calls/123",
+		Method:        http.MethodGet,
+		ContentToSend: `{"id": "123", "state":"active"}`,
+	},
+}
+
+func TestIsRetryableCatapultError(t *testing.T) {
+	assert.True(t, isRetryableCatapultError(errors.New("Http code 503")))
+	assert.True(t, isRetryableCatapultError(errors.New("Http code 429")))
+	assert.True(t, isRetryableCatapultError(errCatapultTimeout))
+	assert.True(t, isRetryableCatapultError(&url.Error{Op: "Get", URL: "http://localhost", Err: errors.New("connection refused")}))
+	assert.True(t, isRetryableCatapultError(errors.New("Http code 502: Bad Gateway")))
+	assert.False(t, isRetryableCatapultError(errors.New("Http code 404")))
+	assert.False(t, isRetryableCatapultError(errors.New("Http code 5000")))
+	assert.False(t, isRetryableCatapultError(errors.New("Call not found")))
+	assert.False(t, isRetryableCatapultError(errCatapultUnavailable))
+	assert.False(t, isRetryableCatapultError(nil))
+}
+
+func TestGetCatapultStatusCode(t *testing.T) {
+	assert.Equal(t, 404, getCatapultStatusCode(errors.New("Http code 404")))
+	assert.Equal(t, 404, getCatapultStatusCode(errors.New("Http code 404: Not Found")))
+	assert.Equal(t, 0, getCatapultStatusCode(errors.New("Call not found")))
+	assert.Equal(t, 0, getCatapultStatusCode(nil))
+}
+
+func TestResilientCatapultAPIRepeatsIdempotentRequests(t *testing.T) {
+	server, api, requests := startMockResilientCatapultAPI(t, getCallHandlers, 2, http.StatusServiceUnavailable)
+	defer server.Close()
+	call, err := api.GetCall("123")
+	assert.NoError(t, err)
+	assert.Equal(t, "active", call.State)
+	assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+	assert.Equal(t, circuitClosed, api.breaker.getState())
+}
+
+func TestResilientCatapultAPIFailsAfterAllAttempts(t *testing.T) {
+	server, api, requests := startMockResilientCatapultAPI(t, getCallHandlers, 10, http.StatusTooManyRequests)
+	defer server.Close()
+	_, err := api.GetCall("123")
+	assert.EqualError(t, err, "Http code 429")
+	assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+}
+
+func TestResilientCatapultAPIDoesntRepeatOtherRequests(t *testing.T) {
+	server, api, requests := startMockResilientCatapultAPI(t, []RequestHandler{
+		RequestHandler{
+			PathAndQuery:  "/v1/users/userID/calls",
+			Method:        http.MethodPost,
+			HeadersToSend: map[string]string{"Location": "/v1/users/userID/calls/123"},
+		},
+	}, 1, http.StatusInternalServerError)
+	defer server.Close()
+	_, err := api.CreateCall(&bandwidth.CreateCallData{From: "111", To: "222"})
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+	// client errors are not repeated
+	_, err = api.GetCall("unknown")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+}
+
+func TestResilientCatapultAPIWithTimeout(t *testing.T) {
+	server, api, _ := startMockResilientCatapultAPI(t, getCallHandlers, 0, 0)
+	defer server.Close()
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		handler.ServeHTTP(w, r)
+	})
+	api.options.timeout = 10 * time.Millisecond
+	api.options.maxAttempts = 1
+	_, err := api.GetCall("123")
+	assert.Equal(t, errCatapultTimeout, err)
+}
+
+func TestResilientCatapultAPIIgnoresLateResponse(t *testing.T) {
+	server, api, requests := startMockResilientCatapultAPI(t, getCallHandlers, 0, 0)
+	defer server.Close()
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(requests) == 1 {
+			// the first attempt is answered after the timeout
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte(`{"id": "123", "state":"completed"}`))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	api.options.timeout = 10 * time.Millisecond
+	call, err := api.GetCall("123")
+	assert.NoError(t, err)
+	// the late response doesn't change the result of the retry
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "active", call.State)
+}
+
+type fakeReadCloser struct {
+	closed int32
+}
+
+func (r *fakeReadCloser) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (r *fakeReadCloser) Close() error {
+	atomic.StoreInt32(&r.closed, 1)
+	return nil
+}
+
+func TestResilientCatapultAPIReleasesAbandonedResult(t *testing.T) {
+	api := newResilientCatapultAPI(nil, &fakeTimerAPI{CurrentTime: time.Now()})
+	api.options.timeout = 10 * time.Millisecond
+	content := &fakeReadCloser{}
+	value, err := api.attempt(func() (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return &catapultMediaFile{content, "audio/wav"}, nil
+	}, releaseCatapultMediaFile)
+	assert.Equal(t, errCatapultTimeout, err)
+	assert.Nil(t, value)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&content.closed))
+}
+
+func TestResilientCatapultAPICircuitBreaker(t *testing.T) {
+	server, api, requests := startMockResilientCatapultAPI(t, getCallHandlers, 5, http.StatusBadGateway)
+	defer server.Close()
+	timerAPI := api.breaker.timerAPI.(*fakeTimerAPI)
+	api.options.maxAttempts = 1
+	for i := 0; i < 5; i++ {
+		_, err := api.GetCall("123")
+		assert.EqualError(t, err, "Http code 502")
+	}
+	assert.Equal(t, circuitOpen, api.breaker.getState())
+	// requests are not sent while the breaker is open
+	_, err := api.GetCall("123")
+	assert.Equal(t, errCatapultUnavailable, err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(requests))
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(api.breaker.openTimeout)
+	call, err := api.GetCall("123")
+	assert.NoError(t, err)
+	assert.Equal(t, "123", call.ID)
+	assert.Equal(t, circuitClosed, api.breaker.getState())
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	breaker := newCircuitBreaker(2, time.Minute, timerAPI)
+	assert.True(t, breaker.allow())
+	breaker.report(errors.New("Http code 500"))
+	breaker.report(errors.New("Call not found")) // client errors don't break the circuit
+	breaker.report(errors.New("Http code 500"))
+	assert.True(t, breaker.allow())
+	breaker.report(errCatapultTimeout)
+	assert.False(t, breaker.allow())
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(time.Minute)
+	assert.True(t, breaker.allow())
+	// only one trial request is allowed
+	assert.False(t, breaker.allow())
+	breaker.report(errCatapultTimeout)
+	assert.Equal(t, circuitOpen, breaker.getState())
+	assert.False(t, breaker.allow())
+}
+
+func openCircuitBreaker(api *resilientCatapultAPI) {
+	for i := 0; i < api.breaker.failureThreshold; i++ {
+		api.breaker.report(errCatapultTimeout)
+	}
+}
+
+func TestRouteRegisterFailWithUnavailableCatapult(t *testing.T) {
+	server, api, requests := startMockResilientCatapultAPI(t, []RequestHandler{}, 0, 0)
+	defer server.Close()
+	openCircuitBreaker(api)
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&User{}, "user_name = ?", "user1")
+	result := map[string]interface{}{}
+	w := makeRequest(t, api.withContext(createFakeGinContext()), nil, db, http.MethodPost, "/register", "", gin.H{
+		"userName":       "user1",
+		"areaCode":       "910",
+		"password":       "123456",
+		"repeatPassword": "123456",
+	}, &result)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, errCatapultUnavailable.Error(), result["message"])
+	assert.Equal(t, int32(0), atomic.LoadInt32(requests))
+}
+
+func TestRouteSIPDataFailWithUnavailableCatapult(t *testing.T) {
+	server, api, requests := startMockResilientCatapultAPI(t, []RequestHandler{}, 0, 0)
+	defer server.Close()
+	openCircuitBreaker(api)
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, api.withContext(createFakeGinContext()), nil, db, http.MethodGet, "/sipData", token)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int32(0), atomic.LoadInt32(requests))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// secrets which were compiled into the app before they became configurable. Development keys are used only in
+// debug and test modes, legacy pepper (version 0) checks hashes created before configuring of peppers.
+const (
+	developmentJWTKey        = "9SbPxeIyvoT3HkIQ19wN9p_e_b6Xb7iJ"
+	developmentEncryptionKey = "ZGV2ZWxvcG1lbnQga2V5IG9mIHNlY3JldHMgISEhISE=" // base64 of 32 bytes
+	legacyPepper             = "cWWRcK0.8^eUgu_!V@@K6D^;#,jL+Yl"
+)
+
+// appConfig contains secrets of the app. They are read from JSON file CONFIG_FILE (optional) and environment
+// variables (they override values from the file).
+type appConfig struct {
+	// JWTKeys are accepted keys of auth tokens. The first key signs new tokens, others are previous keys
+	// which are kept for verification of issued tokens until they expire.
+	JWTKeys []string `json:"jwtKeys"`
+	// Peppers are secrets appended to passwords and PINs before hashing by version. Version of pepper is stored
+	// with each hash so old hashes can be checked after adding of new pepper.
+	Peppers map[int]string `json:"peppers"`
+	// PepperVersion is version of pepper for new hashes (the highest version by default)
+	PepperVersion int `json:"pepperVersion"`
+	// EncryptionKeys are base64 encoded 256-bit keys which encrypt data keys of secrets stored in db (like SIP
+	// passwords) by version. Version of the key is stored with each encrypted secret.
+	EncryptionKeys map[int]string `json:"encryptionKeys"`
+	// EncryptionKeyVersion is version of key for new secrets (the highest version by default)
+	EncryptionKeyVersion int `json:"encryptionKeyVersion"`
+}
+
+// config is current configuration of the app (main replaces it by loaded one)
+var config = &appConfig{
+	JWTKeys:        []string{developmentJWTKey},
+	Peppers:        map[int]string{0: legacyPepper},
+	EncryptionKeys: map[int]string{0: developmentEncryptionKey},
+}
+
+// loadConfig reads configuration from file and environment variables. Missing secrets are allowed in
+// debug and test modes only.
+func loadConfig() (*appConfig, error) {
+	cfg := &appConfig{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(content, cfg); err != nil {
+			return nil, fmt.Errorf("Invalid config file %s: %s", path, err.Error())
+		}
+	}
+	if keys := os.Getenv("JWT_KEYS"); keys != "" {
+		cfg.JWTKeys = strings.Split(keys, ",")
+	}
+	var err error
+	if cfg.Peppers, cfg.PepperVersion, err = readVersionedSecrets("PASSWORD_PEPPERS", "PASSWORD_PEPPER_VERSION",
+		cfg.Peppers, cfg.PepperVersion); err != nil {
+		return nil, err
+	}
+	if cfg.EncryptionKeys, cfg.EncryptionKeyVersion, err = readVersionedSecrets("ENCRYPTION_KEYS", "ENCRYPTION_KEY_VERSION",
+		cfg.EncryptionKeys, cfg.EncryptionKeyVersion); err != nil {
+		return nil, err
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+	if gin.Mode() == gin.ReleaseMode && (len(cfg.JWTKeys) == 0 || len(cfg.Peppers) == 0 || len(cfg.EncryptionKeys) == 0) {
+		return nil, errors.New("JWT_KEYS, PASSWORD_PEPPERS and ENCRYPTION_KEYS should be set in release mode")
+	}
+	if getCallbackSecret() == "" {
+		if gin.Mode() == gin.ReleaseMode {
+			return nil, errors.New("CALLBACK_SECRET or CATAPULT_API_SECRET should be set in release mode")
+		}
+		debugf("CALLBACK_SECRET and CATAPULT_API_SECRET are not set, all callbacks will be rejected\n")
+	}
+	if len(cfg.JWTKeys) == 0 {
+		debugf("JWT_KEYS is not set, development key is used\n")
+		cfg.JWTKeys = []string{developmentJWTKey}
+	}
+	if len(cfg.Peppers) == 0 {
+		debugf("PASSWORD_PEPPERS is not set, development pepper is used\n")
+	}
+	if len(cfg.EncryptionKeys) == 0 {
+		debugf("ENCRYPTION_KEYS is not set, development key is used\n")
+		cfg.EncryptionKeys[0] = developmentEncryptionKey
+	}
+	cfg.Peppers[0] = legacyPepper
+	return cfg, nil
+}
+
+// readVersionedSecrets reads secrets from environment variable (comma separated pairs version:secret, the only
+// secret can be set without version) and version of current secret (the highest version by default)
+func readVersionedSecrets(name string, versionName string, secrets map[int]string, version int) (map[int]string, int, error) {
+	if value := os.Getenv(name); value != "" {
+		secrets = map[int]string{}
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.SplitN(item, ":", 2)
+			if len(parts) == 1 {
+				parts = []string{"1", item}
+			}
+			v, err := strconv.Atoi(parts[0])
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s should contain comma separated pairs version:secret", name)
+			}
+			secrets[v] = parts[1]
+		}
+	}
+	if secrets == nil {
+		secrets = map[int]string{}
+	}
+	if value := os.Getenv(versionName); value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s should be a number", versionName)
+		}
+		version = v
+	} else if version == 0 && len(secrets) > 0 {
+		versions := sortedVersions(secrets)
+		version = versions[len(versions)-1]
+	}
+	return secrets, version, nil
+}
+
+func (cfg *appConfig) validate() error {
+	for _, key := range cfg.JWTKeys {
+		if len(key) < 32 {
+			return errors.New("JWT keys should contain at least 32 symbols")
+		}
+	}
+	for version, pepper := range cfg.Peppers {
+		if version <= 0 {
+			return errors.New("Versions of peppers should be positive numbers (version 0 is reserved)")
+		}
+		if len(pepper) < 16 {
+			return fmt.Errorf("Pepper version %d should contain at least 16 symbols", version)
+		}
+	}
+	if _, ok := cfg.Peppers[cfg.PepperVersion]; cfg.PepperVersion != 0 && !ok {
+		return fmt.Errorf("Pepper version %d is not defined", cfg.PepperVersion)
+	}
+	for version, key := range cfg.EncryptionKeys {
+		if version <= 0 {
+			return errors.New("Versions of encryption keys should be positive numbers (version 0 is reserved)")
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 32 {
+			return fmt.Errorf("Encryption key version %d should be base64 encoded 32 bytes", version)
+		}
+	}
+	if _, ok := cfg.EncryptionKeys[cfg.EncryptionKeyVersion]; cfg.EncryptionKeyVersion != 0 && !ok {
+		return fmt.Errorf("Encryption key version %d is not defined", cfg.EncryptionKeyVersion)
+	}
+	return nil
+}
+
+// sortedVersions returns sorted versions of secrets
+func sortedVersions(secrets map[int]string) []int {
+	versions := make([]int, 0, len(secrets))
+	for version := range secrets {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// signingKey returns key for new auth tokens
+func (cfg *appConfig) signingKey() []byte {
+	return []byte(cfg.JWTKeys[0])
+}
+
+// verificationKeys returns all accepted keys of auth tokens
+func (cfg *appConfig) verificationKeys() [][]byte {
+	keys := make([][]byte, len(cfg.JWTKeys))
+	for i, key := range cfg.JWTKeys {
+		keys[i] = []byte(key)
+	}
+	return keys
+}
+
+// pepper returns pepper of given version
+func (cfg *appConfig) pepper(version int) (string, bool) {
+	pepper, ok := cfg.Peppers[version]
+	return pepper, ok
+}
+
+// encryptionKey returns decoded encryption key of given version
+func (cfg *appConfig) encryptionKey(version int) ([]byte, bool) {
+	key, ok := cfg.EncryptionKeys[version]
+	if !ok {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return decoded, err == nil
+}
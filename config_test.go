@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	j "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testJWTKey1 = "11111111111111111111111111111111"
+	testJWTKey2 = "22222222222222222222222222222222"
+)
+
+// useConfig replaces current configuration and returns function which restores it
+func useConfig(cfg *appConfig) func() {
+	oldConfig := config
+	config = cfg
+	return func() {
+		config = oldConfig
+	}
+}
+
+// createJWT returns auth token signed by the key (token id of the session is optional)
+func createJWT(t *testing.T, key string, id string, expire time.Time, tokenID ...string) string {
+	token := j.New(j.SigningMethodHS256)
+	token.Claims["id"] = id
+	if len(tokenID) > 0 {
+		token.Claims["jti"] = tokenID[0]
+	}
+	token.Claims["exp"] = expire.Unix()
+	token.Claims["orig_iat"] = time.Now().Unix()
+	tokenString, err := token.SignedString([]byte(key))
+	require.NoError(t, err)
+	return tokenString
+}
+
+func TestLoadConfig(t *testing.T) {
+	os.Setenv("JWT_KEYS", testJWTKey2+","+testJWTKey1)
+	os.Setenv("PASSWORD_PEPPERS", "1:pepper1pepper1pepper1,2:pepper2pepper2pepper2")
+	defer os.Unsetenv("JWT_KEYS")
+	defer os.Unsetenv("PASSWORD_PEPPERS")
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []byte(testJWTKey2), cfg.signingKey())
+	assert.Equal(t, [][]byte{[]byte(testJWTKey2), []byte(testJWTKey1)}, cfg.verificationKeys())
+	assert.Equal(t, 2, cfg.PepperVersion)
+	pepper, ok := cfg.pepper(1)
+	assert.True(t, ok)
+	assert.Equal(t, "pepper1pepper1pepper1", pepper)
+	pepper, _ = cfg.pepper(0)
+	assert.Equal(t, legacyPepper, pepper)
+	os.Setenv("PASSWORD_PEPPER_VERSION", "1")
+	defer os.Unsetenv("PASSWORD_PEPPER_VERSION")
+	os.Setenv("ENCRYPTION_KEYS", "1:"+testEncryptionKey1+",2:"+testEncryptionKey2)
+	defer os.Unsetenv("ENCRYPTION_KEYS")
+	cfg, err = loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.PepperVersion)
+	assert.Equal(t, 2, cfg.EncryptionKeyVersion)
+	key, ok := cfg.encryptionKey(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte(testJWTKey1), key)
+}
+
+func TestLoadConfigFromFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString(`{"jwtKeys": ["` + testJWTKey1 + `"], "peppers": {"1": "pepper1pepper1pepper1", "3": "pepper3pepper3pepper3"}}`)
+	file.Close()
+	os.Setenv("CONFIG_FILE", file.Name())
+	defer os.Unsetenv("CONFIG_FILE")
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{testJWTKey1}, cfg.JWTKeys)
+	assert.Equal(t, 3, cfg.PepperVersion)
+	// environment variables override the file
+	os.Setenv("PASSWORD_PEPPERS", "pepper4pepper4pepper4")
+	defer os.Unsetenv("PASSWORD_PEPPERS")
+	cfg, err = loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.PepperVersion)
+	assert.Equal(t, "pepper4pepper4pepper4", cfg.Peppers[1])
+}
+
+func TestLoadConfigWithoutSecrets(t *testing.T) {
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{developmentJWTKey}, cfg.JWTKeys)
+	assert.Equal(t, 0, cfg.PepperVersion)
+	_, ok := cfg.encryptionKey(0)
+	assert.True(t, ok)
+	gin.SetMode(gin.ReleaseMode)
+	defer gin.SetMode(gin.TestMode)
+	_, err = loadConfig()
+	assert.Error(t, err)
+	os.Setenv("JWT_KEYS", testJWTKey1)
+	os.Setenv("PASSWORD_PEPPERS", "pepper1pepper1pepper1")
+	defer os.Unsetenv("JWT_KEYS")
+	defer os.Unsetenv("PASSWORD_PEPPERS")
+	_, err = loadConfig()
+	assert.Error(t, err)
+	os.Setenv("ENCRYPTION_KEYS", testEncryptionKey1)
+	defer os.Unsetenv("ENCRYPTION_KEYS")
+	// callback secret is required too
+	defer os.Setenv("CATAPULT_API_SECRET", os.Getenv("CATAPULT_API_SECRET"))
+	defer os.Setenv("CALLBACK_SECRET", "callbackSecret")
+	os.Unsetenv("CALLBACK_SECRET")
+	os.Unsetenv("CATAPULT_API_SECRET")
+	_, err = loadConfig()
+	assert.Error(t, err)
+	os.Setenv("CATAPULT_API_SECRET", "secret")
+	cfg, err = loadConfig()
+	require.NoError(t, err)
+	_, ok = cfg.encryptionKey(0)
+	assert.False(t, ok)
+}
+
+func TestLoadConfigFail(t *testing.T) {
+	defer os.Unsetenv("JWT_KEYS")
+	defer os.Unsetenv("PASSWORD_PEPPERS")
+	defer os.Unsetenv("PASSWORD_PEPPER_VERSION")
+	os.Setenv("JWT_KEYS", "short")
+	_, err := loadConfig()
+	assert.Error(t, err)
+	os.Setenv("JWT_KEYS", testJWTKey1)
+	os.Setenv("PASSWORD_PEPPERS", "0:pepper0pepper0pepper0")
+	_, err = loadConfig()
+	assert.Error(t, err)
+	os.Setenv("PASSWORD_PEPPERS", "a:pepper1pepper1pepper1")
+	_, err = loadConfig()
+	assert.Error(t, err)
+	os.Setenv("PASSWORD_PEPPERS", "1:pepper1pepper1pepper1")
+	os.Setenv("PASSWORD_PEPPER_VERSION", "2")
+	_, err = loadConfig()
+	assert.Error(t, err)
+	os.Unsetenv("PASSWORD_PEPPER_VERSION")
+	defer os.Unsetenv("ENCRYPTION_KEYS")
+	os.Setenv("ENCRYPTION_KEYS", "1:c2hvcnQ=")
+	_, err = loadConfig()
+	assert.Error(t, err)
+}
+
+func TestParseJWTWithRotatedKeys(t *testing.T) {
+	keys := [][]byte{[]byte(testJWTKey2), []byte(testJWTKey1)}
+	token, err := parseJWT(createJWT(t, testJWTKey1, "1", time.Now().Add(time.Hour)), keys)
+	require.NoError(t, err)
+	assert.Equal(t, "1", token.Claims["id"])
+	_, err = parseJWT(createJWT(t, testJWTKey1, "1", time.Now().Add(time.Hour)), keys[:1])
+	assert.Error(t, err)
+	_, err = parseJWT(createJWT(t, testJWTKey1, "1", time.Now().Add(-time.Hour)), keys)
+	assert.Error(t, err)
+	_, err = parseJWT("invalid", keys)
+	assert.Error(t, err)
+}
+
+func TestComparePasswordsAfterPepperRotation(t *testing.T) {
+	defer useConfig(&appConfig{
+		JWTKeys:       []string{testJWTKey1},
+		Peppers:       map[int]string{0: legacyPepper, 1: "pepper1pepper1pepper1"},
+		PepperVersion: 1,
+	})()
+	user := &User{}
+	require.NoError(t, user.SetPassword("123456"))
+	assert.Equal(t, 1, user.PepperVersion)
+	assert.False(t, user.IsPasswordHashOutdated())
+	config.Peppers[2] = "pepper2pepper2pepper2"
+	config.PepperVersion = 2
+	assert.True(t, user.ComparePasswords("123456"))
+	assert.False(t, user.ComparePasswords("1234567"))
+	assert.True(t, user.IsPasswordHashOutdated())
+	require.NoError(t, user.SetPIN("1234"))
+	assert.Equal(t, 2, user.PINPepperVersion)
+	// pepper has been removed
+	delete(config.Peppers, 1)
+	assert.False(t, user.ComparePasswords("123456"))
+	assert.True(t, user.ComparePIN("1234"))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// maxEmailDeliveryAttempts is how many times the app tries to send a voice message by email
+const maxEmailDeliveryAttempts = 5
+
+// emailRetryDelay is a delay before second attempt of sending email (it grows with each attempt)
+const emailRetryDelay = 30 * time.Second
+
+type emailSenderInterface interface {
+	Send(to, subject, text string, attachment *emailAttachment) error
+}
+
+type emailAttachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+type smtpEmailSender struct {
+	Host     string
+	Port     string
+	UserName string
+	Password string
+	From     string
+}
+
+// newSMTPEmailSender returns SMTP sender configured by environment variables or nil if SMTP is not configured
+func newSMTPEmailSender() *smtpEmailSender {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil
+	}
+	sender := &smtpEmailSender{
+		Host:     host,
+		Port:     os.Getenv("SMTP_PORT"),
+		UserName: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("EMAIL_FROM"),
+	}
+	if sender.Port == "" {
+		sender.Port = "25"
+	}
+	if sender.From == "" {
+		sender.From = "voicemail@" + host
+	}
+	return sender
+}
+
+func (s *smtpEmailSender) Send(to, subject, text string, attachment *emailAttachment) error {
+	var auth smtp.Auth
+	if s.UserName != "" {
+		auth = smtp.PlainAuth("", s.UserName, s.Password, s.Host)
+	}
+	data, err := buildEmail(s.From, to, subject, text, attachment)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.Host+":"+s.Port, auth, s.From, []string{to}, data)
+}
+
+func buildEmail(from, to, subject, text string, attachment *emailAttachment) ([]byte, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte(text))
+	if attachment != nil {
+		part, err = writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded))
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", from)
+	fmt.Fprintf(message, "To: %s\r\n", to)
+	fmt.Fprintf(message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(message, "MIME-Version: 1.0\r\n")
+	// the header is folded because it would be longer than 76 symbols with the boundary
+	fmt.Fprintf(message, "Content-Type: multipart/mixed;\r\n\tboundary=%s\r\n\r\n", writer.Boundary())
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// emailDeliveryJobData is payload of the job which sends a voice message by email
+type emailDeliveryJobData struct {
+	DeliveryID uint `json:"deliveryId"`
+}
+
+// queueVoiceMailEmail schedules sending of a voice message as email attachment (it is retried on errors)
+func queueVoiceMailEmail(message *VoiceMailMessage, user *User, now time.Time, db *gorm.DB) *EmailDelivery {
+	if !user.EmailNotificationsEnabled || user.Email == "" {
+		return nil
+	}
+	delivery := &EmailDelivery{
+		VoiceMailMessageID: message.ID,
+		Email:              user.Email,
+	}
+	if err := db.Create(delivery).Error; err != nil {
+		debugf("Error on saving email delivery data: %s\n", err.Error())
+		return nil
+	}
+	if err := enqueueJob(db, emailDeliveryJob, &emailDeliveryJobData{DeliveryID: delivery.ID}, now); err != nil {
+		debugf("Error on scheduling email delivery: %s\n", err.Error())
+		return nil
+	}
+	return delivery
+}
+
+// handleEmailDeliveryJob makes an attempt to send a voice message by email. Each attempt is stored in EmailDelivery.
+func handleEmailDeliveryJob(job *Job, ctx *jobContext) error {
+	data := &emailDeliveryJobData{}
+	if err := job.decodePayload(data); err != nil {
+		return err
+	}
+	db := ctx.db
+	delivery := &EmailDelivery{}
+	if err := db.First(delivery, data.DeliveryID).Error; err != nil {
+		return err
+	}
+	if delivery.DeliveredAt != nil {
+		return nil
+	}
+	if ctx.emailSender == nil {
+		return errors.New("SMTP server is not configured")
+	}
+	message := &VoiceMailMessage{}
+	if err := db.First(message, delivery.VoiceMailMessageID).Error; err != nil {
+		return err
+	}
+	user := &User{}
+	if err := db.First(user, message.UserID).Error; err != nil {
+		return err
+	}
+	delivery.Attempts++
+	debugf("Sending voice message %d to %s (attempt %d)\n", message.ID, delivery.Email, delivery.Attempts)
+	user.Email = delivery.Email
+	err := sendVoiceMailByEmail(message, user, ctx.api, ctx.emailSender)
+	if err == nil {
+		now := ctx.timerAPI.Now()
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	} else {
+		debugf("Error on sending voice message by email: %s\n", err.Error())
+		delivery.LastError = err.Error()
+	}
+	if err := db.Save(delivery).Error; err != nil {
+		debugf("Error on saving email delivery data: %s\n", err.Error())
+	}
+	return err
+}
+
+// recordingExtensions maps content types of recordings to extensions of attached files
+var recordingExtensions = map[string]string{
+	"audio/wav":   ".wav",
+	"audio/x-wav": ".wav",
+	"audio/mpeg":  ".mp3",
+	"audio/mp3":   ".mp3",
+	"audio/ogg":   ".ogg",
+	"audio/mp4":   ".m4a",
+	"audio/x-m4a": ".m4a",
+	"audio/webm":  ".webm",
+}
+
+// getRecordingExtension returns extension of recording file by its content type (empty string if it is unknown)
+func getRecordingExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if extension, ok := recordingExtensions[mediaType]; ok {
+		return extension
+	}
+	if extensions, _ := mime.ExtensionsByType(mediaType); len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
+
+func sendVoiceMailByEmail(message *VoiceMailMessage, user *User, api catapultAPIInterface, sender emailSenderInterface) error {
+	reader, contentType, err := api.DownloadMediaFile(getMediaName(message.MediaURL))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "audio/wav"
+	}
+	duration := message.EndTime.Sub(message.StartTime) / time.Second
+	text := fmt.Sprintf("You have received a new voice message from %s at %s (%d seconds).",
+		message.From, message.StartTime.Format(time.RFC1123), duration)
+	if message.Transcription != "" {
+		text += "\r\n\r\n" + message.Transcription
+	}
+	return sender.Send(user.Email, "New voice message from "+message.From, text, &emailAttachment{
+		Name:        fmt.Sprintf("Recording%d%s", message.ID, getRecordingExtension(contentType)),
+		ContentType: contentType,
+		Content:     content,
+	})
+}
+
+func emailMiddleware(c *gin.Context) {
+	if sender := newSMTPEmailSender(); sender != nil {
+		c.Set("emailSender", sender)
+	}
+	c.Next()
+}
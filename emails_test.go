@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSMTPEmailSender(t *testing.T) {
+	os.Setenv("SMTP_HOST", "smtp.test.com")
+	os.Setenv("SMTP_USER", "user")
+	os.Setenv("SMTP_PASSWORD", "password")
+	defer os.Unsetenv("SMTP_HOST")
+	defer os.Unsetenv("SMTP_USER")
+	defer os.Unsetenv("SMTP_PASSWORD")
+	sender := newSMTPEmailSender()
+	assert.Equal(t, "smtp.test.com", sender.Host)
+	assert.Equal(t, "25", sender.Port)
+	assert.Equal(t, "user", sender.UserName)
+	assert.Equal(t, "password", sender.Password)
+	assert.Equal(t, "voicemail@smtp.test.com", sender.From)
+}
+
+func TestNewSMTPEmailSenderWithoutConfiguration(t *testing.T) {
+	os.Unsetenv("SMTP_HOST")
+	assert.Nil(t, newSMTPEmailSender())
+}
+
+func TestSMTPEmailSenderSend(t *testing.T) {
+	listener, messages := startMockSMTPServer(t)
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	sender := &smtpEmailSender{Host: host, Port: port, From: "from@test.com"}
+	err := sender.Send("to@test.com", "Subject", "Text", &emailAttachment{
+		Name:        "test.wav",
+		ContentType: "audio/wav",
+		Content:     []byte("1234"),
+	})
+	assert.NoError(t, err)
+	message := <-messages
+	assert.Contains(t, message, "To: to@test.com")
+	assert.Contains(t, message, "Subject: Subject")
+	assert.Contains(t, message, "Text")
+	assert.Contains(t, message, `attachment; filename=test.wav`)
+	assert.Contains(t, message, "MTIzNA==")
+}
+
+func TestSMTPEmailSenderSendFail(t *testing.T) {
+	listener, _ := startMockSMTPServer(t)
+	addr := listener.Addr().String()
+	listener.Close()
+	host, port, _ := net.SplitHostPort(addr)
+	sender := &smtpEmailSender{Host: host, Port: port, From: "from@test.com"}
+	assert.Error(t, sender.Send("to@test.com", "Subject", "Text", nil))
+}
+
+func TestBuildEmail(t *testing.T) {
+	data, err := buildEmail("from@test.com", "to@test.com", "Subject", "Text", &emailAttachment{
+		Name:        "test.wav",
+		ContentType: "audio/wav",
+		Content:     []byte(strings.Repeat("1", 100)),
+	})
+	assert.NoError(t, err)
+	message := string(data)
+	assert.Contains(t, message, "From: from@test.com\r\n")
+	assert.Contains(t, message, "MIME-Version: 1.0\r\n")
+	assert.Contains(t, message, "Content-Type: multipart/mixed;\r\n\tboundary=")
+	assert.Contains(t, message, "Content-Transfer-Encoding: base64")
+	for _, line := range strings.Split(message, "\r\n") {
+		assert.True(t, len(line) <= 76, line)
+	}
+	// the message can be parsed
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	require.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+	assert.NotEmpty(t, params["boundary"])
+}
+
+func TestSendVoiceMailByEmail(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	sender := &fakeEmailSender{}
+	message := &VoiceMailMessage{
+		MediaURL:  "http://some-host/name1",
+		StartTime: parseTime("2016-05-31T10:00:00Z"),
+		EndTime:   parseTime("2016-05-31T10:01:00Z"),
+		From:      "+1234567980",
+	}
+	message.ID = 1
+	api.On("DownloadMediaFile", "name1").Return(ioutil.NopCloser(strings.NewReader("1234")), "audio/wav", nil)
+	sender.On("Send", "user@test.com", "New voice message from +1234567980",
+		"You have received a new voice message from +1234567980 at Tue, 31 May 2016 10:00:00 UTC (60 seconds).", &emailAttachment{
+			Name:        "Recording1.wav",
+			ContentType: "audio/wav",
+			Content:     []byte("1234"),
+		}).Return(nil)
+	assert.NoError(t, sendVoiceMailByEmail(message, &User{Email: "user@test.com"}, api, sender))
+	api.AssertExpectations(t)
+	sender.AssertExpectations(t)
+}
+
+func TestSendVoiceMailByEmailWithMP3(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	sender := &fakeEmailSender{}
+	message := &VoiceMailMessage{MediaURL: "http://some-host/name1"}
+	message.ID = 2
+	api.On("DownloadMediaFile", "name1").Return(ioutil.NopCloser(strings.NewReader("1234")), "audio/mpeg", nil)
+	sender.On("Send", "user@test.com", mock.Anything, mock.Anything, &emailAttachment{
+		Name:        "Recording2.mp3",
+		ContentType: "audio/mpeg",
+		Content:     []byte("1234"),
+	}).Return(nil)
+	assert.NoError(t, sendVoiceMailByEmail(message, &User{Email: "user@test.com"}, api, sender))
+	sender.AssertExpectations(t)
+}
+
+func TestGetRecordingExtension(t *testing.T) {
+	assert.Equal(t, ".wav", getRecordingExtension("audio/wav"))
+	assert.Equal(t, ".wav", getRecordingExtension("audio/x-wav"))
+	assert.Equal(t, ".mp3", getRecordingExtension("audio/mpeg"))
+	assert.Equal(t, ".ogg", getRecordingExtension("audio/ogg; codecs=opus"))
+	assert.Equal(t, "", getRecordingExtension("application/x-unknown-type"))
+	assert.Equal(t, "", getRecordingExtension("invalid/"))
+}
+
+func TestSendVoiceMailByEmailFail(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	sender := &fakeEmailSender{}
+	message := &VoiceMailMessage{MediaURL: "http://some-host/name1"}
+	api.On("DownloadMediaFile", "name1").Return(ioutil.NopCloser(nil), "", errors.New("error"))
+	assert.Error(t, sendVoiceMailByEmail(message, &User{Email: "user@test.com"}, api, sender))
+	sender.AssertNotCalled(t, "Send")
+}
+
+func TestDeliverVoiceMailByEmail(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	sender := &fakeEmailSender{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		UserName:                  "euser",
+		AreaCode:                  "910",
+		Email:                     "user@test.com",
+		EmailNotificationsEnabled: true,
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	message := &VoiceMailMessage{
+		MediaURL:  "http://some-host/name1",
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		UserID:    user.ID,
+	}
+	db.Create(message)
+	api.On("DownloadMediaFile", "name1").Return(ioutil.NopCloser(strings.NewReader("1234")), "audio/wav", nil)
+	sender.On("Send", "user@test.com", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("error")).Once()
+	sender.On("Send", "user@test.com", mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+	delivery := queueVoiceMailEmail(message, user, timer.Now(), db)
+	assert.NotNil(t, delivery)
+	assert.Equal(t, 1, runDueJobs(db, api, timer, sender))
+	assert.Equal(t, 0, runDueJobs(db, api, timer, sender))
+	timer.CurrentTime = timer.CurrentTime.Add(emailRetryDelay)
+	assert.Equal(t, 1, runDueJobs(db, api, timer, sender))
+	sender.AssertExpectations(t)
+	stored := &EmailDelivery{}
+	assert.NoError(t, db.First(stored, delivery.ID).Error)
+	assert.Equal(t, 2, stored.Attempts)
+	assert.NotNil(t, stored.DeliveredAt)
+	count := 0
+	db.Model(&Job{}).Count(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestDeliverVoiceMailByEmailFail(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	sender := &fakeEmailSender{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		UserName:                  "euser1",
+		AreaCode:                  "910",
+		Email:                     "user@test.com",
+		EmailNotificationsEnabled: true,
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	message := &VoiceMailMessage{
+		MediaURL:  "http://some-host/name1",
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		UserID:    user.ID,
+	}
+	db.Create(message)
+	api.On("DownloadMediaFile", "name1").Return(ioutil.NopCloser(nil), "", errors.New("error"))
+	delivery := queueVoiceMailEmail(message, user, timer.Now(), db)
+	for i := 0; i < maxEmailDeliveryAttempts; i++ {
+		assert.Equal(t, 1, runDueJobs(db, api, timer, sender))
+		timer.CurrentTime = timer.CurrentTime.Add(time.Duration(i+1) * emailRetryDelay)
+	}
+	assert.Equal(t, 0, runDueJobs(db, api, timer, sender))
+	stored := &EmailDelivery{}
+	assert.NoError(t, db.First(stored, delivery.ID).Error)
+	assert.Equal(t, maxEmailDeliveryAttempts, stored.Attempts)
+	assert.Nil(t, stored.DeliveredAt)
+	assert.Equal(t, "error", stored.LastError)
+	job := &Job{}
+	assert.NoError(t, db.First(job).Error)
+	assert.Equal(t, JobFailed, job.State)
+	sender.AssertNotCalled(t, "Send")
+}
+
+func TestDeliverVoiceMailByEmailDisabled(t *testing.T) {
+	assert.Nil(t, queueVoiceMailEmail(&VoiceMailMessage{}, &User{Email: "user@test.com"}, time.Now(), nil))
+}
+
+func TestEmailMiddleware(t *testing.T) {
+	os.Setenv("SMTP_HOST", "smtp.test.com")
+	defer os.Unsetenv("SMTP_HOST")
+	context := createFakeGinContext()
+	emailMiddleware(context)
+	_, ok := context.Get("emailSender")
+	assert.True(t, ok)
+}
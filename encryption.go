@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Secrets stored in db are encrypted by envelope encryption: each value is encrypted (AES-256-GCM) by own random
+// data key, the data key is encrypted by encryption key from configuration. Stored value has format
+// v1:<version of encryption key>:<encrypted data key>:<encrypted value>, so rotation of the encryption key
+// requires re-encrypting of data keys only.
+const encryptedSecretPrefix = "v1"
+
+var errInvalidEncryptedSecret = errors.New("Invalid encrypted secret")
+
+func sealAESGCM(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openAESGCM(key []byte, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errInvalidEncryptedSecret
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
+
+// encryptedSecret is parsed encrypted value
+type encryptedSecret struct {
+	keyVersion int
+	dataKey    []byte // encrypted
+	value      []byte // encrypted
+}
+
+func parseEncryptedSecret(secret string) (*encryptedSecret, error) {
+	parts := strings.Split(secret, ":")
+	if len(parts) != 4 || parts[0] != encryptedSecretPrefix {
+		return nil, errInvalidEncryptedSecret
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, errInvalidEncryptedSecret
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidEncryptedSecret
+	}
+	value, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, errInvalidEncryptedSecret
+	}
+	return &encryptedSecret{version, dataKey, value}, nil
+}
+
+func (s *encryptedSecret) String() string {
+	return fmt.Sprintf("%s:%d:%s:%s", encryptedSecretPrefix, s.keyVersion,
+		base64.StdEncoding.EncodeToString(s.dataKey), base64.StdEncoding.EncodeToString(s.value))
+}
+
+// encryptSecret encrypts value by new data key and current encryption key. Empty value is not encrypted.
+func encryptSecret(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	encryptedValue, err := sealAESGCM(dataKey, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	secret := &encryptedSecret{keyVersion: config.EncryptionKeyVersion, value: encryptedValue}
+	if secret.dataKey, err = encryptDataKey(dataKey, secret.keyVersion); err != nil {
+		return "", err
+	}
+	return secret.String(), nil
+}
+
+// decryptSecret returns value encrypted by encryptSecret
+func decryptSecret(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	s, err := parseEncryptedSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := decryptDataKey(s.dataKey, s.keyVersion)
+	if err != nil {
+		return "", err
+	}
+	value, err := openAESGCM(dataKey, s.value)
+	if err != nil {
+		return "", errInvalidEncryptedSecret
+	}
+	return string(value), nil
+}
+
+// readSecret decrypts secret or returns plain text value stored before encryption
+func readSecret(secret string, plain string) (string, error) {
+	if secret == "" {
+		return plain, nil
+	}
+	return decryptSecret(secret)
+}
+
+// rotateSecret encrypts data key of the secret by current encryption key. It returns false if the secret uses
+// current key already.
+func rotateSecret(secret string) (string, bool, error) {
+	s, err := parseEncryptedSecret(secret)
+	if err != nil {
+		return "", false, err
+	}
+	if s.keyVersion == config.EncryptionKeyVersion {
+		return secret, false, nil
+	}
+	dataKey, err := decryptDataKey(s.dataKey, s.keyVersion)
+	if err != nil {
+		return "", false, err
+	}
+	s.keyVersion = config.EncryptionKeyVersion
+	if s.dataKey, err = encryptDataKey(dataKey, s.keyVersion); err != nil {
+		return "", false, err
+	}
+	return s.String(), true, nil
+}
+
+func encryptDataKey(dataKey []byte, version int) ([]byte, error) {
+	key, ok := config.encryptionKey(version)
+	if !ok {
+		return nil, fmt.Errorf("Encryption key version %d is not defined", version)
+	}
+	return sealAESGCM(key, dataKey)
+}
+
+func decryptDataKey(encryptedDataKey []byte, version int) ([]byte, error) {
+	key, ok := config.encryptionKey(version)
+	if !ok {
+		return nil, fmt.Errorf("Encryption key version %d is not defined", version)
+	}
+	dataKey, err := openAESGCM(key, encryptedDataKey)
+	if err != nil {
+		return nil, errInvalidEncryptedSecret
+	}
+	return dataKey, nil
+}
+
+// encryptedColumns lists columns with encrypted secrets and columns where they were stored in plain text before
+var encryptedColumns = []struct {
+	table     string
+	plain     string
+	encrypted string
+}{
+	{"users", "sip_password", "encrypted_sip_password"},
+	{"registrations", "sip_password", "encrypted_sip_password"},
+}
+
+// encryptSecrets encrypts secrets which are stored in plain text and encrypts data keys of other secrets by current
+// encryption key. It returns count of changed values.
+func encryptSecrets(db *gorm.DB) (int, error) {
+	count := 0
+	for _, column := range encryptedColumns {
+		rows, err := db.Raw(fmt.Sprintf("SELECT id, COALESCE(%s, ''), COALESCE(%s, '') FROM %s WHERE %s <> '' OR %s <> ''",
+			column.plain, column.encrypted, column.table, column.plain, column.encrypted)).Rows()
+		if err != nil {
+			return count, err
+		}
+		type change struct {
+			id    uint
+			value string
+		}
+		changes := []change{}
+		for rows.Next() {
+			var id uint
+			var plain, encrypted string
+			if err = rows.Scan(&id, &plain, &encrypted); err != nil {
+				rows.Close()
+				return count, err
+			}
+			changed := true
+			if encrypted != "" {
+				encrypted, changed, err = rotateSecret(encrypted)
+			} else {
+				encrypted, err = encryptSecret(plain)
+			}
+			if err != nil {
+				rows.Close()
+				return count, fmt.Errorf("Error on encrypting %s.%s of id %d: %s", column.table, column.plain, id, err.Error())
+			}
+			if changed || plain != "" {
+				changes = append(changes, change{id, encrypted})
+			}
+		}
+		rows.Close()
+		for _, c := range changes {
+			err = db.Exec(fmt.Sprintf("UPDATE %s SET %s = ?, %s = '' WHERE id = ?", column.table, column.encrypted,
+				column.plain), c.value, c.id).Error
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// runEncryptSecretsCommand encrypts secrets stored in plain text and rotates encryption key of others
+func runEncryptSecretsCommand(args []string, db *gorm.DB, output io.Writer) error {
+	flags := flag.NewFlagSet("encrypt-secrets", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	count, err := encryptSecrets(db)
+	fmt.Fprintf(output, "Encrypted secrets: %d\n", count)
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testEncryptionKey1 = base64.StdEncoding.EncodeToString([]byte(testJWTKey1))
+	testEncryptionKey2 = base64.StdEncoding.EncodeToString([]byte(testJWTKey2))
+)
+
+func useEncryptionKeys(keys map[int]string, version int) func() {
+	return useConfig(&appConfig{
+		JWTKeys:              config.JWTKeys,
+		Peppers:              config.Peppers,
+		PepperVersion:        config.PepperVersion,
+		EncryptionKeys:       keys,
+		EncryptionKeyVersion: version,
+	})
+}
+
+func TestEncryptSecret(t *testing.T) {
+	defer useEncryptionKeys(map[int]string{1: testEncryptionKey1}, 1)()
+	secret1, err := encryptSecret("password")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(secret1, "v1:1:"))
+	assert.False(t, strings.Contains(secret1, "password"))
+	secret2, _ := encryptSecret("password")
+	assert.NotEqual(t, secret1, secret2) // each secret has own data key
+	value, err := decryptSecret(secret1)
+	require.NoError(t, err)
+	assert.Equal(t, "password", value)
+	secret, _ := encryptSecret("")
+	assert.Equal(t, "", secret)
+	value, _ = decryptSecret("")
+	assert.Equal(t, "", value)
+}
+
+func TestDecryptSecretFail(t *testing.T) {
+	defer useEncryptionKeys(map[int]string{1: testEncryptionKey1}, 1)()
+	secret, _ := encryptSecret("password")
+	s, _ := parseEncryptedSecret(secret)
+	s.value[len(s.value)-1] ^= 1
+	_, err := decryptSecret(s.String())
+	assert.Equal(t, errInvalidEncryptedSecret, err)
+	_, err = decryptSecret("password")
+	assert.Equal(t, errInvalidEncryptedSecret, err)
+	// unknown key
+	useEncryptionKeys(map[int]string{2: testEncryptionKey2}, 2)
+	_, err = decryptSecret(secret)
+	assert.EqualError(t, err, "Encryption key version 1 is not defined")
+}
+
+func TestRotateSecret(t *testing.T) {
+	defer useEncryptionKeys(map[int]string{1: testEncryptionKey1}, 1)()
+	secret, _ := encryptSecret("password")
+	_, changed, err := rotateSecret(secret)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	config.EncryptionKeys[2] = testEncryptionKey2
+	config.EncryptionKeyVersion = 2
+	rotated, changed, err := rotateSecret(secret)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, strings.HasPrefix(rotated, "v1:2:"))
+	// value is not encrypted again
+	s1, _ := parseEncryptedSecret(secret)
+	s2, _ := parseEncryptedSecret(rotated)
+	assert.True(t, bytes.Equal(s1.value, s2.value))
+	delete(config.EncryptionKeys, 1)
+	value, err := decryptSecret(rotated)
+	require.NoError(t, err)
+	assert.Equal(t, "password", value)
+}
+
+func TestUserSIPPasswordIsEncrypted(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{UserName: "user1", SIPPassword: "654321"}
+	require.NoError(t, db.Create(user).Error)
+	var plain, encrypted string
+	require.NoError(t, db.Raw("SELECT sip_password, encrypted_sip_password FROM users WHERE id = ?", user.ID).
+		Row().Scan(&plain, &encrypted))
+	assert.Equal(t, "", plain)
+	assert.NotEqual(t, "", encrypted)
+	assert.False(t, strings.Contains(encrypted, "654321"))
+	user = &User{}
+	require.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.Equal(t, "654321", user.SIPPassword)
+}
+
+func TestEncryptSecrets(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	defer useEncryptionKeys(map[int]string{1: testEncryptionKey1}, 1)()
+	user1 := &User{UserName: "user1", SIPPassword: "111111"}
+	user2 := &User{UserName: "user2", PhoneNumber: "+1234567891", SIPPassword: "222222"}
+	require.NoError(t, db.Create(user1).Error)
+	require.NoError(t, db.Create(user2).Error)
+	// password stored before encryption
+	require.NoError(t, db.Exec("UPDATE users SET sip_password = ?, encrypted_sip_password = NULL WHERE id = ?",
+		"111111", user1.ID).Error)
+	user := &User{}
+	require.NoError(t, db.First(user, user1.ID).Error)
+	assert.Equal(t, "111111", user.SIPPassword)
+	output := &bytes.Buffer{}
+	require.NoError(t, runEncryptSecretsCommand([]string{}, db, output))
+	assert.Equal(t, "Encrypted secrets: 1\n", output.String())
+	var plain string
+	db.Raw("SELECT sip_password FROM users WHERE id = ?", user1.ID).Row().Scan(&plain)
+	assert.Equal(t, "", plain)
+	// rotation
+	config.EncryptionKeys[2] = testEncryptionKey2
+	config.EncryptionKeyVersion = 2
+	count, err := encryptSecrets(db)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	delete(config.EncryptionKeys, 1)
+	require.NoError(t, db.First(user, user1.ID).Error)
+	assert.Equal(t, "111111", user.SIPPassword)
+	user = &User{}
+	require.NoError(t, db.First(user, user2.ID).Error)
+	assert.Equal(t, "222222", user.SIPPassword)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// types of exported data
+const (
+	ExportCalls         = "calls"
+	ExportVoiceMessages = "voiceMessages"
+)
+
+// formats of exported data
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson" // newline delimited JSON
+)
+
+var callRecordColumns = []string{"id", "userId", "userName", "callId", "direction", "from", "to",
+	"startTime", "answerTime", "endTime", "disposition", "duration"}
+
+var voiceMessageColumns = []string{"id", "userId", "userName", "from", "startTime", "endTime", "duration",
+	"folder", "listened", "transcription"}
+
+// ExportOptions defines which data should be exported
+type ExportOptions struct {
+	Type   string
+	Format string
+	UserID uint // 0 means all users
+	Since  time.Time
+	Until  time.Time
+}
+
+// Validate checks options
+func (o *ExportOptions) Validate() error {
+	if o.Type != ExportCalls && o.Type != ExportVoiceMessages {
+		return fmt.Errorf("Unknown type of exported data %q (use %s or %s)", o.Type, ExportCalls, ExportVoiceMessages)
+	}
+	if o.Format != ExportCSV && o.Format != ExportNDJSON {
+		return fmt.Errorf("Unknown export format %q (use %s or %s)", o.Format, ExportCSV, ExportNDJSON)
+	}
+	if o.Since.IsZero() || o.Until.IsZero() {
+		return errors.New("Date range (since and until) is required")
+	}
+	if !o.Since.Before(o.Until) {
+		return errors.New("Start of date range should be before its end")
+	}
+	return nil
+}
+
+// ContentType returns MIME type of exported data
+func (o *ExportOptions) ContentType() string {
+	if o.Format == ExportCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// parseExportTime accepts dates (like 2016-12-01) and time in RFC3339 format. Empty value is zero time.
+func parseExportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("Invalid time %q (use formats like 2016-12-01 or 2016-12-01T10:00:00Z)", value)
+	}
+	return t, nil
+}
+
+type exportWriter interface {
+	WriteRow(values []interface{}) error
+	Flush() error
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+}
+
+func (w *csvExportWriter) WriteRow(values []interface{}) error {
+	row := make([]string, len(values))
+	for i, value := range values {
+		row[i] = formatExportValue(value)
+	}
+	return w.writer.Write(row)
+}
+
+func (w *csvExportWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type ndjsonExportWriter struct {
+	columns []string
+	encoder *json.Encoder
+}
+
+func (w *ndjsonExportWriter) WriteRow(values []interface{}) error {
+	item := make(map[string]interface{}, len(values))
+	for i, value := range values {
+		item[w.columns[i]] = value
+	}
+	return w.encoder.Encode(item)
+}
+
+func (w *ndjsonExportWriter) Flush() error {
+	return nil
+}
+
+func newExportWriter(w io.Writer, format string, columns []string) (exportWriter, error) {
+	if format == ExportNDJSON {
+		return &ndjsonExportWriter{columns, json.NewEncoder(w)}, nil
+	}
+	writer := &csvExportWriter{csv.NewWriter(w)}
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	return writer, writer.WriteRow(header)
+}
+
+func formatExportValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	case *time.Time:
+		if v == nil {
+			return ""
+		}
+		return v.UTC().Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// exportData writes call records or voice messages metadata to w row by row (without loading all of them to memory)
+func exportData(w io.Writer, options *ExportOptions, db *gorm.DB) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	var query *gorm.DB
+	var columns []string
+	if options.Type == ExportCalls {
+		query = db.Model(&CallRecord{})
+		columns = callRecordColumns
+	} else {
+		query = db.Model(&VoiceMailMessage{})
+		columns = voiceMessageColumns
+	}
+	query = query.Where("start_time >= ? AND start_time < ?", options.Since, options.Until)
+	if options.UserID != 0 {
+		query = query.Where("user_id = ?", options.UserID)
+	}
+	rows, err := query.Order("start_time, id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	writer, err := newExportWriter(w, options.Format, columns)
+	if err != nil {
+		return err
+	}
+	userNames := map[uint]string{}
+	getUserName := func(id uint) string {
+		name, ok := userNames[id]
+		if !ok {
+			user := &User{}
+			if err := db.Unscoped().Select("user_name").First(user, id).Error; err == nil {
+				name = user.UserName
+			}
+			userNames[id] = name
+		}
+		return name
+	}
+	count := 0
+	for rows.Next() {
+		var values []interface{}
+		if options.Type == ExportCalls {
+			record := &CallRecord{}
+			if err = db.ScanRows(rows, record); err != nil {
+				return err
+			}
+			values = []interface{}{record.ID, record.UserID, getUserName(record.UserID), record.CallID, record.Direction,
+				record.From, record.To, record.StartTime, record.AnswerTime, record.EndTime, record.Disposition, record.Duration}
+		} else {
+			message := &VoiceMailMessage{}
+			if err = db.ScanRows(rows, message); err != nil {
+				return err
+			}
+			values = []interface{}{message.ID, message.UserID, getUserName(message.UserID), message.From, message.StartTime,
+				message.EndTime, int(message.EndTime.Sub(message.StartTime) / time.Second), message.Folder, message.Listened,
+				message.Transcription}
+		}
+		if err = writer.WriteRow(values); err != nil {
+			return err
+		}
+		count++
+		if count%100 == 0 {
+			if err = writer.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// runExportCommand handles command line like "export -type calls -format csv -since 2016-12-01 -until 2017-01-01"
+func runExportCommand(args []string, db *gorm.DB, output io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	options := &ExportOptions{}
+	var since, until, userName, outputFile string
+	flags.StringVar(&options.Type, "type", ExportCalls, "type of exported data: calls or voiceMessages")
+	flags.StringVar(&options.Format, "format", ExportCSV, "format of exported data: csv or ndjson")
+	flags.StringVar(&since, "since", "", "start of date range (like 2016-12-01)")
+	flags.StringVar(&until, "until", "", "end of date range (exclusive)")
+	flags.StringVar(&userName, "user", "", "name of user to export data of (all users by default)")
+	flags.StringVar(&outputFile, "output", "", "file to write data to (standard output by default)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var err error
+	if options.Since, err = parseExportTime(since); err != nil {
+		return err
+	}
+	if options.Until, err = parseExportTime(until); err != nil {
+		return err
+	}
+	if err = options.Validate(); err != nil {
+		return err
+	}
+	if userName != "" {
+		user := &User{}
+		if db.First(user, "user_name = ?", userName).RecordNotFound() {
+			return fmt.Errorf("User %q is not found", userName)
+		}
+		options.UserID = user.ID
+	}
+	if outputFile != "" {
+		file, err := os.Create(outputFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+	return exportData(output, options, db)
+}
+
+// parseExportQuery converts query parameters of export request to ExportOptions
+func parseExportQuery(exportType string, query func(string) string) (*ExportOptions, error) {
+	options := &ExportOptions{Type: exportType, Format: query("format")}
+	if options.Format == "" {
+		options.Format = ExportCSV
+	}
+	var err error
+	if options.Since, err = parseExportTime(query("since")); err != nil {
+		return nil, err
+	}
+	if options.Until, err = parseExportTime(query("until")); err != nil {
+		return nil, err
+	}
+	return options, options.Validate()
+}
+
+func exportFileName(options *ExportOptions) string {
+	extension := ".csv"
+	if options.Format == ExportNDJSON {
+		extension = ".ndjson"
+	}
+	return options.Type + "-" + options.Since.Format("20060102") + "-" + options.Until.Format("20060102") + extension
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExportTime(t *testing.T) {
+	value, err := parseExportTime("2016-12-01")
+	assert.NoError(t, err)
+	assert.True(t, time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC).Equal(value))
+	value, err = parseExportTime("2016-12-01T10:00:00Z")
+	assert.NoError(t, err)
+	assert.True(t, time.Date(2016, 12, 1, 10, 0, 0, 0, time.UTC).Equal(value))
+	value, err = parseExportTime("")
+	assert.NoError(t, err)
+	assert.True(t, value.IsZero())
+	_, err = parseExportTime("01.12.2016")
+	assert.Error(t, err)
+}
+
+func TestExportOptionsValidate(t *testing.T) {
+	since := time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Options ExportOptions
+		Valid   bool
+	}{
+		{ExportOptions{Type: ExportCalls, Format: ExportCSV, Since: since, Until: until}, true},
+		{ExportOptions{Type: ExportVoiceMessages, Format: ExportNDJSON, Since: since, Until: until}, true},
+		{ExportOptions{Type: "users", Format: ExportCSV, Since: since, Until: until}, false},
+		{ExportOptions{Type: ExportCalls, Format: "xml", Since: since, Until: until}, false},
+		{ExportOptions{Type: ExportCalls, Format: ExportCSV, Since: since}, false},
+		{ExportOptions{Type: ExportCalls, Format: ExportCSV, Since: until, Until: since}, false},
+	}
+	for _, test := range tests {
+		if test.Valid {
+			assert.NoError(t, test.Options.Validate())
+		} else {
+			assert.Error(t, test.Options.Validate())
+		}
+	}
+}
+
+func TestExportWriters(t *testing.T) {
+	answerTime := time.Date(2016, 12, 1, 10, 0, 0, 0, time.UTC)
+	values := []interface{}{uint(1), "+1234567890", answerTime, (*time.Time)(nil), true}
+	columns := []string{"id", "from", "answerTime", "endTime", "listened"}
+	buffer := &bytes.Buffer{}
+	writer, err := newExportWriter(buffer, ExportCSV, columns)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteRow(values))
+	assert.NoError(t, writer.Flush())
+	assert.Equal(t, "id,from,answerTime,endTime,listened\n1,+1234567890,2016-12-01T10:00:00Z,,true\n", buffer.String())
+
+	buffer.Reset()
+	writer, err = newExportWriter(buffer, ExportNDJSON, columns)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteRow(values))
+	assert.NoError(t, writer.WriteRow(values))
+	assert.NoError(t, writer.Flush())
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, `{"answerTime":"2016-12-01T10:00:00Z","endTime":null,"from":"+1234567890","id":1,"listened":true}`, lines[0])
+}
+
+func TestExportFileName(t *testing.T) {
+	assert.Equal(t, "calls-20161201-20170101.ndjson", exportFileName(&ExportOptions{
+		Type:   ExportCalls,
+		Format: ExportNDJSON,
+		Since:  time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC),
+		Until:  time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+	}))
+}
+
+func TestRunExportCommandFailWithInvalidArgs(t *testing.T) {
+	assert.Error(t, runExportCommand([]string{"-type", "calls"}, nil, &bytes.Buffer{}))
+	assert.Error(t, runExportCommand([]string{"-since", "yesterday", "-until", "2017-01-01"}, nil, &bytes.Buffer{}))
+	assert.Error(t, runExportCommand([]string{"-format", "xml", "-since", "2016-12-01", "-until", "2017-01-01"}, nil, &bytes.Buffer{}))
+}
+
+func TestExportData(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&User{}, "user_name = ?", "exportuser")
+	user := &User{UserName: "exportuser", PhoneNumber: "+1234567830"}
+	user.SetPassword("123456")
+	assert.NoError(t, db.Create(user).Error)
+	startTime := time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+	db.Unscoped().Delete(&CallRecord{}, "call_id IN (?)", []string{"exCallID1", "exCallID2"})
+	db.Create(&CallRecord{CallID: "exCallID1", UserID: user.ID, Direction: IncomingCall, From: "+1472583688",
+		To: user.PhoneNumber, StartTime: startTime, Disposition: MissedCall})
+	db.Create(&CallRecord{CallID: "exCallID2", UserID: user.ID, Direction: IncomingCall, From: "+1472583688",
+		To: user.PhoneNumber, StartTime: startTime.AddDate(0, 1, 0), Disposition: MissedCall})
+	buffer := &bytes.Buffer{}
+	err := runExportCommand([]string{"-type", "calls", "-since", "2015-06-01", "-until", "2015-07-01", "-user", "exportuser"}, db, buffer)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[1], ",exportuser,exCallID1,incoming,+1472583688,+1234567830,2015-06-01T10:00:00Z,,,missed,0")
+}
+
+func TestExportVoiceMessages(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&User{}, "user_name = ?", "exportuser2")
+	user := &User{UserName: "exportuser2", PhoneNumber: "+1234567831"}
+	user.SetPassword("123456")
+	assert.NoError(t, db.Create(user).Error)
+	startTime := time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+	db.Create(&VoiceMailMessage{UserID: user.ID, From: "+1472583688", StartTime: startTime,
+		EndTime: startTime.Add(15 * time.Second), Transcription: "Call me back"})
+	buffer := &bytes.Buffer{}
+	err := exportData(buffer, &ExportOptions{
+		Type:   ExportVoiceMessages,
+		Format: ExportNDJSON,
+		UserID: user.ID,
+		Since:  startTime,
+		Until:  startTime.Add(time.Hour),
+	}, db)
+	assert.NoError(t, err)
+	assert.Contains(t, buffer.String(), `"duration":15`)
+	assert.Contains(t, buffer.String(), `"transcription":"Call me back"`)
+	assert.Contains(t, buffer.String(), `"userName":"exportuser2"`)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/jinzhu/gorm"
+)
+
+// states of greeting recording call
+const (
+	greetingStateStarting       = "Starting"       // the call is not answered yet
+	greetingStateMenu           = "Menu"           // main menu is played
+	greetingStateSelectingType  = "SelectingType"  // menu of greeting types is played
+	greetingStatePlaying        = "Playing"        // greeting or a message is played, main menu follows it
+	greetingStateAwaitingRecord = "AwaitingRecord" // recording instructions are played
+	greetingStateBeep           = "Beep"           // beep is played, recording starts after it
+	greetingStateRecording      = "Recording"
+	greetingStateSaving         = "Saving" // recording is stopped, waiting for its media
+	greetingStateSaved          = "Saved"
+)
+
+// tags of gathers of greeting recording call
+const (
+	greetingMenuTag   = "Menu"
+	greetingTypeTag   = "GreetingType"
+	greetingRecordTag = "Record" // any key completes recording
+)
+
+// greetingTransitions contains allowed transitions between states of greeting recording call
+var greetingTransitions = map[string][]string{
+	greetingStateStarting:       {greetingStateMenu},
+	greetingStateMenu:           {greetingStateMenu, greetingStatePlaying, greetingStateAwaitingRecord, greetingStateSelectingType},
+	greetingStateSelectingType:  {greetingStatePlaying},
+	greetingStatePlaying:        {greetingStateMenu},
+	greetingStateAwaitingRecord: {greetingStateBeep},
+	greetingStateBeep:           {greetingStateRecording, greetingStatePlaying},
+	greetingStateRecording:      {greetingStateSaving},
+	greetingStateSaving:         {greetingStateSaved, greetingStatePlaying},
+	greetingStateSaved:          {greetingStateMenu},
+}
+
+// timeouts of states of greeting recording call
+const (
+	greetingPromptTimeout       = time.Second // next menu is played after it
+	greetingInstructionsTimeout = 5 * time.Second
+	greetingBeepTimeout         = time.Second
+	greetingSavingTimeout       = 30 * time.Second
+)
+
+// MaxGreetingRecordingTime limits duration of greeting recorded by phone
+const MaxGreetingRecordingTime = 3 * time.Minute
+
+// maxGreetingMenuAttempts is how many times user can make invalid choice (or no choice) in a row before hang up
+const maxGreetingMenuAttempts = 3
+
+// errGreetingStateChanged is returned when state of the call has been changed by concurrent event
+var errGreetingStateChanged = errors.New("State of greeting call has been changed already")
+
+// greetingTimeoutJobData is payload of the job which handles timeout of a state of greeting recording call
+type greetingTimeoutJobData struct {
+	CallID  string `json:"callId"`
+	Version int    `json:"version"`
+}
+
+// canChangeGreetingState checks if greeting recording call can be moved from one state to another
+func canChangeGreetingState(from string, to string) bool {
+	for _, state := range greetingTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// startGreetingSession is called when a call to record greeting has been created
+func startGreetingSession(callID string, user *User, db *gorm.DB) error {
+	return db.Create(&GreetingSession{
+		CallID:       callID,
+		UserID:       user.ID,
+		State:        greetingStateStarting,
+		GreetingType: NoAnswerGreeting,
+	}).Error
+}
+
+// setGreetingState moves the call to another state and schedules timeout of the new state (if it is not zero).
+// It fails if the state has been changed by another event since the session was read.
+func setGreetingState(session *GreetingSession, state string, timeout time.Duration, now time.Time, db *gorm.DB) error {
+	if !canChangeGreetingState(session.State, state) {
+		return fmt.Errorf("Greeting call can't be moved from state %s to %s", session.State, state)
+	}
+	result := db.Model(&GreetingSession{}).Where("call_id = ? AND version = ?", session.CallID, session.Version).Updates(map[string]interface{}{
+		"state":         state,
+		"version":       session.Version + 1,
+		"attempts":      session.Attempts,
+		"greeting_type": session.GreetingType,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errGreetingStateChanged
+	}
+	debugf("Greeting call %s: %s -> %s\n", session.CallID, session.State, state)
+	session.State = state
+	session.Version++
+	if timeout == 0 {
+		return nil
+	}
+	return enqueueJob(db, greetingTimeoutJob, &greetingTimeoutJobData{CallID: session.CallID, Version: session.Version}, now.Add(timeout))
+}
+
+// handleGreetingSessionEvent handles Catapult events of greeting recording call
+func handleGreetingSessionEvent(form *CallbackForm, now time.Time, db *gorm.DB, api catapultAPIInterface) {
+	if form.EventType == "hangup" {
+		completeCallRecord(form.CallID, now, db)
+	}
+	session := &GreetingSession{}
+	if db.First(session, "call_id = ?", form.CallID).RecordNotFound() {
+		debugf("Greeting session for call %s is not found\n", form.CallID)
+		return
+	}
+	user := &User{}
+	if err := db.First(user, session.UserID).Error; err != nil {
+		debugf("Error on getting user: %s\n", err.Error())
+		return
+	}
+	var err error
+	switch {
+	case form.EventType == "answer":
+		err = handleGreetingCallAnswer(session, user, form, now, db, api)
+	case form.EventType == "hangup":
+		err = handleGreetingCallHangup(session, db)
+	case form.EventType == "gather" && form.State == "completed":
+		err = handleGreetingInput(session, user, form.Tag, form.Digits, now, db, api)
+	case form.EventType == "recording" && form.State == "complete":
+		err = handleGreetingRecorded(session, user, form.RecordingID, now, db, api)
+	}
+	if err != nil {
+		debugf("Error on handling event %s of greeting call %s: %s\n", form.EventType, form.CallID, err.Error())
+	}
+}
+
+func handleGreetingCallAnswer(session *GreetingSession, user *User, form *CallbackForm, now time.Time, db *gorm.DB,
+	api catapultAPIInterface) error {
+	if session.State != greetingStateStarting {
+		return nil
+	}
+	if record := createCallRecord(form, user, GreetingCall, now, db); record != nil {
+		markCallRecordAnswered(form.CallID, now, db)
+	}
+	if err := setGreetingState(session, greetingStateMenu, 0, now, db); err != nil {
+		return err
+	}
+	return createGreetingMenu(session.CallID, api)
+}
+
+// handleGreetingCallHangup removes the session. If recording has been completed already the session is kept to save the greeting.
+func handleGreetingCallHangup(session *GreetingSession, db *gorm.DB) error {
+	if session.State == greetingStateSaving {
+		return db.Model(session).Update("hung_up", true).Error
+	}
+	// greeting is not saved if user hangs up without completing of recording
+	return db.Delete(session).Error
+}
+
+// handleGreetingInput handles completed gathers. Gathers of previous states are ignored.
+func handleGreetingInput(session *GreetingSession, user *User, tag string, digits string, now time.Time, db *gorm.DB,
+	api catapultAPIInterface) error {
+	callID := session.CallID
+	switch {
+	case session.State == greetingStateMenu && tag == greetingMenuTag:
+		switch digits {
+		case "1":
+			debugf("Play greeting\n")
+			session.Attempts = 0
+			if err := setGreetingState(session, greetingStatePlaying, greetingPromptTimeout, now, db); err != nil {
+				return err
+			}
+			url := user.GetGreetingURL(session.GreetingType)
+			if url == "" {
+				url = user.GreetingURL // no answer greeting is used instead of missing ones
+			}
+			playGreetingURL(callID, user, url, api)
+		case "2":
+			debugf("Record greeting\n")
+			session.Attempts = 0
+			if err := setGreetingState(session, greetingStateAwaitingRecord, greetingInstructionsTimeout, now, db); err != nil {
+				return err
+			}
+			return api.SpeakSentenceToCall(callID, "Say your greeting after beep. Press any key to complete recording.")
+		case "3":
+			debugf("Reset greeting\n")
+			session.Attempts = 0
+			if err := setGreetingState(session, greetingStatePlaying, greetingPromptTimeout, now, db); err != nil {
+				return err
+			}
+			user.SetGreetingURL(session.GreetingType, "")
+			if err := db.Save(user).Error; err != nil {
+				return err
+			}
+			return api.SpeakSentenceToCall(callID, "Your greeting has been set to default.")
+		case "4":
+			debugf("Select greeting\n")
+			session.Attempts = 0
+			if err := setGreetingState(session, greetingStateSelectingType, 0, now, db); err != nil {
+				return err
+			}
+			return createGreetingTypeMenu(callID, api)
+		default:
+			return handleInvalidGreetingInput(session, digits, now, db, api)
+		}
+	case session.State == greetingStateSelectingType && tag == greetingTypeTag:
+		index, err := strconv.Atoi(digits)
+		if err != nil || index < 1 || index > len(GreetingTypes) {
+			return handleInvalidGreetingInput(session, digits, now, db, api)
+		}
+		session.Attempts = 0
+		session.GreetingType = GreetingTypes[index-1]
+		if err = setGreetingState(session, greetingStatePlaying, greetingPromptTimeout, now, db); err != nil {
+			return err
+		}
+		return api.SpeakSentenceToCall(callID, fmt.Sprintf("%s greeting is selected.", greetingNames[session.GreetingType]))
+	case session.State == greetingStateBeep && tag == greetingRecordTag:
+		// a key has been pressed before start of recording
+		if err := setGreetingState(session, greetingStatePlaying, greetingPromptTimeout, now, db); err != nil {
+			return err
+		}
+		return api.SpeakSentenceToCall(callID, "Recording has been cancelled.")
+	case session.State == greetingStateRecording && tag == greetingRecordTag:
+		return stopGreetingRecording(session, now, db, api)
+	}
+	debugf("Gather %q of greeting call %s is ignored in state %s\n", tag, callID, session.State)
+	return nil
+}
+
+// handleInvalidGreetingInput repeats the menu (invalid choice is reported) or hangs up after too many attempts
+func handleInvalidGreetingInput(session *GreetingSession, digits string, now time.Time, db *gorm.DB, api catapultAPIInterface) error {
+	session.Attempts++
+	if session.Attempts >= maxGreetingMenuAttempts {
+		debugf("Too many invalid choices in greeting call %s\n", session.CallID)
+		_, err := api.UpdateCall(session.CallID, &bandwidth.UpdateCallData{State: "completed"})
+		return err
+	}
+	if digits == "" && session.State == greetingStateMenu {
+		// nothing has been pressed
+		if err := setGreetingState(session, greetingStateMenu, 0, now, db); err != nil {
+			return err
+		}
+		return createGreetingMenu(session.CallID, api)
+	}
+	if err := setGreetingState(session, greetingStatePlaying, greetingPromptTimeout, now, db); err != nil {
+		return err
+	}
+	return api.SpeakSentenceToCall(session.CallID, "Invalid option.")
+}
+
+func stopGreetingRecording(session *GreetingSession, now time.Time, db *gorm.DB, api catapultAPIInterface) error {
+	debugf("Stoping recording of call %s\n", session.CallID)
+	if err := setGreetingState(session, greetingStateSaving, greetingSavingTimeout, now, db); err != nil {
+		return err
+	}
+	_, err := api.UpdateCall(session.CallID, &bandwidth.UpdateCallData{RecordingEnabled: false})
+	return err
+}
+
+// handleGreetingRecorded saves recorded greeting. Recordings are accepted only after user has completed recording.
+func handleGreetingRecorded(session *GreetingSession, user *User, recordingID string, now time.Time, db *gorm.DB,
+	api catapultAPIInterface) error {
+	if session.State != greetingStateSaving {
+		debugf("Recording %s of greeting call %s is ignored in state %s\n", recordingID, session.CallID, session.State)
+		return nil
+	}
+	recording, err := api.GetRecording(recordingID)
+	if err != nil {
+		return err
+	}
+	if err = addRecordedGreeting(user, session.GreetingType, recording.Media, db); err != nil {
+		return err
+	}
+	if session.HungUp {
+		return db.Delete(session).Error
+	}
+	if err = setGreetingState(session, greetingStateSaved, greetingPromptTimeout, now, db); err != nil {
+		return err
+	}
+	return api.SpeakSentenceToCall(session.CallID, "Your greeting has been saved.")
+}
+
+// handleGreetingTimeout moves the call to next state when time of current state is over
+func handleGreetingTimeout(session *GreetingSession, now time.Time, db *gorm.DB, api catapultAPIInterface) error {
+	callID := session.CallID
+	switch session.State {
+	case greetingStatePlaying, greetingStateSaved:
+		if err := setGreetingState(session, greetingStateMenu, 0, now, db); err != nil {
+			return err
+		}
+		return createGreetingMenu(callID, api)
+	case greetingStateAwaitingRecord:
+		if err := setGreetingState(session, greetingStateBeep, greetingBeepTimeout, now, db); err != nil {
+			return err
+		}
+		_, err := api.CreateGather(callID, &bandwidth.CreateGatherData{
+			MaxDigits:         1,
+			InterDigitTimeout: int(MaxGreetingRecordingTime / time.Second),
+			Prompt:            &bandwidth.GatherPromptData{FileURL: beepURL},
+			Tag:               greetingRecordTag,
+		})
+		return err
+	case greetingStateBeep:
+		if err := setGreetingState(session, greetingStateRecording, MaxGreetingRecordingTime, now, db); err != nil {
+			return err
+		}
+		_, err := api.UpdateCall(callID, &bandwidth.UpdateCallData{RecordingEnabled: true})
+		return err
+	case greetingStateRecording:
+		return stopGreetingRecording(session, now, db, api)
+	case greetingStateSaving:
+		if session.HungUp {
+			return db.Delete(session).Error
+		}
+		if err := setGreetingState(session, greetingStatePlaying, greetingPromptTimeout, now, db); err != nil {
+			return err
+		}
+		return api.SpeakSentenceToCall(callID, "Your greeting has not been saved.")
+	}
+	return nil
+}
+
+// handleGreetingTimeoutJob handles timeout of a state. Timeouts of previous states are ignored.
+func handleGreetingTimeoutJob(job *Job, ctx *jobContext) error {
+	data := &greetingTimeoutJobData{}
+	if err := job.decodePayload(data); err != nil {
+		return err
+	}
+	session := &GreetingSession{}
+	if ctx.db.First(session, "call_id = ?", data.CallID).RecordNotFound() || session.Version != data.Version {
+		return nil
+	}
+	err := handleGreetingTimeout(session, ctx.timerAPI.Now(), ctx.db, ctx.api)
+	if err == errGreetingStateChanged {
+		return nil
+	}
+	return err
+}
+
+// createGreetingMenu starts main menu of greeting recording by phone
+func createGreetingMenu(callID string, api catapultAPIInterface) error {
+	debugf("Main menu of greating recording\n")
+	_, err := api.CreateGather(callID, &bandwidth.CreateGatherData{
+		MaxDigits:         1,
+		InterDigitTimeout: 30,
+		Prompt: &bandwidth.GatherPromptData{
+			Gender:   "female",
+			Voice:    "julie",
+			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default. Press 4 to select another greeting.",
+		},
+		Tag: greetingMenuTag,
+	})
+	return err
+}
+
+func createGreetingTypeMenu(callID string, api catapultAPIInterface) error {
+	_, err := api.CreateGather(callID, &bandwidth.CreateGatherData{
+		MaxDigits:         1,
+		InterDigitTimeout: 30,
+		Prompt: &bandwidth.GatherPromptData{
+			Gender: "female",
+			Voice:  "julie",
+			Sentence: "Press 1 for no answer greeting. Press 2 for busy greeting. Press 3 for after hours greeting. " +
+				"Press 4 for extended absence greeting.",
+		},
+		Tag: greetingTypeTag,
+	})
+	return err
+}
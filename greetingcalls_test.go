@@ -0,0 +1,200 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func createGreetingSession(t *testing.T, db *gorm.DB, user *User, callID string, state string) *GreetingSession {
+	session := &GreetingSession{CallID: callID, UserID: user.ID, State: state, GreetingType: NoAnswerGreeting}
+	assert.NoError(t, db.Create(session).Error)
+	return session
+}
+
+func getGreetingState(t *testing.T, db *gorm.DB, callID string) string {
+	session := &GreetingSession{}
+	if err := db.First(session, "call_id = ?", callID).Error; err != nil {
+		return ""
+	}
+	return session.State
+}
+
+func createGreetingCallUser(t *testing.T, db *gorm.DB, userName string) *User {
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:" + userName + "@test.com",
+		PhoneNumber: "+1334567899",
+		UserName:    userName,
+		GreetingURL: "greetingURL",
+	}
+	user.SetPassword("123456")
+	assert.NoError(t, db.Save(user).Error)
+	return user
+}
+
+func TestCanChangeGreetingState(t *testing.T) {
+	assert.True(t, canChangeGreetingState(greetingStateStarting, greetingStateMenu))
+	assert.True(t, canChangeGreetingState(greetingStateMenu, greetingStateMenu))
+	assert.True(t, canChangeGreetingState(greetingStateRecording, greetingStateSaving))
+	assert.True(t, canChangeGreetingState(greetingStateSaving, greetingStatePlaying))
+	assert.False(t, canChangeGreetingState(greetingStateStarting, greetingStateRecording))
+	assert.False(t, canChangeGreetingState(greetingStateMenu, greetingStateSaved))
+	assert.False(t, canChangeGreetingState(greetingStatePlaying, greetingStateRecording))
+	assert.False(t, canChangeGreetingState(greetingStateSaved, greetingStateSaving))
+	assert.False(t, canChangeGreetingState("unknown", greetingStateMenu))
+	// each state can be reached
+	for state := range greetingTransitions {
+		if state == greetingStateStarting {
+			continue
+		}
+		found := false
+		for from := range greetingTransitions {
+			found = found || canChangeGreetingState(from, state)
+		}
+		assert.True(t, found, state)
+	}
+}
+
+func TestSetGreetingState(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createGreetingCallUser(t, db, "gsuser1")
+	now := time.Now()
+	session := createGreetingSession(t, db, user, "gsCallID1", greetingStateMenu)
+	assert.NoError(t, setGreetingState(session, greetingStatePlaying, greetingPromptTimeout, now, db))
+	assert.Equal(t, 1, session.Version)
+	assert.Equal(t, greetingStatePlaying, getGreetingState(t, db, "gsCallID1"))
+	job := &Job{}
+	assert.NoError(t, db.First(job, "type = ?", greetingTimeoutJob).Error)
+	assert.WithinDuration(t, now.Add(greetingPromptTimeout), job.RunAt, time.Millisecond)
+	assert.EqualError(t, setGreetingState(session, greetingStateSaved, 0, now, db),
+		"Greeting call can't be moved from state Playing to Saved")
+}
+
+func TestSetGreetingStateFailWithConcurrentChange(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createGreetingCallUser(t, db, "gsuser2")
+	now := time.Now()
+	createGreetingSession(t, db, user, "gsCallID2", greetingStateMenu)
+	session1, session2 := &GreetingSession{}, &GreetingSession{}
+	db.First(session1, "call_id = ?", "gsCallID2")
+	db.First(session2, "call_id = ?", "gsCallID2")
+	assert.NoError(t, setGreetingState(session1, greetingStateAwaitingRecord, 0, now, db))
+	assert.Equal(t, errGreetingStateChanged, setGreetingState(session2, greetingStatePlaying, 0, now, db))
+	assert.Equal(t, greetingStateAwaitingRecord, getGreetingState(t, db, "gsCallID2"))
+}
+
+func TestGreetingCallInvalidInput(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createGreetingCallUser(t, db, "gsuser3")
+	createGreetingSession(t, db, user, "gsCallID3", greetingStateMenu)
+	api.On("SpeakSentenceToCall", "gsCallID3", "Invalid option.").Return(nil)
+	api.On("CreateGather", "gsCallID3", &bandwidth.CreateGatherData{
+		MaxDigits:         1,
+		InterDigitTimeout: 30,
+		Prompt: &bandwidth.GatherPromptData{
+			Gender:   "female",
+			Voice:    "julie",
+			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default. Press 4 to select another greeting.",
+		},
+		Tag: "Menu",
+	}).Return("", nil)
+	api.On("UpdateCall", "gsCallID3", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	input := func(digits string) {
+		handleGreetingSessionEvent(&CallbackForm{
+			CallID:    "gsCallID3",
+			EventType: "gather",
+			State:     "completed",
+			Tag:       "Menu",
+			Digits:    digits,
+		}, timer.Now(), db, api)
+	}
+	input("9")
+	assert.Equal(t, greetingStatePlaying, getGreetingState(t, db, "gsCallID3"))
+	timer.CurrentTime = timer.CurrentTime.Add(greetingPromptTimeout)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	assert.Equal(t, greetingStateMenu, getGreetingState(t, db, "gsCallID3"))
+	// nothing has been pressed
+	input("")
+	assert.Equal(t, greetingStateMenu, getGreetingState(t, db, "gsCallID3"))
+	api.AssertNumberOfCalls(t, "CreateGather", 2)
+	api.AssertNotCalled(t, "UpdateCall", "gsCallID3", &bandwidth.UpdateCallData{State: "completed"})
+	input("#")
+	api.AssertExpectations(t)
+	api.AssertNumberOfCalls(t, "SpeakSentenceToCall", 1)
+}
+
+func TestGreetingCallHangupWhileRecording(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createGreetingCallUser(t, db, "gsuser4")
+	session := createGreetingSession(t, db, user, "gsCallID4", greetingStateAwaitingRecord)
+	api.On("CreateGather", "gsCallID4", &bandwidth.CreateGatherData{
+		MaxDigits:         1,
+		InterDigitTimeout: 180,
+		Prompt:            &bandwidth.GatherPromptData{FileURL: beepURL},
+		Tag:               "Record",
+	}).Return("", nil)
+	assert.NoError(t, handleGreetingTimeout(session, timer.Now(), db, api))
+	handleGreetingSessionEvent(&CallbackForm{CallID: "gsCallID4", EventType: "hangup"}, timer.Now(), db, api)
+	assert.Empty(t, getGreetingState(t, db, "gsCallID4"))
+	// recording is not enabled for completed call
+	timer.CurrentTime = timer.CurrentTime.Add(greetingBeepTimeout)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	api.AssertExpectations(t)
+	api.AssertNotCalled(t, "UpdateCall", "gsCallID4", &bandwidth.UpdateCallData{RecordingEnabled: true})
+	assert.NoError(t, db.First(user, user.ID).Error)
+	assert.Equal(t, "greetingURL", user.GreetingURL)
+}
+
+func TestGreetingCallIgnoresOutOfOrderEvents(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createGreetingCallUser(t, db, "gsuser5")
+	createGreetingSession(t, db, user, "gsCallID5", greetingStateMenu)
+	events := []*CallbackForm{
+		{CallID: "gsCallID5", EventType: "answer"},
+		{CallID: "gsCallID5", EventType: "gather", State: "completed", Tag: "Record", Digits: "1"},
+		{CallID: "gsCallID5", EventType: "gather", State: "completed", Tag: "GreetingType", Digits: "2"},
+		{CallID: "gsCallID5", EventType: "recording", State: "complete", RecordingID: "recordingID"},
+	}
+	for _, form := range events {
+		handleGreetingSessionEvent(form, timer.Now(), db, api)
+	}
+	// outdated timeout
+	assert.NoError(t, enqueueJob(db, greetingTimeoutJob, &greetingTimeoutJobData{CallID: "gsCallID5", Version: 10}, timer.Now()))
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	api.AssertExpectations(t)
+	assert.Equal(t, greetingStateMenu, getGreetingState(t, db, "gsCallID5"))
+}
+
+func TestGreetingCallCancelRecordingOnBeep(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createGreetingCallUser(t, db, "gsuser6")
+	createGreetingSession(t, db, user, "gsCallID6", greetingStateBeep)
+	api.On("SpeakSentenceToCall", "gsCallID6", "Recording has been cancelled.").Return(nil)
+	handleGreetingSessionEvent(&CallbackForm{
+		CallID:    "gsCallID6",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       "Record",
+		Digits:    "1",
+	}, timer.Now(), db, api)
+	api.AssertExpectations(t)
+	assert.Equal(t, greetingStatePlaying, getGreetingState(t, db, "gsCallID6"))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MaxGreetingFileSize limits size of uploaded greeting files
+const MaxGreetingFileSize = 5 * 1024 * 1024
+
+// greetingFileTypes contains allowed types of greeting files (detected by content) and extensions of media files for them
+var greetingFileTypes = map[string]string{
+	"audio/wave": ".wav",
+	"audio/mpeg": ".mp3",
+}
+
+// GreetingMedia model is a greeting recorded by phone for a user. Uploaded greeting files are recognized by their
+// names. Greetings can be set to urls of any other files but only these files are downloaded and removed by the app.
+type GreetingMedia struct {
+	gorm.Model
+	UserID uint   `gorm:"column:user_id;index"`
+	Name   string `gorm:"type:varchar(256);unique_index"`
+}
+
+// getOwnMediaName returns name of media file if url points to media storage of the Catapult account
+func getOwnMediaName(mediaURL string) string {
+	prefix := getMediaURLPrefix()
+	if !strings.HasPrefix(mediaURL, prefix) {
+		return ""
+	}
+	name := mediaURL[len(prefix):]
+	if strings.ContainsAny(name, "/?#") {
+		return ""
+	}
+	return name
+}
+
+// getUploadedGreetingPrefix returns prefix of names of greeting files uploaded for the user
+func getUploadedGreetingPrefix(user *User) string {
+	return fmt.Sprintf("greeting-%d-", user.ID)
+}
+
+// getGreetingMediaName returns name of media file of the greeting if it has been uploaded or recorded by the app for
+// the user. It returns empty string for other urls.
+func getGreetingMediaName(user *User, greetingURL string, db *gorm.DB) string {
+	name := getOwnMediaName(greetingURL)
+	if name == "" || strings.HasPrefix(name, getUploadedGreetingPrefix(user)) {
+		return name
+	}
+	if db.First(&GreetingMedia{}, "user_id = ? AND name = ?", user.ID, name).RecordNotFound() {
+		return ""
+	}
+	return name
+}
+
+// addRecordedGreeting saves recorded greeting of the user
+func addRecordedGreeting(user *User, greetingType string, mediaURL string, db *gorm.DB) error {
+	if name := getOwnMediaName(mediaURL); name != "" {
+		if err := db.Create(&GreetingMedia{UserID: user.ID, Name: name}).Error; err != nil {
+			return err
+		}
+	}
+	user.SetGreetingURL(greetingType, mediaURL)
+	return db.Save(user).Error
+}
+
+// readGreetingFile returns content and type of audio file uploaded as multipart form field "file"
+func readGreetingFile(r *http.Request) ([]byte, string, error) {
+	file, _, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		return nil, "", errors.New("Missing greeting file")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(file, MaxGreetingFileSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(content) > MaxGreetingFileSize {
+		return nil, "", fmt.Errorf("Greeting file is too large (max size is %d MB)", MaxGreetingFileSize/1024/1024)
+	}
+	if len(content) == 0 {
+		return nil, "", errors.New("Greeting file is empty")
+	}
+	contentType := http.DetectContentType(content)
+	if contentType == "application/octet-stream" && len(content) > 1 && content[0] == 0xff && content[1]&0xe0 == 0xe0 {
+		contentType = "audio/mpeg" // mp3 file without ID3 tag starts with frame sync bits
+	}
+	if _, ok := greetingFileTypes[contentType]; !ok {
+		return nil, "", fmt.Errorf("Unsupported type of greeting file %q (use WAV or MP3 files)", contentType)
+	}
+	return content, contentType, nil
+}
+
+// uploadGreeting stores greeting file on Catapult and returns its url
+func uploadGreeting(user *User, greetingType string, content []byte, contentType string, api catapultAPIInterface) (string, error) {
+	name := fmt.Sprintf("%s%s-%s%s", getUploadedGreetingPrefix(user), greetingType, randomString(8), greetingFileTypes[contentType])
+	return api.UploadMediaFile(name, ioutil.NopCloser(bytes.NewReader(content)), contentType)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var testWAVFile = []byte("RIFF\x24\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00")
+
+func createGreetingRequest(t *testing.T, fieldName string, content []byte) *http.Request {
+	body := createMultipartBody(t, fieldName, content)
+	req, _ := http.NewRequest(http.MethodPost, "/greetings/noAnswer/media", bytes.NewReader(body.Data))
+	req.Header.Set("Content-Type", body.ContentType)
+	return req
+}
+
+func TestReadGreetingFile(t *testing.T) {
+	content, contentType, err := readGreetingFile(createGreetingRequest(t, "file", testWAVFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "audio/wave", contentType)
+	assert.Equal(t, testWAVFile, content)
+}
+
+func TestReadGreetingFileMP3(t *testing.T) {
+	_, contentType, err := readGreetingFile(createGreetingRequest(t, "file", []byte("ID3\x03\x00\x00\x00\x00\x00\x00")))
+	assert.NoError(t, err)
+	assert.Equal(t, "audio/mpeg", contentType)
+	_, contentType, err = readGreetingFile(createGreetingRequest(t, "file", []byte("\xff\xfb\x90\x64\x00\x00\x00\x00")))
+	assert.NoError(t, err)
+	assert.Equal(t, "audio/mpeg", contentType)
+}
+
+func TestReadGreetingFileFail(t *testing.T) {
+	_, _, err := readGreetingFile(createGreetingRequest(t, "file", []byte("Hello world")))
+	assert.Error(t, err)
+	_, _, err = readGreetingFile(createGreetingRequest(t, "anotherFile", testWAVFile))
+	assert.EqualError(t, err, "Missing greeting file")
+	_, _, err = readGreetingFile(createGreetingRequest(t, "file", []byte{}))
+	assert.Error(t, err)
+	_, _, err = readGreetingFile(createGreetingRequest(t, "file", append(testWAVFile, make([]byte, MaxGreetingFileSize)...)))
+	assert.Error(t, err)
+}
+
+func TestUploadGreeting(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	user := &User{}
+	user.ID = 10
+	api.On("UploadMediaFile", mock.MatchedBy(func(name string) bool {
+		return strings.HasPrefix(name, "greeting-10-busy-") && strings.HasSuffix(name, ".wav")
+	}), mock.MatchedBy(func(reader io.ReadCloser) bool {
+		content, _ := ioutil.ReadAll(reader)
+		return bytes.Equal(content, testWAVFile)
+	}), "audio/wave").Return("http://media/greeting.wav", nil)
+	url, err := uploadGreeting(user, BusyGreeting, testWAVFile, "audio/wave", api)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://media/greeting.wav", url)
+	api.AssertExpectations(t)
+}
+
+func TestGetOwnMediaName(t *testing.T) {
+	os.Setenv("CATAPULT_USER_ID", "userID")
+	assert.Equal(t, "greeting.wav", getOwnMediaName("https://api.catapult.inetwork.com/v1/users/userID/media/greeting.wav"))
+	assert.Equal(t, "", getOwnMediaName("https://api.catapult.inetwork.com/v1/users/userID/media/"))
+	assert.Equal(t, "", getOwnMediaName("https://api.catapult.inetwork.com/v1/users/userID2/media/greeting.wav"))
+	assert.Equal(t, "", getOwnMediaName("https://api.catapult.inetwork.com/v1/users/userID/media/../greeting.wav"))
+	assert.Equal(t, "", getOwnMediaName("https://api.catapult.inetwork.com/v1/users/userID/media/greeting.wav?a=1"))
+	assert.Equal(t, "", getOwnMediaName("http://localhost/v1/users/userID/media/greeting.wav"))
+	assert.Equal(t, "", getOwnMediaName(""))
+}
+
+func TestGetGreetingMediaName(t *testing.T) {
+	os.Setenv("CATAPULT_USER_ID", "userID")
+	user := &User{}
+	user.ID = 10
+	// uploaded greetings are recognized without database
+	assert.Equal(t, "greeting-10-busy-1.wav", getGreetingMediaName(user,
+		"https://api.catapult.inetwork.com/v1/users/userID/media/greeting-10-busy-1.wav", nil))
+	assert.Equal(t, "", getGreetingMediaName(user, "http://localhost/media/greeting-10-busy-1.wav", nil))
+	assert.Equal(t, "", getGreetingMediaName(user, "", nil))
+}
+
+func TestGetGreetingMediaNameOfRecordedGreeting(t *testing.T) {
+	os.Setenv("CATAPULT_USER_ID", "userID")
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	anotherUser := &User{UserName: "user2", AreaCode: "999"}
+	require.NoError(t, db.Create(anotherUser).Error)
+	url := "https://api.catapult.inetwork.com/v1/users/userID/media/recording.wav"
+	require.NoError(t, addRecordedGreeting(user, NoAnswerGreeting, url, db))
+	assert.Equal(t, url, user.GreetingURL)
+	assert.Equal(t, "recording.wav", getGreetingMediaName(user, url, db))
+	assert.Equal(t, "", getGreetingMediaName(anotherUser, url, db))
+	assert.Equal(t, "", getGreetingMediaName(user, "https://api.catapult.inetwork.com/v1/users/userID/media/recording2.wav", db))
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,6 +23,10 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func init() {
+	os.Setenv("CALLBACK_SECRET", "callbackSecret")
+}
+
 func createFakeResponse(body string, statusCode int) *http.Response {
 	return &http.Response{StatusCode: statusCode,
 		Body: ioutil.NopCloser(bytes.NewReader([]byte(body))),
@@ -76,7 +84,7 @@ func startMockCatapultServer(t *testing.T, handlers []RequestHandler) (*httptest
 		w.WriteHeader(http.StatusNotFound)
 	}))
 	client.APIEndPoint = mockServer.URL
-	return mockServer, &catapultAPI{client: client, context: createFakeGinContext()}
+	return mockServer, &catapultAPI{client: client, context: createFakeGinContext(), cache: newProvisioningCache(nil)}
 }
 
 func createFakeGinContext() *gin.Context {
@@ -96,7 +104,7 @@ func readText(t *testing.T, r io.Reader) string {
 	return string(text)
 }
 
-func openDBConnection(t *testing.T) *gorm.DB {
+func getTestConnectionString() string {
 	connectionString := os.Getenv("TEST_DATABASE_URL")
 	if connectionString == "" {
 		// to use with Docker's links
@@ -109,13 +117,30 @@ func openDBConnection(t *testing.T) *gorm.DB {
 	if connectionString == "" {
 		connectionString = "postgresql://postgres@localhost/golang_voice_reference_app_test?sslmode=disable"
 	}
-	db, err := gorm.Open("postgres", connectionString)
+	return connectionString
+}
+
+func openDBConnection(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("postgres", getTestConnectionString())
 	require.NoError(t, err)
-	db.DropTableIfExists(&User{})
+	db.DropTableIfExists(&User{}, &ProcessedEvent{}, &Job{}, &GreetingSession{}, &ProvisionedResource{}, &Registration{}, &PasswordResetCode{}, &Session{}, &StreamTicket{}, &GreetingMedia{})
 	require.NoError(t, AutoMigrate(db).Error)
 	return db
 }
 
+// runDueJobs runs all jobs which are due at current time of timerAPI and returns their count
+func runDueJobs(db *gorm.DB, api catapultAPIInterface, timerAPI timerInterface, emailSender ...emailSenderInterface) int {
+	ctx := &jobContext{db: db, api: api, timerAPI: timerAPI}
+	if len(emailSender) > 0 {
+		ctx.emailSender = emailSender[0]
+	}
+	count := 0
+	for processNextJob(ctx) {
+		count++
+	}
+	return count
+}
+
 type fakeCatapultAPI struct {
 	mock.Mock
 }
@@ -130,16 +155,36 @@ func (m *fakeCatapultAPI) GetDomain() (string, string, error) {
 	return args.String(0), args.String(1), args.Error(2)
 }
 
-func (m *fakeCatapultAPI) CreatePhoneNumber(areaCode string) (string, error) {
-	args := m.Called(areaCode)
+func (m *fakeCatapultAPI) CreatePhoneNumber(areaCode string, name string) (string, error) {
+	args := m.Called(areaCode, name)
 	return args.String(0), args.Error(1)
 }
 
-func (m *fakeCatapultAPI) CreateSIPAccount() (*sipAccount, error) {
-	args := m.Called()
+func (m *fakeCatapultAPI) FindPhoneNumber(name string) (string, error) {
+	args := m.Called(name)
+	return args.String(0), args.Error(1)
+}
+
+func (m *fakeCatapultAPI) ReleasePhoneNumber(number string) error {
+	args := m.Called(number)
+	return args.Error(0)
+}
+
+func (m *fakeCatapultAPI) CreateSIPAccount(userName string) (*sipAccount, error) {
+	args := m.Called(userName)
 	return args.Get(0).(*sipAccount), args.Error(1)
 }
 
+func (m *fakeCatapultAPI) FindSIPAccount(userName string) (string, error) {
+	args := m.Called(userName)
+	return args.String(0), args.Error(1)
+}
+
+func (m *fakeCatapultAPI) DeleteSIPAccount(endpointID string) error {
+	args := m.Called(endpointID)
+	return args.Error(0)
+}
+
 func (m *fakeCatapultAPI) CreateSIPAuthToken(endpointID string) (*bandwidth.DomainEndpointToken, error) {
 	args := m.Called(endpointID)
 	return args.Get(0).(*bandwidth.DomainEndpointToken), args.Error(1)
@@ -185,12 +230,94 @@ func (m *fakeCatapultAPI) DownloadMediaFile(name string) (io.ReadCloser, string,
 	return args.Get(0).(io.ReadCloser), args.String(1), args.Error(2)
 }
 
-type fakeTimerAPI struct {
+func (m *fakeCatapultAPI) DeleteMediaFile(name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
+func (m *fakeCatapultAPI) CreateRecordingTranscription(recordingID string) (string, error) {
+	args := m.Called(recordingID)
+	return args.String(0), args.Error(1)
+}
+
+func (m *fakeCatapultAPI) GetRecordingTranscription(recordingID string, transcriptionID string) (*bandwidth.Transcription, error) {
+	args := m.Called(recordingID, transcriptionID)
+	return args.Get(0).(*bandwidth.Transcription), args.Error(1)
+}
+
+func (m *fakeCatapultAPI) CreateMessage(data *bandwidth.CreateMessageData) (string, error) {
+	args := m.Called(data)
+	return args.String(0), args.Error(1)
+}
+
+func (m *fakeCatapultAPI) CreateBridge(data *bandwidth.BridgeData) (string, error) {
+	args := m.Called(data)
+	return args.String(0), args.Error(1)
+}
+
+func (m *fakeCatapultAPI) UploadMediaFile(name string, content io.ReadCloser, contentType string) (string, error) {
+	args := m.Called(name, content, contentType)
+	return args.String(0), args.Error(1)
+}
+
+type fakeEmailSender struct {
 	mock.Mock
 }
 
-func (m *fakeTimerAPI) Sleep(d time.Duration) {
-	m.Called(d)
+func (m *fakeEmailSender) Send(to, subject, text string, attachment *emailAttachment) error {
+	args := m.Called(to, subject, text, attachment)
+	return args.Error(0)
+}
+
+// startMockSMTPServer starts minimal SMTP server which passes received messages to returned channel
+func startMockSMTPServer(t *testing.T) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(connection net.Conn) {
+				defer connection.Close()
+				reader := textproto.NewReader(bufio.NewReader(connection))
+				fmt.Fprint(connection, "220 localhost ESMTP\r\n")
+				for {
+					line, err := reader.ReadLine()
+					if err != nil {
+						return
+					}
+					command := strings.ToUpper(line)
+					switch {
+					case strings.HasPrefix(command, "DATA"):
+						fmt.Fprint(connection, "354 End data with <CR><LF>.<CR><LF>\r\n")
+						lines, _ := reader.ReadDotLines()
+						messages <- strings.Join(lines, "\r\n")
+						fmt.Fprint(connection, "250 OK\r\n")
+					case strings.HasPrefix(command, "QUIT"):
+						fmt.Fprint(connection, "221 Bye\r\n")
+						return
+					default:
+						fmt.Fprint(connection, "250 OK\r\n")
+					}
+				}
+			}(connection)
+		}
+	}()
+	return listener, messages
+}
+
+type fakeTimerAPI struct {
+	CurrentTime time.Time
+}
+
+func (m *fakeTimerAPI) Now() time.Time {
+	if m.CurrentTime.IsZero() {
+		return time.Now()
+	}
+	return m.CurrentTime
 }
 
 type fakeSSEEmiter struct {
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// job states
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobFailed  = "failed"
+)
+
+// DefaultJobWorkers is number of job workers if JOB_WORKERS is not set
+const DefaultJobWorkers = 4
+
+const jobPollInterval = time.Second
+
+// jobLockTimeout is time after which a running job is considered lost (its worker has been stopped) and is run again
+const jobLockTimeout = 5 * time.Minute
+
+// types of jobs
+const (
+	checkTransferredCallJob = "checkTransferredCall"
+	ringStepTimeoutJob      = "ringStepTimeout"
+	greetingTimeoutJob      = "greetingTimeout"
+	emailDeliveryJob        = "emailDelivery"
+	recoverRegistrationsJob = "recoverRegistrations"
+)
+
+// Job model is a delayed task. Jobs are stored in database so they survive restarts of the application.
+type Job struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Type        string     `gorm:"type:varchar(32);not null"`
+	Payload     string     `gorm:"type:text"`
+	State       string     `gorm:"type:varchar(16);not null;default:'pending'"`
+	RunAt       time.Time  `gorm:"not null"`
+	Attempts    int        `gorm:"not null;default:0"`
+	LockedUntil *time.Time // set while the job is running
+	LastError   string     `gorm:"type:text"`
+}
+
+// decodePayload reads job's data to v
+func (j *Job) decodePayload(v interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), v)
+}
+
+// jobContext contains dependencies of job handlers
+type jobContext struct {
+	db          *gorm.DB
+	api         catapultAPIInterface
+	timerAPI    timerInterface
+	emailSender emailSenderInterface
+}
+
+type jobDefinition struct {
+	handler     func(job *Job, ctx *jobContext) error
+	maxAttempts int
+	retryDelay  time.Duration // it is multiplied by number of attempts
+}
+
+var jobDefinitions = map[string]*jobDefinition{
+	checkTransferredCallJob: {handleCheckTransferredCallJob, 3, 5 * time.Second},
+	ringStepTimeoutJob:      {handleRingStepTimeoutJob, 3, 5 * time.Second},
+	greetingTimeoutJob:      {handleGreetingTimeoutJob, 1, 0}, // prompts are useless after delay
+	emailDeliveryJob:        {handleEmailDeliveryJob, maxEmailDeliveryAttempts, emailRetryDelay},
+	recoverRegistrationsJob: {handleRecoverRegistrationsJob, 3, time.Minute},
+}
+
+// enqueueJob stores a job which will be run by one of workers at time runAt
+func enqueueJob(db *gorm.DB, jobType string, payload interface{}, runAt time.Time) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return db.Create(&Job{Type: jobType, Payload: string(data), State: JobPending, RunAt: runAt}).Error
+}
+
+// ensureJob stores a job of given type without payload if there is no pending job of this type. It is used for
+// repeating jobs which schedule their next run (duplicates created by concurrent calls stop after one run).
+func ensureJob(db *gorm.DB, jobType string, runAt time.Time) error {
+	count := 0
+	if err := db.Model(&Job{}).Where("type = ? AND state = ?", jobType, JobPending).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return enqueueJob(db, jobType, nil, runAt)
+}
+
+// claimJob locks a due job for current worker. It returns nil if there are no due jobs.
+func claimJob(db *gorm.DB, now time.Time) (*Job, error) {
+	job := &Job{}
+	err := db.Raw(`UPDATE jobs SET state = ?, attempts = attempts + 1, locked_until = ?, updated_at = ?
+		WHERE id = (SELECT id FROM jobs WHERE (state = ? AND run_at <= ?) OR (state = ? AND locked_until < ?)
+		ORDER BY run_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING *`, JobRunning, now.Add(jobLockTimeout), now, JobPending, now, JobRunning, now).Scan(job).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func runJob(definition *jobDefinition, job *Job, ctx *jobContext) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Job has panicked: %v", r)
+		}
+	}()
+	return definition.handler(job, ctx)
+}
+
+// processNextJob runs one due job. It returns false if there are no due jobs.
+func processNextJob(ctx *jobContext) bool {
+	job, err := claimJob(ctx.db, ctx.timerAPI.Now())
+	if err != nil {
+		debugf("Error on getting next job: %s\n", err.Error())
+		return false
+	}
+	if job == nil {
+		return false
+	}
+	debugf("Running job %d (%s, attempt %d)\n", job.ID, job.Type, job.Attempts)
+	definition := jobDefinitions[job.Type]
+	if definition == nil {
+		err = fmt.Errorf("Unknown job type %q", job.Type)
+	} else {
+		err = runJob(definition, job, ctx)
+	}
+	if err == nil {
+		if err = ctx.db.Delete(job).Error; err != nil {
+			debugf("Error on removing completed job: %s\n", err.Error())
+		}
+		return true
+	}
+	debugf("Error on running job %d: %s\n", job.ID, err.Error())
+	updates := map[string]interface{}{
+		"locked_until": nil,
+		"last_error":   err.Error(),
+	}
+	if definition == nil || job.Attempts >= definition.maxAttempts {
+		updates["state"] = JobFailed // it is kept for investigation
+	} else {
+		updates["state"] = JobPending
+		updates["run_at"] = ctx.timerAPI.Now().Add(time.Duration(job.Attempts) * definition.retryDelay)
+	}
+	if err = ctx.db.Model(job).Updates(updates).Error; err != nil {
+		debugf("Error on saving job state: %s\n", err.Error())
+	}
+	return true
+}
+
+// startJobWorkers starts workers which run due jobs until stop is closed
+func startJobWorkers(count int, ctx *jobContext, stop <-chan struct{}) {
+	for i := 0; i < count; i++ {
+		go func() {
+			for {
+				if processNextJob(ctx) {
+					select {
+					case <-stop:
+						return
+					default:
+						continue
+					}
+				}
+				select {
+				case <-stop:
+					return
+				case <-time.After(jobPollInterval):
+				}
+			}
+		}()
+	}
+}
+
+// getJobWorkersCount returns number of job workers from JOB_WORKERS
+func getJobWorkersCount() int {
+	count, err := strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil || count < 1 {
+		return DefaultJobWorkers
+	}
+	return count
+}
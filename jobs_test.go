@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testJobData struct {
+	Value int `json:"value"`
+}
+
+func TestDecodeJobPayload(t *testing.T) {
+	data := &testJobData{}
+	assert.NoError(t, (&Job{Payload: `{"value":10}`}).decodePayload(data))
+	assert.Equal(t, 10, data.Value)
+	assert.Error(t, (&Job{Payload: `{`}).decodePayload(data))
+}
+
+func TestRunJobWithPanic(t *testing.T) {
+	err := runJob(&jobDefinition{handler: func(job *Job, ctx *jobContext) error {
+		panic("test")
+	}}, &Job{}, nil)
+	assert.EqualError(t, err, "Job has panicked: test")
+}
+
+func TestGetJobWorkersCount(t *testing.T) {
+	os.Unsetenv("JOB_WORKERS")
+	assert.Equal(t, DefaultJobWorkers, getJobWorkersCount())
+	os.Setenv("JOB_WORKERS", "10")
+	defer os.Unsetenv("JOB_WORKERS")
+	assert.Equal(t, 10, getJobWorkersCount())
+	os.Setenv("JOB_WORKERS", "0")
+	assert.Equal(t, DefaultJobWorkers, getJobWorkersCount())
+}
+
+func TestProcessNextJob(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	values := []int{}
+	jobDefinitions["test"] = &jobDefinition{handler: func(job *Job, ctx *jobContext) error {
+		data := &testJobData{}
+		job.decodePayload(data)
+		values = append(values, data.Value)
+		return nil
+	}, maxAttempts: 1}
+	defer delete(jobDefinitions, "test")
+	assert.NoError(t, enqueueJob(db, "test", &testJobData{2}, timerAPI.Now().Add(2*time.Second)))
+	assert.NoError(t, enqueueJob(db, "test", &testJobData{1}, timerAPI.Now().Add(time.Second)))
+	assert.Equal(t, 0, runDueJobs(db, nil, timerAPI))
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(2 * time.Second)
+	assert.Equal(t, 2, runDueJobs(db, nil, timerAPI))
+	assert.Equal(t, []int{1, 2}, values)
+	count := 0
+	db.Model(&Job{}).Count(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestEnsureJob(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	assert.NoError(t, ensureJob(db, "test", now))
+	assert.NoError(t, ensureJob(db, "test", now.Add(time.Minute)))
+	assert.NoError(t, ensureJob(db, "test2", now))
+	jobs := []Job{}
+	require.NoError(t, db.Order("id").Find(&jobs).Error)
+	require.Equal(t, 2, len(jobs))
+	assert.Equal(t, "test", jobs[0].Type)
+	assert.Equal(t, "test2", jobs[1].Type)
+}
+
+func TestProcessNextJobWithRetries(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	jobDefinitions["test"] = &jobDefinition{handler: func(job *Job, ctx *jobContext) error {
+		return errors.New("error")
+	}, maxAttempts: 2, retryDelay: time.Minute}
+	defer delete(jobDefinitions, "test")
+	assert.NoError(t, enqueueJob(db, "test", &testJobData{}, timerAPI.Now()))
+	assert.Equal(t, 1, runDueJobs(db, nil, timerAPI))
+	job := &Job{}
+	assert.NoError(t, db.First(job).Error)
+	assert.Equal(t, JobPending, job.State)
+	assert.Equal(t, 1, job.Attempts)
+	assert.Equal(t, "error", job.LastError)
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(time.Minute)
+	assert.Equal(t, 1, runDueJobs(db, nil, timerAPI))
+	assert.NoError(t, db.First(job).Error)
+	assert.Equal(t, JobFailed, job.State)
+	assert.Equal(t, 2, job.Attempts)
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(time.Hour)
+	assert.Equal(t, 0, runDueJobs(db, nil, timerAPI))
+}
+
+func TestProcessNextJobWithUnknownType(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	assert.NoError(t, enqueueJob(db, "unknown", nil, timerAPI.Now()))
+	assert.Equal(t, 1, runDueJobs(db, nil, timerAPI))
+	job := &Job{}
+	assert.NoError(t, db.First(job).Error)
+	assert.Equal(t, JobFailed, job.State)
+}
+
+func TestClaimJobWithExpiredLock(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	assert.NoError(t, enqueueJob(db, "test", nil, now))
+	job, err := claimJob(db, now)
+	assert.NoError(t, err)
+	assert.Equal(t, JobRunning, job.State)
+	job, err = claimJob(db, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Nil(t, job)
+	// worker of the job has been stopped
+	job, err = claimJob(db, now.Add(jobLockTimeout+time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, job.Attempts)
+}
+
+func TestProcessNextJobConcurrently(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	var lock sync.Mutex
+	counts := map[int]int{}
+	jobDefinitions["test"] = &jobDefinition{handler: func(job *Job, ctx *jobContext) error {
+		data := &testJobData{}
+		job.decodePayload(data)
+		lock.Lock()
+		counts[data.Value]++
+		lock.Unlock()
+		return nil
+	}, maxAttempts: 1}
+	defer delete(jobDefinitions, "test")
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, enqueueJob(db, "test", &testJobData{i}, timerAPI.Now()))
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runDueJobs(db, nil, timerAPI)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 20, len(counts))
+	for _, count := range counts {
+		assert.Equal(t, 1, count)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/jinzhu/gorm"
+)
+
+// states of dial-in voice mail menu (they are used as gather tags too)
+const (
+	mailboxStateMailbox = "Mailbox"
+	mailboxStatePIN     = "PIN"
+	mailboxStateMenu    = "Menu"
+)
+
+// maxMailboxAttempts is how many times caller can enter wrong mailbox number or PIN before hang up
+const maxMailboxAttempts = 3
+
+// maxPINFailures is how many wrong PINs in a row (in all calls) lock the mailbox for pinLockoutPeriod
+const (
+	maxPINFailures   = 6
+	pinLockoutPeriod = time.Hour
+)
+
+const mailboxMenuSentence = "Press 1 to play the message again. Press 4 for previous message. Press 6 for next message. " +
+	"Press 7 to delete the message. Press 9 to save the message. Press 8 to call back. Press 0 to hang up."
+
+// startVoiceMailSession answers a call to the voice mail. User is nil if caller should enter mailbox number.
+func startVoiceMailSession(callID string, user *User, host string, db *gorm.DB, api catapultAPIInterface) {
+	debugf("Starting voice mail session for call %s\n", callID)
+	session := &VoiceMailSession{CallID: callID, State: mailboxStateMailbox}
+	if user != nil {
+		session.UserID = user.ID
+		session.State = mailboxStatePIN
+	}
+	if err := db.Create(session).Error; err != nil {
+		debugf("Error on saving voice mail session: %s\n", err.Error())
+		return
+	}
+	// next events of the call will be handled by /voiceMailCallback
+	api.UpdateCall(callID, &bandwidth.UpdateCallData{
+		CallbackURL: buildCallbackURL(host, "/voiceMailCallback"),
+	})
+	askMailboxInput(callID, session.State, api)
+}
+
+func handleVoiceMailSessionEvent(form *CallbackForm, now time.Time, db *gorm.DB, api catapultAPIInterface) {
+	session := &VoiceMailSession{}
+	if db.First(session, "call_id = ?", form.CallID).RecordNotFound() {
+		debugf("Voice mail session for call %s is not found\n", form.CallID)
+		return
+	}
+	if form.EventType == "hangup" {
+		db.Delete(session)
+		return
+	}
+	if form.EventType != "gather" || form.State != "completed" || form.Tag != session.State {
+		return
+	}
+	switch session.State {
+	case mailboxStateMailbox:
+		handleMailboxNumber(form, session, db, api)
+	case mailboxStatePIN:
+		handleMailboxPIN(form, session, now, db, api)
+	case mailboxStateMenu:
+		handleMailboxMenu(form, session, db, api)
+	}
+}
+
+func handleMailboxNumber(form *CallbackForm, session *VoiceMailSession, db *gorm.DB, api catapultAPIInterface) {
+	user := &User{}
+	phoneNumber := "+" + form.Digits
+	if len(form.Digits) == 10 {
+		phoneNumber = "+1" + form.Digits
+	}
+	if form.Digits == "" || db.First(user, "phone_number = ?", phoneNumber).RecordNotFound() {
+		session.Attempts++
+		if session.Attempts >= maxMailboxAttempts {
+			hangUpMailbox(form.CallID, "Mailbox is not found. Goodbye.", api)
+			return
+		}
+		db.Save(session)
+		api.SpeakSentenceToCall(form.CallID, "Mailbox is not found.")
+		askMailboxInput(form.CallID, session.State, api)
+		return
+	}
+	session.UserID = user.ID
+	session.State = mailboxStatePIN
+	session.Attempts = 0
+	db.Save(session)
+	askMailboxInput(form.CallID, session.State, api)
+}
+
+func handleMailboxPIN(form *CallbackForm, session *VoiceMailSession, now time.Time, db *gorm.DB, api catapultAPIInterface) {
+	user := &User{}
+	if err := db.First(user, session.UserID).Error; err != nil {
+		debugf("Error on getting user: %s\n", err.Error())
+		return
+	}
+	if user.PINLockedUntil != nil && now.Before(*user.PINLockedUntil) {
+		debugf("Mailbox of user %s is locked\n", user.UserName)
+		hangUpMailbox(form.CallID, "Mailbox is locked. Please try again later. Goodbye.", api)
+		return
+	}
+	if !user.ComparePIN(form.Digits) {
+		if countPINFailure(user, now, db) {
+			hangUpMailbox(form.CallID, "Mailbox is locked. Please try again later. Goodbye.", api)
+			return
+		}
+		session.Attempts++
+		if session.Attempts >= maxMailboxAttempts {
+			hangUpMailbox(form.CallID, "Invalid PIN. Goodbye.", api)
+			return
+		}
+		db.Save(session)
+		api.SpeakSentenceToCall(form.CallID, "Invalid PIN.")
+		askMailboxInput(form.CallID, session.State, api)
+		return
+	}
+	if user.PINFailures != 0 || user.PINLockedUntil != nil {
+		db.Model(user).UpdateColumns(map[string]interface{}{"pin_failures": 0, "pin_locked_until": nil})
+	}
+	session.State = mailboxStateMenu
+	session.Attempts = 0
+	session.MessageIndex = 0
+	db.Save(session)
+	count, unreadCount := 0, 0
+	db.Model(&VoiceMailMessage{}).Where("user_id = ? AND folder <> ?", user.ID, ArchiveFolder).Count(&count)
+	db.Model(&VoiceMailMessage{}).Where("user_id = ? AND folder <> ? AND listened = ?", user.ID, ArchiveFolder, false).Count(&unreadCount)
+	api.SpeakSentenceToCall(form.CallID, fmt.Sprintf("You have %d new and %d total voice messages.", unreadCount, count))
+	playMailboxMessage(form.CallID, session, db, api)
+}
+
+// countPINFailure stores wrong PIN of the user. It locks the mailbox and returns true after maxPINFailures wrong PINs
+// in a row.
+func countPINFailure(user *User, now time.Time, db *gorm.DB) bool {
+	err := db.Model(user).UpdateColumn("pin_failures", gorm.Expr("pin_failures + 1")).Error
+	if err == nil {
+		err = db.Model(&User{}).Where("id = ?", user.ID).Select("pin_failures").Row().Scan(&user.PINFailures)
+	}
+	if err != nil {
+		debugf("Error on counting wrong PIN: %s\n", err.Error())
+		return false
+	}
+	if user.PINFailures < maxPINFailures {
+		return false
+	}
+	debugf("Locking mailbox of user %s after %d wrong PINs\n", user.UserName, user.PINFailures)
+	lockedUntil := now.Add(pinLockoutPeriod)
+	err = db.Model(user).UpdateColumns(map[string]interface{}{"pin_failures": 0, "pin_locked_until": lockedUntil}).Error
+	if err != nil {
+		debugf("Error on locking mailbox: %s\n", err.Error())
+	}
+	return true
+}
+
+func handleMailboxMenu(form *CallbackForm, session *VoiceMailSession, db *gorm.DB, api catapultAPIInterface) {
+	user := &User{}
+	if err := db.First(user, session.UserID).Error; err != nil {
+		debugf("Error on getting user: %s\n", err.Error())
+		return
+	}
+	message, count := getMailboxMessage(session, db)
+	if message == nil {
+		playMailboxMessage(form.CallID, session, db, api)
+		return
+	}
+	switch form.Digits {
+	case "1":
+		break
+	case "4":
+		if session.MessageIndex == 0 {
+			api.SpeakSentenceToCall(form.CallID, "This is the first message.")
+		} else {
+			session.MessageIndex--
+		}
+	case "6":
+		if session.MessageIndex+1 >= count {
+			api.SpeakSentenceToCall(form.CallID, "There are no more messages.")
+			askMailboxInput(form.CallID, session.State, api)
+			return
+		}
+		session.MessageIndex++
+	case "7":
+		if err := db.Delete(message).Error; err != nil {
+			debugf("Error on removing a voice message: %s\n", err.Error())
+			break
+		}
+		api.SpeakSentenceToCall(form.CallID, "Message deleted.")
+	case "9":
+		if err := db.Model(message).Update("folder", SavedFolder).Error; err != nil {
+			debugf("Error on saving a voice message: %s\n", err.Error())
+			break
+		}
+		api.SpeakSentenceToCall(form.CallID, "Message saved.")
+		if session.MessageIndex+1 >= count {
+			askMailboxInput(form.CallID, session.State, api)
+			return
+		}
+		session.MessageIndex++
+	case "8":
+		debugf("Calling back to %q\n", message.From)
+		api.UpdateCall(form.CallID, &bandwidth.UpdateCallData{
+			State:            "transferring",
+			TransferTo:       message.From,
+			TransferCallerID: user.PhoneNumber,
+		})
+		return
+	case "0":
+		hangUpMailbox(form.CallID, "Goodbye.", api)
+		return
+	default:
+		api.SpeakSentenceToCall(form.CallID, "Invalid option.")
+		askMailboxInput(form.CallID, session.State, api)
+		return
+	}
+	db.Save(session)
+	playMailboxMessage(form.CallID, session, db, api)
+}
+
+// getMailboxMessage returns current message of the session (newest messages go first) and total count of messages.
+// Archived messages are not available by phone.
+func getMailboxMessage(session *VoiceMailSession, db *gorm.DB) (*VoiceMailMessage, int) {
+	count := 0
+	db.Model(&VoiceMailMessage{}).Where("user_id = ? AND folder <> ?", session.UserID, ArchiveFolder).Count(&count)
+	if count == 0 {
+		return nil, 0
+	}
+	if session.MessageIndex >= count {
+		session.MessageIndex = count - 1
+	}
+	message := &VoiceMailMessage{}
+	err := db.Where("user_id = ? AND folder <> ?", session.UserID, ArchiveFolder).Order("start_time desc").
+		Offset(session.MessageIndex).First(message).Error
+	if err != nil {
+		debugf("Error on getting voice message: %s\n", err.Error())
+		return nil, count
+	}
+	return message, count
+}
+
+func playMailboxMessage(callID string, session *VoiceMailSession, db *gorm.DB, api catapultAPIInterface) {
+	message, count := getMailboxMessage(session, db)
+	if message == nil {
+		hangUpMailbox(callID, "You have no voice messages. Goodbye.", api)
+		return
+	}
+	from := message.From
+	if strings.HasPrefix(from, "+") {
+		from = strings.Join(strings.Split(from[1:], ""), " ") // to pronounce number digit by digit
+	}
+	api.SpeakSentenceToCall(callID, fmt.Sprintf("Message %d of %d from %s, received %s.",
+		session.MessageIndex+1, count, from, message.StartTime.Format("January 2 at 3:04 PM")))
+	api.PlayAudioToCall(callID, message.MediaURL)
+	if !message.Listened {
+		db.Model(message).Update("listened", true)
+	}
+	askMailboxInput(callID, session.State, api)
+}
+
+func askMailboxInput(callID string, state string, api catapultAPIInterface) {
+	data := &bandwidth.CreateGatherData{
+		MaxDigits:         1,
+		InterDigitTimeout: 30,
+		Tag:               state,
+		Prompt: &bandwidth.GatherPromptData{
+			Gender: "female",
+			Voice:  "julie",
+		},
+	}
+	switch state {
+	case mailboxStateMailbox:
+		data.MaxDigits = 15
+		data.InterDigitTimeout = 10
+		data.TerminatingDigits = "#"
+		data.Prompt.Sentence = "Please enter your mailbox number followed by the pound key."
+	case mailboxStatePIN:
+		data.MaxDigits = MaxPINLength
+		data.InterDigitTimeout = 10
+		data.TerminatingDigits = "#"
+		data.Prompt.Sentence = "Please enter your PIN followed by the pound key."
+	default:
+		data.Prompt.Sentence = mailboxMenuSentence
+	}
+	id, err := api.CreateGather(callID, data)
+	debugf("CreateGather result %v\n", []interface{}{id, err})
+}
+
+func hangUpMailbox(callID string, sentence string, api catapultAPIInterface) {
+	api.SpeakSentenceToCall(callID, sentence)
+	api.UpdateCall(callID, &bandwidth.UpdateCallData{State: "completed"})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func createMailboxUser(t *testing.T, db *gorm.DB, userName string, phoneNumber string) *User {
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:" + userName + "@test.com",
+		PhoneNumber: phoneNumber,
+		UserName:    userName,
+	}
+	user.SetPassword("123456")
+	user.SetPIN("1234")
+	assert.NoError(t, db.Save(user).Error)
+	db.Delete(&VoiceMailMessage{}, "user_id = ?", user.ID)
+	return user
+}
+
+func TestAskMailboxInput(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	api.On("CreateGather", "callID", &bandwidth.CreateGatherData{
+		MaxDigits:         MaxPINLength,
+		InterDigitTimeout: 10,
+		TerminatingDigits: "#",
+		Tag:               "PIN",
+		Prompt: &bandwidth.GatherPromptData{
+			Gender:   "female",
+			Voice:    "julie",
+			Sentence: "Please enter your PIN followed by the pound key.",
+		},
+	}).Return("", nil)
+	askMailboxInput("callID", mailboxStatePIN, api)
+	api.AssertExpectations(t)
+}
+
+func TestHangUpMailbox(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	api.On("SpeakSentenceToCall", "callID", "Goodbye.").Return(nil)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	hangUpMailbox("callID", "Goodbye.", api)
+	api.AssertExpectations(t)
+}
+
+func TestStartVoiceMailSession(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createMailboxUser(t, db, "mbuser1", "+1234567811")
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "mbCallID1")
+	api.On("UpdateCall", "mbCallID1", &bandwidth.UpdateCallData{CallbackURL: "http://localhost/voiceMailCallback?secret=callbackSecret"}).Return("", nil)
+	api.On("CreateGather", "mbCallID1", mock.AnythingOfType("*bandwidth.CreateGatherData")).Return("", nil)
+	startVoiceMailSession("mbCallID1", user, "localhost", db, api)
+	api.AssertExpectations(t)
+	session := &VoiceMailSession{}
+	assert.NoError(t, db.First(session, "call_id = ?", "mbCallID1").Error)
+	assert.Equal(t, mailboxStatePIN, session.State)
+	assert.Equal(t, user.ID, session.UserID)
+}
+
+func TestVoiceMailSessionMailboxNumber(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createMailboxUser(t, db, "mbuser2", "+1234567812")
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "mbCallID2")
+	db.Create(&VoiceMailSession{CallID: "mbCallID2", State: mailboxStateMailbox})
+	api.On("CreateGather", "mbCallID2", mock.AnythingOfType("*bandwidth.CreateGatherData")).Return("", nil)
+	handleVoiceMailSessionEvent(&CallbackForm{
+		CallID:    "mbCallID2",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       mailboxStateMailbox,
+		Digits:    "2345678121",
+	}, time.Now(), db, api)
+	api.AssertExpectations(t)
+	session := &VoiceMailSession{}
+	assert.NoError(t, db.First(session, "call_id = ?", "mbCallID2").Error)
+	assert.Equal(t, mailboxStatePIN, session.State)
+	assert.Equal(t, user.ID, session.UserID)
+}
+
+func TestVoiceMailSessionWrongPIN(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createMailboxUser(t, db, "mbuser3", "+1234567813")
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "mbCallID3")
+	db.Create(&VoiceMailSession{CallID: "mbCallID3", State: mailboxStatePIN, UserID: user.ID, Attempts: maxMailboxAttempts - 1})
+	api.On("SpeakSentenceToCall", "mbCallID3", "Invalid PIN. Goodbye.").Return(nil)
+	api.On("UpdateCall", "mbCallID3", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	handleVoiceMailSessionEvent(&CallbackForm{
+		CallID:    "mbCallID3",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       mailboxStatePIN,
+		Digits:    "0000",
+	}, time.Now(), db, api)
+	api.AssertExpectations(t)
+}
+
+func TestVoiceMailSessionPINLockout(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createMailboxUser(t, db, "mbuser7", "+1234567817")
+	api.On("SpeakSentenceToCall", mock.Anything, mock.Anything).Return(nil)
+	api.On("CreateGather", mock.Anything, mock.Anything).Return("", nil)
+	api.On("UpdateCall", mock.Anything, mock.Anything).Return("", nil)
+	now := time.Now()
+	enterPIN := func(callID string, pin string, now time.Time) {
+		handleVoiceMailSessionEvent(&CallbackForm{
+			CallID:    callID,
+			EventType: "gather",
+			State:     "completed",
+			Tag:       mailboxStatePIN,
+			Digits:    pin,
+		}, now, db, api)
+	}
+	// each call allows maxMailboxAttempts attempts, failures are counted over all calls
+	for i := 0; i < maxPINFailures/maxMailboxAttempts; i++ {
+		callID := fmt.Sprintf("mbLockCallID%d", i)
+		db.Delete(&VoiceMailSession{}, "call_id = ?", callID)
+		db.Create(&VoiceMailSession{CallID: callID, State: mailboxStatePIN, UserID: user.ID})
+		for j := 0; j < maxMailboxAttempts; j++ {
+			enterPIN(callID, "0000", now)
+		}
+	}
+	api.AssertCalled(t, "SpeakSentenceToCall", "mbLockCallID1", "Mailbox is locked. Please try again later. Goodbye.")
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "mbLockCallID")
+	db.Create(&VoiceMailSession{CallID: "mbLockCallID", State: mailboxStatePIN, UserID: user.ID})
+	enterPIN("mbLockCallID", "1234", now)
+	api.AssertCalled(t, "SpeakSentenceToCall", "mbLockCallID", "Mailbox is locked. Please try again later. Goodbye.")
+	// the lock expires
+	enterPIN("mbLockCallID", "1234", now.Add(pinLockoutPeriod))
+	session := &VoiceMailSession{}
+	assert.NoError(t, db.First(session, "call_id = ?", "mbLockCallID").Error)
+	assert.Equal(t, mailboxStateMenu, session.State)
+}
+
+func TestVoiceMailSessionPIN(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createMailboxUser(t, db, "mbuser4", "+1234567814")
+	db.Create(&VoiceMailMessage{
+		MediaURL:  "url1",
+		StartTime: parseTime("2016-05-31T10:00:00Z"),
+		EndTime:   parseTime("2016-05-31T10:01:00Z"),
+		UserID:    user.ID,
+		From:      "+19195551212",
+	})
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "mbCallID4")
+	db.Create(&VoiceMailSession{CallID: "mbCallID4", State: mailboxStatePIN, UserID: user.ID})
+	api.On("SpeakSentenceToCall", "mbCallID4", "You have 1 new and 1 total voice messages.").Return(nil)
+	api.On("SpeakSentenceToCall", "mbCallID4", "Message 1 of 1 from 1 9 1 9 5 5 5 1 2 1 2, received May 31 at 10:00 AM.").Return(nil)
+	api.On("PlayAudioToCall", "mbCallID4", "url1").Return(nil)
+	api.On("CreateGather", "mbCallID4", mock.AnythingOfType("*bandwidth.CreateGatherData")).Return("", nil)
+	handleVoiceMailSessionEvent(&CallbackForm{
+		CallID:    "mbCallID4",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       mailboxStatePIN,
+		Digits:    "1234",
+	}, time.Now(), db, api)
+	api.AssertExpectations(t)
+	session := &VoiceMailSession{}
+	assert.NoError(t, db.First(session, "call_id = ?", "mbCallID4").Error)
+	assert.Equal(t, mailboxStateMenu, session.State)
+}
+
+func TestVoiceMailSessionMenuNextAndDelete(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createMailboxUser(t, db, "mbuser5", "+1234567815")
+	db.Create(&VoiceMailMessage{
+		MediaURL:  "url1",
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		UserID:    user.ID,
+		From:      "sip:caller@test.com",
+	})
+	older := &VoiceMailMessage{
+		MediaURL:  "url2",
+		StartTime: time.Now().Add(-time.Hour),
+		EndTime:   time.Now().Add(-time.Hour),
+		UserID:    user.ID,
+		From:      "sip:caller@test.com",
+	}
+	db.Create(older)
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "mbCallID5")
+	db.Create(&VoiceMailSession{CallID: "mbCallID5", State: mailboxStateMenu, UserID: user.ID})
+	api.On("SpeakSentenceToCall", "mbCallID5", mock.AnythingOfType("string")).Return(nil)
+	api.On("PlayAudioToCall", "mbCallID5", "url2").Return(nil)
+	api.On("CreateGather", "mbCallID5", mock.AnythingOfType("*bandwidth.CreateGatherData")).Return("", nil)
+	form := &CallbackForm{
+		CallID:    "mbCallID5",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       mailboxStateMenu,
+		Digits:    "6",
+	}
+	handleVoiceMailSessionEvent(form, time.Now(), db, api)
+	api.AssertExpectations(t)
+	session := &VoiceMailSession{}
+	assert.NoError(t, db.First(session, "call_id = ?", "mbCallID5").Error)
+	assert.Equal(t, 1, session.MessageIndex)
+
+	api.On("PlayAudioToCall", "mbCallID5", "url1").Return(nil)
+	form.Digits = "7"
+	handleVoiceMailSessionEvent(form, time.Now(), db, api)
+	assert.True(t, db.First(&VoiceMailMessage{}, older.ID).RecordNotFound())
+	assert.NoError(t, db.First(session, "call_id = ?", "mbCallID5").Error)
+	assert.Equal(t, 0, session.MessageIndex)
+}
+
+func TestVoiceMailSessionMenuCallBack(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := createMailboxUser(t, db, "mbuser6", "+1234567816")
+	db.Create(&VoiceMailMessage{
+		MediaURL:  "url1",
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		UserID:    user.ID,
+		From:      "+19195551212",
+	})
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "mbCallID6")
+	db.Create(&VoiceMailSession{CallID: "mbCallID6", State: mailboxStateMenu, UserID: user.ID})
+	api.On("UpdateCall", "mbCallID6", &bandwidth.UpdateCallData{
+		State:            "transferring",
+		TransferTo:       "+19195551212",
+		TransferCallerID: "+1234567816",
+	}).Return("", nil)
+	handleVoiceMailSessionEvent(&CallbackForm{
+		CallID:    "mbCallID6",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       mailboxStateMenu,
+		Digits:    "8",
+	}, time.Now(), db, api)
+	api.AssertExpectations(t)
+}
+
+func TestVoiceMailSessionIgnoresOutOfOrderGather(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "mbCallID7")
+	db.Create(&VoiceMailSession{CallID: "mbCallID7", State: mailboxStatePIN})
+	handleVoiceMailSessionEvent(&CallbackForm{
+		CallID:    "mbCallID7",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       mailboxStateMenu,
+		Digits:    "7",
+	}, time.Now(), db, api)
+	api.AssertNotCalled(t, "SpeakSentenceToCall")
+	api.AssertNotCalled(t, "CreateGather")
+}
+
+func TestVoiceMailSessionHangup(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "mbCallID8")
+	db.Create(&VoiceMailSession{CallID: "mbCallID8", State: mailboxStateMenu})
+	handleVoiceMailSessionEvent(&CallbackForm{
+		CallID:    "mbCallID8",
+		EventType: "hangup",
+	}, time.Now(), db, api)
+	assert.True(t, db.First(&VoiceMailSession{}, "call_id = ?", "mbCallID8").RecordNotFound())
+}
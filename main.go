@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
@@ -11,10 +12,10 @@ import (
 )
 
 func main() {
-	router := gin.Default()
-	router.NoRoute(static.ServeRoot("/", "./public")) //serve static files for other routes
-	router.Use(catapultMiddleware)                    // make CatapultAPI available for all routes
-	router.Use(timerMiddleware)
+	var err error
+	if config, err = loadConfig(); err != nil {
+		panic(fmt.Sprintf("Error on loading configuration: %s", err.Error()))
+	}
 	connectionString := os.Getenv("DATABASE_URL")
 	if connectionString == "" {
 		// Docker's links support
@@ -34,8 +35,48 @@ func main() {
 	if err = AutoMigrate(db).Error; err != nil {
 		panic(fmt.Sprintf("Error on executing db migrations: %s", err.Error()))
 	}
-	if err = getRoutes(router, db, nil); err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		// command line mode: ./go-voice-reference-app export -type calls -since 2016-12-01 -until 2017-01-01 > calls.csv
+		if err = runExportCommand(os.Args[2:], db, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "encrypt-secrets" {
+		// encrypts SIP passwords stored in plain text and rotates encryption key: ./go-voice-reference-app encrypt-secrets
+		if err = runEncryptSecretsCommand(os.Args[2:], db, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	provisioning = newProvisioningCache(db) // ids of application and domain are shared between instances
+	catapultClient, err := newCatapultAPI(nil)
+	if err != nil {
+		panic(fmt.Sprintf("Error on creating Catapult API client: %s", err.Error()))
+	}
+	api := newResilientCatapultAPI(catapultClient, &timer{}) // it is shared by all requests and jobs
+	// release resources of registrations interrupted by restart
+	if err = ensureJob(db, recoverRegistrationsJob, time.Now()); err != nil {
+		panic(fmt.Sprintf("Error on scheduling recovery of registrations: %s", err.Error()))
+	}
+	router := gin.Default()
+	router.NoRoute(static.ServeRoot("/", "./public")) //serve static files for other routes
+	router.Use(newCatapultMiddleware(api))            // make CatapultAPI available for all routes
+	router.Use(timerMiddleware)
+	router.Use(emailMiddleware)
+	bus, err := newNotificationBus(connectionString, db)
+	if err != nil {
+		panic(fmt.Sprintf("Error on creating notification bus: %s", err.Error()))
+	}
+	if err = getRoutes(router, db, bus); err != nil {
 		panic(fmt.Sprintf("Error on creating routes: %s", err.Error()))
 	}
+	jobs := &jobContext{db: db, api: api, timerAPI: &timer{}}
+	if sender := newSMTPEmailSender(); sender != nil {
+		jobs.emailSender = sender
+	}
+	startJobWorkers(getJobWorkersCount(), jobs, make(chan struct{})) // delayed tasks of calls and email delivery
 	router.Run()
 }
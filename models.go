@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -11,20 +13,128 @@ import (
 // MinPasswordLength defines minimal length of password
 const MinPasswordLength = 6
 
-const salt = "cWWRcK0.8^eUgu_!V@@K6D^;#,jL+Yl"
+// DefaultNoAnswerTimeout is used when user has not changed time to wait for answer before moving a call to voice mail
+const DefaultNoAnswerTimeout = 15
+
+// MinPINLength defines minimal length of PIN for voice mail access by phone
+const MinPINLength = 4
+
+// MaxPINLength defines maximal length of PIN for voice mail access by phone
+const MaxPINLength = 10
 
 // User model
 type User struct {
 	gorm.Model
-	UserName          string `gorm:"type:varchar(64);not null;unique_index"`
-	PasswordHash      []byte
-	AreaCode          string `gorm:"type:char(3)"`
-	PhoneNumber       string `gorm:"type:varchar(32);unique_index"`
-	EndpointID        string `gorm:"column:endpoint_id;type:varchar(64)"`
-	SIPURI            string `gorm:"column:sip_uri;type:varchar(1024);index"`
-	SIPPassword       string `gorm:"column:sip_password;type:varchar(128)"`
-	GreetingURL       string `gorm:"column:greeting_url;type:varchar(1024)"`
-	VoiceMailMessages []VoiceMailMessage
+	UserName             string `gorm:"type:varchar(64);not null;unique_index"`
+	PasswordHash         []byte
+	PepperVersion        int    `gorm:"column:pepper_version;not null;default:0"` // version of pepper of password hash
+	TokenVersion         int    `gorm:"column:token_version;not null;default:0"`  // auth tokens of other versions are invalid
+	AreaCode             string `gorm:"type:char(3)"`
+	PhoneNumber          string `gorm:"type:varchar(32);unique_index"`
+	EndpointID           string `gorm:"column:endpoint_id;type:varchar(64)"`
+	SIPURI               string `gorm:"column:sip_uri;type:varchar(1024);index"`
+	SIPPassword          string `gorm:"-"` // it is stored encrypted
+	EncryptedSIPPassword string `gorm:"column:encrypted_sip_password;type:varchar(512)"`
+	LegacySIPPassword    string `gorm:"column:sip_password;type:varchar(128)"`  // plain text, it is removed on save
+	GreetingURL          string `gorm:"column:greeting_url;type:varchar(1024)"` // no answer greeting
+	VoiceMailMessages    []VoiceMailMessage
+
+	NotificationNumber      string `gorm:"column:notification_number;type:varchar(32)"`
+	SMSNotificationsEnabled bool   `gorm:"column:sms_notifications_enabled"`
+
+	Email                     string `gorm:"column:email;type:varchar(256)"`
+	EmailNotificationsEnabled bool   `gorm:"column:email_notifications_enabled"`
+
+	PINHash          []byte     `gorm:"column:pin_hash"`
+	PINPepperVersion int        `gorm:"column:pin_pepper_version;not null;default:0"`
+	PINFailures      int        `gorm:"column:pin_failures;not null;default:0"` // wrong PINs in a row over all calls
+	PINLockedUntil   *time.Time `gorm:"column:pin_locked_until"`                // voice mail can't be accessed by phone till this time
+
+	NoAnswerTimeout int `gorm:"column:no_answer_timeout"` // in seconds
+	RingSteps       []RingStep
+
+	TimeZone     string `gorm:"column:time_zone;type:varchar(64)"` // IANA name, UTC by default
+	DoNotDisturb bool   `gorm:"column:do_not_disturb"`
+	WorkingHours []WorkingHours
+	Holidays     []Holiday
+
+	BusyGreetingURL          string     `gorm:"column:busy_greeting_url;type:varchar(1024)"`
+	AfterHoursGreetingURL    string     `gorm:"column:after_hours_greeting_url;type:varchar(1024)"`
+	AbsenceGreetingURL       string     `gorm:"column:absence_greeting_url;type:varchar(1024)"`
+	AbsenceGreetingExpiresAt *time.Time `gorm:"column:absence_greeting_expires_at"`
+}
+
+// types of greetings (they are reasons of moving a call to voice mail too)
+const (
+	NoAnswerGreeting   = "noAnswer"
+	BusyGreeting       = "busy"
+	AfterHoursGreeting = "afterHours"
+	AbsenceGreeting    = "absence" // extended absence, it is used for all calls until expiration
+)
+
+// GreetingTypes contains all known types of greetings
+var GreetingTypes = []string{NoAnswerGreeting, BusyGreeting, AfterHoursGreeting, AbsenceGreeting}
+
+// IsValidGreetingType checks if greeting type is known
+func IsValidGreetingType(greetingType string) bool {
+	for _, t := range GreetingTypes {
+		if t == greetingType {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) greetingURLField(greetingType string) *string {
+	switch greetingType {
+	case BusyGreeting:
+		return &u.BusyGreetingURL
+	case AfterHoursGreeting:
+		return &u.AfterHoursGreetingURL
+	case AbsenceGreeting:
+		return &u.AbsenceGreetingURL
+	default:
+		return &u.GreetingURL
+	}
+}
+
+// GetGreetingURL returns url of user's greeting of given type (empty string for default greeting)
+func (u *User) GetGreetingURL(greetingType string) string {
+	return *u.greetingURLField(greetingType)
+}
+
+// SetGreetingURL changes user's greeting of given type (empty url means default greeting)
+func (u *User) SetGreetingURL(greetingType string, url string) {
+	*u.greetingURLField(greetingType) = url
+	if greetingType == AbsenceGreeting && url == "" {
+		u.AbsenceGreetingExpiresAt = nil
+	}
+}
+
+// SelectGreetingURL returns url of greeting which should be played when a call reaches voice mail by given reason.
+// Extended absence greeting has priority until its expiration. Missing greetings fall back to no answer greeting.
+func (u *User) SelectGreetingURL(reason string, now time.Time) string {
+	if u.AbsenceGreetingURL != "" && (u.AbsenceGreetingExpiresAt == nil || now.Before(*u.AbsenceGreetingExpiresAt)) {
+		return u.AbsenceGreetingURL
+	}
+	if reason != AbsenceGreeting {
+		if url := u.GetGreetingURL(reason); url != "" {
+			return url
+		}
+	}
+	return u.GreetingURL
+}
+
+// folders of voice mail messages
+const (
+	InboxFolder   = "inbox"
+	SavedFolder   = "saved"
+	ArchiveFolder = "archive"
+)
+
+// IsValidFolder checks if folder name is known
+func IsValidFolder(folder string) bool {
+	return folder == InboxFolder || folder == SavedFolder || folder == ArchiveFolder
 }
 
 // VoiceMailMessage model
@@ -36,6 +146,25 @@ type VoiceMailMessage struct {
 	EndTime   time.Time
 	MediaURL  string `gorm:"column:media_url;type:varchar(1024)"`
 	From      string
+
+	RecordingID     string `gorm:"column:recording_id;type:varchar(64);index"`
+	TranscriptionID string `gorm:"column:transcription_id;type:varchar(64)"`
+	Transcription   string `gorm:"type:text"`
+	Folder          string `gorm:"type:varchar(16);not null;default:'inbox';index"`
+	Listened        bool   `gorm:"not null;default:false"`
+}
+
+// BeforeSave encrypts SIP password
+func (u *User) BeforeSave() (err error) {
+	u.EncryptedSIPPassword, err = encryptSecret(u.SIPPassword)
+	u.LegacySIPPassword = ""
+	return
+}
+
+// AfterFind decrypts SIP password (users which have not been migrated yet have plain text password)
+func (u *User) AfterFind() (err error) {
+	u.SIPPassword, err = readSecret(u.EncryptedSIPPassword, u.LegacySIPPassword)
+	return
 }
 
 // SetPassword sets hash for password
@@ -43,23 +172,92 @@ func (u *User) SetPassword(password string) error {
 	if len(password) < MinPasswordLength {
 		return fmt.Errorf("Password length should be more or equal %d symbols", MinPasswordLength)
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password+salt), bcrypt.DefaultCost)
+	hash, version, err := hashSecret(password)
 	u.PasswordHash = hash
+	u.PepperVersion = version
 	return err
 }
 
 // ComparePasswords compares hashed password with parameter
 func (u *User) ComparePasswords(password string) bool {
-	return bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password+salt)) == nil
+	return compareSecret(u.PasswordHash, u.PepperVersion, password)
+}
+
+// IsPasswordHashOutdated checks if password hash uses pepper which is not current (it should be hashed again)
+func (u *User) IsPasswordHashOutdated() bool {
+	return u.PepperVersion != config.PepperVersion
+}
+
+// SetPIN sets hash for PIN which is used to access voice mail by phone
+func (u *User) SetPIN(pin string) error {
+	if len(pin) < MinPINLength || len(pin) > MaxPINLength {
+		return fmt.Errorf("PIN length should be from %d to %d digits", MinPINLength, MaxPINLength)
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return errors.New("PIN should contain digits only")
+		}
+	}
+	hash, version, err := hashSecret(pin)
+	u.PINHash = hash
+	u.PINPepperVersion = version
+	// new PIN unlocks the mailbox
+	u.PINFailures = 0
+	u.PINLockedUntil = nil
+	return err
+}
+
+// ComparePIN compares hashed PIN with parameter
+func (u *User) ComparePIN(pin string) bool {
+	if len(u.PINHash) == 0 {
+		return false
+	}
+	return compareSecret(u.PINHash, u.PINPepperVersion, pin)
+}
+
+// hashSecret hashes password or PIN with current pepper and returns version of the pepper
+func hashSecret(secret string) ([]byte, int, error) {
+	version := config.PepperVersion
+	pepper, _ := config.pepper(version)
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret+pepper), bcrypt.DefaultCost)
+	return hash, version, err
+}
+
+// compareSecret checks password or PIN by hash created with pepper of given version
+func compareSecret(hash []byte, version int, secret string) bool {
+	pepper, ok := config.pepper(version)
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(secret+pepper)) == nil
+}
+
+// BeforeCreate places new messages to inbox
+func (m *VoiceMailMessage) BeforeCreate() error {
+	if m.Folder == "" {
+		m.Folder = InboxFolder
+	}
+	return nil
+}
+
+// GetNoAnswerTimeout returns time to wait for answer of user before moving a call to voice mail
+func (u *User) GetNoAnswerTimeout() time.Duration {
+	if u.NoAnswerTimeout <= 0 {
+		return DefaultNoAnswerTimeout * time.Second
+	}
+	return time.Duration(u.NoAnswerTimeout) * time.Second
 }
 
 // ToJSONObject returns map presentation of model instance (usefull for json)
 func (m *VoiceMailMessage) ToJSONObject() map[string]interface{} {
 	return map[string]interface{}{
-		"startTime": m.StartTime,
-		"endTime":   m.EndTime,
-		"from":      m.From,
-		"id":        m.ID,
+		"startTime":     m.StartTime,
+		"endTime":       m.EndTime,
+		"from":          m.From,
+		"id":            m.ID,
+		"transcription": m.Transcription,
+		"folder":        m.Folder,
+		"listened":      m.Listened,
 	}
 }
 
@@ -72,10 +270,173 @@ type ActiveCall struct {
 	To        string
 }
 
+// EmailDelivery model stores state of sending of voice mail message by email
+type EmailDelivery struct {
+	gorm.Model
+	VoiceMailMessageID uint   `gorm:"column:voice_mail_message_id;index"`
+	Email              string `gorm:"type:varchar(256)"`
+	Attempts           int
+	LastError          string `gorm:"type:text"`
+	DeliveredAt        *time.Time
+}
+
+// VoiceMailSession model keeps state of dial-in voice mail menu for a call
+type VoiceMailSession struct {
+	CallID       string `gorm:"column:call_id;type:varchar(64);primary_key"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	UserID       uint   `gorm:"column:user_id"`
+	State        string `gorm:"type:varchar(16)"`
+	Attempts     int
+	MessageIndex int
+}
+
+// GreetingSession model keeps state of a call which records user's greeting (see greetingcalls.go).
+// Version is incremented on each change of state to ignore outdated timeouts and concurrent events.
+type GreetingSession struct {
+	CallID       string `gorm:"column:call_id;type:varchar(64);primary_key"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	UserID       uint   `gorm:"column:user_id"`
+	State        string `gorm:"type:varchar(16)"`
+	GreetingType string `gorm:"type:varchar(16)"`
+	Version      int
+	Attempts     int  // invalid choices in a row
+	HungUp       bool // user has hung up while recording is being saved
+}
+
+// RingStep model is a step of routing of incoming calls (find me/follow me).
+// All targets of a step are rung simultaneously, steps are tried in order of their positions.
+type RingStep struct {
+	gorm.Model
+	UserID   uint   `gorm:"column:user_id;index"`
+	Position int    `gorm:"not null"`
+	Targets  string `gorm:"type:varchar(2048)"` // comma separated SIP URIs and phone numbers
+	Timeout  int    // in seconds
+}
+
+// TargetList returns list of SIP URIs and phone numbers to ring
+func (s *RingStep) TargetList() []string {
+	if s.Targets == "" {
+		return []string{}
+	}
+	return strings.Split(s.Targets, ",")
+}
+
+// ToJSONObject returns map presentation of model instance (usefull for json)
+func (s *RingStep) ToJSONObject() map[string]interface{} {
+	return map[string]interface{}{
+		"targets": s.TargetList(),
+		"timeout": s.Timeout,
+	}
+}
+
+// RingCall model links an outgoing call of find me/follow me ringing with the incoming call
+type RingCall struct {
+	CreatedAt      time.Time `gorm:"index"`
+	CallID         string    `gorm:"column:call_id;type:varchar(64);primary_key"`
+	IncomingCallID string    `gorm:"column:incoming_call_id;type:varchar(64);index"`
+	Answered       bool      `gorm:"not null;default:false"`
+	Expired        bool      `gorm:"not null;default:false"`
+	Busy           bool      `gorm:"not null;default:false"` // callee rejected the call as busy
+}
+
+// ProcessedEvent model stores identity of handled Catapult callback (Catapult can send the same callback several times)
+type ProcessedEvent struct {
+	CreatedAt time.Time `gorm:"index"`
+	EventKey  string    `gorm:"column:event_key;type:varchar(64);primary_key"` // hash of callback path and event fields
+	CallID    string    `gorm:"column:call_id;type:varchar(64);index"`
+	EventType string    `gorm:"column:event_type;type:varchar(32)"`
+}
+
+// WorkingHours model is a time range of a week day when user accepts calls (in user's time zone).
+// Users without working hours accept calls at any time.
+type WorkingHours struct {
+	gorm.Model
+	UserID      uint `gorm:"column:user_id;index"`
+	Weekday     int  // 0 is Sunday
+	StartMinute int  // minutes since midnight
+	EndMinute   int
+}
+
+// ToJSONObject returns map presentation of model instance (usefull for json)
+func (h *WorkingHours) ToJSONObject() map[string]interface{} {
+	return map[string]interface{}{
+		"weekday": h.Weekday,
+		"start":   formatDayTime(h.StartMinute),
+		"end":     formatDayTime(h.EndMinute),
+	}
+}
+
+// Holiday model is a day (in user's time zone) when all calls go to voice mail
+type Holiday struct {
+	gorm.Model
+	UserID uint   `gorm:"column:user_id;index"`
+	Date   string `gorm:"type:char(10);not null"` // like 2006-01-02
+	Name   string `gorm:"type:varchar(256)"`
+}
+
+// ToJSONObject returns map presentation of model instance (usefull for json)
+func (h *Holiday) ToJSONObject() map[string]interface{} {
+	return map[string]interface{}{
+		"id":   h.ID,
+		"date": h.Date,
+		"name": h.Name,
+	}
+}
+
+// directions of calls
+const (
+	IncomingCall = "incoming"
+	OutgoingCall = "outgoing"
+	GreetingCall = "greeting" // a call from the app to record user's greeting
+)
+
+// dispositions of calls
+const (
+	AnsweredCall  = "answered"
+	VoiceMailCall = "voicemail"
+	MissedCall    = "missed"
+)
+
+// CallRecord model keeps history of user's calls (unlike ActiveCall it is not removed)
+type CallRecord struct {
+	gorm.Model
+	CallID            string    `gorm:"column:call_id;type:varchar(64);unique_index"`
+	TransferredCallID string    `gorm:"column:transferred_call_id;type:varchar(64);index"`
+	UserID            uint      `gorm:"column:user_id;index"`
+	Direction         string    `gorm:"type:varchar(16);index"`
+	From              string    `gorm:"type:varchar(1024)"`
+	To                string    `gorm:"type:varchar(1024)"`
+	StartTime         time.Time `gorm:"index"`
+	AnswerTime        *time.Time
+	EndTime           *time.Time
+	Disposition       string `gorm:"type:varchar(16);index"` // empty while call is in progress
+	Duration          int    // in seconds since answer
+	Busy              bool   `gorm:"not null;default:false"` // user's SIP account rejected the transferred call as busy
+}
+
+// ToJSONObject returns map presentation of model instance (usefull for json)
+func (r *CallRecord) ToJSONObject() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          r.ID,
+		"direction":   r.Direction,
+		"from":        r.From,
+		"to":          r.To,
+		"startTime":   r.StartTime,
+		"answerTime":  r.AnswerTime,
+		"endTime":     r.EndTime,
+		"disposition": r.Disposition,
+		"duration":    r.Duration,
+	}
+}
+
 // AutoMigrate updates tables in db using models definitions
 func AutoMigrate(db *gorm.DB) *gorm.DB {
 	execSQL := !db.HasTable(&ActiveCall{})
-	db.AutoMigrate(&User{}, &VoiceMailMessage{}, &ActiveCall{})
+	db.AutoMigrate(&User{}, &VoiceMailMessage{}, &ActiveCall{}, &EmailDelivery{}, &VoiceMailSession{}, &RingStep{}, &RingCall{},
+		&WorkingHours{}, &Holiday{}, &CallRecord{}, &ProcessedEvent{}, &Job{}, &GreetingSession{}, &ProvisionedResource{},
+		&Registration{}, &PasswordResetCode{}, &Session{}, &StreamTicket{}, &GreetingMedia{})
 	// Postgresql will remove expired records itself
 	if execSQL {
 		time.Sleep(2 * time.Second)
@@ -95,5 +456,30 @@ func AutoMigrate(db *gorm.DB) *gorm.DB {
 		FOR EACH ROW
 		EXECUTE PROCEDURE delete_old_rows();`)
 	}
+	// index for full-text search of voice mail messages by transcription
+	db.Exec(`CREATE INDEX IF NOT EXISTS idx_voice_mail_messages_transcription
+		ON voice_mail_messages USING gin(to_tsvector('english', transcription));`)
+	// identities of processed callbacks are needed only while Catapult can repeat them
+	db.Exec(`CREATE OR REPLACE FUNCTION delete_old_processed_events()
+		RETURNS trigger AS
+		$BODY$
+		BEGIN
+		DELETE FROM processed_events WHERE created_at < NOW() - INTERVAL '1 day';
+		RETURN NULL;
+		END;
+		$BODY$
+		LANGUAGE plpgsql VOLATILE
+		COST 100;`)
+	db.Exec(`DROP TRIGGER IF EXISTS "RemoveOldProcessedEvents" ON processed_events;`)
+	db.Exec(`CREATE TRIGGER "RemoveOldProcessedEvents"
+		AFTER INSERT
+		ON processed_events
+		FOR EACH STATEMENT
+		EXECUTE PROCEDURE delete_old_processed_events();`)
+	// workers look for due jobs
+	db.Exec(`CREATE INDEX IF NOT EXISTS idx_jobs_state_run_at ON jobs (state, run_at);`)
+	// only one outgoing call of find me/follow me ringing can be connected with incoming call
+	db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_ring_calls_answered
+		ON ring_calls (incoming_call_id) WHERE answered;`)
 	return db
 }
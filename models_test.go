@@ -28,16 +28,133 @@ func TestUserComparePasswords(t *testing.T) {
 	assert.False(t, user.ComparePasswords("1234567"))
 }
 
+func TestUserSetPIN(t *testing.T) {
+	user := &User{}
+	assert.NoError(t, user.SetPIN("1234"))
+	assert.True(t, len(user.PINHash) > 0)
+}
+
+func TestUserSetInvalidPIN(t *testing.T) {
+	user := &User{}
+	assert.Error(t, user.SetPIN("123"))
+	assert.Error(t, user.SetPIN("12345678901"))
+	assert.Error(t, user.SetPIN("12a4"))
+	assert.True(t, len(user.PINHash) == 0)
+}
+
+func TestUserComparePIN(t *testing.T) {
+	user := &User{}
+	assert.False(t, user.ComparePIN(""))
+	assert.NoError(t, user.SetPIN("1234"))
+	assert.True(t, user.ComparePIN("1234"))
+	assert.False(t, user.ComparePIN("4321"))
+}
+
+func TestUserGetNoAnswerTimeout(t *testing.T) {
+	user := &User{}
+	assert.Equal(t, DefaultNoAnswerTimeout*time.Second, user.GetNoAnswerTimeout())
+	user.NoAnswerTimeout = 30
+	assert.Equal(t, 30*time.Second, user.GetNoAnswerTimeout())
+}
+
+func TestRingStepTargetList(t *testing.T) {
+	step := &RingStep{}
+	assert.Empty(t, step.TargetList())
+	step.Targets = "sip:user@test.com,+19195551212"
+	assert.Equal(t, []string{"sip:user@test.com", "+19195551212"}, step.TargetList())
+	assert.Equal(t, map[string]interface{}{
+		"targets": []string{"sip:user@test.com", "+19195551212"},
+		"timeout": 0,
+	}, step.ToJSONObject())
+}
+
+func TestIsValidGreetingType(t *testing.T) {
+	assert.True(t, IsValidGreetingType(NoAnswerGreeting))
+	assert.True(t, IsValidGreetingType(AbsenceGreeting))
+	assert.False(t, IsValidGreetingType("unknown"))
+}
+
+func TestUserSetGreetingURL(t *testing.T) {
+	user := &User{}
+	expiresAt := time.Now()
+	user.SetGreetingURL(BusyGreeting, "http://busy")
+	user.SetGreetingURL(AbsenceGreeting, "http://absence")
+	user.AbsenceGreetingExpiresAt = &expiresAt
+	assert.Equal(t, "http://busy", user.BusyGreetingURL)
+	assert.Equal(t, "http://busy", user.GetGreetingURL(BusyGreeting))
+	assert.Equal(t, "", user.GetGreetingURL(NoAnswerGreeting))
+	user.SetGreetingURL(AbsenceGreeting, "")
+	assert.Equal(t, "", user.AbsenceGreetingURL)
+	assert.Nil(t, user.AbsenceGreetingExpiresAt)
+}
+
+func TestUserSelectGreetingURL(t *testing.T) {
+	now := time.Date(2016, 12, 20, 12, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Hour)
+	notExpired := now.Add(time.Hour)
+	tests := []struct {
+		Name   string
+		User   User
+		Reason string
+		URL    string
+	}{
+		{"default greeting", User{}, NoAnswerGreeting, ""},
+		{"no answer", User{GreetingURL: "http://noAnswer", BusyGreetingURL: "http://busy"}, NoAnswerGreeting, "http://noAnswer"},
+		{"busy", User{GreetingURL: "http://noAnswer", BusyGreetingURL: "http://busy"}, BusyGreeting, "http://busy"},
+		{"missing after hours", User{GreetingURL: "http://noAnswer"}, AfterHoursGreeting, "http://noAnswer"},
+		{"after hours", User{AfterHoursGreetingURL: "http://afterHours"}, AfterHoursGreeting, "http://afterHours"},
+		{"absence", User{BusyGreetingURL: "http://busy", AbsenceGreetingURL: "http://absence"}, BusyGreeting, "http://absence"},
+		{"absence before expiration", User{AbsenceGreetingURL: "http://absence", AbsenceGreetingExpiresAt: &notExpired}, NoAnswerGreeting, "http://absence"},
+		{"expired absence", User{GreetingURL: "http://noAnswer", AbsenceGreetingURL: "http://absence", AbsenceGreetingExpiresAt: &expired}, NoAnswerGreeting, "http://noAnswer"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.URL, test.User.SelectGreetingURL(test.Reason, now), test.Name)
+	}
+}
+
 func TestVoiceMailMessageToJSONObject(t *testing.T) {
 	message := &VoiceMailMessage{
-		StartTime: time.Now(),
-		EndTime:   time.Now(),
+		StartTime:     time.Now(),
+		EndTime:       time.Now(),
+		Transcription: "Hello",
 	}
 	message.ID = 1
 	result := message.ToJSONObject()
 	assert.NotEmpty(t, result["startTime"])
 	assert.NotEmpty(t, result["endTime"])
 	assert.NotEmpty(t, result["id"])
+	assert.Equal(t, "Hello", result["transcription"])
+}
+
+func TestCallRecordToJSONObject(t *testing.T) {
+	record := &CallRecord{
+		Direction:   IncomingCall,
+		From:        "+1472583688",
+		To:          "+1234567890",
+		Disposition: VoiceMailCall,
+	}
+	record.ID = 1
+	result := record.ToJSONObject()
+	assert.Equal(t, uint(1), result["id"])
+	assert.Equal(t, IncomingCall, result["direction"])
+	assert.Equal(t, VoiceMailCall, result["disposition"])
+	assert.Nil(t, result["answerTime"])
+}
+
+func TestIsValidFolder(t *testing.T) {
+	assert.True(t, IsValidFolder(InboxFolder))
+	assert.True(t, IsValidFolder(SavedFolder))
+	assert.True(t, IsValidFolder(ArchiveFolder))
+	assert.False(t, IsValidFolder("trash"))
+}
+
+func TestVoiceMailMessageBeforeCreate(t *testing.T) {
+	message := &VoiceMailMessage{}
+	assert.NoError(t, message.BeforeCreate())
+	assert.Equal(t, InboxFolder, message.Folder)
+	message.Folder = SavedFolder
+	assert.NoError(t, message.BeforeCreate())
+	assert.Equal(t, SavedFolder, message.Folder)
 }
 
 func TestAutoMigrate(t *testing.T) {
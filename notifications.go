@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/tuxychandru/pubsub"
+)
+
+// notificationChannel is name of Postgresql channel for notifications about voice messages
+const notificationChannel = "voice_messages"
+
+// notificationBus delivers new and changed voice messages to subscribers (SSE clients). Topic is id of user.
+// *pubsub.PubSub works inside of one process, postgresNotificationBus delivers messages to all instances of the app.
+type notificationBus interface {
+	Pub(msg interface{}, topics ...string)
+	Sub(topics ...string) chan interface{}
+	Unsub(ch chan interface{}, topics ...string)
+}
+
+// voiceMessageNotification is payload of Postgresql notification.
+// Only id of the message is sent because size of payload is limited (data is read from db on receiving).
+type voiceMessageNotification struct {
+	Event     string `json:"event"` // "message" or "update"
+	MessageID uint   `json:"messageId"`
+	UserID    uint   `json:"userId"`
+}
+
+func encodeVoiceMessageNotification(msg interface{}) (string, error) {
+	var notification *voiceMessageNotification
+	switch message := msg.(type) {
+	case *VoiceMailMessage:
+		notification = &voiceMessageNotification{"message", message.ID, message.UserID}
+	case *voiceMailMessageUpdate:
+		notification = &voiceMessageNotification{"update", message.ID, message.UserID}
+	default:
+		return "", errors.New("Unsupported type of notification")
+	}
+	data, err := json.Marshal(notification)
+	return string(data), err
+}
+
+func decodeVoiceMessageNotification(payload string) (*voiceMessageNotification, error) {
+	notification := &voiceMessageNotification{}
+	if err := json.Unmarshal([]byte(payload), notification); err != nil {
+		return nil, err
+	}
+	if notification.Event != "message" && notification.Event != "update" {
+		return nil, errors.New("Unknown notification event " + notification.Event)
+	}
+	return notification, nil
+}
+
+// postgresNotificationBus sends messages via Postgresql NOTIFY. Each instance listens the channel and passes received
+// messages to local subscribers (including messages published by this instance).
+type postgresNotificationBus struct {
+	db       *gorm.DB
+	listener *pq.Listener
+	local    *pubsub.PubSub
+}
+
+// newPostgresNotificationBus starts listening of notifications using a separate connection to db
+func newPostgresNotificationBus(connectionString string, db *gorm.DB) (*postgresNotificationBus, error) {
+	listener := pq.NewListener(connectionString, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			debugf("Error of notifications listener: %s\n", err.Error())
+		}
+	})
+	if err := listener.Listen(notificationChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	bus := &postgresNotificationBus{db: db, listener: listener, local: pubsub.New(1)}
+	go bus.listen()
+	return bus, nil
+}
+
+func (b *postgresNotificationBus) listen() {
+	for notification := range b.listener.NotificationChannel() {
+		if notification == nil {
+			// connection has been restored, notifications sent while it was lost are missed
+			continue
+		}
+		b.dispatch(notification.Extra)
+	}
+}
+
+// dispatch passes received notification to local subscribers
+func (b *postgresNotificationBus) dispatch(payload string) {
+	notification, err := decodeVoiceMessageNotification(payload)
+	if err != nil {
+		debugf("Invalid notification %q: %s\n", payload, err.Error())
+		return
+	}
+	message := &VoiceMailMessage{}
+	if err = b.db.First(message, "id = ? AND user_id = ?", notification.MessageID, notification.UserID).Error; err != nil {
+		debugf("Error on getting voice message %d: %s\n", notification.MessageID, err.Error())
+		return
+	}
+	topic := strconv.FormatUint(uint64(notification.UserID), 10)
+	if notification.Event == "update" {
+		b.local.Pub(&voiceMailMessageUpdate{message}, topic)
+	} else {
+		b.local.Pub(message, topic)
+	}
+}
+
+// Pub sends notification to all instances. Topics are ignored (user id of the message is used instead).
+func (b *postgresNotificationBus) Pub(msg interface{}, topics ...string) {
+	payload, err := encodeVoiceMessageNotification(msg)
+	if err != nil {
+		debugf("Error on encoding notification: %s\n", err.Error())
+		return
+	}
+	if err = b.db.Exec("SELECT pg_notify(?, ?)", notificationChannel, payload).Error; err != nil {
+		debugf("Error on sending notification: %s\n", err.Error())
+	}
+}
+
+// Sub subscribes to messages of given users
+func (b *postgresNotificationBus) Sub(topics ...string) chan interface{} {
+	return b.local.Sub(topics...)
+}
+
+// Unsub cancels subscription
+func (b *postgresNotificationBus) Unsub(ch chan interface{}, topics ...string) {
+	b.local.Unsub(ch, topics...)
+}
+
+// Close stops listening of notifications
+func (b *postgresNotificationBus) Close() error {
+	b.local.Shutdown()
+	return b.listener.Close()
+}
+
+// deferredNotificationBus keeps messages published inside of a transaction until Flush is called after commit.
+// Subscribers of other instances read messages from db (uncommitted ones are not found yet) and messages of rolled
+// back transactions must not be announced at all.
+type deferredNotificationBus struct {
+	notificationBus
+	messages []deferredNotification
+}
+
+type deferredNotification struct {
+	msg    interface{}
+	topics []string
+}
+
+func newDeferredNotificationBus(bus notificationBus) *deferredNotificationBus {
+	return &deferredNotificationBus{notificationBus: bus}
+}
+
+// Pub queues the message until Flush
+func (b *deferredNotificationBus) Pub(msg interface{}, topics ...string) {
+	b.messages = append(b.messages, deferredNotification{msg, topics})
+}
+
+// Flush sends queued messages (call it after the transaction has been committed)
+func (b *deferredNotificationBus) Flush() {
+	for _, notification := range b.messages {
+		b.notificationBus.Pub(notification.msg, notification.topics...)
+	}
+	b.messages = nil
+}
+
+// newNotificationBus creates notification bus selected by NOTIFICATION_BUS ("postgres" by default or "memory" for single instance)
+func newNotificationBus(connectionString string, db *gorm.DB) (notificationBus, error) {
+	switch os.Getenv("NOTIFICATION_BUS") {
+	case "memory":
+		return pubsub.New(1), nil
+	case "", "postgres":
+		return newPostgresNotificationBus(connectionString, db)
+	default:
+		return nil, errors.New("Unknown NOTIFICATION_BUS " + os.Getenv("NOTIFICATION_BUS") + " (use postgres or memory)")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tuxychandru/pubsub"
+)
+
+func TestEncodeVoiceMessageNotification(t *testing.T) {
+	message := &VoiceMailMessage{UserID: 2, Transcription: "Hello"}
+	message.ID = 10
+	payload, err := encodeVoiceMessageNotification(message)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"event":"message","messageId":10,"userId":2}`, payload)
+	notification, err := decodeVoiceMessageNotification(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, &voiceMessageNotification{"message", 10, 2}, notification)
+	payload, err = encodeVoiceMessageNotification(&voiceMailMessageUpdate{message})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"event":"update","messageId":10,"userId":2}`, payload)
+	_, err = encodeVoiceMessageNotification("message")
+	assert.Error(t, err)
+}
+
+func TestDecodeVoiceMessageNotificationFail(t *testing.T) {
+	_, err := decodeVoiceMessageNotification("{")
+	assert.Error(t, err)
+	_, err = decodeVoiceMessageNotification(`{"event":"unknown","messageId":10,"userId":2}`)
+	assert.EqualError(t, err, "Unknown notification event unknown")
+}
+
+func TestNewNotificationBus(t *testing.T) {
+	os.Setenv("NOTIFICATION_BUS", "memory")
+	defer os.Unsetenv("NOTIFICATION_BUS")
+	bus, err := newNotificationBus("", nil)
+	assert.NoError(t, err)
+	assert.IsType(t, &pubsub.PubSub{}, bus)
+	os.Setenv("NOTIFICATION_BUS", "unknown")
+	_, err = newNotificationBus("", nil)
+	assert.Error(t, err)
+}
+
+func TestPostgresNotificationBus(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	// two instances of the app
+	bus1, err := newPostgresNotificationBus(getTestConnectionString(), db)
+	require.NoError(t, err)
+	defer bus1.Close()
+	bus2, err := newPostgresNotificationBus(getTestConnectionString(), db)
+	require.NoError(t, err)
+	defer bus2.Close()
+	message := &VoiceMailMessage{UserID: 2, From: "+1234567890", StartTime: time.Now(), EndTime: time.Now()}
+	require.NoError(t, db.Create(message).Error)
+	channel := bus2.Sub("2")
+	defer bus2.Unsub(channel, "2")
+	otherChannel := bus2.Sub("3")
+	defer bus2.Unsub(otherChannel, "3")
+	bus1.Pub(message, "2")
+	bus1.Pub(&voiceMailMessageUpdate{message}, "2")
+	receive := func() interface{} {
+		select {
+		case msg := <-channel:
+			return msg
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+	received, ok := receive().(*VoiceMailMessage)
+	require.True(t, ok)
+	assert.Equal(t, message.ID, received.ID)
+	assert.Equal(t, "+1234567890", received.From)
+	updated, ok := receive().(*voiceMailMessageUpdate)
+	require.True(t, ok)
+	assert.Equal(t, message.ID, updated.ID)
+	select {
+	case <-otherChannel:
+		assert.Fail(t, "Message of other user has been received")
+	default:
+	}
+}
+
+func TestDeferredNotificationBus(t *testing.T) {
+	local := pubsub.New(1)
+	defer local.Shutdown()
+	channel := local.Sub("2")
+	defer local.Unsub(channel, "2")
+	bus := newDeferredNotificationBus(local)
+	message := &VoiceMailMessage{UserID: 2}
+	bus.Pub(message, "2")
+	select {
+	case <-channel:
+		assert.Fail(t, "Message has been sent before Flush")
+	case <-time.After(10 * time.Millisecond):
+	}
+	bus.Flush()
+	select {
+	case msg := <-channel:
+		assert.Equal(t, message, msg)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Message has not been sent")
+	}
+	bus.Flush()
+	select {
+	case <-channel:
+		assert.Fail(t, "Message has been sent twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestPostgresNotificationBusWithTransaction(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	bus1, err := newPostgresNotificationBus(getTestConnectionString(), db)
+	require.NoError(t, err)
+	defer bus1.Close()
+	bus2, err := newPostgresNotificationBus(getTestConnectionString(), db)
+	require.NoError(t, err)
+	defer bus2.Close()
+	channel := bus2.Sub("2")
+	defer bus2.Unsub(channel, "2")
+	receive := func() interface{} {
+		select {
+		case msg := <-channel:
+			return msg
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	// rolled back message is not announced
+	events := newDeferredNotificationBus(bus1)
+	tx := db.Begin()
+	require.NoError(t, tx.Create(&VoiceMailMessage{UserID: 2, From: "+1234567890", StartTime: time.Now(), EndTime: time.Now()}).Error)
+	events.Pub(&VoiceMailMessage{UserID: 2}, "2")
+	tx.Rollback()
+	assert.Nil(t, receive())
+	// committed message is found by receivers
+	events = newDeferredNotificationBus(bus1)
+	tx = db.Begin()
+	message := &VoiceMailMessage{UserID: 2, From: "+1234567890", StartTime: time.Now(), EndTime: time.Now()}
+	require.NoError(t, tx.Create(message).Error)
+	events.Pub(message, "2")
+	require.NoError(t, tx.Commit().Error)
+	events.Flush()
+	received, ok := receive().(*VoiceMailMessage)
+	require.True(t, ok)
+	assert.Equal(t, message.ID, received.ID)
+}
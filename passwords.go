@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/jinzhu/gorm"
+)
+
+// channels of delivery of password reset codes
+const (
+	PasswordResetBySMS   = "sms"
+	PasswordResetByEmail = "email"
+)
+
+const (
+	passwordResetCodeLength   = 6
+	passwordResetCodeLifetime = 15 * time.Minute
+	passwordResetCodeInterval = time.Minute // minimal interval between codes of the same user
+	maxPasswordResetAttempts  = 5           // failed attempts for each code
+	passwordResetHistory      = 24 * time.Hour
+)
+
+// passwordResetLimits limit codes and failed attempts of each user over longer periods (new code doesn't reset them).
+// Codes are kept for passwordResetHistory to apply the limits.
+var passwordResetLimits = []struct {
+	period   time.Duration
+	codes    int
+	failures int
+}{
+	{time.Hour, 3, 10},
+	{24 * time.Hour, 10, 20},
+}
+
+var errInvalidPasswordResetCode = errors.New("Invalid or expired code")
+
+// PasswordResetCode model is a one-time code which allows to set new password without knowing the old one.
+// Only hash of the code is stored.
+type PasswordResetCode struct {
+	gorm.Model
+	UserID        uint       `gorm:"column:user_id;index"`
+	Channel       string     `gorm:"type:varchar(16)"`
+	CodeHash      []byte     `gorm:"column:code_hash"`
+	PepperVersion int        `gorm:"column:pepper_version;not null;default:0"`
+	RequestedAt   time.Time  `gorm:"column:requested_at;index"`
+	ExpiresAt     time.Time  `gorm:"column:expires_at"`
+	UsedAt        *time.Time `gorm:"column:used_at"`
+	Attempts      int        // failed attempts of confirmation
+}
+
+// getPasswordResetChannel returns channel which should be used to deliver code to the user (preferred one if it is
+// available). It returns empty string if the user has no notification number and email.
+func getPasswordResetChannel(user *User, preferred string) string {
+	available := map[string]bool{
+		PasswordResetBySMS:   user.NotificationNumber != "" && user.PhoneNumber != "",
+		PasswordResetByEmail: user.Email != "",
+	}
+	if available[preferred] {
+		return preferred
+	}
+	for _, channel := range []string{PasswordResetBySMS, PasswordResetByEmail} {
+		if available[channel] {
+			return channel
+		}
+	}
+	return ""
+}
+
+func generatePasswordResetCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < passwordResetCodeLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", passwordResetCodeLength, n), nil
+}
+
+// checkPasswordResetLimits checks if the user has requested too many codes or has made too many failed attempts
+// recently
+func checkPasswordResetLimits(user *User, now time.Time, db *gorm.DB) (codesExceeded bool, failuresExceeded bool, err error) {
+	for _, limit := range passwordResetLimits {
+		var codes, failures int
+		err = db.Model(&PasswordResetCode{}).Where("user_id = ? AND requested_at > ?", user.ID, now.Add(-limit.period)).
+			Select("COUNT(*), COALESCE(SUM(attempts), 0)").Row().Scan(&codes, &failures)
+		if err != nil {
+			return false, false, err
+		}
+		codesExceeded = codesExceeded || codes >= limit.codes
+		failuresExceeded = failuresExceeded || failures >= limit.failures
+	}
+	return codesExceeded, failuresExceeded, nil
+}
+
+// createPasswordResetCode replaces previous codes of the user by new one. It returns empty code if previous code
+// has been created less than passwordResetCodeInterval ago or the user has requested too many codes recently.
+func createPasswordResetCode(user *User, channel string, now time.Time, db *gorm.DB) (string, error) {
+	last := &PasswordResetCode{}
+	if !db.Order("requested_at DESC").First(last, "user_id = ?", user.ID).RecordNotFound() &&
+		last.RequestedAt.After(now.Add(-passwordResetCodeInterval)) {
+		return "", nil
+	}
+	codesExceeded, _, err := checkPasswordResetLimits(user, now, db)
+	if err != nil {
+		return "", err
+	}
+	if codesExceeded {
+		return "", nil
+	}
+	code, err := generatePasswordResetCode()
+	if err != nil {
+		return "", err
+	}
+	resetCode := &PasswordResetCode{
+		UserID:      user.ID,
+		Channel:     channel,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(passwordResetCodeLifetime),
+	}
+	if resetCode.CodeHash, resetCode.PepperVersion, err = hashSecret(code); err != nil {
+		return "", err
+	}
+	tx := db.Begin()
+	// only the last code is valid, previous ones are kept for the limits
+	err = tx.Unscoped().Where("user_id = ? AND requested_at <= ?", user.ID, now.Add(-passwordResetHistory)).
+		Delete(&PasswordResetCode{}).Error
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if err = tx.Create(resetCode).Error; err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return code, tx.Commit().Error
+}
+
+// sendPasswordResetCode delivers the code by SMS (from user's number to notification number) or by email
+func sendPasswordResetCode(user *User, channel string, code string, api catapultAPIInterface, emailSender emailSenderInterface) error {
+	text := fmt.Sprintf("Your password reset code is %s. It expires in %d minutes.", code,
+		int(passwordResetCodeLifetime/time.Minute))
+	switch channel {
+	case PasswordResetBySMS:
+		_, err := api.CreateMessage(&bandwidth.CreateMessageData{
+			From: user.PhoneNumber,
+			To:   user.NotificationNumber,
+			Text: text,
+		})
+		return err
+	case PasswordResetByEmail:
+		if emailSender == nil {
+			return errors.New("Email delivery is not configured")
+		}
+		return emailSender.Send(user.Email, "Password reset", text, nil)
+	default:
+		return fmt.Errorf("Unknown channel %s", channel)
+	}
+}
+
+// resetPassword sets new password if the last code of the user is valid. The code can be used once, too many failed
+// attempts invalidate it (and all codes of the user for some time). All sessions of the user are closed.
+func resetPassword(user *User, code string, password string, now time.Time, db *gorm.DB) error {
+	resetCode := &PasswordResetCode{}
+	if db.Order("requested_at DESC").First(resetCode, "user_id = ?", user.ID).RecordNotFound() {
+		return errInvalidPasswordResetCode
+	}
+	if resetCode.UsedAt != nil || !now.Before(resetCode.ExpiresAt) || resetCode.Attempts >= maxPasswordResetAttempts {
+		return errInvalidPasswordResetCode
+	}
+	_, failuresExceeded, err := checkPasswordResetLimits(user, now, db)
+	if err != nil {
+		return err
+	}
+	if failuresExceeded {
+		return errInvalidPasswordResetCode
+	}
+	if !compareSecret(resetCode.CodeHash, resetCode.PepperVersion, code) {
+		if err := db.Model(resetCode).Update("attempts", gorm.Expr("attempts + 1")).Error; err != nil {
+			return err
+		}
+		return errInvalidPasswordResetCode
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	tx := db.Begin()
+	// the condition protects from concurrent usage of the same code
+	result := tx.Model(resetCode).Where("used_at IS NULL").Update("used_at", now)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return errInvalidPasswordResetCode
+	}
+	if err := updatePassword(user, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := closeSessions(user, 0, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// updatePassword saves password hash of the user and invalidates issued auth tokens
+func updatePassword(user *User, db *gorm.DB) error {
+	user.TokenVersion++
+	return db.Model(user).Updates(map[string]interface{}{
+		"password_hash":  user.PasswordHash,
+		"pepper_version": user.PepperVersion,
+		"token_version":  user.TokenVersion,
+	}).Error
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratePasswordResetCode(t *testing.T) {
+	code, err := generatePasswordResetCode()
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^\d{6}$`), code)
+}
+
+func TestGetPasswordResetChannel(t *testing.T) {
+	user := &User{PhoneNumber: "+1234567890", NotificationNumber: "+1234567891", Email: "user@test.com"}
+	assert.Equal(t, PasswordResetBySMS, getPasswordResetChannel(user, ""))
+	assert.Equal(t, PasswordResetByEmail, getPasswordResetChannel(user, PasswordResetByEmail))
+	user.NotificationNumber = ""
+	assert.Equal(t, PasswordResetByEmail, getPasswordResetChannel(user, PasswordResetBySMS))
+	user.Email = ""
+	assert.Equal(t, "", getPasswordResetChannel(user, ""))
+}
+
+func TestSendPasswordResetCodeBySMS(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	user := &User{PhoneNumber: "+1234567890", NotificationNumber: "+1234567891"}
+	api.On("CreateMessage", &bandwidth.CreateMessageData{
+		From: "+1234567890",
+		To:   "+1234567891",
+		Text: "Your password reset code is 123456. It expires in 15 minutes.",
+	}).Return("id", nil)
+	assert.NoError(t, sendPasswordResetCode(user, PasswordResetBySMS, "123456", api, nil))
+	api.AssertExpectations(t)
+}
+
+func TestSendPasswordResetCodeByEmail(t *testing.T) {
+	sender := &fakeEmailSender{}
+	user := &User{Email: "user@test.com"}
+	sender.On("Send", "user@test.com", "Password reset", "Your password reset code is 123456. It expires in 15 minutes.",
+		(*emailAttachment)(nil)).Return(nil)
+	assert.NoError(t, sendPasswordResetCode(user, PasswordResetByEmail, "123456", nil, sender))
+	sender.AssertExpectations(t)
+	assert.Error(t, sendPasswordResetCode(user, PasswordResetByEmail, "123456", nil, nil))
+}
+
+func TestSendPasswordResetCodeFail(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	user := &User{PhoneNumber: "+1234567890", NotificationNumber: "+1234567891"}
+	api.On("CreateMessage", &bandwidth.CreateMessageData{
+		From: "+1234567890",
+		To:   "+1234567891",
+		Text: "Your password reset code is 123456. It expires in 15 minutes.",
+	}).Return("", errors.New("error"))
+	assert.Error(t, sendPasswordResetCode(user, PasswordResetBySMS, "123456", api, nil))
+}
+
+func TestResetPassword(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	user.SetPassword("123456")
+	require.NoError(t, db.Create(user).Error)
+	code, err := createPasswordResetCode(user, PasswordResetBySMS, now, db)
+	require.NoError(t, err)
+	require.NotEqual(t, "", code)
+	// the next code can be requested a bit later only
+	next, err := createPasswordResetCode(user, PasswordResetBySMS, now, db)
+	require.NoError(t, err)
+	assert.Equal(t, "", next)
+	assert.Equal(t, errInvalidPasswordResetCode, resetPassword(user, "wrong", "1234567", now, db))
+	require.NoError(t, resetPassword(user, code, "1234567", now, db))
+	require.NoError(t, db.First(user, user.ID).Error)
+	assert.True(t, user.ComparePasswords("1234567"))
+	assert.Equal(t, 1, user.TokenVersion)
+	// the code can be used once
+	assert.Equal(t, errInvalidPasswordResetCode, resetPassword(user, code, "7654321", now, db))
+}
+
+func TestResetPasswordWithExpiredCode(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	code, err := createPasswordResetCode(user, PasswordResetBySMS, now, db)
+	require.NoError(t, err)
+	assert.Equal(t, errInvalidPasswordResetCode, resetPassword(user, code, "1234567", now.Add(passwordResetCodeLifetime), db))
+}
+
+func TestResetPasswordWithTooManyAttempts(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	code, err := createPasswordResetCode(user, PasswordResetBySMS, now, db)
+	require.NoError(t, err)
+	wrongCode := strings.Repeat("0", passwordResetCodeLength)
+	if code == wrongCode {
+		wrongCode = strings.Repeat("1", passwordResetCodeLength)
+	}
+	for i := 0; i < maxPasswordResetAttempts; i++ {
+		assert.Equal(t, errInvalidPasswordResetCode, resetPassword(user, wrongCode, "1234567", now, db))
+	}
+	assert.Equal(t, errInvalidPasswordResetCode, resetPassword(user, code, "1234567", now, db))
+	// new code replaces the blocked one
+	code, err = createPasswordResetCode(user, PasswordResetBySMS, now.Add(passwordResetCodeInterval), db)
+	require.NoError(t, err)
+	assert.NoError(t, resetPassword(user, code, "1234567", now.Add(passwordResetCodeInterval), db))
+}
+
+func TestResetPasswordFailuresAreLimitedAcrossCodes(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	for i := 0; i < 2; i++ {
+		now = now.Add(passwordResetCodeInterval)
+		code, err := createPasswordResetCode(user, PasswordResetBySMS, now, db)
+		require.NoError(t, err)
+		require.NotEqual(t, "", code)
+		wrongCode := strings.Repeat("0", passwordResetCodeLength)
+		if code == wrongCode {
+			wrongCode = strings.Repeat("1", passwordResetCodeLength)
+		}
+		for j := 0; j < maxPasswordResetAttempts; j++ {
+			assert.Equal(t, errInvalidPasswordResetCode, resetPassword(user, wrongCode, "1234567", now, db))
+		}
+	}
+	// a fresh code doesn't reset the failure budget
+	now = now.Add(passwordResetCodeInterval)
+	code, err := createPasswordResetCode(user, PasswordResetBySMS, now, db)
+	require.NoError(t, err)
+	require.NotEqual(t, "", code)
+	assert.Equal(t, errInvalidPasswordResetCode, resetPassword(user, code, "1234567", now, db))
+	// the budget is restored later
+	now = now.Add(time.Hour)
+	code, err = createPasswordResetCode(user, PasswordResetBySMS, now, db)
+	require.NoError(t, err)
+	require.NotEqual(t, "", code)
+	assert.NoError(t, resetPassword(user, code, "1234567", now, db))
+}
+
+func TestCreatePasswordResetCodeIsLimited(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	for i := 0; i < 3; i++ {
+		now = now.Add(passwordResetCodeInterval)
+		code, err := createPasswordResetCode(user, PasswordResetBySMS, now, db)
+		require.NoError(t, err)
+		assert.NotEqual(t, "", code)
+	}
+	now = now.Add(passwordResetCodeInterval)
+	code, err := createPasswordResetCode(user, PasswordResetBySMS, now, db)
+	require.NoError(t, err)
+	assert.Equal(t, "", code)
+	code, err = createPasswordResetCode(user, PasswordResetBySMS, now.Add(time.Hour), db)
+	require.NoError(t, err)
+	assert.NotEqual(t, "", code)
+}
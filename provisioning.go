@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// error codes of Catapult for missing resources (like "not-found" or "domain-endpoint-not-found")
+var notFoundCodeRegexp = regexp.MustCompile(`^([a-z]+-)*not-found$`)
+
+// keys of provisioned Catapult resources
+const domainKey = "domain"
+
+func applicationKey(host string) string {
+	return "application:" + host
+}
+
+// ProvisionedResource model keeps id of Catapult resource created by the app (application for each host or SIP domain)
+type ProvisionedResource struct {
+	Key        string `gorm:"column:resource_key;type:varchar(256);primary_key"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	ResourceID string `gorm:"type:varchar(64);not null"`
+	Name       string `gorm:"type:varchar(256)"`
+}
+
+// provisioningCache keeps ids of Catapult resources in memory and in database (so they are shared between instances
+// and survive restarts). It is safe for concurrent use. Memory only cache is used if db is nil.
+type provisioningCache struct {
+	db       *gorm.DB
+	lock     sync.Mutex
+	items    map[string]ProvisionedResource
+	keyLocks map[string]*sync.Mutex
+}
+
+func newProvisioningCache(db *gorm.DB) *provisioningCache {
+	return &provisioningCache{
+		db:       db,
+		items:    map[string]ProvisionedResource{},
+		keyLocks: map[string]*sync.Mutex{},
+	}
+}
+
+func (c *provisioningCache) get(key string) (ProvisionedResource, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	item, ok := c.items[key]
+	return item, ok
+}
+
+// set stores resource in memory only
+func (c *provisioningCache) set(key string, id string, name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.items[key] = ProvisionedResource{Key: key, ResourceID: id, Name: name}
+}
+
+// keyLock returns mutex which serializes provisioning of resource with given key
+func (c *provisioningCache) keyLock(key string) *sync.Mutex {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	lock := c.keyLocks[key]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		c.keyLocks[key] = lock
+	}
+	return lock
+}
+
+// resolve returns id and name of cached resource. Missing resource is looked up or created by provision
+// (only one provision for the key runs at the same time). Errors are not cached.
+func (c *provisioningCache) resolve(key string, provision func() (string, string, error)) (string, string, error) {
+	if item, ok := c.get(key); ok {
+		return item.ResourceID, item.Name, nil
+	}
+	lock := c.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if item, ok := c.get(key); ok {
+		return item.ResourceID, item.Name, nil
+	}
+	if c.db != nil {
+		item := &ProvisionedResource{}
+		if err := c.db.First(item, "resource_key = ?", key).Error; err == nil {
+			c.set(key, item.ResourceID, item.Name)
+			return item.ResourceID, item.Name, nil
+		}
+	}
+	id, name, err := provision()
+	if err != nil {
+		return "", "", err
+	}
+	if c.db != nil {
+		item := &ProvisionedResource{Key: key, ResourceID: id, Name: name}
+		if err = c.db.Create(item).Error; err != nil {
+			// another instance has stored the resource already
+			existing := &ProvisionedResource{}
+			if c.db.First(existing, "resource_key = ?", key).Error == nil {
+				id, name = existing.ResourceID, existing.Name
+			} else {
+				debugf("Error on saving provisioned resource %s: %s\n", key, err.Error())
+			}
+		}
+	}
+	c.set(key, id, name)
+	return id, name, nil
+}
+
+// invalidate removes resource from the cache (it is called when Catapult reports that the resource is gone)
+func (c *provisioningCache) invalidate(key string) {
+	debugf("Removing provisioned resource %s from cache\n", key)
+	c.lock.Lock()
+	delete(c.items, key)
+	c.lock.Unlock()
+	if c.db != nil {
+		if err := c.db.Delete(&ProvisionedResource{}, "resource_key = ?", key).Error; err != nil {
+			debugf("Error on removing provisioned resource %s: %s\n", key, err.Error())
+		}
+	}
+}
+
+// isNotFoundError checks if Catapult has reported that requested resource doesn't exist. Status code is known only
+// if the response has no error message, otherwise error code of Catapult (like "application-not-found") is checked.
+func isNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if code := getCatapultStatusCode(err); code != 0 {
+		return code == http.StatusNotFound
+	}
+	return notFoundCodeRegexp.MatchString(err.Error())
+}
+
+// isTargetNotFoundError checks if Catapult has reported that the target resource of the request doesn't exist
+// (status 404 or one of given error codes). Missing parent resources (like "domain-not-found") are not reported.
+func isTargetNotFoundError(err error, codes ...string) bool {
+	if err == nil {
+		return false
+	}
+	if code := getCatapultStatusCode(err); code != 0 {
+		return code == http.StatusNotFound
+	}
+	for _, code := range codes {
+		if err.Error() == code {
+			return true
+		}
+	}
+	return false
+}
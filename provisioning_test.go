@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvisioningCacheResolve(t *testing.T) {
+	cache := newProvisioningCache(nil)
+	calls := 0
+	provision := func() (string, string, error) {
+		calls++
+		if calls == 1 {
+			return "", "", errors.New("error")
+		}
+		return "123", "name", nil
+	}
+	_, _, err := cache.resolve("key", provision)
+	assert.EqualError(t, err, "error")
+	for i := 0; i < 2; i++ {
+		id, name, err := cache.resolve("key", provision)
+		assert.NoError(t, err)
+		assert.Equal(t, "123", id)
+		assert.Equal(t, "name", name)
+	}
+	assert.Equal(t, 2, calls)
+	cache.invalidate("key")
+	cache.resolve("key", provision)
+	assert.Equal(t, 3, calls)
+}
+
+func TestProvisioningCacheResolveConcurrently(t *testing.T) {
+	cache := newProvisioningCache(nil)
+	var calls int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := applicationKey("localhost")
+			if i%2 == 0 {
+				key = domainKey
+			}
+			id, _, err := cache.resolve(key, func() (string, string, error) {
+				atomic.AddInt32(&calls, 1)
+				return key + "ID", "", nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, key+"ID", id)
+			if i%10 == 0 {
+				cache.invalidate(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// each key is provisioned once plus once after each invalidation at most
+	assert.True(t, atomic.LoadInt32(&calls) >= 2)
+	assert.True(t, atomic.LoadInt32(&calls) <= 7)
+}
+
+func TestProvisioningCachePersisted(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	cache1 := newProvisioningCache(db)
+	id, name, err := cache1.resolve(domainKey, func() (string, string, error) {
+		return "123", "domain", nil
+	})
+	assert.NoError(t, err)
+	// another instance of the app
+	cache2 := newProvisioningCache(db)
+	id, name, err = cache2.resolve(domainKey, func() (string, string, error) {
+		return "", "", errors.New("Domain should be read from db")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "123", id)
+	assert.Equal(t, "domain", name)
+	cache2.invalidate(domainKey)
+	count := 0
+	db.Model(&ProvisionedResource{}).Count(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestIsNotFoundError(t *testing.T) {
+	// status code
+	assert.True(t, isNotFoundError(errors.New("Http code 404")))
+	assert.True(t, isNotFoundError(errors.New("Http code 404: {}")))
+	assert.False(t, isNotFoundError(errors.New("Http code 500")))
+	assert.False(t, isNotFoundError(errors.New("Http code 400: resource not found")))
+	// error code of Catapult
+	assert.True(t, isNotFoundError(errors.New("application-not-found")))
+	assert.True(t, isNotFoundError(errors.New("not-found")))
+	assert.False(t, isNotFoundError(errors.New("invalid-application-id")))
+	// messages are not checked
+	assert.False(t, isNotFoundError(errors.New("The domain 'rd-123' could not be found")))
+	assert.False(t, isNotFoundError(errors.New("Media file not found")))
+	assert.False(t, isNotFoundError(nil))
+}
+
+func TestIsTargetNotFoundError(t *testing.T) {
+	assert.True(t, isTargetNotFoundError(errors.New("Http code 404"), "endpoint-not-found"))
+	assert.False(t, isTargetNotFoundError(errors.New("Http code 500"), "endpoint-not-found"))
+	assert.True(t, isTargetNotFoundError(errors.New("endpoint-not-found"), "endpoint-not-found"))
+	// missing parent resource
+	assert.False(t, isTargetNotFoundError(errors.New("domain-not-found"), "endpoint-not-found"))
+	assert.False(t, isTargetNotFoundError(errors.New("application-not-found"), "endpoint-not-found"))
+	assert.False(t, isTargetNotFoundError(errors.New("Endpoint not found"), "endpoint-not-found"))
+	assert.False(t, isTargetNotFoundError(nil, "endpoint-not-found"))
+}
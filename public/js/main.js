@@ -127,6 +127,53 @@
 		});
 	});
 
+	var greetingUpload = document.getElementById('greetingUpload');
+	greetingUpload.addEventListener('submit', function(e){
+		e.preventDefault();
+		var fields = greetingUpload.elements;
+		if (!fields['file'].files.length) {
+			return;
+		}
+		var data = new FormData();
+		data.append('file', fields['file'].files[0]);
+		fetch('/greetings/' + fields['greetingType'].value + '/media', {
+			method: 'POST',
+			headers: {
+				'Authorization': 'Bearer ' + authData.token
+			},
+			body: data
+		})
+		.then(checkResponse)
+		.then(function(){
+			greetingUpload.reset();
+		}, function(err){
+			setError(document, err);
+		});
+	});
+
+	greetingUpload.getElementsByClassName('preview-greeting')[0].addEventListener('click', function(e){
+		e.preventDefault();
+		fetch('/greetings/' + greetingUpload.elements['greetingType'].value + '/media', {
+			headers: {
+				'Authorization': 'Bearer ' + authData.token
+			}
+		})
+		.then(function(r){
+			if (r.ok) {
+				return r.blob();
+			}
+			throw new Error('Default greeting is used');
+		})
+		.then(function(blob){
+			var player = greetingUpload.getElementsByClassName('greeting-player')[0];
+			player.src = URL.createObjectURL(blob);
+			player.show();
+			player.play();
+		}, function(err){
+			setError(document, err);
+		});
+	});
+
 	function makeCall(){
 		var number = toField.value;
 		if (!number) {
@@ -144,6 +191,11 @@
 		var startTime = new Date(msg.startTime);
 		item.innerHTML = '<a href="#">' + msg.from + ' - ' + startTime.toLocaleString('en') +' (' + (new Date(msg.endTime) - new Date(msg.startTime))/1000 + 's)</a>' +
 			'<a href="#" class="remove"><span class="fa fa-trash"></span></a>';
+		item.id = 'voiceMessage' + msg.id;
+		item.title = msg.transcription || '';
+		if (!msg.listened) {
+			item.className = 'unread';
+		}
 		var remove = item.getElementsByClassName('remove')[0];
 		remove.addEventListener('click', function(e){
 			e.preventDefault();
@@ -168,6 +220,7 @@
 		item.getElementsByTagName('a')[0].addEventListener('click', function(e){
 			e.preventDefault();
 			downloadVoiceMessage(msg);
+			item.className = '';
 		});
 		return item;
 	}
@@ -203,7 +256,16 @@
 		voiceMailMessages.show();
 	});
 
-	logOut.addEventListener('click', makeLogOut);
+	logOut.addEventListener('click', function(){
+		// close the session on server side, local data are removed anyway
+		fetch('/logout', {
+			method: 'POST',
+			headers: {
+				'Authorization': 'Bearer ' + authData.token
+			}
+		})
+		.then(makeLogOut, makeLogOut);
+	});
 
 	toField.addEventListener('keypress', function(e){
 		if(e.which === 13){//enter
@@ -358,8 +420,37 @@
 		if (!window.EventSource) { // if SSE supported
 			return;
 		}
-		// show new voice messages in real time (without reloading of page)
-		var source = new window.EventSource('/voiceMessagesStream?token=' + authData.token);
+		openVoiceMessagesStream();
+	}
+
+	function createStreamTicket() {
+		return fetch('/streamTickets', {
+			method: 'POST',
+			headers: {
+				'Accept': 'application/json',
+				'Authorization': 'Bearer ' + authData.token
+			}
+		})
+		.then(checkResponse);
+	}
+
+	// show new voice messages in real time (without reloading of page)
+	function openVoiceMessagesStream() {
+		// a ticket can be used once, so each connection needs new one (auth token is not passed in the url)
+		createStreamTicket().then(function(result){
+			var source = new window.EventSource('/voiceMessagesStream?ticket=' + encodeURIComponent(result.ticket));
+			source.addEventListener('error', function(){
+				// browser reconnects with the same (used) ticket, so the stream is reopened with a new one
+				source.close();
+				setTimeout(openVoiceMessagesStream, 5000);
+			});
+			listenVoiceMessagesStream(source);
+		}, function(err){
+			console.error(err);
+		});
+	}
+
+	function listenVoiceMessagesStream(source) {
 		source.addEventListener('message', function(e){
 			var msg = JSON.parse(e.data);
 			var item = addVoiceMailMessage(msg);
@@ -379,6 +470,14 @@
   				setTimeout(notification.close.bind(notification), 10000);
 			}
 		});
+		source.addEventListener('update', function(e){
+			// transcription of the message has been received
+			var msg = JSON.parse(e.data);
+			var item = document.getElementById('voiceMessage' + msg.id);
+			if (item) {
+				item.title = msg.transcription || '';
+			}
+		});
 	}
 
 	function downloadVoiceMessage(msg) {
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// registration states (steps of registration saga)
+const (
+	registrationStarted           = "started"
+	registrationNumberCreated     = "numberCreated"
+	registrationSIPAccountCreated = "sipAccountCreated"
+	registrationCompleted         = "completed"
+	registrationCompensating      = "compensating" // registration has failed, provisioned resources are being released
+	registrationFailed            = "failed"
+)
+
+// registrationTimeout is time after which unfinished registration is treated as interrupted
+const registrationTimeout = 10 * time.Minute
+
+// registrationRecoveryInterval is interval between runs of recoverRegistrations
+const registrationRecoveryInterval = 5 * time.Minute
+
+var errRegistrationInProgress = errors.New("Registration is processed by another instance")
+
+var errRegistrationInterrupted = errors.New("Registration has been interrupted")
+
+// Registration model tracks Catapult resources provisioned for a new user so they can be released if
+// registration fails or is interrupted
+type Registration struct {
+	gorm.Model
+	UserName             string `gorm:"type:varchar(64);not null;index"`
+	AreaCode             string `gorm:"type:char(3)"`
+	ResourceName         string `gorm:"type:varchar(32)"` // name of phone number and SIP user name
+	PasswordHash         []byte // it is removed when registration is finished
+	PepperVersion        int
+	State                string `gorm:"type:varchar(32);not null;index"`
+	PhoneNumber          string `gorm:"type:varchar(32)"`
+	EndpointID           string `gorm:"column:endpoint_id;type:varchar(64)"`
+	SIPURI               string `gorm:"column:sip_uri;type:varchar(1024)"`
+	SIPPassword          string `gorm:"-"` // it is stored encrypted
+	EncryptedSIPPassword string `gorm:"column:encrypted_sip_password;type:varchar(512)"`
+	LegacySIPPassword    string `gorm:"column:sip_password;type:varchar(128)"`
+	UserID               uint
+	LastError            string `gorm:"type:varchar(1024)"`
+}
+
+// BeforeSave encrypts SIP password
+func (r *Registration) BeforeSave() (err error) {
+	r.EncryptedSIPPassword, err = encryptSecret(r.SIPPassword)
+	r.LegacySIPPassword = ""
+	return
+}
+
+// AfterFind decrypts SIP password
+func (r *Registration) AfterFind() (err error) {
+	r.SIPPassword, err = readSecret(r.EncryptedSIPPassword, r.LegacySIPPassword)
+	return
+}
+
+// startRegistration stores registration of the user before provisioning of any resources
+func startRegistration(user *User, db *gorm.DB) (*Registration, error) {
+	registration := &Registration{
+		UserName:      user.UserName,
+		AreaCode:      user.AreaCode,
+		PasswordHash:  user.PasswordHash,
+		PepperVersion: user.PepperVersion,
+		ResourceName:  randomString(16),
+		State:         registrationStarted,
+	}
+	return registration, db.Create(registration).Error
+}
+
+// interruptRegistration keeps the registration in current state if result of Catapult request is unknown (it has timed
+// out), recoverRegistrations finds and releases resources of the registration when the request has surely finished.
+func interruptRegistration(registration *Registration, cause error, db *gorm.DB) {
+	registration.LastError = cause.Error()
+	if err := db.Save(registration).Error; err != nil {
+		debugf("Error on saving registration %d: %s\n", registration.ID, err.Error())
+	}
+}
+
+// findRegistrationResources records resources which could be created by interrupted request of the registration
+func findRegistrationResources(registration *Registration, api catapultAPIInterface, db *gorm.DB) error {
+	if registration.ResourceName == "" {
+		return nil
+	}
+	switch registration.State {
+	case registrationStarted:
+		number, err := api.FindPhoneNumber(registration.ResourceName)
+		if err != nil || number == "" {
+			return err
+		}
+		registration.PhoneNumber = number
+	case registrationNumberCreated:
+		endpointID, err := api.FindSIPAccount(registration.ResourceName)
+		if err != nil || endpointID == "" {
+			return err
+		}
+		registration.EndpointID = endpointID
+	default:
+		return nil
+	}
+	return db.Save(registration).Error
+}
+
+// setRegistrationState saves provisioned resources of the registration with new state
+func setRegistrationState(registration *Registration, state string, db *gorm.DB) error {
+	registration.State = state
+	return db.Save(registration).Error
+}
+
+// completeRegistration creates the user from provisioned resources. Registration is finished in the same transaction.
+func completeRegistration(registration *Registration, db *gorm.DB) (*User, error) {
+	user := &User{
+		UserName:      registration.UserName,
+		AreaCode:      registration.AreaCode,
+		PasswordHash:  registration.PasswordHash,
+		PepperVersion: registration.PepperVersion,
+		PhoneNumber:   registration.PhoneNumber,
+		EndpointID:    registration.EndpointID,
+		SIPURI:        registration.SIPURI,
+		SIPPassword:   registration.SIPPassword,
+	}
+	tx := db.Begin()
+	if err := tx.Create(user).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	completed := *registration
+	completed.State = registrationCompleted
+	completed.UserID = user.ID
+	completed.PasswordHash = nil
+	completed.SIPPassword = "" // it is stored by the user
+	if err := tx.Save(&completed).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	*registration = completed
+	return user, nil
+}
+
+// compensateRegistration releases resources provisioned for failed registration in reverse order.
+// Registration stays in compensating state if some resource can't be released now (it is repeated by recoverRegistrations).
+func compensateRegistration(registration *Registration, cause error, api catapultAPIInterface, db *gorm.DB) error {
+	registration.State = registrationCompensating
+	registration.LastError = cause.Error()
+	if err := db.Save(registration).Error; err != nil {
+		debugf("Error on saving registration %d: %s\n", registration.ID, err.Error())
+	}
+	if registration.EndpointID != "" {
+		debugf("Removing SIP account %s of failed registration\n", registration.EndpointID)
+		if err := api.DeleteSIPAccount(registration.EndpointID); err != nil {
+			return err
+		}
+		registration.EndpointID = ""
+		registration.SIPURI = ""
+		registration.SIPPassword = ""
+		db.Save(registration)
+	}
+	if registration.PhoneNumber != "" {
+		debugf("Releasing phone number %s of failed registration\n", registration.PhoneNumber)
+		if err := api.ReleasePhoneNumber(registration.PhoneNumber); err != nil {
+			return err
+		}
+		registration.PhoneNumber = ""
+	}
+	registration.PasswordHash = nil
+	return setRegistrationState(registration, registrationFailed, db)
+}
+
+// claimRegistration marks interrupted registration as processed by this instance
+func claimRegistration(registration *Registration, db *gorm.DB) error {
+	result := db.Model(registration).Where("state = ? AND updated_at = ?", registration.State, registration.UpdatedAt).
+		Update("updated_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errRegistrationInProgress
+	}
+	return nil
+}
+
+// recoverRegistrations finishes registrations interrupted by restart of the app or failed compensation. Registration
+// with provisioned SIP account is completed, resources of others are released.
+func recoverRegistrations(db *gorm.DB, api catapultAPIInterface, timerAPI timerInterface) error {
+	registrations := []Registration{}
+	err := db.Where("state NOT IN (?) AND updated_at < ?", []string{registrationCompleted, registrationFailed},
+		timerAPI.Now().Add(-registrationTimeout)).Find(&registrations).Error
+	if err != nil {
+		return err
+	}
+	for i := range registrations {
+		registration := &registrations[i]
+		if err = claimRegistration(registration, db); err != nil {
+			continue
+		}
+		debugf("Recovering registration of user %s (%s)\n", registration.UserName, registration.State)
+		err = errRegistrationInterrupted
+		if registration.State == registrationSIPAccountCreated {
+			if _, err = completeRegistration(registration, db); err == nil {
+				continue
+			}
+		}
+		if findErr := findRegistrationResources(registration, api, db); findErr != nil {
+			debugf("Error on finding resources of registration %d: %s\n", registration.ID, findErr.Error())
+			continue // it is repeated by next run
+		}
+		if err = compensateRegistration(registration, err, api, db); err != nil {
+			debugf("Error on releasing resources of registration %d: %s\n", registration.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+// handleRecoverRegistrationsJob runs recoverRegistrations and schedules its next run
+func handleRecoverRegistrationsJob(job *Job, ctx *jobContext) error {
+	if err := recoverRegistrations(ctx.db, ctx.api, ctx.timerAPI); err != nil {
+		debugf("Error on recovering registrations: %s\n", err.Error())
+	}
+	return ensureJob(ctx.db, recoverRegistrationsJob, ctx.timerAPI.Now().Add(registrationRecoveryInterval))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createInterruptedRegistration creates registration which has been stopped in given state long time ago
+func createInterruptedRegistration(t *testing.T, db *gorm.DB, userName string, state string) *Registration {
+	registration := &Registration{UserName: userName, AreaCode: "910", PasswordHash: []byte("hash"), State: state}
+	if state != registrationStarted {
+		registration.PhoneNumber = "+1234567890"
+	}
+	if state == registrationSIPAccountCreated || state == registrationCompensating {
+		registration.EndpointID = "endpointId"
+		registration.SIPURI = "test@test.net"
+		registration.SIPPassword = "12345678"
+	}
+	require.NoError(t, db.Create(registration).Error)
+	return registration
+}
+
+func getRegistration(t *testing.T, db *gorm.DB, id uint) *Registration {
+	registration := &Registration{}
+	require.NoError(t, db.First(registration, id).Error)
+	return registration
+}
+
+func TestRecoverRegistrations(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	started := createInterruptedRegistration(t, db, "user1", registrationStarted)
+	numberCreated := createInterruptedRegistration(t, db, "user2", registrationNumberCreated)
+	sipAccountCreated := createInterruptedRegistration(t, db, "user3", registrationSIPAccountCreated)
+	api := &fakeCatapultAPI{}
+	api.On("ReleasePhoneNumber", "+1234567890").Return(nil).Once()
+	recoverRegistrations(db, api, &fakeTimerAPI{CurrentTime: time.Now().Add(registrationTimeout + time.Minute)})
+	api.AssertExpectations(t)
+	registration := getRegistration(t, db, started.ID)
+	assert.Equal(t, registrationFailed, registration.State)
+	assert.Equal(t, errRegistrationInterrupted.Error(), registration.LastError)
+	registration = getRegistration(t, db, numberCreated.ID)
+	assert.Equal(t, registrationFailed, registration.State)
+	assert.Equal(t, "", registration.PhoneNumber)
+	assert.Empty(t, registration.PasswordHash)
+	registration = getRegistration(t, db, sipAccountCreated.ID)
+	assert.Equal(t, registrationCompleted, registration.State)
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user3").Error)
+	assert.Equal(t, user.ID, registration.UserID)
+	assert.Equal(t, "+1234567890", user.PhoneNumber)
+	assert.Equal(t, "endpointId", user.EndpointID)
+	assert.Equal(t, []byte("hash"), user.PasswordHash)
+}
+
+func TestRecoverRegistrationsWithUnavailableCatapult(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	compensating := createInterruptedRegistration(t, db, "user1", registrationCompensating)
+	api := &fakeCatapultAPI{}
+	api.On("DeleteSIPAccount", "endpointId").Return(nil)
+	api.On("ReleasePhoneNumber", "+1234567890").Return(errCatapultUnavailable).Once()
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now().Add(registrationTimeout + time.Minute)}
+	recoverRegistrations(db, api, timerAPI)
+	registration := getRegistration(t, db, compensating.ID)
+	assert.Equal(t, registrationCompensating, registration.State)
+	assert.Equal(t, "", registration.EndpointID)
+	assert.Equal(t, "+1234567890", registration.PhoneNumber)
+	// next start
+	api.On("ReleasePhoneNumber", "+1234567890").Return(nil).Once()
+	recoverRegistrations(db, api, timerAPI)
+	registration = getRegistration(t, db, compensating.ID)
+	assert.Equal(t, registrationFailed, registration.State)
+	api.AssertNumberOfCalls(t, "DeleteSIPAccount", 1)
+	api.AssertNumberOfCalls(t, "ReleasePhoneNumber", 2)
+}
+
+func TestRecoverRegistrationsSkipsActiveRegistrations(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	active := createInterruptedRegistration(t, db, "user1", registrationNumberCreated)
+	api := &fakeCatapultAPI{}
+	recoverRegistrations(db, api, &fakeTimerAPI{CurrentTime: time.Now()})
+	api.AssertNotCalled(t, "ReleasePhoneNumber", "+1234567890")
+	assert.Equal(t, registrationNumberCreated, getRegistration(t, db, active.ID).State)
+}
+
+func TestRecoverRegistrationsFindsInterruptedResources(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	started := createInterruptedRegistration(t, db, "user1", registrationStarted)
+	notFound := createInterruptedRegistration(t, db, "user2", registrationStarted)
+	failed := createInterruptedRegistration(t, db, "user3", registrationNumberCreated)
+	db.Model(started).UpdateColumn("resource_name", "name1")
+	db.Model(notFound).UpdateColumn("resource_name", "name2")
+	db.Model(failed).UpdateColumn("resource_name", "name3")
+	api := &fakeCatapultAPI{}
+	api.On("FindPhoneNumber", "name1").Return("+1234567891", nil)
+	api.On("FindPhoneNumber", "name2").Return("", nil)
+	api.On("FindSIPAccount", "name3").Return("", errCatapultUnavailable)
+	api.On("ReleasePhoneNumber", "+1234567891").Return(nil)
+	recoverRegistrations(db, api, &fakeTimerAPI{CurrentTime: time.Now().Add(registrationTimeout + time.Minute)})
+	api.AssertExpectations(t)
+	assert.Equal(t, registrationFailed, getRegistration(t, db, started.ID).State)
+	assert.Equal(t, registrationFailed, getRegistration(t, db, notFound.ID).State)
+	// it is repeated later
+	registration := getRegistration(t, db, failed.ID)
+	assert.Equal(t, registrationNumberCreated, registration.State)
+	assert.Equal(t, "+1234567890", registration.PhoneNumber)
+	api.AssertNotCalled(t, "ReleasePhoneNumber", "+1234567890")
+}
+
+func TestRecoverRegistrationsJob(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	started := createInterruptedRegistration(t, db, "user1", registrationStarted)
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	require.NoError(t, ensureJob(db, recoverRegistrationsJob, timerAPI.Now()))
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	assert.Equal(t, registrationStarted, getRegistration(t, db, started.ID).State)
+	// the job is repeated
+	job := &Job{}
+	require.NoError(t, db.First(job, "type = ? AND state = ?", recoverRegistrationsJob, JobPending).Error)
+	assert.Equal(t, timerAPI.Now().Add(registrationRecoveryInterval).Unix(), job.RunAt.Unix())
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(registrationTimeout + time.Minute)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	assert.Equal(t, registrationFailed, getRegistration(t, db, started.ID).State)
+	count := 0
+	db.Model(&Job{}).Where("type = ?", recoverRegistrationsJob).Count(&count)
+	assert.Equal(t, 1, count)
+}
+
+func TestCompensateRegistration(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	registration := createInterruptedRegistration(t, db, "user1", registrationSIPAccountCreated)
+	api := &fakeCatapultAPI{}
+	api.On("DeleteSIPAccount", "endpointId").Return(errors.New("Http code 500")).Once()
+	err := compensateRegistration(registration, errors.New("error"), api, db)
+	assert.EqualError(t, err, "Http code 500")
+	api.AssertNotCalled(t, "ReleasePhoneNumber", "+1234567890")
+	registration = getRegistration(t, db, registration.ID)
+	assert.Equal(t, registrationCompensating, registration.State)
+	assert.Equal(t, "error", registration.LastError)
+	assert.Equal(t, "endpointId", registration.EndpointID)
+}
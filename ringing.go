@@ -0,0 +1,217 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/jinzhu/gorm"
+)
+
+// MinRingStepTimeout and MaxRingStepTimeout limit time of ringing of each find me/follow me step (in seconds)
+const (
+	MinRingStepTimeout = 5
+	MaxRingStepTimeout = 120
+)
+
+// ringStepJobData is payload of the job which checks result of a find me/follow me step after its timeout
+type ringStepJobData struct {
+	IncomingCallID string   `json:"incomingCallId"`
+	CallerID       string   `json:"callerId"`
+	UserID         uint     `json:"userId"`
+	Step           int      `json:"step"`
+	Host           string   `json:"host"`
+	CallIDs        []string `json:"callIds"`
+}
+
+// transferredCallJobData is payload of the job which moves not answered transferred call to voice mail
+type transferredCallJobData struct {
+	CallID string `json:"callId"`
+}
+
+// ringFollowMe rings targets of user's routing step with given index (steps without reachable targets are skipped).
+// Result of the step is checked by a delayed job which starts the next step. If nobody answers the incoming call is moved to voice mail.
+func ringFollowMe(incomingCallID string, callerID string, user *User, steps []RingStep, index int, host string, now time.Time,
+	db *gorm.DB, api catapultAPIInterface) error {
+	for ; index < len(steps); index++ {
+		step := steps[index]
+		callIDs := []string{}
+		for _, target := range step.TargetList() {
+			from := user.PhoneNumber
+			if strings.HasPrefix(target, "sip:") {
+				from = callerID // SIP clients can show real caller id
+			}
+			debugf("Ringing %q for call %s\n", target, incomingCallID)
+			callID, err := api.CreateCall(&bandwidth.CreateCallData{
+				From:        from,
+				To:          target,
+				CallbackURL: buildCallbackURL(host, "/ringCallback"),
+				Tag:         incomingCallID,
+			})
+			if err != nil {
+				debugf("Error on calling %q: %s\n", target, err.Error())
+				continue
+			}
+			if err = db.Create(&RingCall{CallID: callID, IncomingCallID: incomingCallID}).Error; err != nil {
+				debugf("Error on saving ring call: %s\n", err.Error())
+			}
+			callIDs = append(callIDs, callID)
+		}
+		if len(callIDs) == 0 {
+			continue
+		}
+		return enqueueJob(db, ringStepTimeoutJob, &ringStepJobData{
+			IncomingCallID: incomingCallID,
+			CallerID:       callerID,
+			UserID:         user.ID,
+			Step:           index,
+			Host:           host,
+			CallIDs:        callIDs,
+		}, now.Add(time.Duration(step.Timeout)*time.Second))
+	}
+	debugf("Moving call %s to voice mail\n", incomingCallID)
+	api.UpdateCall(incomingCallID, &bandwidth.UpdateCallData{
+		CallbackURL: buildCallbackURL(host, "/transferCallback"),
+	})
+	reason := NoAnswerGreeting
+	count := 0
+	db.Model(&RingCall{}).Where("incoming_call_id = ? AND busy = ?", incomingCallID, true).Count(&count)
+	if count > 0 {
+		reason = BusyGreeting
+	}
+	startVoiceMailRecording(incomingCallID, user, reason, now, api)
+	return nil
+}
+
+// handleRingStepTimeoutJob stops ringing of a find me/follow me step and starts the next one if nobody has answered
+func handleRingStepTimeoutJob(job *Job, ctx *jobContext) error {
+	data := &ringStepJobData{}
+	if err := job.decodePayload(data); err != nil {
+		return err
+	}
+	db, api := ctx.db, ctx.api
+	// outgoing calls which were not answered in time can't be connected with incoming call anymore
+	db.Model(&RingCall{}).Where("call_id IN (?) AND answered = ?", data.CallIDs, false).Update("expired", true)
+	count := 0
+	db.Model(&RingCall{}).Where("incoming_call_id = ? AND answered = ?", data.IncomingCallID, true).Count(&count)
+	if count > 0 {
+		debugf("Call %s has been answered\n", data.IncomingCallID)
+		return nil
+	}
+	for _, callID := range data.CallIDs {
+		api.UpdateCall(callID, &bandwidth.UpdateCallData{State: "completed"})
+	}
+	call, err := api.GetCall(data.IncomingCallID)
+	if err != nil {
+		return err
+	}
+	if call.State != "active" {
+		debugf("Incoming call %s has been completed\n", data.IncomingCallID)
+		return nil
+	}
+	user := &User{}
+	if err = db.First(user, data.UserID).Error; err != nil {
+		return err
+	}
+	steps := []RingStep{}
+	if err = db.Where("user_id = ?", user.ID).Order("position").Find(&steps).Error; err != nil {
+		return err
+	}
+	return ringFollowMe(data.IncomingCallID, data.CallerID, user, steps, data.Step+1, data.Host, ctx.timerAPI.Now(), db, api)
+}
+
+// handleCheckTransferredCallJob moves transferred call to voice mail if nobody has answered it
+func handleCheckTransferredCallJob(job *Job, ctx *jobContext) error {
+	data := &transferredCallJobData{}
+	if err := job.decodePayload(data); err != nil {
+		return err
+	}
+	call, err := ctx.api.GetCall(data.CallID)
+	if err != nil {
+		return err
+	}
+	if call.State != "started" {
+		return nil
+	}
+	debugf("Moving call %s to voice mail\n", data.CallID)
+	_, err = ctx.api.UpdateCall(data.CallID, &bandwidth.UpdateCallData{State: "active"})
+	return err
+}
+
+// handleTransferredCallBusy moves transferred call to voice mail right away when user's SIP account rejects it as
+// busy (the busy greeting is played then). It returns false if the call doesn't wait for answer anymore.
+func handleTransferredCallBusy(callID string, db *gorm.DB, api catapultAPIInterface) bool {
+	record := findCallRecord(callID, db)
+	if record == nil || record.AnswerTime != nil || record.TransferredCallID == "" {
+		return false
+	}
+	db.Model(record).Update("busy", true)
+	call, err := api.GetCall(record.TransferredCallID)
+	if err != nil || call.State != "started" {
+		return false
+	}
+	debugf("User is busy, moving call %s to voice mail\n", record.TransferredCallID)
+	_, err = api.UpdateCall(record.TransferredCallID, &bandwidth.UpdateCallData{State: "active"})
+	return err == nil
+}
+
+func handleRingCallEvent(form *CallbackForm, now time.Time, db *gorm.DB, api catapultAPIInterface) {
+	ringCall := &RingCall{}
+	if db.First(ringCall, "call_id = ?", form.CallID).RecordNotFound() {
+		debugf("Ring call %s is not found\n", form.CallID)
+		return
+	}
+	switch form.EventType {
+	case "answer":
+		// unique index allows to mark as answered only one call for each incoming call
+		result := db.Model(&RingCall{}).Where("call_id = ? AND expired = ?", form.CallID, false).Update("answered", true)
+		if result.Error != nil || result.RowsAffected == 0 {
+			debugf("Call %s has been answered too late\n", form.CallID)
+			api.UpdateCall(form.CallID, &bandwidth.UpdateCallData{State: "completed"})
+			return
+		}
+		debugf("Connecting call %s with %s\n", ringCall.IncomingCallID, form.CallID)
+		_, err := api.CreateBridge(&bandwidth.BridgeData{
+			BridgeAudio: true,
+			CallIDs:     []string{ringCall.IncomingCallID, form.CallID},
+		})
+		if err != nil {
+			debugf("Error on creating bridge: %s\n", err.Error())
+		}
+		hangUpRingCalls(ringCall.IncomingCallID, form.CallID, db, api)
+		markCallRecordAnswered(ringCall.IncomingCallID, now, db)
+	case "hangup":
+		if ringCall.Answered {
+			api.UpdateCall(ringCall.IncomingCallID, &bandwidth.UpdateCallData{State: "completed"})
+		} else if form.Cause == "USER_BUSY" {
+			db.Model(ringCall).Update("busy", true)
+		}
+	}
+}
+
+// hangUpRingCalls completes all outgoing calls of the incoming call except exceptCallID
+func hangUpRingCalls(incomingCallID string, exceptCallID string, db *gorm.DB, api catapultAPIInterface) {
+	ringCalls := []RingCall{}
+	db.Where("incoming_call_id = ? AND call_id <> ? AND (expired = ? OR answered = ?)",
+		incomingCallID, exceptCallID, false, true).Find(&ringCalls)
+	db.Model(&RingCall{}).Where("incoming_call_id = ? AND call_id <> ? AND answered = ?",
+		incomingCallID, exceptCallID, false).Update("expired", true)
+	for _, ringCall := range ringCalls {
+		api.UpdateCall(ringCall.CallID, &bandwidth.UpdateCallData{State: "completed"})
+	}
+}
+
+// startVoiceMailRecording plays user's greeting for given reason and records a voice message
+func startVoiceMailRecording(callID string, user *User, reason string, now time.Time, api catapultAPIInterface) {
+	playGreeting(callID, user, reason, now, api)
+	api.PlayAudioToCall(callID, beepURL)
+	api.UpdateCall(callID, &bandwidth.UpdateCallData{RecordingEnabled: true})
+}
+
+// isValidRingTarget returns true for SIP URIs and phone numbers in E.164 format
+func isValidRingTarget(target string) bool {
+	if strings.HasPrefix(target, "sip:") {
+		return len(target) > 4 && !strings.ContainsAny(target, ", ")
+	}
+	return phoneNumberRegexp.MatchString(target)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsValidRingTarget(t *testing.T) {
+	assert.True(t, isValidRingTarget("sip:user@test.com"))
+	assert.True(t, isValidRingTarget("+19195551212"))
+	assert.False(t, isValidRingTarget("sip:"))
+	assert.False(t, isValidRingTarget("sip:user@test.com,+19195551212"))
+	assert.False(t, isValidRingTarget("9195551212"))
+}
+
+func TestStartVoiceMailRecording(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	api.On("PlayAudioToCall", "callID", "http://greeting").Return(nil)
+	api.On("PlayAudioToCall", "callID", beepURL).Return(nil)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
+	startVoiceMailRecording("callID", &User{GreetingURL: "http://greeting"}, NoAnswerGreeting, time.Now(), api)
+	api.AssertExpectations(t)
+}
+
+func createRingingUser(t *testing.T, db *gorm.DB, userName string, phoneNumber string, steps []RingStep) (*User, []RingStep) {
+	user := &User{UserName: userName, PhoneNumber: phoneNumber, AreaCode: "910"}
+	user.SetPassword("123456")
+	require.NoError(t, db.Save(user).Error)
+	db.Unscoped().Delete(&RingStep{}, "user_id = ?", user.ID)
+	for i := range steps {
+		steps[i].UserID = user.ID
+		steps[i].Position = i
+		require.NoError(t, db.Save(&steps[i]).Error)
+	}
+	return user, steps
+}
+
+func TestRingFollowMeAnswered(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "rfIncoming1")
+	user, steps := createRingingUser(t, db, "rfuser1", "+1234567821", []RingStep{
+		{Targets: "sip:desk@test.com,+1987654321", Timeout: 10},
+		{Targets: "+1987654322", Timeout: 20},
+	})
+	api.On("CreateCall", &bandwidth.CreateCallData{
+		From:        "+1472583690",
+		To:          "sip:desk@test.com",
+		CallbackURL: "http://localhost/ringCallback?secret=callbackSecret",
+		Tag:         "rfIncoming1",
+	}).Return("rfCall1", nil)
+	api.On("CreateCall", &bandwidth.CreateCallData{
+		From:        "+1234567821",
+		To:          "+1987654321",
+		CallbackURL: "http://localhost/ringCallback?secret=callbackSecret",
+		Tag:         "rfIncoming1",
+	}).Return("rfCall2", nil)
+	assert.NoError(t, ringFollowMe("rfIncoming1", "+1472583690", user, steps, 0, "localhost", timerAPI.Now(), db, api))
+	// the second call is answered while the first step is ringing
+	db.Model(&RingCall{}).Where("call_id = ?", "rfCall2").Update("answered", true)
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(10 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	api.AssertExpectations(t)
+	ringCall := &RingCall{}
+	assert.NoError(t, db.First(ringCall, "call_id = ?", "rfCall1").Error)
+	assert.True(t, ringCall.Expired)
+}
+
+func TestRingFollowMeMoveToVoiceMail(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "rfIncoming2")
+	user, steps := createRingingUser(t, db, "rfuser2", "+1234567822", []RingStep{
+		{Targets: "+1987654323", Timeout: 10},
+		{Targets: "+1987654324", Timeout: 20},
+	})
+	api.On("CreateCall", &bandwidth.CreateCallData{
+		From:        "+1234567822",
+		To:          "+1987654323",
+		CallbackURL: "http://localhost/ringCallback?secret=callbackSecret",
+		Tag:         "rfIncoming2",
+	}).Return("rfCall3", nil)
+	api.On("CreateCall", &bandwidth.CreateCallData{
+		From:        "+1234567822",
+		To:          "+1987654324",
+		CallbackURL: "http://localhost/ringCallback?secret=callbackSecret",
+		Tag:         "rfIncoming2",
+	}).Return("rfCall4", nil)
+	api.On("UpdateCall", "rfCall3", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	api.On("UpdateCall", "rfCall4", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	api.On("GetCall", "rfIncoming2").Return(&bandwidth.Call{State: "active"}, nil)
+	api.On("UpdateCall", "rfIncoming2", &bandwidth.UpdateCallData{CallbackURL: "http://localhost/transferCallback?secret=callbackSecret"}).Return("", nil)
+	api.On("SpeakSentenceToCall", "rfIncoming2", "Hello. You have called to +1234567822. Please leave a message after beep.").Return(nil)
+	api.On("PlayAudioToCall", "rfIncoming2", beepURL).Return(nil)
+	api.On("UpdateCall", "rfIncoming2", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
+	assert.NoError(t, ringFollowMe("rfIncoming2", "+1472583690", user, steps, 0, "localhost", timerAPI.Now(), db, api))
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(10 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	api.AssertNotCalled(t, "UpdateCall", "rfCall4", &bandwidth.UpdateCallData{State: "completed"})
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(20 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	api.AssertExpectations(t)
+}
+
+func TestRingFollowMeStopsWhenCallerHangsUp(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "rfIncoming3")
+	user, steps := createRingingUser(t, db, "rfuser3", "+1234567823", []RingStep{
+		{Targets: "+1987654325", Timeout: 10},
+		{Targets: "+1987654326", Timeout: 20},
+	})
+	api.On("CreateCall", &bandwidth.CreateCallData{
+		From:        "+1234567823",
+		To:          "+1987654325",
+		CallbackURL: "http://localhost/ringCallback?secret=callbackSecret",
+		Tag:         "rfIncoming3",
+	}).Return("rfCall5", nil)
+	api.On("UpdateCall", "rfCall5", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	api.On("GetCall", "rfIncoming3").Return(&bandwidth.Call{State: "completed"}, nil)
+	assert.NoError(t, ringFollowMe("rfIncoming3", "+1472583690", user, steps, 0, "localhost", timerAPI.Now(), db, api))
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(10 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	api.AssertExpectations(t)
+	api.AssertNumberOfCalls(t, "CreateCall", 1)
+}
+
+func TestHandleRingCallEventAnswer(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "rcIncoming1")
+	db.Create(&RingCall{CallID: "rcCall1", IncomingCallID: "rcIncoming1"})
+	db.Create(&RingCall{CallID: "rcCall2", IncomingCallID: "rcIncoming1"})
+	api.On("CreateBridge", &bandwidth.BridgeData{
+		BridgeAudio: true,
+		CallIDs:     []string{"rcIncoming1", "rcCall1"},
+	}).Return("bridgeID", nil)
+	api.On("UpdateCall", "rcCall2", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	handleRingCallEvent(&CallbackForm{CallID: "rcCall1", EventType: "answer"}, time.Now(), db, api)
+	api.AssertExpectations(t)
+
+	// the second call can't be connected anymore
+	api = &fakeCatapultAPI{}
+	api.On("UpdateCall", "rcCall2", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	handleRingCallEvent(&CallbackForm{CallID: "rcCall2", EventType: "answer"}, time.Now(), db, api)
+	api.AssertExpectations(t)
+	ringCall := &RingCall{}
+	assert.NoError(t, db.First(ringCall, "call_id = ?", "rcCall2").Error)
+	assert.False(t, ringCall.Answered)
+}
+
+func TestHandleRingCallEventAnswerExpired(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "rcIncoming2")
+	db.Create(&RingCall{CallID: "rcCall3", IncomingCallID: "rcIncoming2", Expired: true})
+	api.On("UpdateCall", "rcCall3", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	handleRingCallEvent(&CallbackForm{CallID: "rcCall3", EventType: "answer"}, time.Now(), db, api)
+	api.AssertExpectations(t)
+}
+
+func TestRingFollowMeBusy(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "rfIncoming4")
+	user, steps := createRingingUser(t, db, "rfuser4", "+1234567824", []RingStep{
+		{Targets: "+1987654328", Timeout: 10},
+	})
+	user.BusyGreetingURL = "http://busy"
+	db.Save(user)
+	api.On("CreateCall", mock.AnythingOfType("*bandwidth.CreateCallData")).Return("rfCall6", nil)
+	api.On("UpdateCall", "rfCall6", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	api.On("GetCall", "rfIncoming4").Return(&bandwidth.Call{State: "active"}, nil)
+	api.On("UpdateCall", "rfIncoming4", &bandwidth.UpdateCallData{CallbackURL: "http://localhost/transferCallback?secret=callbackSecret"}).Return("", nil)
+	api.On("PlayAudioToCall", "rfIncoming4", "http://busy").Return(nil)
+	api.On("PlayAudioToCall", "rfIncoming4", beepURL).Return(nil)
+	api.On("UpdateCall", "rfIncoming4", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
+	assert.NoError(t, ringFollowMe("rfIncoming4", "+1472583690", user, steps, 0, "localhost", timerAPI.Now(), db, api))
+	handleRingCallEvent(&CallbackForm{CallID: "rfCall6", EventType: "hangup", Cause: "USER_BUSY"}, time.Now(), db, api)
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(10 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	api.AssertExpectations(t)
+}
+
+func TestHandleRingCallEventHangup(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "rcIncoming3")
+	db.Create(&RingCall{CallID: "rcCall4", IncomingCallID: "rcIncoming3", Answered: true})
+	api.On("UpdateCall", "rcIncoming3", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	handleRingCallEvent(&CallbackForm{CallID: "rcCall4", EventType: "hangup"}, time.Now(), db, api)
+	api.AssertExpectations(t)
+}
@@ -8,12 +8,13 @@ import (
 
 	"errors"
 	"net/http"
+	"os"
 
+	"regexp"
 	"strings"
 
 	"github.com/appleboy/gin-jwt"
 	"github.com/bandwidthcom/go-bandwidth"
-	j "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/tuxychandru/pubsub"
@@ -29,26 +30,125 @@ type RegisterForm struct {
 
 // CallbackForm is used for call callbacks
 type CallbackForm struct {
-	From        string `json:"from"`
-	To          string `json:"to"`
-	State       string `json:"state"`
-	EventType   string `json:"eventType"`
-	CallID      string `json:"callId"`
-	Tag         string `json:"tag"`
-	RecordingID string `json:"recordingId"`
-	Digits      string `json:"digits"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	State           string `json:"state"`
+	EventType       string `json:"eventType"`
+	CallID          string `json:"callId"`
+	Tag             string `json:"tag"`
+	RecordingID     string `json:"recordingId"`
+	TranscriptionID string `json:"transcriptionId"`
+	Digits          string `json:"digits"`
+	Cause           string `json:"cause"`
+	GatherID        string `json:"gatherId"`
+}
+
+// NotificationSettingsForm is used to change notification settings of user
+type NotificationSettingsForm struct {
+	NotificationNumber        string `json:"notificationNumber"`
+	SMSNotificationsEnabled   bool   `json:"smsNotificationsEnabled"`
+	Email                     string `json:"email"`
+	EmailNotificationsEnabled bool   `json:"emailNotificationsEnabled"`
+}
+
+// VoiceMessageUpdateForm is used to move voice message to another folder or to change its listened state
+type VoiceMessageUpdateForm struct {
+	Folder   string `json:"folder"`
+	Listened *bool  `json:"listened"`
+}
+
+// RingSettingsForm is used to change time of waiting for answer and find me/follow me routing
+type RingSettingsForm struct {
+	NoAnswerTimeout int            `json:"noAnswerTimeout"`
+	Steps           []RingStepForm `json:"steps"`
+}
+
+// RingStepForm is a step of find me/follow me routing
+type RingStepForm struct {
+	Targets []string `json:"targets"`
+	Timeout int      `json:"timeout"`
+}
+
+// ScheduleForm is used to change weekly schedule of user
+type ScheduleForm struct {
+	TimeZone     string             `json:"timeZone"`
+	DoNotDisturb bool               `json:"doNotDisturb"`
+	WorkingHours []WorkingHoursForm `json:"workingHours"`
+}
+
+// WorkingHoursForm is a time range of a week day (like 09:00-17:00)
+type WorkingHoursForm struct {
+	Weekday int    `json:"weekday"`
+	Start   string `json:"start"`
+	End     string `json:"end"`
+}
+
+// HolidayForm is used to add a holiday
+type HolidayForm struct {
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+// DoNotDisturbForm is used to toggle "do not disturb" mode
+type DoNotDisturbForm struct {
+	Enabled bool `json:"enabled"`
+}
+
+// GreetingForm is used to change greeting of some type
+type GreetingForm struct {
+	URL       string     `json:"url"`
+	ExpiresAt *time.Time `json:"expiresAt"` // for extended absence greeting only
+}
+
+// PINForm is used to set PIN for voice mail access by phone
+type PINForm struct {
+	PIN string `json:"pin"`
+}
+
+// PasswordForm is used to change password of user
+type PasswordForm struct {
+	OldPassword    string `json:"oldPassword"`
+	Password       string `json:"password"`
+	RepeatPassword string `json:"repeatPassword"`
+}
+
+// PasswordResetForm is used to request a code which allows to set new password
+type PasswordResetForm struct {
+	UserName string `json:"userName"`
+	Channel  string `json:"channel"` // sms or email (optional)
+}
+
+// PasswordResetConfirmForm is used to set new password by code
+type PasswordResetConfirmForm struct {
+	UserName       string `json:"userName"`
+	Code           string `json:"code"`
+	Password       string `json:"password"`
+	RepeatPassword string `json:"repeatPassword"`
 }
 
 const beepURL = "https://s3.amazonaws.com/bwdemos/beep.mp3"
 
-func getRoutes(router *gin.Engine, db *gorm.DB, newVoiceMessageEvent *pubsub.PubSub) error {
+// streamSessionCheckInterval is maximal time between checks of the session of voice messages stream
+const streamSessionCheckInterval = 30 * time.Second
+
+var phoneNumberRegexp = regexp.MustCompile(`^\+[1-9]\d{1,14}$`)
+
+var greetingNames = map[string]string{
+	NoAnswerGreeting:   "No answer",
+	BusyGreeting:       "Busy",
+	AfterHoursGreeting: "After hours",
+	AbsenceGreeting:    "Extended absence",
+}
+
+var emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+func getRoutes(router *gin.Engine, db *gorm.DB, newVoiceMessageEvent notificationBus) error {
 	if newVoiceMessageEvent == nil {
 		newVoiceMessageEvent = pubsub.New(1)
 	}
 
-	authMiddleware := &jwt.GinJWTMiddleware{
+	authMiddleware, err := newJWTMiddleware(&jwt.GinJWTMiddleware{
 		Realm:      "Bandwidth",
-		Key:        []byte("9SbPxeIyvoT3HkIQ19wN9p_e_b6Xb7iJ"),
 		Timeout:    time.Hour * 24,
 		MaxRefresh: time.Hour * 24 * 7,
 		Authenticator: func(userId string, password string, c *gin.Context) (string, bool) {
@@ -56,26 +156,59 @@ func getRoutes(router *gin.Engine, db *gorm.DB, newVoiceMessageEvent *pubsub.Pub
 			if db.First(user, "user_name = ?", userId).RecordNotFound() {
 				return "", false
 			}
-			return strconv.FormatUint(uint64(user.ID), 10), user.ComparePasswords(password)
-		},
-		Authorizator: func(userId string, c *gin.Context) bool {
-			user := &User{}
-			id, err := strconv.ParseUint(userId, 10, 32)
-			if err != nil {
-				return false
+			if !user.ComparePasswords(password) {
+				return "", false
 			}
-			if db.First(user, id).RecordNotFound() {
-				return false
+			if user.IsPasswordHashOutdated() {
+				// pepper has been rotated
+				if err := user.SetPassword(password); err == nil {
+					db.Model(user).Updates(map[string]interface{}{"password_hash": user.PasswordHash, "pepper_version": user.PepperVersion})
+				}
 			}
-			c.Set("user", user)
-			return true
+			return strconv.FormatUint(uint64(user.ID), 10), true
 		},
 		Unauthorized: setErrorMessage,
+	}, config, db)
+	if err != nil {
+		return err
 	}
 
 	router.POST("/login", authMiddleware.LoginHandler)
 	router.GET("/refreshToken", authMiddleware.MiddlewareFunc(), authMiddleware.RefreshHandler)
 
+	router.POST("/logout", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		session := c.MustGet("session").(*Session)
+		if err := db.Delete(session).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on closing session")
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	router.POST("/logoutAll", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		if err := closeSessions(user, 0, db); err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on closing sessions")
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	router.GET("/sessions", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		current := c.MustGet("session").(*Session)
+		sessions, err := getSessions(user, time.Now(), db)
+		if err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on getting sessions")
+			return
+		}
+		list := make([]map[string]interface{}, len(sessions))
+		for i, session := range sessions {
+			list[i] = session.ToJSONObject(session.ID == current.ID)
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
 	router.POST("/register", func(c *gin.Context) {
 		api := c.MustGet("catapultAPI").(catapultAPIInterface)
 		form := &RegisterForm{}
@@ -88,160 +221,697 @@ func getRoutes(router *gin.Engine, db *gorm.DB, newVoiceMessageEvent *pubsub.Pub
 			setError(c, http.StatusBadRequest, errors.New("Missing some required fields"))
 			return
 		}
-		if form.Password != form.RepeatPassword {
-			setError(c, http.StatusBadRequest, errors.New("Passwords are mismatched"))
+		if form.Password != form.RepeatPassword {
+			setError(c, http.StatusBadRequest, errors.New("Passwords are mismatched"))
+			return
+		}
+		user := &User{
+			UserName: form.UserName,
+			AreaCode: form.AreaCode,
+		}
+		if err = user.SetPassword(form.Password); err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if !db.First(&User{}, "user_name = ?", form.UserName).RecordNotFound() {
+			setError(c, http.StatusBadRequest, errors.New("User with such name is registered already"))
+			return
+		}
+		registration, err := startRegistration(user, db)
+		if err != nil {
+			setError(c, http.StatusInternalServerError, err, "Error on saving registration")
+			return
+		}
+		// provisioned resources are released if any next step fails
+		fail := func(err error) {
+			if err == errCatapultTimeout {
+				// the resource could be created, it is found and released by recoverRegistrations later
+				interruptRegistration(registration, err, db)
+				return
+			}
+			if compensationErr := compensateRegistration(registration, err, api, db); compensationErr != nil {
+				debugf("Error on releasing resources of registration %d: %s\n", registration.ID, compensationErr.Error())
+			}
+		}
+		debugf("Reserving phone number for area code %s\n", form.AreaCode)
+		phoneNumber, err := api.CreatePhoneNumber(user.AreaCode, registration.ResourceName)
+		if err != nil {
+			fail(err)
+			setCatapultError(c, err, "Error on creating phone number: "+err.Error())
+			return
+		}
+		registration.PhoneNumber = phoneNumber
+		if err = setRegistrationState(registration, registrationNumberCreated, db); err != nil {
+			fail(err)
+			setError(c, http.StatusInternalServerError, err, "Error on saving registration")
+			return
+		}
+		debugf("Creating SIP account\n")
+		sipAccount, err := api.CreateSIPAccount(registration.ResourceName)
+		if err != nil {
+			fail(err)
+			setCatapultError(c, err, "Error on creating SIP Account: "+err.Error())
+			return
+		}
+		registration.EndpointID = sipAccount.EndpointID
+		registration.SIPURI = sipAccount.URI
+		registration.SIPPassword = sipAccount.Password
+		if err = setRegistrationState(registration, registrationSIPAccountCreated, db); err != nil {
+			fail(err)
+			setError(c, http.StatusInternalServerError, err, "Error on saving registration")
+			return
+		}
+		if user, err = completeRegistration(registration, db); err != nil {
+			fail(err)
+			setError(c, http.StatusBadGateway, err, "Error on saving user's data")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id": user.ID,
+		})
+	})
+
+	router.PUT("/password", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		form := &PasswordForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if !user.ComparePasswords(form.OldPassword) {
+			setErrorMessage(c, http.StatusBadRequest, "Invalid current password")
+			return
+		}
+		if form.Password != form.RepeatPassword {
+			setError(c, http.StatusBadRequest, errors.New("Passwords are mismatched"))
+			return
+		}
+		if err = user.SetPassword(form.Password); err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		session := c.MustGet("session").(*Session)
+		if err = updatePassword(user, db); err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on saving user's data")
+			return
+		}
+		// other devices are logged out, current session gets new token
+		if err = closeSessions(user, session.ID, db); err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on closing sessions")
+			return
+		}
+		authMiddleware.respondWithToken(c, user, session)
+	})
+
+	router.POST("/passwordReset", func(c *gin.Context) {
+		api := c.MustGet("catapultAPI").(catapultAPIInterface)
+		timerAPI := c.MustGet("timerAPI").(timerInterface)
+		form := &PasswordResetForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if form.Channel != "" && form.Channel != PasswordResetBySMS && form.Channel != PasswordResetByEmail {
+			setErrorMessage(c, http.StatusBadRequest, "Channel should be sms or email")
+			return
+		}
+		// the response doesn't depend on existence of the user
+		user := &User{}
+		if db.First(user, "user_name = ?", form.UserName).RecordNotFound() {
+			c.Status(http.StatusOK)
+			return
+		}
+		channel := getPasswordResetChannel(user, form.Channel)
+		if channel == "" {
+			debugf("User %s has no channels to deliver password reset code\n", user.UserName)
+			c.Status(http.StatusOK)
+			return
+		}
+		code, err := createPasswordResetCode(user, channel, timerAPI.Now(), db)
+		if err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on saving password reset code")
+			return
+		}
+		if code == "" {
+			debugf("Password reset code of user %s has been sent recently\n", user.UserName)
+			c.Status(http.StatusOK)
+			return
+		}
+		var emailSender emailSenderInterface
+		if value, ok := c.Get("emailSender"); ok {
+			emailSender = value.(emailSenderInterface)
+		}
+		if err = sendPasswordResetCode(user, channel, code, api, emailSender); err != nil {
+			// the error is not returned to keep the response the same for all users
+			debugf("Error on sending password reset code to user %s: %s\n", user.UserName, err.Error())
+		}
+		c.Status(http.StatusOK)
+	})
+
+	router.POST("/passwordReset/confirm", func(c *gin.Context) {
+		timerAPI := c.MustGet("timerAPI").(timerInterface)
+		form := &PasswordResetConfirmForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if form.Password != form.RepeatPassword {
+			setError(c, http.StatusBadRequest, errors.New("Passwords are mismatched"))
+			return
+		}
+		user := &User{}
+		if db.First(user, "user_name = ?", form.UserName).RecordNotFound() {
+			setError(c, http.StatusBadRequest, errInvalidPasswordResetCode)
+			return
+		}
+		if err = resetPassword(user, form.Code, form.Password, timerAPI.Now(), db); err != nil {
+			if err == errInvalidPasswordResetCode {
+				setError(c, http.StatusBadRequest, err)
+			} else {
+				setError(c, http.StatusBadGateway, err, "Error on changing password")
+			}
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	router.DELETE("/account", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		handleAccountDeletion(c, c.MustGet("user").(*User), db)
+	})
+
+	router.DELETE("/admin/users/:userName", adminAuthMiddleware, func(c *gin.Context) {
+		user := &User{}
+		if db.First(user, "user_name = ?", c.Param("userName")).RecordNotFound() {
+			setErrorMessage(c, http.StatusNotFound, "User not found")
+			return
+		}
+		handleAccountDeletion(c, user, db)
+	})
+
+	router.GET("/sipData", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		api := c.MustGet("catapultAPI").(catapultAPIInterface)
+		token, err := api.CreateSIPAuthToken(user.EndpointID)
+		if err != nil {
+			setCatapultError(c, err, "Error on getting auth token for SIP account")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"phoneNumber": user.PhoneNumber,
+			"sipUri":      user.SIPURI,
+			"sipPassword": user.SIPPassword, // only to show to user. it is not used by webrtc auth
+			"token":       token.Token,
+			"expire":      time.Now().Add(time.Duration(token.Expires) * time.Second),
+		})
+	})
+
+	router.GET("/notificationSettings", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		c.JSON(http.StatusOK, gin.H{
+			"notificationNumber":        user.NotificationNumber,
+			"smsNotificationsEnabled":   user.SMSNotificationsEnabled,
+			"email":                     user.Email,
+			"emailNotificationsEnabled": user.EmailNotificationsEnabled,
+		})
+	})
+
+	router.PUT("/notificationSettings", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		form := &NotificationSettingsForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if form.NotificationNumber != "" && !phoneNumberRegexp.MatchString(form.NotificationNumber) {
+			setError(c, http.StatusBadRequest, errors.New("Notification number should be in E.164 format (like +19195551212)"))
+			return
+		}
+		if form.SMSNotificationsEnabled && form.NotificationNumber == "" {
+			setError(c, http.StatusBadRequest, errors.New("Notification number is required to enable SMS notifications"))
+			return
+		}
+		if form.Email != "" && !emailRegexp.MatchString(form.Email) {
+			setError(c, http.StatusBadRequest, errors.New("Invalid email address"))
+			return
+		}
+		if form.EmailNotificationsEnabled && form.Email == "" {
+			setError(c, http.StatusBadRequest, errors.New("Email is required to enable email notifications"))
+			return
+		}
+		err = db.Model(user).Updates(map[string]interface{}{
+			"notification_number":         form.NotificationNumber,
+			"sms_notifications_enabled":   form.SMSNotificationsEnabled,
+			"email":                       form.Email,
+			"email_notifications_enabled": form.EmailNotificationsEnabled,
+		}).Error
+		if err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on saving user's data")
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	router.POST("/callCallback", callbackAuthMiddleware, func(c *gin.Context) {
+		form := &CallbackForm{}
+		api := c.MustGet("catapultAPI").(catapultAPIInterface)
+		timerAPI := c.MustGet("timerAPI").(timerInterface)
+		err := c.Bind(form)
+		debugf("Catapult Event: %+v\n", *form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		err = handleCallbackOnce(c.Request.URL.Path, form, db, func(tx *gorm.DB) error {
+			return handleCallEvent(form, c.Request.Host, tx, api, timerAPI)
+		})
+		if err != nil {
+			setError(c, http.StatusInternalServerError, err, "Error on handling callback")
+			return
+		}
+		c.String(http.StatusOK, "")
+	})
+
+	router.POST("/transferCallback", callbackAuthMiddleware, func(c *gin.Context) {
+		api := c.MustGet("catapultAPI").(catapultAPIInterface)
+		timerAPI := c.MustGet("timerAPI").(timerInterface)
+		value, _ := c.Get("emailSender")
+		emailSender, _ := value.(emailSenderInterface)
+		form := &CallbackForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		debugf("Catapult Event for transfered call: %+v\n", *form)
+		// voice messages are announced after commit of the transaction
+		events := newDeferredNotificationBus(newVoiceMessageEvent)
+		err = handleCallbackOnce(c.Request.URL.Path, form, db, func(tx *gorm.DB) error {
+			if form.EventType == "hangup" {
+				if form.Cause == "USER_BUSY" && handleTransferredCallBusy(form.CallID, tx, api) {
+					return nil
+				}
+				completeCallRecord(form.CallID, timerAPI.Now(), tx)
+			}
+			return handleVoiceMailEvent(form, c.Request.Host, tx, api, timerAPI, emailSender, events)
+		})
+		if err != nil {
+			setError(c, http.StatusInternalServerError, err, "Error on handling callback")
+			return
+		}
+		events.Flush()
+		c.String(http.StatusOK, "")
+	})
+
+	router.POST("/ringCallback", callbackAuthMiddleware, func(c *gin.Context) {
+		api := c.MustGet("catapultAPI").(catapultAPIInterface)
+		timerAPI := c.MustGet("timerAPI").(timerInterface)
+		form := &CallbackForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		debugf("Catapult Event for find me/follow me call: %+v\n", *form)
+		err = handleCallbackOnce(c.Request.URL.Path, form, db, func(tx *gorm.DB) error {
+			handleRingCallEvent(form, timerAPI.Now(), tx, api)
+			return nil
+		})
+		if err != nil {
+			setError(c, http.StatusInternalServerError, err, "Error on handling callback")
+			return
+		}
+		c.String(http.StatusOK, "")
+	})
+
+	router.GET("/ringSettings", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		steps := []RingStep{}
+		if err := db.Where("user_id = ?", user.ID).Order("position").Find(&steps).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on getting routing rules")
+			return
+		}
+		list := make([]map[string]interface{}, len(steps))
+		for i, step := range steps {
+			list[i] = step.ToJSONObject()
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"noAnswerTimeout": int(user.GetNoAnswerTimeout() / time.Second),
+			"steps":           list,
+		})
+	})
+
+	router.PUT("/ringSettings", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		form := &RingSettingsForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if form.NoAnswerTimeout != 0 && (form.NoAnswerTimeout < MinRingStepTimeout || form.NoAnswerTimeout > MaxRingStepTimeout) {
+			setError(c, http.StatusBadRequest, fmt.Errorf("No answer timeout should be between %d and %d seconds", MinRingStepTimeout, MaxRingStepTimeout))
+			return
+		}
+		for _, step := range form.Steps {
+			if step.Timeout < MinRingStepTimeout || step.Timeout > MaxRingStepTimeout {
+				setError(c, http.StatusBadRequest, fmt.Errorf("Ringing timeout should be between %d and %d seconds", MinRingStepTimeout, MaxRingStepTimeout))
+				return
+			}
+			if len(step.Targets) == 0 {
+				setError(c, http.StatusBadRequest, errors.New("Each step should have at least one number to ring"))
+				return
+			}
+			for _, target := range step.Targets {
+				if !isValidRingTarget(target) {
+					setError(c, http.StatusBadRequest, fmt.Errorf("Invalid number to ring %q (use SIP URI or E.164 format)", target))
+					return
+				}
+			}
+		}
+		tx := db.Begin()
+		err = tx.Model(user).Update("no_answer_timeout", form.NoAnswerTimeout).Error
+		if err == nil {
+			err = tx.Delete(&RingStep{}, "user_id = ?", user.ID).Error
+		}
+		for i, step := range form.Steps {
+			if err != nil {
+				break
+			}
+			err = tx.Create(&RingStep{
+				UserID:   user.ID,
+				Position: i,
+				Targets:  strings.Join(step.Targets, ","),
+				Timeout:  step.Timeout,
+			}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			setError(c, http.StatusBadGateway, err, "Error on saving routing rules")
+			return
+		}
+		tx.Commit()
+		c.Status(http.StatusOK)
+	})
+
+	router.GET("/schedule", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		hours := []WorkingHours{}
+		if err := db.Where("user_id = ?", user.ID).Order("weekday, start_minute").Find(&hours).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on getting working hours")
+			return
+		}
+		list := make([]map[string]interface{}, len(hours))
+		for i, h := range hours {
+			list[i] = h.ToJSONObject()
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"timeZone":     user.getLocation().String(),
+			"doNotDisturb": user.DoNotDisturb,
+			"workingHours": list,
+		})
+	})
+
+	router.PUT("/schedule", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		form := &ScheduleForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if _, err = time.LoadLocation(form.TimeZone); err != nil {
+			setError(c, http.StatusBadRequest, fmt.Errorf("Unknown time zone %q", form.TimeZone))
+			return
+		}
+		hours, err := parseWorkingHours(form.WorkingHours)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		tx := db.Begin()
+		err = tx.Model(user).Updates(map[string]interface{}{
+			"time_zone":      form.TimeZone,
+			"do_not_disturb": form.DoNotDisturb,
+		}).Error
+		if err == nil {
+			err = tx.Delete(&WorkingHours{}, "user_id = ?", user.ID).Error
+		}
+		for _, h := range hours {
+			if err != nil {
+				break
+			}
+			h.UserID = user.ID
+			err = tx.Create(&h).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			setError(c, http.StatusBadGateway, err, "Error on saving schedule")
+			return
+		}
+		tx.Commit()
+		c.Status(http.StatusOK)
+	})
+
+	router.PUT("/doNotDisturb", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		form := &DoNotDisturbForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if err = db.Model(user).Update("do_not_disturb", form.Enabled).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on saving user's data")
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	router.GET("/holidays", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		holidays := []Holiday{}
+		if err := db.Where("user_id = ?", user.ID).Order("date").Find(&holidays).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on getting holidays")
+			return
+		}
+		list := make([]map[string]interface{}, len(holidays))
+		for i, holiday := range holidays {
+			list[i] = holiday.ToJSONObject()
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	router.POST("/holidays", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		form := &HolidayForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if _, err = time.Parse(holidayDateFormat, form.Date); err != nil {
+			setError(c, http.StatusBadRequest, fmt.Errorf("Invalid date %q (use format like 2016-12-25)", form.Date))
+			return
+		}
+		holiday := &Holiday{UserID: user.ID, Date: form.Date, Name: form.Name}
+		if err = db.Create(holiday).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on saving holiday")
+			return
+		}
+		c.JSON(http.StatusCreated, holiday.ToJSONObject())
+	})
+
+	router.DELETE("/holidays/:id", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		id := c.Param("id")
+		holiday := &Holiday{}
+		if db.First(holiday, "id = ? AND user_id = ?", id, user.ID).RecordNotFound() {
+			setErrorMessage(c, http.StatusNotFound, "Holiday is not found")
+			return
+		}
+		if err := db.Delete(holiday).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on removing holiday")
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	router.POST("/voiceMailCallback", callbackAuthMiddleware, func(c *gin.Context) {
+		api := c.MustGet("catapultAPI").(catapultAPIInterface)
+		timerAPI := c.MustGet("timerAPI").(timerInterface)
+		form := &CallbackForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		debugf("Catapult Event for voice mail access: %+v\n", *form)
+		err = handleCallbackOnce(c.Request.URL.Path, form, db, func(tx *gorm.DB) error {
+			handleVoiceMailSessionEvent(form, timerAPI.Now(), tx, api)
+			return nil
+		})
+		if err != nil {
+			setError(c, http.StatusInternalServerError, err, "Error on handling callback")
+			return
+		}
+		c.String(http.StatusOK, "")
+	})
+
+	router.PUT("/voiceMailPIN", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		form := &PINForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if err = user.SetPIN(form.PIN); err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		if err = db.Model(user).Update("pin_hash", user.PINHash).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on saving user's data")
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	router.POST("/recordGreeting", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		api := c.MustGet("catapultAPI").(catapultAPIInterface)
+		user := c.MustGet("user").(*User)
+		callID, err := api.CreateCall(&bandwidth.CreateCallData{
+			From:        user.PhoneNumber,
+			To:          user.SIPURI,
+			CallbackURL: buildCallbackURL(c.Request.Host, "/recordCallback"),
+		})
+		if err != nil {
+			setError(c, http.StatusBadGateway, err)
+			return
+		}
+		if err = startGreetingSession(callID, user, db); err != nil {
+			debugf("Error on saving greeting session: %s\n", err.Error())
+		}
+	})
+
+	router.GET("/greetings", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		result := gin.H{}
+		for _, greetingType := range GreetingTypes {
+			result[greetingType] = gin.H{"url": user.GetGreetingURL(greetingType)}
+		}
+		result[AbsenceGreeting].(gin.H)["expiresAt"] = user.AbsenceGreetingExpiresAt
+		c.JSON(http.StatusOK, result)
+	})
+
+	router.PUT("/greetings/:type", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		greetingType := c.Param("type")
+		if !IsValidGreetingType(greetingType) {
+			setErrorMessage(c, http.StatusNotFound, "Unknown greeting type")
 			return
 		}
-		user := &User{
-			UserName: form.UserName,
-			AreaCode: form.AreaCode,
-		}
-		if err = user.SetPassword(form.Password); err != nil {
+		form := &GreetingForm{}
+		err := c.Bind(form)
+		if err != nil {
 			setError(c, http.StatusBadRequest, err)
 			return
 		}
-		if !db.First(&User{}, "user_name = ?", form.UserName).RecordNotFound() {
-			setError(c, http.StatusBadRequest, errors.New("User with such name is registered already"))
+		if !strings.HasPrefix(form.URL, "http://") && !strings.HasPrefix(form.URL, "https://") {
+			setError(c, http.StatusBadRequest, errors.New("Greeting url should be http or https url"))
 			return
 		}
-		debugf("Reserving phone number for area code %s\n", form.AreaCode)
-		phoneNumber, err := api.CreatePhoneNumber(user.AreaCode)
-		if err != nil {
-			setError(c, http.StatusBadGateway, err, "Error on creating phone number: "+err.Error())
+		if form.ExpiresAt != nil && greetingType != AbsenceGreeting {
+			setError(c, http.StatusBadRequest, errors.New("Only extended absence greeting can expire"))
 			return
 		}
-		debugf("Creating SIP account\n")
-		sipAccount, err := api.CreateSIPAccount()
-		if err != nil {
-			setError(c, http.StatusBadGateway, err, "Error on creating SIP Account: "+err.Error())
-			return
+		user.SetGreetingURL(greetingType, form.URL)
+		if greetingType == AbsenceGreeting {
+			user.AbsenceGreetingExpiresAt = form.ExpiresAt
 		}
-		user.PhoneNumber = phoneNumber
-		user.SIPURI = sipAccount.URI
-		user.SIPPassword = sipAccount.Password
-		user.EndpointID = sipAccount.EndpointID
-		if err = db.Create(user).Error; err != nil {
+		if err = db.Save(user).Error; err != nil {
 			setError(c, http.StatusBadGateway, err, "Error on saving user's data")
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"id": user.ID,
-		})
+		c.Status(http.StatusOK)
 	})
 
-	router.GET("/sipData", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+	router.DELETE("/greetings/:type", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
 		user := c.MustGet("user").(*User)
-		api := c.MustGet("catapultAPI").(catapultAPIInterface)
-		token, err := api.CreateSIPAuthToken(user.EndpointID)
-		if err != nil {
-			setError(c, http.StatusBadGateway, err, "Error on getting auth token for SIP account")
+		greetingType := c.Param("type")
+		if !IsValidGreetingType(greetingType) {
+			setErrorMessage(c, http.StatusNotFound, "Unknown greeting type")
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"phoneNumber": user.PhoneNumber,
-			"sipUri":      user.SIPURI,
-			"sipPassword": user.SIPPassword, // only to show to user. it is not used by webrtc auth
-			"token":       token.Token,
-			"expire":      time.Now().Add(time.Duration(token.Expires) * time.Second),
-		})
+		user.SetGreetingURL(greetingType, "")
+		if err := db.Save(user).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on saving user's data")
+			return
+		}
+		c.Status(http.StatusOK)
 	})
 
-	router.POST("/callCallback", func(c *gin.Context) {
-		form := &CallbackForm{}
+	router.POST("/greetings/:type/media", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
 		api := c.MustGet("catapultAPI").(catapultAPIInterface)
-		timerAPI := c.MustGet("timerAPI").(timerInterface)
-		err := c.Bind(form)
-		debugf("Catapult Event: %+v\n", *form)
+		user := c.MustGet("user").(*User)
+		greetingType := c.Param("type")
+		if !IsValidGreetingType(greetingType) {
+			setErrorMessage(c, http.StatusNotFound, "Unknown greeting type")
+			return
+		}
+		// some space is reserved for multipart headers
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxGreetingFileSize+64*1024)
+		content, contentType, err := readGreetingFile(c.Request)
 		if err != nil {
 			setError(c, http.StatusBadRequest, err)
 			return
 		}
-		user := &User{}
-		if !db.First(user, "sip_uri = ? OR phone_number = ?", form.From, form.To).RecordNotFound() {
-			if form.EventType == "answer" {
-				db.Create(&ActiveCall{
-					CallID: form.CallID,
-					UserID: user.ID,
-					From:   form.From,
-					To:     form.To,
-				})
-				if form.To == user.PhoneNumber {
-					debugf("Transfering incoming call to %q\n", user.SIPURI)
-					callerID := form.From
-					anotherUser := &User{}
-					if strings.Index(callerID, "sip:") == 0 && !db.First(anotherUser, "sip_uri = ?", callerID).RecordNotFound() {
-						// try to use phone number for caller id instead of sip uri
-						callerID = anotherUser.PhoneNumber
-					}
-					debugf("Using caller id %q\n", callerID)
-					transferedCallID, _ := api.UpdateCall(form.CallID, &bandwidth.UpdateCallData{
-						State:            "transferring",
-						TransferTo:       user.SIPURI,
-						TransferCallerID: callerID,
-						CallbackURL:      fmt.Sprintf("http://%s/transferCallback", c.Request.Host), // to handle redirection to voice mail
-					})
-					go func() {
-						debugf("Waiting for answer call %s\n", transferedCallID)
-						timerAPI.Sleep(15 * time.Second)
-						call, _ := api.GetCall(transferedCallID)
-						if call.State == "started" {
-							// move to voice mail
-							debugf("Moving call to voice mail\n")
-							api.UpdateCall(transferedCallID, &bandwidth.UpdateCallData{
-								State: "active",
-							})
-						}
-					}()
-					return
-				}
-				if form.From == user.SIPURI {
-					debugf("Transfering outgoing call to  %q\n", form.To)
-					api.UpdateCall(form.CallID, &bandwidth.UpdateCallData{
-						State:            "transferring",
-						TransferTo:       form.To,
-						TransferCallerID: user.PhoneNumber,
-					})
-					return
-				}
-			}
-		}
-		c.String(http.StatusOK, "")
-	})
-
-	router.POST("/transferCallback", func(c *gin.Context) {
-		api := c.MustGet("catapultAPI").(catapultAPIInterface)
-		form := &CallbackForm{}
-		err := c.Bind(form)
+		url, err := uploadGreeting(user, greetingType, content, contentType, api)
 		if err != nil {
-			setError(c, http.StatusBadRequest, err)
+			setError(c, http.StatusBadGateway, err, "Error on uploading greeting file")
 			return
 		}
-		debugf("Catapult Event for transfered call: %+v\n", *form)
-		handleVoiceMailEvent(form, db, api, newVoiceMessageEvent)
-		c.String(http.StatusOK, "")
+		user.SetGreetingURL(greetingType, url)
+		if err = db.Save(user).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on saving user's data")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"url": url})
 	})
 
-	router.POST("/recordGreeting", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+	router.GET("/greetings/:type/media", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
 		api := c.MustGet("catapultAPI").(catapultAPIInterface)
 		user := c.MustGet("user").(*User)
-		callID, err := api.CreateCall(&bandwidth.CreateCallData{
-			From:        user.PhoneNumber,
-			To:          user.SIPURI,
-			CallbackURL: fmt.Sprintf("http://%s/recordCallback", c.Request.Host),
-		})
+		greetingType := c.Param("type")
+		if !IsValidGreetingType(greetingType) {
+			setErrorMessage(c, http.StatusNotFound, "Unknown greeting type")
+			return
+		}
+		url := user.GetGreetingURL(greetingType)
+		if url == "" {
+			setErrorMessage(c, http.StatusNotFound, "Default greeting is used")
+			return
+		}
+		name := getGreetingMediaName(user, url, db)
+		if name == "" {
+			setErrorMessage(c, http.StatusNotFound, "Greeting file is not stored by the application")
+			return
+		}
+		reader, contentType, err := api.DownloadMediaFile(name)
 		if err != nil {
-			setError(c, http.StatusBadGateway, err)
+			setError(c, http.StatusBadGateway, err, "Error on downloading media file")
 			return
 		}
-		db.Create(&ActiveCall{
-			UserID: user.ID,
-			CallID: callID,
-			From:   user.PhoneNumber,
-			To:     user.SIPURI,
-		})
+		defer reader.Close()
+		c.Header("Content-Type", contentType)
+		length, _ := io.Copy(c.Writer, reader)
+		c.Header("Content-Length", strconv.FormatInt(length, 10))
 	})
 
-	router.POST("/recordCallback", func(c *gin.Context) {
+	router.POST("/recordCallback", callbackAuthMiddleware, func(c *gin.Context) {
 		api := c.MustGet("catapultAPI").(catapultAPIInterface)
 		timerAPI := c.MustGet("timerAPI").(timerInterface)
 		form := &CallbackForm{}
@@ -251,107 +921,13 @@ func getRoutes(router *gin.Engine, db *gorm.DB, newVoiceMessageEvent *pubsub.Pub
 			return
 		}
 		debugf("Catapult Event for greeting record: %+v\n", *form)
-		mainMenu := func() {
-			debugf("Main menu of greating recording\n")
-			id, err := api.CreateGather(form.CallID, &bandwidth.CreateGatherData{
-				MaxDigits:         1,
-				InterDigitTimeout: 30,
-				Prompt: &bandwidth.GatherPromptData{
-					Gender:   "female",
-					Voice:    "julie",
-					Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default.",
-				},
-				Tag: "Menu",
-			})
-			debugf("CreateGather result %v\n", []interface{}{id, err})
-		}
-		if form.EventType == "gather" && form.State == "completed" && form.Tag == "Record" {
-			debugf("Stoping recording of call %s\n", form.CallID)
-			api.UpdateCall(form.CallID, &bandwidth.UpdateCallData{
-				RecordingEnabled: false,
-			})
-			timerAPI.Sleep(time.Second)
-			api.SpeakSentenceToCall(form.CallID, "Your greeting has been changed.")
-			timerAPI.Sleep(time.Second)
-			mainMenu()
-			c.String(http.StatusOK, "")
-			return
-		}
-		user, err := getUserForCall(form, db)
-		if err != nil {
-			debugf("Error on getting user: %s\n", err.Error())
-			return
-		}
-		switch form.EventType {
-		case "answer":
-			mainMenu()
-			break
-		case "gather":
-			{
-				if form.State == "completed" {
-					switch form.Digits {
-					case "1":
-						debugf("Play greeting\n")
-						playGreeting(form.CallID, user, api)
-						timerAPI.Sleep(time.Second)
-						mainMenu()
-						break
-					case "2":
-						debugf("Record greeting\n")
-						api.SpeakSentenceToCall(form.CallID, "Say your greeting after beep. Press any key to complete recording.")
-						timerAPI.Sleep(5 * time.Second)
-						api.CreateGather(form.CallID, &bandwidth.CreateGatherData{
-							MaxDigits:         1,
-							InterDigitTimeout: 30,
-							Prompt:            &bandwidth.GatherPromptData{FileURL: beepURL},
-							Tag:               "Record",
-						})
-						timerAPI.Sleep(time.Second)
-						api.UpdateCall(form.CallID, &bandwidth.UpdateCallData{
-							RecordingEnabled: true,
-						})
-						break
-					case "3":
-						debugf("Reset greeting\n")
-						user.GreetingURL = ""
-						err := db.Save(user).Error
-						if err != nil {
-							debugf("Error on saving user's data %s\n", err.Error())
-							break
-						}
-						api.SpeakSentenceToCall(form.CallID, "Your greeting has been set to default.")
-						timerAPI.Sleep(time.Second)
-						mainMenu()
-						break
-					}
-
-				}
-				break
-			}
-		case "recording":
-			if form.State == "complete" {
-				recording, err := api.GetRecording(form.RecordingID)
-				if err != nil {
-					debugf("Error getting recording data: %s\n", err.Error())
-					break
-				}
-				user.GreetingURL = recording.Media
-				err = db.Save(user).Error
-				if err != nil {
-					debugf("Error on saving user's data %s\n", err.Error())
-					break
-				}
-				call, err := api.GetCall(form.CallID)
-				if err != nil {
-					debugf("Error getting call data: %s\n", err.Error())
-					break
-				}
-				if call.State == "active" {
-					api.SpeakSentenceToCall(form.CallID, "Your greeting has been saved.")
-					mainMenu()
-				}
-			}
-			break
+		err = handleCallbackOnce(c.Request.URL.Path, form, db, func(tx *gorm.DB) error {
+			handleGreetingSessionEvent(form, timerAPI.Now(), tx, api)
+			return nil
+		})
+		if err != nil {
+			setError(c, http.StatusInternalServerError, err, "Error on handling callback")
+			return
 		}
 		c.String(http.StatusOK, "")
 	})
@@ -359,11 +935,31 @@ func getRoutes(router *gin.Engine, db *gorm.DB, newVoiceMessageEvent *pubsub.Pub
 	router.GET("/voiceMessages", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
 		user := c.MustGet("user").(*User)
 		list := []VoiceMailMessage{}
-		err := db.Order("start_time desc").Model(user).Related(&list).Error
+		query := db.Order("start_time desc")
+		unreadQuery := db.Model(&VoiceMailMessage{}).Where("user_id = ? AND listened = ?", user.ID, false)
+		if folder := c.Query("folder"); folder != "" {
+			if !IsValidFolder(folder) {
+				setError(c, http.StatusBadRequest, fmt.Errorf("Unknown folder %q", folder))
+				return
+			}
+			query = query.Where("folder = ?", folder)
+			unreadQuery = unreadQuery.Where("folder = ?", folder)
+		}
+		if text := c.Query("q"); text != "" {
+			// full-text search by transcription of voice message
+			query = query.Where("to_tsvector('english', transcription) @@ plainto_tsquery('english', ?)", text)
+		}
+		err := query.Model(user).Related(&list).Error
 		if err != nil {
 			setError(c, http.StatusBadGateway, err, "Error on getting voice messages")
 			return
 		}
+		unreadCount := 0
+		if err = unreadQuery.Count(&unreadCount).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on getting count of unread voice messages")
+			return
+		}
+		c.Header("X-Unread-Count", strconv.Itoa(unreadCount))
 		result := make([]interface{}, len(list))
 		for i, m := range list {
 			result[i] = m.ToJSONObject()
@@ -371,6 +967,62 @@ func getRoutes(router *gin.Engine, db *gorm.DB, newVoiceMessageEvent *pubsub.Pub
 		c.JSON(http.StatusOK, result)
 	})
 
+	router.GET("/calls", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		query, err := parseCallRecordsQuery(c.Query)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		list := []CallRecord{}
+		total := 0
+		filtered := query.Apply(db.Model(&CallRecord{}).Where("user_id = ?", user.ID))
+		if err = filtered.Count(&total).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on getting count of calls")
+			return
+		}
+		err = filtered.Order("start_time desc").Offset((query.Page - 1) * query.Size).Limit(query.Size).Find(&list).Error
+		if err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on getting calls")
+			return
+		}
+		c.Header("X-Total-Count", strconv.Itoa(total))
+		result := make([]interface{}, len(list))
+		for i, record := range list {
+			result[i] = record.ToJSONObject()
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	router.GET("/export/:type", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		options, err := parseExportQuery(c.Param("type"), c.Query)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		options.UserID = user.ID
+		sendExportedData(c, options, db)
+	})
+
+	router.GET("/admin/export/:type", adminAuthMiddleware, func(c *gin.Context) {
+		options, err := parseExportQuery(c.Param("type"), c.Query)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		// data of all users by default
+		if userName := c.Query("user"); userName != "" {
+			user := &User{}
+			if db.First(user, "user_name = ?", userName).RecordNotFound() {
+				setErrorMessage(c, http.StatusNotFound, "User not found")
+				return
+			}
+			options.UserID = user.ID
+		}
+		sendExportedData(c, options, db)
+	})
+
 	router.GET("/voiceMessages/:id/media", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
 		api := c.MustGet("catapultAPI").(catapultAPIInterface)
 		user := c.MustGet("user").(*User)
@@ -380,18 +1032,56 @@ func getRoutes(router *gin.Engine, db *gorm.DB, newVoiceMessageEvent *pubsub.Pub
 			setError(c, http.StatusBadGateway, err, "Error on getting voice message data")
 			return
 		}
-		parts := strings.Split(message.MediaURL, "/")
-		reader, contentType, err := api.DownloadMediaFile(parts[len(parts)-1])
+		reader, contentType, err := api.DownloadMediaFile(getMediaName(message.MediaURL))
 		if err != nil {
 			setError(c, http.StatusBadGateway, err, "Error on downloading media file")
 			return
 		}
 		defer reader.Close()
+		if !message.Listened {
+			db.Model(message).Update("listened", true)
+		}
 		c.Header("Content-Type", contentType)
 		length, _ := io.Copy(c.Writer, reader)
 		c.Header("Content-Length", strconv.FormatInt(length, 10))
 	})
 
+	router.PATCH("/voiceMessages/:id", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+		form := &VoiceMessageUpdateForm{}
+		err := c.Bind(form)
+		if err != nil {
+			setError(c, http.StatusBadRequest, err)
+			return
+		}
+		changes := map[string]interface{}{}
+		if form.Folder != "" {
+			if !IsValidFolder(form.Folder) {
+				setError(c, http.StatusBadRequest, fmt.Errorf("Unknown folder %q", form.Folder))
+				return
+			}
+			changes["folder"] = form.Folder
+		}
+		if form.Listened != nil {
+			changes["listened"] = *form.Listened
+		}
+		if len(changes) == 0 {
+			setError(c, http.StatusBadRequest, errors.New("Nothing to change"))
+			return
+		}
+		message := &VoiceMailMessage{}
+		if db.Where("user_id = ? and id = ?", user.ID, c.Param("id")).First(message).RecordNotFound() {
+			setError(c, http.StatusNotFound, errors.New("Voice message is not found"))
+			return
+		}
+		if err = db.Model(message).Updates(changes).Error; err != nil {
+			setError(c, http.StatusBadGateway, err, "Error on updating a voice message")
+			return
+		}
+		newVoiceMessageEvent.Pub(&voiceMailMessageUpdate{message}, strconv.FormatUint(uint64(user.ID), 10))
+		c.JSON(http.StatusOK, message.ToJSONObject())
+	})
+
 	router.DELETE("/voiceMessages/:id", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
 		user := c.MustGet("user").(*User)
 		err := db.Where("user_id = ? and id = ?", user.ID, c.Param("id")).Delete(VoiceMailMessage{}).Error
@@ -402,31 +1092,44 @@ func getRoutes(router *gin.Engine, db *gorm.DB, newVoiceMessageEvent *pubsub.Pub
 		c.Status(http.StatusOK)
 	})
 
-	router.GET("/voiceMessagesStream", func(c *gin.Context) {
-
-		tokenString := c.Query("token")
-		token, err := j.Parse(tokenString, func(token *j.Token) (interface{}, error) {
-			if j.GetSigningMethod("HS256") != token.Method {
-				return nil, errors.New("Invalid signing algorithm")
-			}
-			return authMiddleware.Key, nil
-		})
+	router.POST("/streamTickets", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+		session := c.MustGet("session").(*Session)
+		ticket, expire, err := createStreamTicket(session, time.Now(), db)
 		if err != nil {
-			setError(c, http.StatusBadRequest, err, "Error on validating JWT token")
+			setError(c, http.StatusBadGateway, err, "Error on creating stream ticket")
 			return
 		}
-		user := &User{}
-		userID := token.Claims["id"].(string)
-		err = db.First(user, userID).Error
+		c.JSON(http.StatusOK, gin.H{
+			"ticket": ticket,
+			"expire": expire.Format(time.RFC3339),
+		})
+	})
+
+	router.GET("/voiceMessagesStream", func(c *gin.Context) {
+		// auth tokens are not accepted in the url (they would be kept in logs of servers and proxies)
+		user, session, err := redeemStreamTicket(c.Query("ticket"), time.Now(), db)
 		if err != nil {
-			setError(c, http.StatusBadGateway, err, "Error on getting user's data")
+			if err == errInvalidStreamTicket {
+				setError(c, http.StatusUnauthorized, err)
+			} else {
+				setError(c, http.StatusBadGateway, err, "Error on checking stream ticket")
+			}
 			return
 		}
+		userID := strconv.FormatUint(uint64(user.ID), 10)
 		channel := newVoiceMessageEvent.Sub(userID)
 		defer newVoiceMessageEvent.Unsub(channel)
+		// the stream is closed when the session is closed (logout, password change) or expired
+		checkSession := func() bool {
+			active, err := isSessionActive(session, time.Now(), db)
+			if err != nil {
+				debugf("Error on checking session of stream: %s\n", err.Error())
+			}
+			return active
+		}
 		debugf("Started streaming of new voice messages\n")
 		c.Stream(func(w io.Writer) bool {
-			return streamNewVoceMailMessage(c, channel)
+			return streamNewVoceMailMessage(c, channel, checkSession)
 		})
 	})
 
@@ -438,16 +1141,138 @@ type sseEmiter interface {
 	SSEvent(name string, message interface{})
 }
 
-func streamNewVoceMailMessage(c sseEmiter, channel chan interface{}) bool {
-	message := <-channel
-	json := message.(*VoiceMailMessage).ToJSONObject()
-	debugf("Received new message %+v\n", json)
-	c.SSEvent("message", json)
+// voiceMailMessageUpdate is published when data of existing voice message has been changed
+type voiceMailMessageUpdate struct {
+	*VoiceMailMessage
+}
+
+// streamNewVoceMailMessage waits for next message (but not longer than streamSessionCheckInterval) and sends it if
+// the session of the stream is still active. It returns false to close the stream.
+func streamNewVoceMailMessage(c sseEmiter, channel chan interface{}, checkSession func() bool) bool {
+	timer := time.NewTimer(streamSessionCheckInterval)
+	defer timer.Stop()
+	var event interface{}
+	select {
+	case event = <-channel:
+	case <-timer.C:
+	}
+	if !checkSession() {
+		debugf("Session of the stream has been closed\n")
+		return false
+	}
+	switch message := event.(type) {
+	case *VoiceMailMessage:
+		json := message.ToJSONObject()
+		debugf("Received new message %+v\n", json)
+		c.SSEvent("message", json)
+	case *voiceMailMessageUpdate:
+		json := message.ToJSONObject()
+		debugf("Received updated message %+v\n", json)
+		c.SSEvent("update", json)
+	}
 	return true
 }
 
-func handleVoiceMailEvent(form *CallbackForm, db *gorm.DB, api catapultAPIInterface, newVoiceMessageEvent *pubsub.PubSub) {
+// handleCallEvent handles events of calls from and to users
+func handleCallEvent(form *CallbackForm, host string, db *gorm.DB, api catapultAPIInterface, timerAPI timerInterface) error {
+	var err error
+	if form.EventType == "hangup" {
+		completeCallRecord(form.CallID, timerAPI.Now(), db)
+		// caller hung up, stop find me/follow me ringing if any
+		hangUpRingCalls(form.CallID, "", db, api)
+		return nil
+	}
+	if form.EventType == "transferComplete" {
+		// another side has answered the transferred call
+		markCallRecordAnswered(form.CallID, timerAPI.Now(), db)
+		return nil
+	}
+	if form.EventType == "answer" && form.To != "" && form.To == os.Getenv("VOICEMAIL_ACCESS_NUMBER") {
+		// a call to dedicated voice mail access number
+		caller := &User{}
+		if db.First(caller, "sip_uri = ? OR phone_number = ?", form.From, form.From).RecordNotFound() {
+			caller = nil // caller will be asked for mailbox number
+		}
+		startVoiceMailSession(form.CallID, caller, host, db, api)
+		return nil
+	}
+	user := &User{}
+	if !db.First(user, "sip_uri = ? OR phone_number = ?", form.From, form.To).RecordNotFound() {
+		if form.EventType == "answer" {
+			if form.From == user.SIPURI && form.To == user.PhoneNumber {
+				debugf("User %q calls to own voice mail\n", user.UserName)
+				startVoiceMailSession(form.CallID, user, host, db, api)
+				return nil
+			}
+			db.Create(&ActiveCall{
+				CallID: form.CallID,
+				UserID: user.ID,
+				From:   form.From,
+				To:     form.To,
+			})
+			direction := OutgoingCall
+			if form.To == user.PhoneNumber {
+				direction = IncomingCall
+			}
+			createCallRecord(form, user, direction, timerAPI.Now(), db)
+			if form.To == user.PhoneNumber {
+				if !checkUserAvailability(user, db, timerAPI.Now()) {
+					debugf("User %q doesn't accept calls now, moving call to voice mail\n", user.UserName)
+					startAfterHoursVoiceMail(form.CallID, user, host, timerAPI.Now(), api)
+					return nil
+				}
+				debugf("Transfering incoming call to %q\n", user.SIPURI)
+				callerID := form.From
+				anotherUser := &User{}
+				if strings.Index(callerID, "sip:") == 0 && !db.First(anotherUser, "sip_uri = ?", callerID).RecordNotFound() {
+					// try to use phone number for caller id instead of sip uri
+					callerID = anotherUser.PhoneNumber
+				}
+				debugf("Using caller id %q\n", callerID)
+				steps := []RingStep{}
+				db.Where("user_id = ?", user.ID).Order("position").Find(&steps)
+				if len(steps) > 0 {
+					err = ringFollowMe(form.CallID, callerID, user, steps, 0, host, timerAPI.Now(), db, api)
+					if err != nil {
+						debugf("Error on starting find me/follow me ringing: %s\n", err.Error())
+					}
+					return nil
+				}
+				transferedCallID, _ := api.UpdateCall(form.CallID, &bandwidth.UpdateCallData{
+					State:            "transferring",
+					TransferTo:       user.SIPURI,
+					TransferCallerID: callerID,
+					CallbackURL:      buildCallbackURL(host, "/transferCallback"), // to handle redirection to voice mail
+				})
+				setCallRecordTransferredCallID(form.CallID, transferedCallID, db)
+				debugf("Waiting for answer call %s\n", transferedCallID)
+				err = enqueueJob(db, checkTransferredCallJob, &transferredCallJobData{CallID: transferedCallID},
+					timerAPI.Now().Add(user.GetNoAnswerTimeout()))
+				if err != nil {
+					debugf("Error on scheduling check of call %s: %s\n", transferedCallID, err.Error())
+				}
+				return nil
+			}
+			if form.From == user.SIPURI {
+				debugf("Transfering outgoing call to  %q\n", form.To)
+				api.UpdateCall(form.CallID, &bandwidth.UpdateCallData{
+					State:            "transferring",
+					TransferTo:       form.To,
+					TransferCallerID: user.PhoneNumber,
+				})
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func handleVoiceMailEvent(form *CallbackForm, host string, db *gorm.DB, api catapultAPIInterface, timerAPI timerInterface,
+	emailSender emailSenderInterface, newVoiceMessageEvent notificationBus) error {
 	debugf("Handle voice mail event\n")
+	if form.EventType == "transcription" {
+		return handleTranscriptionEvent(form, db, api, newVoiceMessageEvent)
+	}
 	var user *User
 	var err error
 	if form.EventType == "answer" {
@@ -456,9 +1281,12 @@ func handleVoiceMailEvent(form *CallbackForm, db *gorm.DB, api catapultAPIInterf
 	} else {
 		user, err = getUserForCall(form, db)
 	}
-	if err != nil {
+	if err == gorm.ErrRecordNotFound {
 		debugf("Error on getting user: %s\n", err.Error())
-		return
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 	switch form.EventType {
 	case "answer":
@@ -468,34 +1296,91 @@ func handleVoiceMailEvent(form *CallbackForm, db *gorm.DB, api catapultAPIInterf
 			From:   form.From,
 			To:     form.To,
 		})
-		playGreeting(form.CallID, user, api)
-		api.PlayAudioToCall(form.CallID, beepURL)
-		api.UpdateCall(form.CallID, &bandwidth.UpdateCallData{RecordingEnabled: true})
+		reason := NoAnswerGreeting
+		if record := findCallRecord(form.CallID, db); record != nil && record.Busy {
+			reason = BusyGreeting
+		}
+		startVoiceMailRecording(form.CallID, user, reason, timerAPI.Now(), api)
 		break
 	case "recording":
 		if form.State == "complete" {
 			debugf("Recording %s has been completed.\n", form.RecordingID)
-			recording, _ := api.GetRecording(form.RecordingID)
-			call, _ := api.GetCall(form.CallID)
+			if !db.First(&VoiceMailMessage{}, "recording_id = ?", form.RecordingID).RecordNotFound() {
+				debugf("Voice mail message for recording %s exists already\n", form.RecordingID)
+				return nil
+			}
+			recording, err := api.GetRecording(form.RecordingID)
+			if err != nil {
+				return err
+			}
+			call, err := api.GetCall(form.CallID)
+			if err != nil {
+				return err
+			}
 			message := &VoiceMailMessage{
-				MediaURL:  recording.Media,
-				StartTime: parseTime(recording.StartTime),
-				EndTime:   parseTime(recording.EndTime),
-				UserID:    user.ID,
-				From:      call.From,
+				MediaURL:    recording.Media,
+				StartTime:   parseTime(recording.StartTime),
+				EndTime:     parseTime(recording.EndTime),
+				UserID:      user.ID,
+				From:        call.From,
+				RecordingID: form.RecordingID,
 			}
-			err := db.Create(message).Error
+			if err := db.Create(message).Error; err != nil {
+				return err
+			}
+			markCallRecordVoiceMail(form.CallID, db)
+
+			// text of the message will be received later with "transcription" event
+			transcriptionID, err := api.CreateRecordingTranscription(form.RecordingID)
 			if err != nil {
-				debugf("Error on on saving voice mail message: %s\n", err.Error())
-				return
+				debugf("Error on creating transcription: %s\n", err.Error())
+			} else {
+				db.Model(message).Update("transcription_id", transcriptionID)
 			}
 
 			// send notification about new voice mail message
 			if newVoiceMessageEvent != nil {
 				newVoiceMessageEvent.Pub(message, strconv.FormatUint(uint64(user.ID), 10))
 			}
+			sendVoiceMailSMSNotification(message, user, host, api)
+			if emailSender != nil {
+				queueVoiceMailEmail(message, user, timerAPI.Now(), db)
+			}
 		}
 	}
+	return nil
+}
+
+func handleTranscriptionEvent(form *CallbackForm, db *gorm.DB, api catapultAPIInterface, newVoiceMessageEvent notificationBus) error {
+	if form.State != "completed" {
+		return nil
+	}
+	message := &VoiceMailMessage{}
+	err := db.First(message, "recording_id = ?", form.RecordingID).Error
+	if err == gorm.ErrRecordNotFound {
+		debugf("Error on getting voice mail message: %s\n", err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	transcription, err := api.GetRecordingTranscription(form.RecordingID, form.TranscriptionID)
+	if err != nil {
+		return err
+	}
+	err = db.Model(message).Updates(map[string]interface{}{
+		"transcription_id": form.TranscriptionID,
+		"transcription":    transcription.Text,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	// send notification about changed voice mail message
+	if newVoiceMessageEvent != nil {
+		newVoiceMessageEvent.Pub(&voiceMailMessageUpdate{message}, strconv.FormatUint(uint64(message.UserID), 10))
+	}
+	return nil
 }
 
 func getUserForCall(form *CallbackForm, db *gorm.DB) (*User, error) {
@@ -509,12 +1394,53 @@ func getUserForCall(form *CallbackForm, db *gorm.DB) (*User, error) {
 	return user, err
 }
 
-func playGreeting(callID string, user *User, api catapultAPIInterface) {
-	if user.GreetingURL == "" {
+func sendVoiceMailSMSNotification(message *VoiceMailMessage, user *User, host string, api catapultAPIInterface) {
+	if !user.SMSNotificationsEnabled || user.NotificationNumber == "" {
+		return
+	}
+	debugf("Sending SMS notification about new voice message to %s\n", user.NotificationNumber)
+	duration := message.EndTime.Sub(message.StartTime) / time.Second
+	_, err := api.CreateMessage(&bandwidth.CreateMessageData{
+		From: user.PhoneNumber,
+		To:   user.NotificationNumber,
+		Text: fmt.Sprintf("New voice message from %s (%d seconds). Listen to it on http://%s/", message.From, duration, host),
+	})
+	if err != nil {
+		debugf("Error on sending SMS notification: %s\n", err.Error())
+	}
+}
+
+// playGreeting plays a greeting which suits the reason of moving the call to voice mail
+func playGreeting(callID string, user *User, reason string, now time.Time, api catapultAPIInterface) {
+	playGreetingURL(callID, user, user.SelectGreetingURL(reason, now), api)
+}
+
+func playGreetingURL(callID string, user *User, url string, api catapultAPIInterface) {
+	if url == "" {
 		api.SpeakSentenceToCall(callID, fmt.Sprintf("Hello. You have called to %s. Please leave a message after beep.", user.PhoneNumber))
 	} else {
-		api.PlayAudioToCall(callID, user.GreetingURL)
+		api.PlayAudioToCall(callID, url)
+	}
+}
+
+// sendExportedData streams exported data as attachment
+func sendExportedData(c *gin.Context, options *ExportOptions, db *gorm.DB) {
+	c.Header("Content-Type", options.ContentType())
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(options)))
+	c.Status(http.StatusOK)
+	// data is streamed so errors can't change response status
+	if err := exportData(c.Writer, options, db); err != nil {
+		debugf("Error on exporting data: %s\n", err.Error())
+	}
+}
+
+// setCatapultError reports failed request to Catapult (with status 503 if Catapult is unavailable now)
+func setCatapultError(c *gin.Context, err error, message string) {
+	if err == errCatapultUnavailable || err == errCatapultTimeout {
+		setError(c, http.StatusServiceUnavailable, err, err.Error())
+		return
 	}
+	setError(c, http.StatusBadGateway, err, message)
 }
 
 func setErrorMessage(c *gin.Context, code int, message string) {
@@ -535,6 +1461,12 @@ func setError(c *gin.Context, code int, err error, message ...string) {
 	setErrorMessage(c, code, errorMessage)
 }
 
+// getMediaName returns name of media file by its url
+func getMediaName(mediaURL string) string {
+	parts := strings.Split(mediaURL, "/")
+	return parts[len(parts)-1]
+}
+
 func parseTime(isoTime string) time.Time {
 	time, _ := time.Parse(time.RFC3339Nano, isoTime)
 	return time
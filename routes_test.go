@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -18,8 +20,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
-	"github.com/tuxychandru/pubsub"
 )
 
 func TestRouteRegister(t *testing.T) {
@@ -33,8 +35,8 @@ func TestRouteRegister(t *testing.T) {
 	db := openDBConnection(t)
 	defer db.Close()
 
-	api.On("CreatePhoneNumber", "910").Return("+1234567890", nil)
-	api.On("CreateSIPAccount").Return(&sipAccount{
+	api.On("CreatePhoneNumber", "910", mock.Anything).Return("+1234567890", nil)
+	api.On("CreateSIPAccount", mock.Anything).Return(&sipAccount{
 		EndpointID: "endpointId",
 		URI:        "test@test.net",
 		Password:   "12345678",
@@ -50,6 +52,11 @@ func TestRouteRegister(t *testing.T) {
 	assert.Equal(t, "test@test.net", user.SIPURI)
 	assert.Equal(t, "12345678", user.SIPPassword)
 	assert.True(t, user.ComparePasswords("123456"))
+	registration := &Registration{}
+	assert.NoError(t, db.First(registration, "user_name = ?", "user1").Error)
+	assert.Equal(t, registrationCompleted, registration.State)
+	assert.Equal(t, user.ID, registration.UserID)
+	assert.Empty(t, registration.PasswordHash)
 }
 
 func TestRouteRegisterFailWithMismatchedPaswords(t *testing.T) {
@@ -65,8 +72,8 @@ func TestRouteRegisterFailWithMismatchedPaswords(t *testing.T) {
 
 	w := makeRequest(t, api, nil, db, http.MethodPost, "/register", "", data)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
-	api.AssertNotCalled(t, "CreatePhoneNumber")
-	api.AssertNotCalled(t, "CreateSIPAccount")
+	api.AssertNotCalled(t, "CreatePhoneNumber", mock.Anything, mock.Anything)
+	api.AssertNotCalled(t, "CreateSIPAccount", mock.Anything)
 	user := &User{}
 	assert.True(t, db.First(user, "user_name = ?", "user1").RecordNotFound())
 }
@@ -84,8 +91,8 @@ func TestRouteRegisterFailWithShortPassword(t *testing.T) {
 
 	w := makeRequest(t, api, nil, db, http.MethodPost, "/register", "", data)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
-	api.AssertNotCalled(t, "CreatePhoneNumber")
-	api.AssertNotCalled(t, "CreateSIPAccount")
+	api.AssertNotCalled(t, "CreatePhoneNumber", mock.Anything, mock.Anything)
+	api.AssertNotCalled(t, "CreateSIPAccount", mock.Anything)
 	user := &User{}
 	assert.True(t, db.First(user, "user_name = ?", "user1").RecordNotFound())
 }
@@ -101,8 +108,8 @@ func TestRouteRegisterFailWithMissingFields(t *testing.T) {
 
 	w := makeRequest(t, api, nil, db, http.MethodPost, "/register", "", data)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
-	api.AssertNotCalled(t, "CreatePhoneNumber")
-	api.AssertNotCalled(t, "CreateSIPAccount")
+	api.AssertNotCalled(t, "CreatePhoneNumber", mock.Anything, mock.Anything)
+	api.AssertNotCalled(t, "CreateSIPAccount", mock.Anything)
 	user := &User{}
 	assert.True(t, db.First(user, "user_name = ?", "user1").RecordNotFound())
 }
@@ -120,8 +127,8 @@ func TestRouteRegisterFailWithSameUser(t *testing.T) {
 	db.Create(&User{UserName: "user1", AreaCode: "910"})
 	w := makeRequest(t, api, nil, db, http.MethodPost, "/register", "", data)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
-	api.AssertNotCalled(t, "CreatePhoneNumber")
-	api.AssertNotCalled(t, "CreateSIPAccount")
+	api.AssertNotCalled(t, "CreatePhoneNumber", mock.Anything, mock.Anything)
+	api.AssertNotCalled(t, "CreateSIPAccount", mock.Anything)
 }
 
 func TestRouteRegisterFailWithFailedCreatePhoneNumber(t *testing.T) {
@@ -132,12 +139,12 @@ func TestRouteRegisterFailWithFailedCreatePhoneNumber(t *testing.T) {
 		"repeatPassword": "123456",
 	}
 	api := &fakeCatapultAPI{}
-	api.On("CreatePhoneNumber", "910").Return("", errors.New("Error"))
+	api.On("CreatePhoneNumber", "910", mock.Anything).Return("", errors.New("Error"))
 	db := openDBConnection(t)
 	defer db.Close()
 	w := makeRequest(t, api, nil, db, http.MethodPost, "/register", "", data)
 	assert.Equal(t, http.StatusBadGateway, w.Code)
-	api.AssertNotCalled(t, "CreateSIPAccount")
+	api.AssertNotCalled(t, "CreateSIPAccount", mock.Anything)
 	user := &User{}
 	assert.True(t, db.First(user, "user_name = ?", "user1").RecordNotFound())
 }
@@ -150,16 +157,82 @@ func TestRouteRegisterFailWithFailedCreateSIPAccount(t *testing.T) {
 		"repeatPassword": "123456",
 	}
 	api := &fakeCatapultAPI{}
-	api.On("CreatePhoneNumber", "910").Return("+1234567890", nil)
-	api.On("CreateSIPAccount").Return((*sipAccount)(nil), errors.New("Error"))
+	api.On("CreatePhoneNumber", "910", mock.Anything).Return("+1234567890", nil)
+	api.On("CreateSIPAccount", mock.Anything).Return((*sipAccount)(nil), errors.New("Error"))
+	api.On("ReleasePhoneNumber", "+1234567890").Return(nil)
 	db := openDBConnection(t)
 	defer db.Close()
 	w := makeRequest(t, api, nil, db, http.MethodPost, "/register", "", data)
 	assert.Equal(t, http.StatusBadGateway, w.Code)
+	api.AssertExpectations(t)
 	user := &User{}
 	assert.True(t, db.First(user, "user_name = ?", "user1").RecordNotFound())
 }
 
+func TestRouteRegisterWithTimedOutCreateSIPAccount(t *testing.T) {
+	data := gin.H{
+		"userName":       "user1",
+		"areaCode":       "910",
+		"password":       "123456",
+		"repeatPassword": "123456",
+	}
+	api := &fakeCatapultAPI{}
+	api.On("CreatePhoneNumber", "910", mock.Anything).Return("+1234567890", nil)
+	api.On("CreateSIPAccount", mock.Anything).Return((*sipAccount)(nil), errCatapultTimeout)
+	db := openDBConnection(t)
+	defer db.Close()
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/register", "", data)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	// the SIP account could be created, so the registration is not failed yet
+	api.AssertNotCalled(t, "ReleasePhoneNumber", "+1234567890")
+	registration := &Registration{}
+	require.NoError(t, db.First(registration, "user_name = ?", "user1").Error)
+	assert.Equal(t, registrationNumberCreated, registration.State)
+	assert.Equal(t, errCatapultTimeout.Error(), registration.LastError)
+	resourceName := api.Calls[1].Arguments.String(0)
+	assert.Equal(t, resourceName, registration.ResourceName)
+	// recovery finds the created SIP account and releases it
+	api.On("FindSIPAccount", resourceName).Return("endpointId", nil)
+	api.On("DeleteSIPAccount", "endpointId").Return(nil)
+	api.On("ReleasePhoneNumber", "+1234567890").Return(nil)
+	recoverRegistrations(db, api, &fakeTimerAPI{CurrentTime: time.Now().Add(registrationTimeout + time.Minute)})
+	api.AssertExpectations(t)
+	registration = getRegistration(t, db, registration.ID)
+	assert.Equal(t, registrationFailed, registration.State)
+	assert.Equal(t, "", registration.EndpointID)
+	assert.Equal(t, "", registration.PhoneNumber)
+}
+
+func TestRouteRegisterFailWithFailedSavingOfUser(t *testing.T) {
+	data := gin.H{
+		"userName":       "user1",
+		"areaCode":       "910",
+		"password":       "123456",
+		"repeatPassword": "123456",
+	}
+	api := &fakeCatapultAPI{}
+	api.On("CreatePhoneNumber", "910", mock.Anything).Return("+1234567890", nil)
+	api.On("CreateSIPAccount", mock.Anything).Return(&sipAccount{
+		EndpointID: "endpointId",
+		URI:        "test@test.net",
+		Password:   "12345678",
+	}, nil)
+	api.On("DeleteSIPAccount", "endpointId").Return(nil)
+	api.On("ReleasePhoneNumber", "+1234567890").Return(nil)
+	db := openDBConnection(t)
+	defer db.Close()
+	// phone numbers are unique
+	db.Create(&User{UserName: "user2", AreaCode: "910", PhoneNumber: "+1234567890"})
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/register", "", data)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	api.AssertExpectations(t)
+	assert.True(t, db.First(&User{}, "user_name = ?", "user1").RecordNotFound())
+	registration := &Registration{}
+	assert.NoError(t, db.First(registration, "user_name = ?", "user1").Error)
+	assert.Equal(t, registrationFailed, registration.State)
+	assert.Empty(t, registration.PasswordHash)
+}
+
 func TestRouteLogin(t *testing.T) {
 	data := gin.H{
 		"userName": "user1",
@@ -216,6 +289,232 @@ func TestRouteRefreshToken(t *testing.T) {
 	assert.NotEmpty(t, result["expire"])
 }
 
+func TestRouteLoginWithRotatedPepper(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	user.SetPassword("123456") // legacy pepper
+	assert.NoError(t, db.Create(user).Error)
+	defer useConfig(&appConfig{
+		JWTKeys:       []string{testJWTKey1},
+		Peppers:       map[int]string{0: legacyPepper, 1: "pepper1pepper1pepper1"},
+		PepperVersion: 1,
+	})()
+	w := makeRequest(t, nil, nil, db, http.MethodPost, "/login", "", gin.H{"userName": "user1", "password": "123456"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, db.First(user, user.ID).Error)
+	assert.Equal(t, 1, user.PepperVersion)
+	assert.True(t, user.ComparePasswords("123456"))
+}
+
+func TestRouteRefreshTokenSignedByPreviousKey(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	assert.NoError(t, db.Create(user).Error)
+	session, err := createSession(user, "", "", time.Hour, time.Now(), db)
+	require.NoError(t, err)
+	defer useConfig(&appConfig{JWTKeys: []string{testJWTKey2, testJWTKey1}, Peppers: map[int]string{0: legacyPepper}})()
+	tokenString := createJWT(t, testJWTKey1, fmt.Sprintf("%d", user.ID), time.Now().Add(time.Hour), session.TokenID)
+	result := map[string]string{}
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/refreshToken", tokenString, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// new token is signed by current key
+	_, err = parseJWT(result["token"], [][]byte{[]byte(testJWTKey2)})
+	assert.NoError(t, err)
+	// unknown keys are rejected
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/refreshToken", createJWT(t, "33333333333333333333333333333333", "1", time.Now().Add(time.Hour)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func login(t *testing.T, db *gorm.DB, userName, password string) string {
+	result := map[string]string{}
+	w := makeRequest(t, nil, nil, db, http.MethodPost, "/login", "", gin.H{"userName": userName, "password": password}, &result)
+	require.Equal(t, http.StatusOK, w.Code)
+	return result["token"]
+}
+
+func TestRouteLogout(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token1 := createUserAndLogin(t, db)
+	token2 := login(t, db, "user1", "123456")
+	w := makeRequest(t, nil, nil, db, http.MethodPost, "/logout", token1)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token1)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/refreshToken", token1)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	// other sessions are still active
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token2)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRouteLogoutAll(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token1 := createUserAndLogin(t, db)
+	token2 := login(t, db, "user1", "123456")
+	w := makeRequest(t, nil, nil, db, http.MethodPost, "/logoutAll", token1)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token1)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token2)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRouteGetSessions(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token1 := createUserAndLogin(t, db)
+	login(t, db, "user1", "123456")
+	result := []map[string]interface{}{}
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/sessions", token1, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, result, 2)
+	current := 0
+	for _, session := range result {
+		assert.NotEmpty(t, session["id"])
+		assert.NotEmpty(t, session["expiresAt"])
+		if session["current"].(bool) {
+			current++
+		}
+	}
+	assert.Equal(t, 1, current)
+}
+
+func TestRouteWithTokenWithoutSession(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	createUserAndLogin(t, db)
+	user := &User{}
+	require.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	token := createJWT(t, developmentJWTKey, fmt.Sprintf("%d", user.ID), time.Now().Add(time.Hour))
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	token = createJWT(t, developmentJWTKey, fmt.Sprintf("%d", user.ID), time.Now().Add(time.Hour), "unknown")
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRouteChangePassword(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	otherToken := login(t, db, "user1", "123456")
+	result := map[string]string{}
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/password", token, gin.H{
+		"oldPassword":    "123456",
+		"password":       "1234567",
+		"repeatPassword": "1234567",
+	}, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	user := &User{}
+	require.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.True(t, user.ComparePasswords("1234567"))
+	// previous tokens are invalid
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", otherToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", result["token"])
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRouteChangePasswordFail(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/password", token, gin.H{
+		"oldPassword":    "1111111",
+		"password":       "1234567",
+		"repeatPassword": "1234567",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodPut, "/password", token, gin.H{
+		"oldPassword":    "123456",
+		"password":       "1234567",
+		"repeatPassword": "7654321",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodPut, "/password", token, gin.H{
+		"oldPassword":    "123456",
+		"password":       "1",
+		"repeatPassword": "1",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRoutePasswordReset(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	db.Model(&User{}).Where("user_name = ?", "user1").Update("notification_number", "+1234567891")
+	code := ""
+	api.On("CreateMessage", mock.Anything).Return("id", nil).Run(func(args mock.Arguments) {
+		data := args.Get(0).(*bandwidth.CreateMessageData)
+		assert.Equal(t, "+1234567890", data.From)
+		assert.Equal(t, "+1234567891", data.To)
+		code = regexp.MustCompile(`\d{6}`).FindString(data.Text)
+	})
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/passwordReset", "", gin.H{"userName": "user1"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.NotEqual(t, "", code)
+	w = makeRequest(t, nil, nil, db, http.MethodPost, "/passwordReset/confirm", "", gin.H{
+		"userName":       "user1",
+		"code":           code,
+		"password":       "1234567",
+		"repeatPassword": "1234567",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	// all tokens are invalid after reset
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodPost, "/login", "", gin.H{"userName": "user1", "password": "1234567"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	// the code can be used once
+	w = makeRequest(t, nil, nil, db, http.MethodPost, "/passwordReset/confirm", "", gin.H{
+		"userName":       "user1",
+		"code":           code,
+		"password":       "7654321",
+		"repeatPassword": "7654321",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRoutePasswordResetForUnknownUser(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/passwordReset", "", gin.H{"userName": "unknown"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertNotCalled(t, "CreateMessage", mock.Anything)
+	w = makeRequest(t, api, nil, db, http.MethodPost, "/passwordReset/confirm", "", gin.H{
+		"userName":       "unknown",
+		"code":           "123456",
+		"password":       "1234567",
+		"repeatPassword": "1234567",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRoutePasswordResetFail(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	createUserAndLogin(t, db)
+	db.Model(&User{}).Where("user_name = ?", "user1").Update("notification_number", "+1234567891")
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/passwordReset", "", gin.H{"userName": "user1", "channel": "fax"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	api.On("CreateMessage", mock.Anything).Return("", errors.New("error"))
+	w = makeRequest(t, api, nil, db, http.MethodPost, "/passwordReset", "", gin.H{"userName": "user1"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+}
+
 func TestRouteSIPData(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
@@ -253,6 +552,60 @@ func TestRouteSIPDataFailUnauthorized(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
 
+func TestRouteGetNotificationSettings(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	db.Model(&User{}).Where("user_name = ?", "user1").Updates(map[string]interface{}{
+		"notification_number":       "+1987654321",
+		"sms_notifications_enabled": true,
+	})
+	result := map[string]interface{}{}
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/notificationSettings", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "+1987654321", result["notificationNumber"])
+	assert.Equal(t, true, result["smsNotificationsEnabled"])
+}
+
+func TestRouteUpdateNotificationSettings(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/notificationSettings", token, gin.H{
+		"notificationNumber":      "+1987654321",
+		"smsNotificationsEnabled": true,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.Equal(t, "+1987654321", user.NotificationNumber)
+	assert.True(t, user.SMSNotificationsEnabled)
+}
+
+func TestRouteUpdateNotificationSettingsFailWithInvalidNumber(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/notificationSettings", token, gin.H{
+		"notificationNumber":      "987-65-43",
+		"smsNotificationsEnabled": true,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.False(t, user.SMSNotificationsEnabled)
+}
+
+func TestRouteUpdateNotificationSettingsFailWithoutNumber(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/notificationSettings", token, gin.H{
+		"smsNotificationsEnabled": true,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestRouteIndex(t *testing.T) {
 	w := makeRequest(t, nil, nil, nil, http.MethodGet, "/", "")
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -275,7 +628,7 @@ func TestRouteCallCallbackOutgoingCall(t *testing.T) {
 		TransferTo:       "+1472583690",
 		TransferCallerID: "+1234567891",
 	}).Return("", nil)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback", "", &CallbackForm{
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:    "callID",
 		EventType: "answer",
 		From:      "sip:otest@test.com",
@@ -286,6 +639,74 @@ func TestRouteCallCallbackOutgoingCall(t *testing.T) {
 	api.On("GetCall", "").Return(&bandwidth.Call{}, nil)
 }
 
+func TestRouteCallCallbackAnswerTwice(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:otest@test.com",
+		PhoneNumber: "+1234567891",
+		UserName:    "ouser",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	db.Delete(&ActiveCall{}, "call_id = ?", "dupAnswerCallID")
+	db.Unscoped().Delete(&CallRecord{}, "call_id = ?", "dupAnswerCallID")
+	api.On("UpdateCall", "dupAnswerCallID", &bandwidth.UpdateCallData{
+		State:            "transferring",
+		TransferTo:       "+1472583690",
+		TransferCallerID: "+1234567891",
+	}).Return("", nil)
+	form := &CallbackForm{
+		CallID:    "dupAnswerCallID",
+		EventType: "answer",
+		From:      "sip:otest@test.com",
+		To:        "+1472583690",
+	}
+	for i := 0; i < 2; i++ {
+		w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", form)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	api.AssertNumberOfCalls(t, "UpdateCall", 1)
+	count := 0
+	db.Model(&ActiveCall{}).Where("call_id = ?", "dupAnswerCallID").Count(&count)
+	assert.Equal(t, 1, count)
+}
+
+func TestRouteRecordCallbackGatherTwice(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:otest@test.com",
+		PhoneNumber: "+1234567891",
+		UserName:    "ouser",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	createGreetingSession(t, db, user, "dupGatherCallID", greetingStateRecording)
+	api.On("UpdateCall", "dupGatherCallID", &bandwidth.UpdateCallData{RecordingEnabled: false}).Return("", nil)
+	timerAPI := &fakeTimerAPI{}
+	form := &CallbackForm{
+		CallID:    "dupGatherCallID",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       "Record",
+		GatherID:  "gatherID1",
+	}
+	for i := 0; i < 2; i++ {
+		w := makeRequest(t, api, timerAPI, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", form)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	api.AssertNumberOfCalls(t, "UpdateCall", 1)
+	// another gather is not expected after completing of recording
+	form.GatherID = "gatherID2"
+	makeRequest(t, api, timerAPI, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", form)
+	api.AssertNumberOfCalls(t, "UpdateCall", 1)
+}
+
 func TestRouteCallCallbackIncomingCall(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
@@ -302,9 +723,9 @@ func TestRouteCallCallbackIncomingCall(t *testing.T) {
 		State:            "transferring",
 		TransferTo:       "sip:itest@test.com",
 		TransferCallerID: "+1472583688",
-		CallbackURL:      "http:///transferCallback",
+		CallbackURL:      "http:///transferCallback?secret=callbackSecret",
 	}).Return("", nil)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback", "", &CallbackForm{
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:    "callID",
 		EventType: "answer",
 		From:      "+1472583688",
@@ -339,9 +760,9 @@ func TestRouteCallCallbackIncomingCallSipToSip(t *testing.T) {
 		State:            "transferring",
 		TransferTo:       "sip:i1test@test.com",
 		TransferCallerID: "+1234567802",
-		CallbackURL:      "http:///transferCallback",
+		CallbackURL:      "http:///transferCallback?secret=callbackSecret",
 	}).Return("", nil)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback", "", &CallbackForm{
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:    "callID",
 		EventType: "answer",
 		From:      "sip:i2test@test.com",
@@ -352,100 +773,655 @@ func TestRouteCallCallbackIncomingCallSipToSip(t *testing.T) {
 	api.On("GetCall", "").Return(&bandwidth.Call{}, nil)
 }
 
-func TestRouteCallCallbackWithUnknownNumber(t *testing.T) {
+func TestRouteCallCallbackCallToOwnVoiceMail(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
 	defer db.Close()
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback", "", &CallbackForm{
-		CallID:    "newCallID",
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:vmatest@test.com",
+		PhoneNumber: "+1234567893",
+		UserName:    "vmauser",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "vmaCallID")
+	api.On("UpdateCall", "vmaCallID", &bandwidth.UpdateCallData{
+		CallbackURL: "http:///voiceMailCallback?secret=callbackSecret",
+	}).Return("", nil)
+	api.On("CreateGather", "vmaCallID", mock.AnythingOfType("*bandwidth.CreateGatherData")).Return("", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "vmaCallID",
 		EventType: "answer",
-		From:      "+1472583688",
-		To:        "+1456567890",
+		From:      "sip:vmatest@test.com",
+		To:        "+1234567893",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
-	api.AssertNotCalled(t, "UpdateCall")
-	api.On("GetCall", "").Return(&bandwidth.Call{}, nil)
+	api.AssertExpectations(t)
+	session := &VoiceMailSession{}
+	assert.NoError(t, db.First(session, "call_id = ?", "vmaCallID").Error)
+	assert.Equal(t, user.ID, session.UserID)
+	assert.Equal(t, mailboxStatePIN, session.State)
 }
 
-func TestRouteCallCallbackIncomingCallRedirectToVoiceMail(t *testing.T) {
+func TestRouteCallCallbackCallToVoiceMailAccessNumber(t *testing.T) {
 	api := &fakeCatapultAPI{}
-	timerAPI := &fakeTimerAPI{}
 	db := openDBConnection(t)
 	defer db.Close()
-	user := &User{
-		AreaCode:    "910",
-		SIPURI:      "sip:vmtest@test.com",
-		PhoneNumber: "+1234567800",
-		UserName:    "vmiuser",
-	}
-	user.SetPassword("123456")
-	db.Save(user)
-	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{
-		State:            "transferring",
-		TransferTo:       "sip:vmtest@test.com",
-		TransferCallerID: "+1472583688",
-		CallbackURL:      "http:///transferCallback",
-	}).Return("111", nil)
-	api.On("GetCall", "111").Return(&bandwidth.Call{
-		State: "started",
-	}, nil)
-	api.On("UpdateCall", "111", &bandwidth.UpdateCallData{
-		State: "active",
-	}).Return("111", nil)
-	timerAPI.On("Sleep", 15*time.Second).Return()
-	w := makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback", "", &CallbackForm{
-		CallID:    "callID",
+	os.Setenv("VOICEMAIL_ACCESS_NUMBER", "+1234567000")
+	defer os.Unsetenv("VOICEMAIL_ACCESS_NUMBER")
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "vmaCallID1")
+	api.On("UpdateCall", "vmaCallID1", &bandwidth.UpdateCallData{
+		CallbackURL: "http:///voiceMailCallback?secret=callbackSecret",
+	}).Return("", nil)
+	api.On("CreateGather", "vmaCallID1", mock.AnythingOfType("*bandwidth.CreateGatherData")).Return("", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "vmaCallID1",
 		EventType: "answer",
 		From:      "+1472583688",
-		To:        "+1234567800",
+		To:        "+1234567000",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
-	time.Sleep(5 * time.Millisecond)
-	timerAPI.AssertExpectations(t)
 	api.AssertExpectations(t)
-	api.On("GetCall", "").Return(&bandwidth.Call{}, nil)
+	session := &VoiceMailSession{}
+	assert.NoError(t, db.First(session, "call_id = ?", "vmaCallID1").Error)
+	assert.Equal(t, mailboxStateMailbox, session.State)
 }
 
-func TestRouteCallCallbackIncomingCallDoNothingForAnsweredAndCompletedCalls(t *testing.T) {
+func TestRouteVoiceMailCallback(t *testing.T) {
 	api := &fakeCatapultAPI{}
-	timerAPI := &fakeTimerAPI{}
 	db := openDBConnection(t)
 	defer db.Close()
-	user := &User{
-		AreaCode:    "910",
-		SIPURI:      "sip:vmtest1@test.com",
-		PhoneNumber: "+1234567800",
-		UserName:    "vmi1user",
-	}
-	user.SetPassword("123456")
+	db.Delete(&VoiceMailSession{}, "call_id = ?", "vmaCallID2")
+	db.Create(&VoiceMailSession{CallID: "vmaCallID2", State: mailboxStateMenu})
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/voiceMailCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "vmaCallID2",
+		EventType: "hangup",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, db.First(&VoiceMailSession{}, "call_id = ?", "vmaCallID2").RecordNotFound())
+}
+
+func TestRouteSetVoiceMailPIN(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/voiceMailPIN", token, gin.H{"pin": "4321"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.True(t, user.ComparePIN("4321"))
+}
+
+func TestRouteSetVoiceMailPINFail(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/voiceMailPIN", token, gin.H{"pin": "12ab"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRouteCallbacksFailWithoutSecret(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	for _, path := range []string{"/callCallback", "/transferCallback", "/ringCallback", "/voiceMailCallback", "/recordCallback"} {
+		w := makeRequest(t, api, nil, nil, http.MethodPost, path, "", &CallbackForm{
+			CallID:    "newCallID",
+			EventType: "answer",
+			From:      "+1472583688",
+			To:        "+1234567890",
+		})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	api.AssertNotCalled(t, "UpdateCall")
+}
+
+func TestRouteCallbacksFailWithInvalidSecret(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	for _, path := range []string{"/callCallback?secret=", "/callCallback?secret=callbackSecret1", "/recordCallback?secret=secret"} {
+		w := makeRequest(t, api, nil, nil, http.MethodPost, path, "", &CallbackForm{
+			CallID:    "newCallID",
+			EventType: "recording",
+		})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	api.AssertNotCalled(t, "GetRecording")
+}
+
+func TestRouteCallCallbackWithUnknownNumber(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "newCallID",
+		EventType: "answer",
+		From:      "+1472583688",
+		To:        "+1456567890",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertNotCalled(t, "UpdateCall")
+	api.On("GetCall", "").Return(&bandwidth.Call{}, nil)
+}
+
+func TestRouteCallCallbackIncomingCallRedirectToVoiceMail(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:vmtest@test.com",
+		PhoneNumber: "+1234567800",
+		UserName:    "vmiuser",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{
+		State:            "transferring",
+		TransferTo:       "sip:vmtest@test.com",
+		TransferCallerID: "+1472583688",
+		CallbackURL:      "http:///transferCallback?secret=callbackSecret",
+	}).Return("111", nil)
+	api.On("GetCall", "111").Return(&bandwidth.Call{
+		State: "started",
+	}, nil)
+	api.On("UpdateCall", "111", &bandwidth.UpdateCallData{
+		State: "active",
+	}).Return("111", nil)
+	w := makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "answer",
+		From:      "+1472583688",
+		To:        "+1234567800",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, runDueJobs(db, api, timerAPI))
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(15 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	api.AssertExpectations(t)
+	api.On("GetCall", "").Return(&bandwidth.Call{}, nil)
+}
+
+func TestRouteCallCallbackIncomingCallDoNothingForAnsweredAndCompletedCalls(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:vmtest1@test.com",
+		PhoneNumber: "+1234567800",
+		UserName:    "vmi1user",
+	}
+	user.SetPassword("123456")
 	db.Save(user)
 	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{
 		State:            "transferring",
 		TransferTo:       "sip:vmtest1@test.com",
 		TransferCallerID: "+1472583688",
-		CallbackURL:      "http:///transferCallback",
+		CallbackURL:      "http:///transferCallback?secret=callbackSecret",
 	}).Return("111", nil)
 	api.On("GetCall", "111").Return(&bandwidth.Call{
 		State: "active",
 	}, nil)
-	timerAPI.On("Sleep", 15*time.Second).Return()
-	w := makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback", "", &CallbackForm{
+	w := makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:    "callID",
 		EventType: "answer",
 		From:      "+1472583688",
 		To:        "+1234567800",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
-	time.Sleep(5 * time.Millisecond)
-	timerAPI.AssertExpectations(t)
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(15 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
 	api.AssertExpectations(t)
+	api.AssertNotCalled(t, "UpdateCall", "111", &bandwidth.UpdateCallData{State: "active"})
 	api.On("GetCall", "").Return(&bandwidth.Call{}, nil)
 }
 
+func TestRouteCallCallbackIncomingCallWithNoAnswerTimeout(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:        "910",
+		SIPURI:          "sip:vmtest2@test.com",
+		PhoneNumber:     "+1234567801",
+		UserName:        "vmi2user",
+		NoAnswerTimeout: 30,
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{
+		State:            "transferring",
+		TransferTo:       "sip:vmtest2@test.com",
+		TransferCallerID: "+1472583688",
+		CallbackURL:      "http:///transferCallback?secret=callbackSecret",
+	}).Return("111", nil)
+	api.On("GetCall", "111").Return(&bandwidth.Call{
+		State: "active",
+	}, nil)
+	w := makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "answer",
+		From:      "+1472583688",
+		To:        "+1234567801",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(15 * time.Second)
+	assert.Equal(t, 0, runDueJobs(db, api, timerAPI))
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(15 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	api.AssertExpectations(t)
+}
+
+func TestRouteCallCallbackIncomingCallWithFollowMe(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "fmCallID")
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:vmtest3@test.com",
+		PhoneNumber: "+1234567802",
+		UserName:    "vmi3user",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	db.Delete(&RingStep{}, "user_id = ?", user.ID)
+	db.Create(&RingStep{UserID: user.ID, Position: 0, Targets: "+1987654327", Timeout: 10})
+	api.On("CreateCall", &bandwidth.CreateCallData{
+		From:        "+1234567802",
+		To:          "+1987654327",
+		CallbackURL: "http:///ringCallback?secret=callbackSecret",
+		Tag:         "fmCallID",
+	}).Return("fmCall1", nil)
+	w := makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "fmCallID",
+		EventType: "answer",
+		From:      "+1472583688",
+		To:        "+1234567802",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	db.Model(&RingCall{}).Where("call_id = ?", "fmCall1").Update("answered", true)
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(10 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timerAPI))
+	api.AssertExpectations(t)
+}
+
+func TestRouteCallCallbackHangupStopsFollowMe(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "fmCallID2")
+	db.Create(&RingCall{CallID: "fmCall2", IncomingCallID: "fmCallID2"})
+	api.On("UpdateCall", "fmCall2", &bandwidth.UpdateCallData{State: "completed"}).Return("", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "fmCallID2",
+		EventType: "hangup",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+}
+
+func TestRouteRingCallback(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Delete(&RingCall{}, "incoming_call_id = ?", "fmCallID3")
+	db.Create(&RingCall{CallID: "fmCall3", IncomingCallID: "fmCallID3"})
+	api.On("CreateBridge", &bandwidth.BridgeData{
+		BridgeAudio: true,
+		CallIDs:     []string{"fmCallID3", "fmCall3"},
+	}).Return("bridgeID", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/ringCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "fmCall3",
+		EventType: "answer",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+}
+
+func TestRouteGetRingSettings(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := &User{}
+	db.First(user, "user_name = ?", "user1")
+	db.Delete(&RingStep{}, "user_id = ?", user.ID)
+	db.Create(&RingStep{UserID: user.ID, Position: 1, Targets: "+1987654321", Timeout: 20})
+	db.Create(&RingStep{UserID: user.ID, Position: 0, Targets: "sip:desk@test.com,+1987654322", Timeout: 10})
+	result := map[string]interface{}{}
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/ringSettings", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, DefaultNoAnswerTimeout, result["noAnswerTimeout"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"targets": []interface{}{"sip:desk@test.com", "+1987654322"}, "timeout": float64(10)},
+		map[string]interface{}{"targets": []interface{}{"+1987654321"}, "timeout": float64(20)},
+	}, result["steps"])
+}
+
+func TestRouteUpdateRingSettings(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/ringSettings", token, gin.H{
+		"noAnswerTimeout": 25,
+		"steps": []gin.H{
+			gin.H{"targets": []string{"sip:desk@test.com", "+1987654322"}, "timeout": 10},
+			gin.H{"targets": []string{"+1987654321"}, "timeout": 20},
+		},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.Equal(t, 25, user.NoAnswerTimeout)
+	steps := []RingStep{}
+	db.Where("user_id = ?", user.ID).Order("position").Find(&steps)
+	assert.Equal(t, 2, len(steps))
+	assert.Equal(t, "sip:desk@test.com,+1987654322", steps[0].Targets)
+	assert.Equal(t, 20, steps[1].Timeout)
+}
+
+func TestRouteUpdateRingSettingsFailWithInvalidData(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/ringSettings", token, gin.H{
+		"noAnswerTimeout": 1,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodPut, "/ringSettings", token, gin.H{
+		"steps": []gin.H{gin.H{"targets": []string{"987-65-43"}, "timeout": 10}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodPut, "/ringSettings", token, gin.H{
+		"steps": []gin.H{gin.H{"targets": []string{}, "timeout": 10}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRouteCallCallbackIncomingCallAfterHours(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Date(2016, 12, 24, 12, 0, 0, 0, time.UTC)}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:              "910",
+		SIPURI:                "sip:vmtest4@test.com",
+		PhoneNumber:           "+1234567803",
+		UserName:              "vmi4user",
+		AfterHoursGreetingURL: "http://afterHours",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	db.Delete(&WorkingHours{}, "user_id = ?", user.ID)
+	db.Create(&WorkingHours{UserID: user.ID, Weekday: 1, StartMinute: 9 * 60, EndMinute: 17 * 60})
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{CallbackURL: "http:///transferCallback?secret=callbackSecret"}).Return("", nil)
+	api.On("PlayAudioToCall", "callID", "http://afterHours").Return(nil)
+	api.On("PlayAudioToCall", "callID", beepURL).Return(nil)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
+	w := makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "answer",
+		From:      "+1472583688",
+		To:        "+1234567803",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+}
+
+func TestRouteGetSchedule(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := &User{}
+	db.First(user, "user_name = ?", "user1")
+	db.Delete(&WorkingHours{}, "user_id = ?", user.ID)
+	db.Create(&WorkingHours{UserID: user.ID, Weekday: 1, StartMinute: 9 * 60, EndMinute: 17*60 + 30})
+	result := map[string]interface{}{}
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/schedule", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "UTC", result["timeZone"])
+	assert.Equal(t, false, result["doNotDisturb"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"weekday": float64(1), "start": "09:00", "end": "17:30"},
+	}, result["workingHours"])
+}
+
+func TestRouteUpdateSchedule(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/schedule", token, gin.H{
+		"timeZone": "America/New_York",
+		"workingHours": []gin.H{
+			gin.H{"weekday": 1, "start": "09:00", "end": "17:00"},
+			gin.H{"weekday": 2, "start": "10:00", "end": "18:00"},
+		},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.Equal(t, "America/New_York", user.TimeZone)
+	hours := []WorkingHours{}
+	db.Where("user_id = ?", user.ID).Order("weekday").Find(&hours)
+	assert.Equal(t, 2, len(hours))
+	assert.Equal(t, 600, hours[1].StartMinute)
+}
+
+func TestRouteUpdateScheduleFailWithInvalidData(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/schedule", token, gin.H{
+		"timeZone": "Unknown/Zone",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodPut, "/schedule", token, gin.H{
+		"workingHours": []gin.H{gin.H{"weekday": 1, "start": "18:00", "end": "09:00"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRouteDoNotDisturb(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/doNotDisturb", token, gin.H{"enabled": true})
+	assert.Equal(t, http.StatusOK, w.Code)
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.True(t, user.DoNotDisturb)
+}
+
+func TestRouteHolidays(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	holiday := map[string]interface{}{}
+	w := makeRequest(t, nil, nil, db, http.MethodPost, "/holidays", token, gin.H{
+		"date": "2016-12-25",
+		"name": "Christmas",
+	}, &holiday)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "2016-12-25", holiday["date"])
+	list := []interface{}{}
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/holidays", token, nil, &list)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(list))
+	w = makeRequest(t, nil, nil, db, http.MethodDelete, fmt.Sprintf("/holidays/%v", holiday["id"]), token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodDelete, fmt.Sprintf("/holidays/%v", holiday["id"]), token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRouteAddHolidayFailWithInvalidDate(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPost, "/holidays", token, gin.H{"date": "25.12.2016"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRouteCallCallbackCreatesCallRecord(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timerAPI := &fakeTimerAPI{CurrentTime: time.Date(2016, 12, 20, 12, 0, 0, 0, time.UTC)}
+	db := openDBConnection(t)
+	defer db.Close()
+	db.Unscoped().Delete(&CallRecord{}, "call_id = ?", "crOutCallID")
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:crtest@test.com",
+		PhoneNumber: "+1234567804",
+		UserName:    "cruser",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	api.On("UpdateCall", "crOutCallID", &bandwidth.UpdateCallData{
+		State:            "transferring",
+		TransferTo:       "+1472583688",
+		TransferCallerID: "+1234567804",
+	}).Return("", nil)
+	w := makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "crOutCallID",
+		EventType: "answer",
+		From:      "sip:crtest@test.com",
+		To:        "+1472583688",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(5 * time.Second)
+	w = makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "crOutCallID",
+		EventType: "transferComplete",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	timerAPI.CurrentTime = timerAPI.CurrentTime.Add(30 * time.Second)
+	w = makeRequest(t, api, timerAPI, db, http.MethodPost, "/callCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "crOutCallID",
+		EventType: "hangup",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	record := findCallRecord("crOutCallID", db)
+	assert.Equal(t, OutgoingCall, record.Direction)
+	assert.Equal(t, user.ID, record.UserID)
+	assert.Equal(t, AnsweredCall, record.Disposition)
+	assert.Equal(t, 30, record.Duration)
+}
+
+func TestRouteGetCalls(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := &User{}
+	db.First(user, "user_name = ?", "user1")
+	startTime := time.Date(2016, 12, 20, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		db.Unscoped().Delete(&CallRecord{}, "call_id = ?", fmt.Sprintf("glCallID%d", i))
+		disposition := AnsweredCall
+		if i%2 == 0 {
+			disposition = MissedCall
+		}
+		db.Create(&CallRecord{
+			CallID:      fmt.Sprintf("glCallID%d", i),
+			UserID:      user.ID,
+			Direction:   IncomingCall,
+			From:        "+1472583688",
+			To:          "+1234567890",
+			StartTime:   startTime.Add(time.Duration(i) * time.Hour),
+			Disposition: disposition,
+		})
+	}
+	result := []map[string]interface{}{}
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/calls?page=2&size=2", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get("X-Total-Count"))
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, startTime.Add(2*time.Hour).Format(time.RFC3339), result[0]["startTime"])
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/calls?disposition=missed&since=2016-12-20T13:00:00Z", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-Total-Count"))
+}
+
+func TestRouteExportCalls(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := &User{}
+	db.First(user, "user_name = ?", "user1")
+	db.Unscoped().Delete(&CallRecord{}, "call_id = ?", "rexCallID")
+	db.Create(&CallRecord{CallID: "rexCallID", UserID: user.ID, Direction: OutgoingCall, From: user.SIPURI,
+		To: "+1472583688", StartTime: time.Date(2015, 5, 1, 10, 0, 0, 0, time.UTC), Disposition: AnsweredCall})
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/export/calls?since=2015-05-01&until=2015-05-02", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="calls-20150501-20150502.csv"`, w.Header().Get("Content-Disposition"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[1], "rexCallID")
+}
+
+func TestRouteExportFailWithInvalidQuery(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/export/users?since=2015-05-01&until=2015-05-02", token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/export/calls", token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRouteAdminExportCalls(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	createUserAndLogin(t, db)
+	user := &User{}
+	db.First(user, "user_name = ?", "user1")
+	other := &User{UserName: "user2", PhoneNumber: "+1234567891"}
+	require.NoError(t, db.Create(other).Error)
+	startTime := time.Date(2015, 5, 1, 10, 0, 0, 0, time.UTC)
+	db.Create(&CallRecord{CallID: "adCallID1", UserID: user.ID, Direction: OutgoingCall, StartTime: startTime})
+	db.Create(&CallRecord{CallID: "adCallID2", UserID: other.ID, Direction: OutgoingCall, StartTime: startTime})
+	w := makeAdminRequest(t, db, http.MethodGet, "/admin/export/calls?since=2015-05-01&until=2015-05-02")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "adCallID1")
+	assert.Contains(t, w.Body.String(), "adCallID2")
+	w = makeAdminRequest(t, db, http.MethodGet, "/admin/export/calls?since=2015-05-01&until=2015-05-02&user=user2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "adCallID1")
+	assert.Contains(t, w.Body.String(), "adCallID2")
+	w = makeAdminRequest(t, db, http.MethodGet, "/admin/export/calls?since=2015-05-01&until=2015-05-02&user=unknown")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	// regular users can't use it
+	token := createUserAndLogin(t, db)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/admin/export/calls?since=2015-05-01&until=2015-05-02", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRouteGetCallsFailWithInvalidQuery(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/calls?size=1000", token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestRouteTransferCallbackDoNothingForMissingUser(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback", "", &CallbackForm{
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "answer",
+		From:      "+1472583688",
+		To:        "+1234567800",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRouteTransferCallbackDoNothingForWrongUserID(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:    "callID",
 		EventType: "answer",
 		From:      "+1472583688",
@@ -454,103 +1430,375 @@ func TestRouteTransferCallbackDoNothingForMissingUser(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
-func TestRouteTransferCallbackDoNothingForWrongUserID(t *testing.T) {
+func TestRouteTransferCallbackAnswerCall(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:atest@test.com",
+		PhoneNumber: "+1234567801",
+		UserName:    "avmuser",
+		GreetingURL: "greetingURL",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	api.On("PlayAudioToCall", "callID", "greetingURL").Return(nil)
+	api.On("PlayAudioToCall", "callID", beepURL).Return(nil)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "answer",
+		From:      "+1472583688",
+		To:        "+1234567801",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+}
+
+func TestRouteTransferCallbackBusy(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:        "910",
+		SIPURI:          "sip:btest@test.com",
+		PhoneNumber:     "+1234567803",
+		UserName:        "bvmuser",
+		GreetingURL:     "greetingURL",
+		BusyGreetingURL: "busyGreetingURL",
+	}
+	require.NoError(t, db.Save(user).Error)
+	require.NoError(t, db.Create(&CallRecord{
+		CallID:            "incomingCallID",
+		TransferredCallID: "callID",
+		UserID:            user.ID,
+		Direction:         IncomingCall,
+	}).Error)
+	// SIP account has rejected the call, it goes to voice mail without waiting for no answer timeout
+	api.On("GetCall", "callID").Return(&bandwidth.Call{State: "started"}, nil)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{State: "active"}).Return("", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "hangup",
+		Cause:     "USER_BUSY",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	record := findCallRecord("incomingCallID", db)
+	require.NotNil(t, record)
+	assert.True(t, record.Busy)
+	assert.Nil(t, record.EndTime)
+	api.On("PlayAudioToCall", "callID", "busyGreetingURL").Return(nil)
+	api.On("PlayAudioToCall", "callID", beepURL).Return(nil)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
+	w = makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "answer",
+		From:      "+1472583688",
+		To:        "+1234567803",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+	api.AssertNotCalled(t, "PlayAudioToCall", "callID", "greetingURL")
+}
+
+func TestRouteTransferCallbackAnswerCallWithDefaultGreeting(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:atest@test.com",
+		PhoneNumber: "+1234567802",
+		UserName:    "avm1user",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	api.On("SpeakSentenceToCall", "callID", fmt.Sprintf("Hello. You have called to %s. Please leave a message after beep.", user.PhoneNumber)).Return(nil)
+	api.On("PlayAudioToCall", "callID", beepURL).Return(nil)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "answer",
+		From:      "+1472583688",
+		To:        "+1234567802",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+}
+
+func TestRouteTransferCallbackRecordCall(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:atest@test.com",
+		PhoneNumber: "+1234567803",
+		UserName:    "avm2user",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	db.Delete(&VoiceMailMessage{}, "user_id = ?", user.ID)
+	api.On("GetCall", "callID").Return(&bandwidth.Call{
+		From: "+1472583688",
+	}, nil)
+	api.On("GetRecording", "recordingID").Return(&bandwidth.Recording{
+		Media:     "url",
+		StartTime: "2016-05-26T10:00:00Z",
+		EndTime:   "2016-05-26T10:01:00Z",
+	}, nil)
+	api.On("CreateRecordingTranscription", "recordingID").Return("transcriptionID", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:      "callID",
+		EventType:   "recording",
+		State:       "complete",
+		From:        "+1472583688",
+		To:          "+1234567803",
+		RecordingID: "recordingID",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+	message := &VoiceMailMessage{}
+	assert.NoError(t, db.First(message, "user_id = ?", user.ID).Error)
+	assert.Equal(t, "url", message.MediaURL)
+	assert.Equal(t, "recordingID", message.RecordingID)
+	assert.Equal(t, "transcriptionID", message.TranscriptionID)
+}
+
+func TestRouteTransferCallbackRecordCallTwice(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:atest@test.com",
+		PhoneNumber: "+1234567803",
+		UserName:    "avm2user",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	db.Unscoped().Delete(&VoiceMailMessage{}, "recording_id = ?", "dupRecordingID")
+	api.On("GetCall", "dupCallID").Return(&bandwidth.Call{
+		From: "+1472583688",
+	}, nil)
+	api.On("GetRecording", "dupRecordingID").Return(&bandwidth.Recording{
+		Media:     "url",
+		StartTime: "2016-05-26T10:00:00Z",
+		EndTime:   "2016-05-26T10:01:00Z",
+	}, nil)
+	api.On("CreateRecordingTranscription", "dupRecordingID").Return("transcriptionID", nil)
+	form := &CallbackForm{
+		CallID:      "dupCallID",
+		EventType:   "recording",
+		State:       "complete",
+		From:        "+1472583688",
+		To:          "+1234567803",
+		RecordingID: "dupRecordingID",
+	}
+	for i := 0; i < 2; i++ {
+		w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", form)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	api.AssertNumberOfCalls(t, "GetRecording", 1)
+	api.AssertNumberOfCalls(t, "CreateRecordingTranscription", 1)
+	count := 0
+	db.Model(&VoiceMailMessage{}).Where("recording_id = ?", "dupRecordingID").Count(&count)
+	assert.Equal(t, 1, count)
+}
+
+func TestRouteTransferCallbackRecordCallRetry(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:atest@test.com",
+		PhoneNumber: "+1234567803",
+		UserName:    "avm2user",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	db.Unscoped().Delete(&VoiceMailMessage{}, "recording_id = ?", "retryRecordingID")
+	db.Delete(&ActiveCall{}, "call_id = ?", "retryCallID")
+	db.Create(&ActiveCall{CallID: "retryCallID", UserID: user.ID, From: "+1472583688", To: "+1234567803"})
+	api.On("GetRecording", "retryRecordingID").Return((*bandwidth.Recording)(nil), errors.New("error")).Once()
+	api.On("GetRecording", "retryRecordingID").Return(&bandwidth.Recording{
+		Media:     "url",
+		StartTime: "2016-05-26T10:00:00Z",
+		EndTime:   "2016-05-26T10:01:00Z",
+	}, nil)
+	api.On("GetCall", "retryCallID").Return(&bandwidth.Call{
+		From: "+1472583688",
+	}, nil)
+	api.On("CreateRecordingTranscription", "retryRecordingID").Return("transcriptionID", nil)
+	form := &CallbackForm{
+		CallID:      "retryCallID",
+		EventType:   "recording",
+		State:       "complete",
+		From:        "+1472583688",
+		To:          "+1234567803",
+		RecordingID: "retryRecordingID",
+	}
+	// the first delivery fails and Catapult should retry it
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", form)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.True(t, db.First(&VoiceMailMessage{}, "recording_id = ?", "retryRecordingID").RecordNotFound())
+	w = makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", form)
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertNumberOfCalls(t, "GetRecording", 2)
+	message := &VoiceMailMessage{}
+	assert.NoError(t, db.First(message, "recording_id = ?", "retryRecordingID").Error)
+	assert.Equal(t, user.ID, message.UserID)
+	assert.Equal(t, "url", message.MediaURL)
+	assert.Equal(t, "transcriptionID", message.TranscriptionID)
+	// the processed event is not handled again
+	w = makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", form)
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertNumberOfCalls(t, "GetRecording", 2)
+}
+
+func TestRouteTransferCallbackRecordCallWithExistingMessage(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback", "", &CallbackForm{
-		CallID:    "callID",
-		EventType: "answer",
-		From:      "+1472583688",
-		To:        "+1234567800",
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:atest@test.com",
+		PhoneNumber: "+1234567803",
+		UserName:    "avm2user",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	db.Unscoped().Delete(&VoiceMailMessage{}, "recording_id = ?", "dupRecordingID2")
+	db.Create(&VoiceMailMessage{UserID: user.ID, RecordingID: "dupRecordingID2"})
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:      "dupCallID2",
+		EventType:   "recording",
+		State:       "complete",
+		From:        "+1472583688",
+		To:          "+1234567803",
+		RecordingID: "dupRecordingID2",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertNotCalled(t, "GetRecording", "dupRecordingID2")
 }
 
-func TestRouteTransferCallbackAnswerCall(t *testing.T) {
+func TestRouteTransferCallbackRecordCallWithSMSNotification(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
 	defer db.Close()
 	user := &User{
-		AreaCode:    "910",
-		SIPURI:      "sip:atest@test.com",
-		PhoneNumber: "+1234567801",
-		UserName:    "avmuser",
-		GreetingURL: "greetingURL",
+		AreaCode:                "910",
+		SIPURI:                  "sip:atest@test.com",
+		PhoneNumber:             "+1234567806",
+		UserName:                "avm5user",
+		NotificationNumber:      "+1987654321",
+		SMSNotificationsEnabled: true,
 	}
 	user.SetPassword("123456")
 	db.Save(user)
-	api.On("PlayAudioToCall", "callID", "greetingURL").Return(nil)
-	api.On("PlayAudioToCall", "callID", beepURL).Return(nil)
-	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback", "", &CallbackForm{
-		CallID:    "callID",
-		EventType: "answer",
-		From:      "+1472583688",
-		To:        "+1234567801",
+	db.Create(&ActiveCall{
+		CallID: "smsCallID",
+		UserID: user.ID,
+		From:   "+1472583688",
+		To:     "+1234567806",
+	})
+	api.On("GetCall", "smsCallID").Return(&bandwidth.Call{
+		From: "+1472583688",
+	}, nil)
+	api.On("GetRecording", "recordingID").Return(&bandwidth.Recording{
+		Media:     "url",
+		StartTime: "2016-05-26T10:00:00Z",
+		EndTime:   "2016-05-26T10:01:00Z",
+	}, nil)
+	api.On("CreateRecordingTranscription", "recordingID").Return("transcriptionID", nil)
+	api.On("CreateMessage", &bandwidth.CreateMessageData{
+		From: "+1234567806",
+		To:   "+1987654321",
+		Text: "New voice message from +1472583688 (60 seconds). Listen to it on http:///",
+	}).Return("messageID", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:      "smsCallID",
+		EventType:   "recording",
+		State:       "complete",
+		RecordingID: "recordingID",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
 	api.AssertExpectations(t)
 }
 
-func TestRouteTransferCallbackAnswerCallWithDefaultGreeting(t *testing.T) {
+func TestRouteTransferCallbackTranscription(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
 	defer db.Close()
 	user := &User{
 		AreaCode:    "910",
 		SIPURI:      "sip:atest@test.com",
-		PhoneNumber: "+1234567802",
-		UserName:    "avm1user",
+		PhoneNumber: "+1234567804",
+		UserName:    "avm3user",
 	}
 	user.SetPassword("123456")
 	db.Save(user)
-	api.On("SpeakSentenceToCall", "callID", fmt.Sprintf("Hello. You have called to %s. Please leave a message after beep.", user.PhoneNumber)).Return(nil)
-	api.On("PlayAudioToCall", "callID", beepURL).Return(nil)
-	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback", "", &CallbackForm{
-		CallID:    "callID",
-		EventType: "answer",
-		From:      "+1472583688",
-		To:        "+1234567802",
+	db.Delete(&VoiceMailMessage{}, "user_id = ?", user.ID)
+	message := &VoiceMailMessage{
+		MediaURL:    "url",
+		StartTime:   time.Now(),
+		EndTime:     time.Now(),
+		UserID:      user.ID,
+		RecordingID: "trRecordingID",
+	}
+	db.Create(message)
+	api.On("GetRecordingTranscription", "trRecordingID", "transcriptionID").Return(&bandwidth.Transcription{
+		ID:   "transcriptionID",
+		Text: "Please call me back",
+	}, nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:          "callID",
+		EventType:       "transcription",
+		State:           "completed",
+		RecordingID:     "trRecordingID",
+		TranscriptionID: "transcriptionID",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
 	api.AssertExpectations(t)
+	assert.NoError(t, db.First(message, message.ID).Error)
+	assert.Equal(t, "Please call me back", message.Transcription)
 }
 
-func TestRouteTransferCallbackRecordCall(t *testing.T) {
+func TestRouteTransferCallbackTranscriptionFail(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
 	defer db.Close()
 	user := &User{
 		AreaCode:    "910",
 		SIPURI:      "sip:atest@test.com",
-		PhoneNumber: "+1234567803",
-		UserName:    "avm2user",
+		PhoneNumber: "+1234567805",
+		UserName:    "avm4user",
 	}
 	user.SetPassword("123456")
 	db.Save(user)
 	db.Delete(&VoiceMailMessage{}, "user_id = ?", user.ID)
-	api.On("GetCall", "callID").Return(&bandwidth.Call{
-		From: "+1472583688",
-	}, nil)
-	api.On("GetRecording", "recordingID").Return(&bandwidth.Recording{
-		Media:     "url",
-		StartTime: "2016-05-26T10:00:00Z",
-		EndTime:   "2016-05-26T10:01:00Z",
-	}, nil)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback", "", &CallbackForm{
-		CallID:      "callID",
-		EventType:   "recording",
-		State:       "complete",
-		From:        "+1472583688",
-		To:          "+1234567803",
-		RecordingID: "recordingID",
+	message := &VoiceMailMessage{
+		MediaURL:    "url",
+		StartTime:   time.Now(),
+		EndTime:     time.Now(),
+		UserID:      user.ID,
+		RecordingID: "trRecordingID1",
+	}
+	db.Create(message)
+	api.On("GetRecordingTranscription", "trRecordingID1", "transcriptionID").Return((*bandwidth.Transcription)(nil), errors.New("Error"))
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/transferCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:          "callID",
+		EventType:       "transcription",
+		State:           "completed",
+		RecordingID:     "trRecordingID1",
+		TranscriptionID: "transcriptionID",
 	})
-	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
 	api.AssertExpectations(t)
-	message := &VoiceMailMessage{}
-	assert.NoError(t, db.First(message, "user_id = ?", user.ID).Error)
-	assert.Equal(t, "url", message.MediaURL)
+	assert.NoError(t, db.First(message, message.ID).Error)
+	assert.Empty(t, message.Transcription)
 }
 
 func TestRouteRecordGreeting(t *testing.T) {
@@ -563,18 +1811,19 @@ func TestRouteRecordGreeting(t *testing.T) {
 	api.On("CreateCall", &bandwidth.CreateCallData{
 		From:        user.PhoneNumber,
 		To:          user.SIPURI,
-		CallbackURL: "http:///recordCallback",
+		CallbackURL: "http:///recordCallback?secret=callbackSecret",
 	}).Return("callId", nil)
 	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordGreeting", token)
 	assert.Equal(t, http.StatusOK, w.Code)
 	api.AssertExpectations(t)
+	assert.Equal(t, greetingStateStarting, getGreetingState(t, db, "callId"))
 }
 
 func TestRouteRecordCallbackWithoutUser(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
 	defer db.Close()
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:    "callID",
 		EventType: "answer",
 	})
@@ -593,27 +1842,29 @@ func TestRouteRecordCallbackAnswer(t *testing.T) {
 	}
 	user.SetPassword("123456")
 	db.Save(user)
+	createGreetingSession(t, db, user, "callID", greetingStateStarting)
 	api.On("CreateGather", "callID", &bandwidth.CreateGatherData{
 		MaxDigits:         1,
 		InterDigitTimeout: 30,
 		Prompt: &bandwidth.GatherPromptData{
 			Gender:   "female",
 			Voice:    "julie",
-			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default.",
+			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default. Press 4 to select another greeting.",
 		},
 		Tag: "Menu",
 	}).Return("", nil)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:    "callID",
 		EventType: "answer",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
 	api.AssertExpectations(t)
+	assert.Equal(t, greetingStateMenu, getGreetingState(t, db, "callID"))
 }
 
 func TestRouteRecordCallbackGather1(t *testing.T) {
 	api := &fakeCatapultAPI{}
-	timer := &fakeTimerAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
 	db := openDBConnection(t)
 	defer db.Close()
 	user := &User{
@@ -625,6 +1876,7 @@ func TestRouteRecordCallbackGather1(t *testing.T) {
 	}
 	user.SetPassword("123456")
 	db.Save(user)
+	createGreetingSession(t, db, user, "callID", greetingStateMenu)
 	api.On("PlayAudioToCall", "callID", "greetingURL").Return(nil)
 	api.On("CreateGather", "callID", &bandwidth.CreateGatherData{
 		MaxDigits:         1,
@@ -632,103 +1884,337 @@ func TestRouteRecordCallbackGather1(t *testing.T) {
 		Prompt: &bandwidth.GatherPromptData{
 			Gender:   "female",
 			Voice:    "julie",
-			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default.",
+			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default. Press 4 to select another greeting.",
 		},
 		Tag: "Menu",
 	}).Return("", nil)
-	timer.On("Sleep", time.Second).Return()
-	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
+	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:    "callID",
 		EventType: "gather",
 		State:     "completed",
+		Tag:       "Menu",
 		Digits:    "1",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
-	api.AssertExpectations(t)
+	assert.Equal(t, greetingStatePlaying, getGreetingState(t, db, "callID"))
+	timer.CurrentTime = timer.CurrentTime.Add(time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	api.AssertExpectations(t)
+	assert.Equal(t, greetingStateMenu, getGreetingState(t, db, "callID"))
+}
+
+func TestRouteRecordCallbackGather2(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:rtest2@test.com",
+		PhoneNumber: "+1334567802",
+		UserName:    "ruser2",
+		GreetingURL: "greetingURL",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	createGreetingSession(t, db, user, "callID", greetingStateMenu)
+	api.On("SpeakSentenceToCall", "callID", "Say your greeting after beep. Press any key to complete recording.").Return(nil)
+	api.On("CreateGather", "callID", &bandwidth.CreateGatherData{
+		MaxDigits:         1,
+		InterDigitTimeout: 180,
+		Prompt:            &bandwidth.GatherPromptData{FileURL: beepURL},
+		Tag:               "Record",
+	}).Return("", nil)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
+	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       "Menu",
+		Digits:    "2",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, greetingStateAwaitingRecord, getGreetingState(t, db, "callID"))
+	timer.CurrentTime = timer.CurrentTime.Add(5 * time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	assert.Equal(t, greetingStateBeep, getGreetingState(t, db, "callID"))
+	timer.CurrentTime = timer.CurrentTime.Add(time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	api.AssertExpectations(t)
+	assert.Equal(t, greetingStateRecording, getGreetingState(t, db, "callID"))
+}
+
+func TestRouteRecordCallbackGather3(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:rtest2@test.com",
+		PhoneNumber: "+1334567802",
+		UserName:    "ruser3",
+		GreetingURL: "greetingURL",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	createGreetingSession(t, db, user, "callID", greetingStateMenu)
+	api.On("SpeakSentenceToCall", "callID", "Your greeting has been set to default.").Return(nil)
+	api.On("CreateGather", "callID", &bandwidth.CreateGatherData{
+		MaxDigits:         1,
+		InterDigitTimeout: 30,
+		Prompt: &bandwidth.GatherPromptData{
+			Gender:   "female",
+			Voice:    "julie",
+			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default. Press 4 to select another greeting.",
+		},
+		Tag: "Menu",
+	}).Return("", nil)
+	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       "Menu",
+		Digits:    "3",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	timer.CurrentTime = timer.CurrentTime.Add(time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	api.AssertExpectations(t)
+	assert.NoError(t, db.First(user, user.ID).Error)
+	assert.Empty(t, user.GreetingURL)
+
+}
+
+func TestRouteRecordCallbackGather4(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:    "910",
+		SIPURI:      "sip:rtest4@test.com",
+		PhoneNumber: "+1334567804",
+		UserName:    "ruser4",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	createGreetingSession(t, db, user, "gtCallID", greetingStateMenu)
+	api.On("CreateGather", "gtCallID", &bandwidth.CreateGatherData{
+		MaxDigits:         1,
+		InterDigitTimeout: 30,
+		Prompt: &bandwidth.GatherPromptData{
+			Gender: "female",
+			Voice:  "julie",
+			Sentence: "Press 1 for no answer greeting. Press 2 for busy greeting. Press 3 for after hours greeting. " +
+				"Press 4 for extended absence greeting.",
+		},
+		Tag: "GreetingType",
+	}).Return("", nil)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "gtCallID",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       "Menu",
+		Digits:    "4",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	api.AssertExpectations(t)
+	assert.Equal(t, greetingStateSelectingType, getGreetingState(t, db, "gtCallID"))
+}
+
+func TestRouteRecordCallbackSelectGreetingAndReset(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
+	db := openDBConnection(t)
+	defer db.Close()
+	user := &User{
+		AreaCode:        "910",
+		SIPURI:          "sip:rtest5@test.com",
+		PhoneNumber:     "+1334567805",
+		UserName:        "ruser5",
+		GreetingURL:     "greetingURL",
+		BusyGreetingURL: "busyGreetingURL",
+	}
+	user.SetPassword("123456")
+	db.Save(user)
+	createGreetingSession(t, db, user, "gtCallID2", greetingStateSelectingType)
+	api.On("SpeakSentenceToCall", "gtCallID2", "Busy greeting is selected.").Return(nil)
+	api.On("SpeakSentenceToCall", "gtCallID2", "Your greeting has been set to default.").Return(nil)
+	api.On("CreateGather", "gtCallID2", mock.AnythingOfType("*bandwidth.CreateGatherData")).Return("", nil)
+	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "gtCallID2",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       "GreetingType",
+		Digits:    "2",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	timer.CurrentTime = timer.CurrentTime.Add(time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	w = makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "gtCallID2",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       "Menu",
+		Digits:    "3",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	timer.CurrentTime = timer.CurrentTime.Add(time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	api.AssertExpectations(t)
+	assert.NoError(t, db.First(user, user.ID).Error)
+	assert.Empty(t, user.BusyGreetingURL)
+	assert.Equal(t, "greetingURL", user.GreetingURL)
+}
+
+func TestRouteGetGreetings(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	db.Model(&User{}).Where("user_name = ?", "user1").Updates(map[string]interface{}{
+		"greeting_url":      "http://noAnswer",
+		"busy_greeting_url": "http://busy",
+	})
+	result := map[string]map[string]interface{}{}
+	w := makeRequest(t, nil, nil, db, http.MethodGet, "/greetings", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "http://noAnswer", result[NoAnswerGreeting]["url"])
+	assert.Equal(t, "http://busy", result[BusyGreeting]["url"])
+	assert.Equal(t, "", result[AfterHoursGreeting]["url"])
+	assert.Nil(t, result[AbsenceGreeting]["expiresAt"])
+}
+
+func TestRouteUpdateGreeting(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	expiresAt := time.Date(2016, 12, 31, 0, 0, 0, 0, time.UTC)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/greetings/absence", token, gin.H{
+		"url":       "http://absence",
+		"expiresAt": expiresAt,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.Equal(t, "http://absence", user.AbsenceGreetingURL)
+	assert.True(t, expiresAt.Equal(*user.AbsenceGreetingExpiresAt))
+	w = makeRequest(t, nil, nil, db, http.MethodDelete, "/greetings/absence", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.Empty(t, user.AbsenceGreetingURL)
+	assert.Nil(t, user.AbsenceGreetingExpiresAt)
+}
+
+func TestRouteUpdateGreetingFail(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, nil, nil, db, http.MethodPut, "/greetings/unknown", token, gin.H{"url": "http://greeting"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodPut, "/greetings/busy", token, gin.H{"url": "greeting"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodPut, "/greetings/busy", token, gin.H{
+		"url":       "http://greeting",
+		"expiresAt": time.Now(),
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRouteUploadGreeting(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	api.On("UploadMediaFile", mock.AnythingOfType("string"), mock.Anything, "audio/wave").Return("http://media/greeting.wav", nil)
+	result := map[string]string{}
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/greetings/busy/media", token, createMultipartBody(t, "file", testWAVFile), &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "http://media/greeting.wav", result["url"])
+	api.AssertExpectations(t)
+	user := &User{}
+	assert.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	assert.Equal(t, "http://media/greeting.wav", user.BusyGreetingURL)
+}
+
+func TestRouteUploadGreetingFailWithInvalidFile(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/greetings/busy/media", token, createMultipartBody(t, "file", []byte("text")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = makeRequest(t, api, nil, db, http.MethodPost, "/greetings/unknown/media", token, createMultipartBody(t, "file", testWAVFile))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRouteUploadGreetingFailWithUploadError(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	api.On("UploadMediaFile", mock.AnythingOfType("string"), mock.Anything, "audio/wave").Return("", errors.New("error"))
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/greetings/busy/media", token, createMultipartBody(t, "file", testWAVFile))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestRouteDownloadGreeting(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := &User{}
+	require.NoError(t, db.First(user, "user_name = ?", "user1").Error)
+	name := fmt.Sprintf("greeting-%d-noAnswer-1.wav", user.ID)
+	db.Model(user).Update("greeting_url", "https://api.catapult.inetwork.com/v1/users/userID/media/"+name)
+	api.On("DownloadMediaFile", name).Return(ioutil.NopCloser(strings.NewReader("123")), "audio/wav", nil)
+	w := makeRequest(t, api, nil, db, http.MethodGet, "/greetings/noAnswer/media", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "audio/wav", w.Header().Get("Content-Type"))
+	assert.Equal(t, "123", w.Body.String())
+	w = makeRequest(t, api, nil, db, http.MethodGet, "/greetings/busy/media", token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
-func TestRouteRecordCallbackGather2(t *testing.T) {
+func TestRouteDownloadGreetingOfOtherOwner(t *testing.T) {
 	api := &fakeCatapultAPI{}
-	timer := &fakeTimerAPI{}
 	db := openDBConnection(t)
 	defer db.Close()
-	user := &User{
-		AreaCode:    "910",
-		SIPURI:      "sip:rtest2@test.com",
-		PhoneNumber: "+1334567802",
-		UserName:    "ruser2",
-		GreetingURL: "greetingURL",
+	token := createUserAndLogin(t, db)
+	urls := []string{
+		"http://localhost/media/greeting.wav",
+		"https://api.catapult.inetwork.com/v1/users/userID/media/greeting-999-noAnswer-1.wav", // another user's greeting
+		"https://api.catapult.inetwork.com/v1/users/userID/media/recording.wav",               // not recorded by the user
+		"https://api.catapult.inetwork.com/v1/users/userID2/media/greeting.wav",
 	}
-	user.SetPassword("123456")
-	db.Save(user)
-	api.On("SpeakSentenceToCall", "callID", "Say your greeting after beep. Press any key to complete recording.").Return(nil)
-	api.On("CreateGather", "callID", &bandwidth.CreateGatherData{
-		MaxDigits:         1,
-		InterDigitTimeout: 30,
-		Prompt:            &bandwidth.GatherPromptData{FileURL: beepURL},
-		Tag:               "Record",
-	}).Return("", nil)
-	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
-	timer.On("Sleep", 5*time.Second).Return()
-	timer.On("Sleep", time.Second).Return()
-	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
-		CallID:    "callID",
-		EventType: "gather",
-		State:     "completed",
-		Digits:    "2",
-	})
-	assert.Equal(t, http.StatusOK, w.Code)
-	api.AssertExpectations(t)
+	for _, url := range urls {
+		db.Model(&User{}).Where("user_name = ?", "user1").Update("greeting_url", url)
+		w := makeRequest(t, api, nil, db, http.MethodGet, "/greetings/noAnswer/media", token)
+		assert.Equal(t, http.StatusNotFound, w.Code, url)
+	}
+	api.AssertNotCalled(t, "DownloadMediaFile", mock.Anything)
 }
 
-func TestRouteRecordCallbackGather3(t *testing.T) {
+func TestRouteRecordCallbackGatherCompleteRecord(t *testing.T) {
 	api := &fakeCatapultAPI{}
-	timer := &fakeTimerAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
 	db := openDBConnection(t)
 	defer db.Close()
 	user := &User{
 		AreaCode:    "910",
-		SIPURI:      "sip:rtest2@test.com",
-		PhoneNumber: "+1334567802",
-		UserName:    "ruser3",
-		GreetingURL: "greetingURL",
+		SIPURI:      "sip:rtest8@test.com",
+		PhoneNumber: "+1334567808",
+		UserName:    "ruser8",
 	}
 	user.SetPassword("123456")
 	db.Save(user)
-	api.On("SpeakSentenceToCall", "callID", "Your greeting has been set to default.").Return(nil)
-	api.On("CreateGather", "callID", &bandwidth.CreateGatherData{
-		MaxDigits:         1,
-		InterDigitTimeout: 30,
-		Prompt: &bandwidth.GatherPromptData{
-			Gender:   "female",
-			Voice:    "julie",
-			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default.",
-		},
-		Tag: "Menu",
-	}).Return("", nil)
-	timer.On("Sleep", time.Second).Return()
-	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
-		CallID:    "callID",
-		EventType: "gather",
-		State:     "completed",
-		Digits:    "3",
-	})
-	assert.Equal(t, http.StatusOK, w.Code)
-	api.AssertExpectations(t)
-	assert.NoError(t, db.First(user, user.ID).Error)
-	assert.Empty(t, user.GreetingURL)
-
-}
-
-func TestRouteRecordCallbackGatherCompleteRecord(t *testing.T) {
-	api := &fakeCatapultAPI{}
-	timer := &fakeTimerAPI{}
-	db := openDBConnection(t)
-	defer db.Close()
+	createGreetingSession(t, db, user, "callID", greetingStateRecording)
 	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{
 		RecordingEnabled: false,
 	}).Return("", nil)
-	api.On("SpeakSentenceToCall", "callID", "Your greeting has been changed.").Return(nil)
+	api.On("GetRecording", "recordingID").Return(&bandwidth.Recording{
+		Media: "url",
+	}, nil)
+	api.On("SpeakSentenceToCall", "callID", "Your greeting has been saved.").Return(nil)
 	api.On("CreateGather", "callID", &bandwidth.CreateGatherData{
 		MaxDigits:         1,
 		InterDigitTimeout: 30,
@@ -736,11 +2222,10 @@ func TestRouteRecordCallbackGatherCompleteRecord(t *testing.T) {
 		Prompt: &bandwidth.GatherPromptData{
 			Gender:   "female",
 			Voice:    "julie",
-			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default.",
+			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default. Press 4 to select another greeting.",
 		},
 	}).Return("", nil)
-	timer.On("Sleep", time.Second).Return()
-	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
+	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:    "callID",
 		EventType: "gather",
 		State:     "completed",
@@ -748,7 +2233,25 @@ func TestRouteRecordCallbackGatherCompleteRecord(t *testing.T) {
 		Digits:    "0",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, greetingStateSaving, getGreetingState(t, db, "callID"))
+	w = makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:      "callID",
+		EventType:   "recording",
+		State:       "complete",
+		RecordingID: "recordingID",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, greetingStateSaved, getGreetingState(t, db, "callID"))
+	timer.CurrentTime = timer.CurrentTime.Add(time.Second)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
+	// timeout of saving is outdated already
+	timer.CurrentTime = timer.CurrentTime.Add(greetingSavingTimeout)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
 	api.AssertExpectations(t)
+	api.AssertNumberOfCalls(t, "CreateGather", 1)
+	assert.Equal(t, greetingStateMenu, getGreetingState(t, db, "callID"))
+	assert.NoError(t, db.First(user, user.ID).Error)
+	assert.Equal(t, "url", user.GreetingURL)
 }
 
 func TestRouteRecordCallbackSaveRecording(t *testing.T) {
@@ -764,24 +2267,13 @@ func TestRouteRecordCallbackSaveRecording(t *testing.T) {
 	}
 	user.SetPassword("123456")
 	db.Save(user)
+	session := createGreetingSession(t, db, user, "callID", greetingStateSaving)
+	db.Model(session).Update("greeting_type", BusyGreeting)
 	api.On("GetRecording", "recordingID").Return(&bandwidth.Recording{
 		Media: "url",
 	}, nil)
-	api.On("GetCall", "callID").Return(&bandwidth.Call{
-		State: "active",
-	}, nil)
 	api.On("SpeakSentenceToCall", "callID", "Your greeting has been saved.").Return(nil)
-	api.On("CreateGather", "callID", &bandwidth.CreateGatherData{
-		MaxDigits:         1,
-		InterDigitTimeout: 30,
-		Prompt: &bandwidth.GatherPromptData{
-			Gender:   "female",
-			Voice:    "julie",
-			Sentence: "Press 1 to listen to your current greeting. Press 2 to record new greeting. Press 3 to set greeting to default.",
-		},
-		Tag: "Menu",
-	}).Return("", nil)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:      "callID",
 		EventType:   "recording",
 		State:       "complete",
@@ -790,11 +2282,11 @@ func TestRouteRecordCallbackSaveRecording(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 	api.AssertExpectations(t)
 	assert.NoError(t, db.First(user, user.ID).Error)
-	assert.Equal(t, "url", user.GreetingURL)
-
+	assert.Equal(t, "greetingURL", user.GreetingURL)
+	assert.Equal(t, "url", user.BusyGreetingURL)
 }
 
-func TestRouteRecordCallbackSaveRecordingWithoutMenu(t *testing.T) {
+func TestRouteRecordCallbackSaveRecordingAfterHangup(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
 	defer db.Close()
@@ -807,13 +2299,16 @@ func TestRouteRecordCallbackSaveRecordingWithoutMenu(t *testing.T) {
 	}
 	user.SetPassword("123456")
 	db.Save(user)
+	createGreetingSession(t, db, user, "callID", greetingStateSaving)
 	api.On("GetRecording", "recordingID").Return(&bandwidth.Recording{
 		Media: "url",
 	}, nil)
-	api.On("GetCall", "callID").Return(&bandwidth.Call{
-		State: "completed",
-	}, nil)
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "hangup",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:      "callID",
 		EventType:   "recording",
 		State:       "complete",
@@ -823,10 +2318,12 @@ func TestRouteRecordCallbackSaveRecordingWithoutMenu(t *testing.T) {
 	api.AssertExpectations(t)
 	assert.NoError(t, db.First(user, user.ID).Error)
 	assert.Equal(t, "url", user.GreetingURL)
+	assert.True(t, db.First(&GreetingSession{}, "call_id = ?", "callID").RecordNotFound())
 }
 
-func TestRouteRecordCallbackSaveRecordingWithoutMenu2(t *testing.T) {
+func TestRouteRecordCallbackSaveRecordingTimeout(t *testing.T) {
 	api := &fakeCatapultAPI{}
+	timer := &fakeTimerAPI{CurrentTime: time.Now()}
 	db := openDBConnection(t)
 	defer db.Close()
 	user := &User{
@@ -838,20 +2335,23 @@ func TestRouteRecordCallbackSaveRecordingWithoutMenu2(t *testing.T) {
 	}
 	user.SetPassword("123456")
 	db.Save(user)
-	api.On("GetRecording", "recordingID").Return(&bandwidth.Recording{
-		Media: "url",
-	}, nil)
-	api.On("GetCall", "callID").Return(&bandwidth.Call{}, errors.New("Error"))
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
-		CallID:      "callID",
-		EventType:   "recording",
-		State:       "complete",
-		RecordingID: "recordingID",
+	createGreetingSession(t, db, user, "callID", greetingStateRecording)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: false}).Return("", nil)
+	api.On("SpeakSentenceToCall", "callID", "Your greeting has not been saved.").Return(nil)
+	w := makeRequest(t, api, timer, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
+		CallID:    "callID",
+		EventType: "gather",
+		State:     "completed",
+		Tag:       "Record",
+		Digits:    "0",
 	})
 	assert.Equal(t, http.StatusOK, w.Code)
+	timer.CurrentTime = timer.CurrentTime.Add(greetingSavingTimeout)
+	assert.Equal(t, 1, runDueJobs(db, api, timer))
 	api.AssertExpectations(t)
+	assert.Equal(t, greetingStatePlaying, getGreetingState(t, db, "callID"))
 	assert.NoError(t, db.First(user, user.ID).Error)
-	assert.Equal(t, "url", user.GreetingURL)
+	assert.Equal(t, "greetingURL", user.GreetingURL)
 }
 
 func TestRouteRecordCallbackDoNothingForWrongRecordingID(t *testing.T) {
@@ -867,8 +2367,9 @@ func TestRouteRecordCallbackDoNothingForWrongRecordingID(t *testing.T) {
 	}
 	user.SetPassword("123456")
 	db.Save(user)
+	createGreetingSession(t, db, user, "callID", greetingStateSaving)
 	api.On("GetRecording", "recordingID").Return(&bandwidth.Recording{}, errors.New("Error"))
-	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback", "", &CallbackForm{
+	w := makeRequest(t, api, nil, db, http.MethodPost, "/recordCallback?secret=callbackSecret", "", &CallbackForm{
 		CallID:      "callID",
 		EventType:   "recording",
 		State:       "complete",
@@ -878,6 +2379,7 @@ func TestRouteRecordCallbackDoNothingForWrongRecordingID(t *testing.T) {
 	api.AssertExpectations(t)
 	assert.NoError(t, db.First(user, user.ID).Error)
 	assert.Equal(t, "greetingURL", user.GreetingURL)
+	assert.Equal(t, greetingStateSaving, getGreetingState(t, db, "callID"))
 }
 
 func TestRouteGetVoiceMessages(t *testing.T) {
@@ -908,6 +2410,35 @@ func TestRouteGetVoiceMessages(t *testing.T) {
 	assert.NotEmpty(t, result[1]["id"])
 }
 
+func TestRouteGetVoiceMessagesWithSearch(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := &User{}
+	db.First(user, "user_name = ?", "user1")
+	db.Delete(&VoiceMailMessage{}, "user_id = ?", user.ID)
+	db.Create(&VoiceMailMessage{
+		MediaURL:      "url1",
+		StartTime:     time.Now(),
+		EndTime:       time.Now(),
+		UserID:        user.ID,
+		Transcription: "Your order has been shipped",
+	})
+	db.Create(&VoiceMailMessage{
+		MediaURL:      "url2",
+		StartTime:     time.Now(),
+		EndTime:       time.Now(),
+		UserID:        user.ID,
+		Transcription: "Please call me back",
+	})
+	result := []map[string]interface{}{}
+	w := makeRequest(t, api, nil, db, http.MethodGet, "/voiceMessages?q=orders", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, "Your order has been shipped", result[0]["transcription"])
+}
+
 func TestRouteDownloadVoiceMessage(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
@@ -930,6 +2461,8 @@ func TestRouteDownloadVoiceMessage(t *testing.T) {
 	assert.Equal(t, "text/plain", w.HeaderMap.Get("Content-Type"))
 	assert.Equal(t, "4", w.HeaderMap.Get("Content-Length"))
 	assert.Equal(t, "1234", w.Body.String())
+	assert.NoError(t, db.First(message, message.ID).Error)
+	assert.True(t, message.Listened)
 }
 
 func TestRouteDownloadVoiceMessageFail(t *testing.T) {
@@ -953,6 +2486,113 @@ func TestRouteDownloadVoiceMessageFail(t *testing.T) {
 	api.AssertExpectations(t)
 }
 
+func TestRouteGetVoiceMessagesFromFolder(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := &User{}
+	db.First(user, "user_name = ?", "user1")
+	db.Delete(&VoiceMailMessage{}, "user_id = ?", user.ID)
+	db.Create(&VoiceMailMessage{
+		MediaURL:  "url1",
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		UserID:    user.ID,
+	})
+	db.Create(&VoiceMailMessage{
+		MediaURL:  "url2",
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		UserID:    user.ID,
+		Listened:  true,
+	})
+	db.Create(&VoiceMailMessage{
+		MediaURL:  "url3",
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		UserID:    user.ID,
+		Folder:    ArchiveFolder,
+	})
+	result := []map[string]interface{}{}
+	w := makeRequest(t, api, nil, db, http.MethodGet, "/voiceMessages?folder=inbox", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, "inbox", result[0]["folder"])
+	assert.Equal(t, "1", w.HeaderMap.Get("X-Unread-Count"))
+	w = makeRequest(t, api, nil, db, http.MethodGet, "/voiceMessages", token, nil, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 3, len(result))
+	assert.Equal(t, "2", w.HeaderMap.Get("X-Unread-Count"))
+}
+
+func TestRouteGetVoiceMessagesFromUnknownFolder(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, api, nil, db, http.MethodGet, "/voiceMessages?folder=trash", token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRouteUpdateVoiceMessage(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := &User{}
+	db.First(user, "user_name = ?", "user1")
+	db.Delete(&VoiceMailMessage{}, "user_id = ?", user.ID)
+	message := &VoiceMailMessage{
+		MediaURL:  "http://some-host/name1",
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		UserID:    user.ID,
+	}
+	db.Create(message)
+	result := map[string]interface{}{}
+	w := makeRequest(t, api, nil, db, http.MethodPatch, fmt.Sprintf("/voiceMessages/%v", message.ID), token, gin.H{
+		"folder":   "saved",
+		"listened": true,
+	}, &result)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "saved", result["folder"])
+	assert.NoError(t, db.First(message, message.ID).Error)
+	assert.Equal(t, SavedFolder, message.Folder)
+	assert.True(t, message.Listened)
+}
+
+func TestRouteUpdateVoiceMessageFailWithUnknownFolder(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	user := &User{}
+	db.First(user, "user_name = ?", "user1")
+	message := &VoiceMailMessage{
+		MediaURL:  "http://some-host/name1",
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		UserID:    user.ID,
+	}
+	db.Create(message)
+	w := makeRequest(t, api, nil, db, http.MethodPatch, fmt.Sprintf("/voiceMessages/%v", message.ID), token, gin.H{
+		"folder": "trash",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRouteUpdateVoiceMessageFailWithUnknownMessage(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	w := makeRequest(t, api, nil, db, http.MethodPatch, "/voiceMessages/0", token, gin.H{
+		"folder": "saved",
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
 func TestRouteDeleteVoiceMessage(t *testing.T) {
 	api := &fakeCatapultAPI{}
 	db := openDBConnection(t)
@@ -1000,7 +2640,83 @@ func TestStreamNewVoceMailMessage(t *testing.T) {
 		time.Sleep(10 * time.Millisecond)
 		channel <- msg
 	}()
-	assert.True(t, streamNewVoceMailMessage(context, channel))
+	assert.True(t, streamNewVoceMailMessage(context, channel, func() bool { return true }))
+}
+
+func TestStreamUpdatedVoceMailMessage(t *testing.T) {
+	msg := &VoiceMailMessage{
+		StartTime:     parseTime("2016-05-31T10:00:00Z"),
+		EndTime:       parseTime("2016-05-31T10:01:00Z"),
+		From:          "+1234567980",
+		Transcription: "Hello",
+	}
+	msg.ID = 1
+	context := &fakeSSEEmiter{}
+	context.On("SSEvent", "update", msg.ToJSONObject()).Return()
+	channel := make(chan interface{})
+	defer close(channel)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		channel <- &voiceMailMessageUpdate{msg}
+	}()
+	assert.True(t, streamNewVoceMailMessage(context, channel, func() bool { return true }))
+	context.AssertExpectations(t)
+}
+
+func TestStreamNewVoceMailMessageWithClosedSession(t *testing.T) {
+	msg := &VoiceMailMessage{From: "+1234567980"}
+	msg.ID = 1
+	context := &fakeSSEEmiter{}
+	channel := make(chan interface{})
+	defer close(channel)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		channel <- msg
+	}()
+	assert.False(t, streamNewVoceMailMessage(context, channel, func() bool { return false }))
+	context.AssertNotCalled(t, "SSEvent", mock.Anything, mock.Anything)
+}
+
+func createStreamTicketForTest(t *testing.T, db *gorm.DB, token string) string {
+	result := map[string]string{}
+	w := makeRequest(t, nil, nil, db, http.MethodPost, "/streamTickets", token, nil, &result)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEmpty(t, result["ticket"])
+	require.NotEmpty(t, result["expire"])
+	return result["ticket"]
+}
+
+func TestRouteCreateStreamTicket(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	assert.NotEqual(t, createStreamTicketForTest(t, db, token), createStreamTicketForTest(t, db, token))
+	w := makeRequest(t, nil, nil, db, http.MethodPost, "/streamTickets", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRouteGetVoiceMessageStreamWithClosedSession(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	ticket := createStreamTicketForTest(t, db, token)
+	w := makeRequest(t, nil, nil, db, http.MethodPost, "/logout", token)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, fmt.Sprintf("/voiceMessagesStream?ticket=%s", ticket), "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRouteGetVoiceMessageStreamFail(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	token := createUserAndLogin(t, db)
+	// auth tokens are not accepted
+	w := makeRequest(t, nil, nil, db, http.MethodGet, fmt.Sprintf("/voiceMessagesStream?token=%s", token), "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, fmt.Sprintf("/voiceMessagesStream?ticket=%s", token), "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = makeRequest(t, nil, nil, db, http.MethodGet, "/voiceMessagesStream?ticket=%7B%7D", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
 
 func TestRouteGetVoiceMessageStream(t *testing.T) {
@@ -1008,15 +2724,17 @@ func TestRouteGetVoiceMessageStream(t *testing.T) {
 	db := openDBConnection(t)
 	defer db.Close()
 	token := createUserAndLogin(t, db)
-	user := &User{}
-	db.First(user, "user_name = ?", "user1")
+	ticket := createStreamTicketForTest(t, db, token)
 	go func() {
-		makeRequest(t, api, nil, db, http.MethodGet, fmt.Sprintf("/voiceMessagesStream?token=%s", token), "")
+		makeRequest(t, api, nil, db, http.MethodGet, fmt.Sprintf("/voiceMessagesStream?ticket=%s", ticket), "")
 	}()
 	time.Sleep(100 * time.Millisecond)
+	// the ticket has been used
+	w := makeRequest(t, api, nil, db, http.MethodGet, fmt.Sprintf("/voiceMessagesStream?ticket=%s", ticket), "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
 
-var newVoiceMailMessage *pubsub.PubSub
+var newVoiceMailMessage notificationBus
 
 func makeRequest(t *testing.T, api catapultAPIInterface, timerAPI timerInterface, db *gorm.DB, method, path, authToken string, body ...interface{}) *responseRecorder {
 	os.Setenv("CATAPULT_USER_ID", "userID")
@@ -1033,13 +2751,19 @@ func makeRequest(t *testing.T, api catapultAPIInterface, timerAPI timerInterface
 	})
 	require.NoError(t, getRoutes(router, db, newVoiceMailMessage))
 	var bodyIo io.Reader
+	contentType := "application/json"
 	if len(body) > 0 && body[0] != nil {
-		rawJSON, _ := json.Marshal(body[0])
-		bodyIo = bytes.NewReader(rawJSON)
+		if form, ok := body[0].(*multipartBody); ok {
+			bodyIo = bytes.NewReader(form.Data)
+			contentType = form.ContentType
+		} else {
+			rawJSON, _ := json.Marshal(body[0])
+			bodyIo = bytes.NewReader(rawJSON)
+		}
 	}
 	req, _ := http.NewRequest(method, path, bodyIo)
 	if bodyIo != nil {
-		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Type", contentType)
 	}
 	if authToken != "" {
 		req.Header.Set("Authorization", "Bearer "+authToken)
@@ -1052,6 +2776,34 @@ func makeRequest(t *testing.T, api catapultAPIInterface, timerAPI timerInterface
 	return w
 }
 
+// makeAdminRequest sends request with valid header X-Admin-Token
+func makeAdminRequest(t *testing.T, db *gorm.DB, method, path string) *responseRecorder {
+	defer os.Setenv("ADMIN_TOKEN", os.Getenv("ADMIN_TOKEN"))
+	os.Setenv("ADMIN_TOKEN", "adminToken")
+	router := gin.New()
+	require.NoError(t, getRoutes(router, db, newVoiceMailMessage))
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("X-Admin-Token", "adminToken")
+	w := &responseRecorder{httptest.NewRecorder()}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+type multipartBody struct {
+	ContentType string
+	Data        []byte
+}
+
+func createMultipartBody(t *testing.T, fieldName string, content []byte) *multipartBody {
+	data := &bytes.Buffer{}
+	writer := multipart.NewWriter(data)
+	part, err := writer.CreateFormFile(fieldName, "greeting")
+	require.NoError(t, err)
+	part.Write(content)
+	require.NoError(t, writer.Close())
+	return &multipartBody{writer.FormDataContentType(), data.Bytes()}
+}
+
 type responseRecorder struct {
 	*httptest.ResponseRecorder
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/jinzhu/gorm"
+)
+
+const holidayDateFormat = "2006-01-02"
+
+func formatDayTime(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// parseDayTime converts time like 17:30 to minutes since midnight (24:00 is allowed as end of day)
+func parseDayTime(value string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil || len(value) != 5 {
+		return 0, fmt.Errorf("Invalid time %q (use format like 09:00)", value)
+	}
+	result := hours*60 + minutes
+	if hours < 0 || minutes < 0 || minutes > 59 || result > 24*60 {
+		return 0, fmt.Errorf("Invalid time %q (use format like 09:00)", value)
+	}
+	return result, nil
+}
+
+// getLocation returns time zone of user
+func (u *User) getLocation() *time.Location {
+	if u.TimeZone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(u.TimeZone)
+	if err != nil {
+		debugf("Error on loading time zone %q: %s\n", u.TimeZone, err.Error())
+		return time.UTC
+	}
+	return location
+}
+
+// isUserAvailable returns false if calls to user should go to voice mail directly
+// (DND mode, holidays or out of working hours)
+func isUserAvailable(user *User, hours []WorkingHours, holidays []Holiday, now time.Time) bool {
+	if user.DoNotDisturb {
+		return false
+	}
+	now = now.In(user.getLocation())
+	today := now.Format(holidayDateFormat)
+	for _, holiday := range holidays {
+		if holiday.Date == today {
+			return false
+		}
+	}
+	if len(hours) == 0 {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, h := range hours {
+		if time.Weekday(h.Weekday) == now.Weekday() && minute >= h.StartMinute && minute < h.EndMinute {
+			return true
+		}
+	}
+	return false
+}
+
+func checkUserAvailability(user *User, db *gorm.DB, now time.Time) bool {
+	hours := []WorkingHours{}
+	holidays := []Holiday{}
+	if err := db.Where("user_id = ?", user.ID).Find(&hours).Error; err != nil {
+		debugf("Error on getting working hours: %s\n", err.Error())
+		return true
+	}
+	if err := db.Where("user_id = ?", user.ID).Find(&holidays).Error; err != nil {
+		debugf("Error on getting holidays: %s\n", err.Error())
+		return true
+	}
+	return isUserAvailable(user, hours, holidays, now)
+}
+
+func parseWorkingHours(forms []WorkingHoursForm) ([]WorkingHours, error) {
+	result := make([]WorkingHours, len(forms))
+	for i, form := range forms {
+		if form.Weekday < int(time.Sunday) || form.Weekday > int(time.Saturday) {
+			return nil, errors.New("Week day should be between 0 (Sunday) and 6 (Saturday)")
+		}
+		start, err := parseDayTime(form.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseDayTime(form.End)
+		if err != nil {
+			return nil, err
+		}
+		if start >= end {
+			return nil, fmt.Errorf("Start time %s should be before end time %s", form.Start, form.End)
+		}
+		result[i] = WorkingHours{Weekday: form.Weekday, StartMinute: start, EndMinute: end}
+	}
+	return result, nil
+}
+
+// startAfterHoursVoiceMail moves answered incoming call to voice mail without ringing the user
+func startAfterHoursVoiceMail(callID string, user *User, host string, now time.Time, api catapultAPIInterface) {
+	api.UpdateCall(callID, &bandwidth.UpdateCallData{
+		CallbackURL: buildCallbackURL(host, "/transferCallback"),
+	})
+	startVoiceMailRecording(callID, user, AfterHoursGreeting, now, api)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bandwidthcom/go-bandwidth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDayTime(t *testing.T) {
+	tests := []struct {
+		Value   string
+		Minutes int
+		Valid   bool
+	}{
+		{"00:00", 0, true},
+		{"09:30", 570, true},
+		{"24:00", 1440, true},
+		{"24:01", 0, false},
+		{"9:30", 0, false},
+		{"09:60", 0, false},
+		{"abcde", 0, false},
+	}
+	for _, test := range tests {
+		minutes, err := parseDayTime(test.Value)
+		if test.Valid {
+			assert.NoError(t, err, test.Value)
+			assert.Equal(t, test.Minutes, minutes, test.Value)
+			assert.Equal(t, test.Value, formatDayTime(minutes))
+		} else {
+			assert.Error(t, err, test.Value)
+		}
+	}
+}
+
+func TestParseWorkingHours(t *testing.T) {
+	hours, err := parseWorkingHours([]WorkingHoursForm{{Weekday: 1, Start: "09:00", End: "17:30"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []WorkingHours{{Weekday: 1, StartMinute: 540, EndMinute: 1050}}, hours)
+	_, err = parseWorkingHours([]WorkingHoursForm{{Weekday: 7, Start: "09:00", End: "17:00"}})
+	assert.Error(t, err)
+	_, err = parseWorkingHours([]WorkingHoursForm{{Weekday: 1, Start: "17:00", End: "09:00"}})
+	assert.Error(t, err)
+}
+
+func TestIsUserAvailable(t *testing.T) {
+	clock := &fakeTimerAPI{}
+	weekdays := []WorkingHours{}
+	for day := 1; day <= 5; day++ {
+		weekdays = append(weekdays, WorkingHours{Weekday: day, StartMinute: 9 * 60, EndMinute: 17 * 60})
+	}
+	holidays := []Holiday{{Date: "2016-12-26"}}
+	tests := []struct {
+		Name      string
+		User      User
+		Hours     []WorkingHours
+		Time      time.Time
+		Available bool
+	}{
+		{"no schedule", User{}, nil, time.Date(2016, 12, 25, 3, 0, 0, 0, time.UTC), true},
+		{"do not disturb", User{DoNotDisturb: true}, nil, time.Date(2016, 12, 20, 12, 0, 0, 0, time.UTC), false},
+		{"working hours", User{}, weekdays, time.Date(2016, 12, 20, 12, 0, 0, 0, time.UTC), true},
+		{"start of working hours", User{}, weekdays, time.Date(2016, 12, 20, 9, 0, 0, 0, time.UTC), true},
+		{"end of working hours", User{}, weekdays, time.Date(2016, 12, 20, 17, 0, 0, 0, time.UTC), false},
+		{"weekend", User{}, weekdays, time.Date(2016, 12, 24, 12, 0, 0, 0, time.UTC), false},
+		{"holiday", User{}, weekdays, time.Date(2016, 12, 26, 12, 0, 0, 0, time.UTC), false},
+		{"holiday without schedule", User{}, nil, time.Date(2016, 12, 26, 12, 0, 0, 0, time.UTC), false},
+		{"time zone", User{TimeZone: "America/New_York"}, weekdays, time.Date(2016, 12, 20, 15, 0, 0, 0, time.UTC), true},
+		{"out of hours in time zone", User{TimeZone: "America/New_York"}, weekdays, time.Date(2016, 12, 20, 23, 0, 0, 0, time.UTC), false},
+		{"holiday in time zone", User{TimeZone: "America/New_York"}, weekdays, time.Date(2016, 12, 27, 2, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		clock.CurrentTime = test.Time
+		assert.Equal(t, test.Available, isUserAvailable(&test.User, test.Hours, holidays, clock.Now()), test.Name)
+	}
+}
+
+func TestStartAfterHoursVoiceMail(t *testing.T) {
+	api := &fakeCatapultAPI{}
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{CallbackURL: "http://localhost/transferCallback?secret=callbackSecret"}).Return("", nil)
+	api.On("PlayAudioToCall", "callID", "http://afterHours").Return(nil)
+	api.On("PlayAudioToCall", "callID", beepURL).Return(nil)
+	api.On("UpdateCall", "callID", &bandwidth.UpdateCallData{RecordingEnabled: true}).Return("", nil)
+	startAfterHoursVoiceMail("callID", &User{AfterHoursGreetingURL: "http://afterHours"}, "localhost", time.Now(), api)
+	api.AssertExpectations(t)
+}
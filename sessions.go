@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// sessionActivityInterval is precision of last usage time of sessions (it is not updated on each request)
+const sessionActivityInterval = time.Minute
+
+var errSessionClosed = errors.New("Session has been closed")
+
+// Session model is a login of a user on some device. Auth tokens contain token id of their session (claim jti),
+// tokens of removed (logged out) and expired sessions are rejected.
+type Session struct {
+	gorm.Model
+	TokenID    string    `gorm:"column:token_id;type:varchar(64);unique_index"`
+	UserID     uint      `gorm:"column:user_id;index"`
+	UserAgent  string    `gorm:"column:user_agent;type:varchar(512)"`
+	IPAddress  string    `gorm:"column:ip_address;type:varchar(64)"`
+	LastUsedAt time.Time `gorm:"column:last_used_at"`
+	ExpiresAt  time.Time `gorm:"column:expires_at"` // tokens of the session can't be refreshed after this time
+}
+
+// ToJSONObject returns data of session which are visible to user
+func (s *Session) ToJSONObject(current bool) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         s.ID,
+		"userAgent":  s.UserAgent,
+		"ipAddress":  s.IPAddress,
+		"createdAt":  s.CreatedAt,
+		"lastUsedAt": s.LastUsedAt,
+		"expiresAt":  s.ExpiresAt,
+		"current":    current,
+	}
+}
+
+// createSession starts new session of user and removes expired ones
+func createSession(user *User, userAgent string, ipAddress string, lifetime time.Duration, now time.Time,
+	db *gorm.DB) (*Session, error) {
+	tokenID := make([]byte, 16)
+	if _, err := rand.Read(tokenID); err != nil {
+		return nil, err
+	}
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	session := &Session{
+		TokenID:    hex.EncodeToString(tokenID),
+		UserID:     user.ID,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(lifetime),
+	}
+	if err := db.Unscoped().Where("user_id = ? AND expires_at <= ?", user.ID, now).Delete(&Session{}).Error; err != nil {
+		return nil, err
+	}
+	return session, db.Create(session).Error
+}
+
+// getSession returns active session of user by token id
+func getSession(user *User, tokenID string, now time.Time, db *gorm.DB) (*Session, error) {
+	session := &Session{}
+	if tokenID == "" || db.First(session, "token_id = ? AND user_id = ?", tokenID, user.ID).RecordNotFound() {
+		return nil, errSessionClosed
+	}
+	if !now.Before(session.ExpiresAt) {
+		return nil, errSessionClosed
+	}
+	if now.Sub(session.LastUsedAt) >= sessionActivityInterval {
+		session.LastUsedAt = now
+		db.Model(session).UpdateColumn("last_used_at", now)
+	}
+	return session, nil
+}
+
+// isSessionActive checks if the session has not been closed or expired since it was loaded
+func isSessionActive(session *Session, now time.Time, db *gorm.DB) (bool, error) {
+	found := &Session{}
+	if err := db.First(found, session.ID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return now.Before(found.ExpiresAt), nil
+}
+
+// getSessions returns active sessions of user (recently used first)
+func getSessions(user *User, now time.Time, db *gorm.DB) ([]Session, error) {
+	sessions := []Session{}
+	err := db.Order("last_used_at DESC").Find(&sessions, "user_id = ? AND expires_at > ?", user.ID, now).Error
+	return sessions, err
+}
+
+// closeSessions removes sessions of user except given one (0 means all sessions)
+func closeSessions(user *User, exceptID uint, db *gorm.DB) error {
+	query := db.Where("user_id = ?", user.ID)
+	if exceptID != 0 {
+		query = query.Where("id <> ?", exceptID)
+	}
+	return query.Delete(&Session{}).Error
+}
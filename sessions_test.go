@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateSession(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	expired, err := createSession(user, "agent", "127.0.0.1", time.Hour, now.Add(-2*time.Hour), db)
+	require.NoError(t, err)
+	session, err := createSession(user, "agent", "127.0.0.1", time.Hour, now, db)
+	require.NoError(t, err)
+	assert.Len(t, session.TokenID, 32)
+	assert.NotEqual(t, expired.TokenID, session.TokenID)
+	// expired sessions are removed
+	count := 0
+	db.Unscoped().Model(&Session{}).Where("user_id = ?", user.ID).Count(&count)
+	assert.Equal(t, 1, count)
+	found, err := getSession(user, session.TokenID, now, db)
+	require.NoError(t, err)
+	assert.Equal(t, session.ID, found.ID)
+}
+
+func TestGetSessionFail(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	session, err := createSession(user, "", "", time.Hour, now, db)
+	require.NoError(t, err)
+	_, err = getSession(user, "", now, db)
+	assert.Equal(t, errSessionClosed, err)
+	_, err = getSession(&User{}, session.TokenID, now, db)
+	assert.Equal(t, errSessionClosed, err)
+	_, err = getSession(user, session.TokenID, now.Add(time.Hour), db)
+	assert.Equal(t, errSessionClosed, err)
+	require.NoError(t, closeSessions(user, 0, db))
+	_, err = getSession(user, session.TokenID, now, db)
+	assert.Equal(t, errSessionClosed, err)
+}
+
+func TestGetSessionUpdatesLastUsage(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	session, err := createSession(user, "", "", time.Hour, now, db)
+	require.NoError(t, err)
+	later := now.Add(2 * sessionActivityInterval)
+	_, err = getSession(user, session.TokenID, later, db)
+	require.NoError(t, err)
+	sessions, err := getSessions(user, later, db)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, later.Unix(), sessions[0].LastUsedAt.Unix())
+}
+
+func TestCloseSessions(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	session1, _ := createSession(user, "", "", time.Hour, now, db)
+	createSession(user, "", "", time.Hour, now, db)
+	require.NoError(t, closeSessions(user, session1.ID, db))
+	sessions, err := getSessions(user, now, db)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, session1.ID, sessions[0].ID)
+}
+
+func TestIsSessionActive(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	session, err := createSession(user, "", "", time.Hour, now, db)
+	require.NoError(t, err)
+	active, err := isSessionActive(session, now, db)
+	require.NoError(t, err)
+	assert.True(t, active)
+	active, err = isSessionActive(session, now.Add(time.Hour), db)
+	require.NoError(t, err)
+	assert.False(t, active)
+	require.NoError(t, closeSessions(user, 0, db))
+	active, err = isSessionActive(session, now, db)
+	require.NoError(t, err)
+	assert.False(t, active)
+}
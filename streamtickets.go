@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const streamTicketLifetime = 60 * time.Second
+
+var errInvalidStreamTicket = errors.New("Invalid or expired stream ticket")
+
+// StreamTicket model is a single-use ticket which opens the stream of voice messages. EventSource can't send header
+// Authorization, so a short-lived ticket is passed in the url instead of auth token. Only hash of the ticket is
+// stored.
+type StreamTicket struct {
+	gorm.Model
+	TicketHash string    `gorm:"column:ticket_hash;type:varchar(64);unique_index"`
+	UserID     uint      `gorm:"column:user_id;index"`
+	SessionID  uint      `gorm:"column:session_id"`
+	ExpiresAt  time.Time `gorm:"column:expires_at"`
+}
+
+func hashStreamTicket(ticket string) string {
+	hash := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(hash[:])
+}
+
+// createStreamTicket issues a ticket for the session and removes expired tickets of the user
+func createStreamTicket(session *Session, now time.Time, db *gorm.DB) (string, time.Time, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return "", time.Time{}, err
+	}
+	ticket := hex.EncodeToString(value)
+	streamTicket := &StreamTicket{
+		TicketHash: hashStreamTicket(ticket),
+		UserID:     session.UserID,
+		SessionID:  session.ID,
+		ExpiresAt:  now.Add(streamTicketLifetime),
+	}
+	if err := db.Unscoped().Where("user_id = ? AND expires_at <= ?", session.UserID, now).Delete(&StreamTicket{}).Error; err != nil {
+		return "", time.Time{}, err
+	}
+	if err := db.Create(streamTicket).Error; err != nil {
+		return "", time.Time{}, err
+	}
+	return ticket, streamTicket.ExpiresAt, nil
+}
+
+// redeemStreamTicket removes the ticket and returns its user and session. Tickets of closed sessions are invalid.
+func redeemStreamTicket(ticket string, now time.Time, db *gorm.DB) (*User, *Session, error) {
+	streamTicket := &StreamTicket{}
+	if ticket == "" || db.First(streamTicket, "ticket_hash = ?", hashStreamTicket(ticket)).RecordNotFound() {
+		return nil, nil, errInvalidStreamTicket
+	}
+	// only one request removes the ticket if it is used concurrently
+	result := db.Unscoped().Delete(streamTicket)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	if result.RowsAffected == 0 || !now.Before(streamTicket.ExpiresAt) {
+		return nil, nil, errInvalidStreamTicket
+	}
+	session := &Session{}
+	if db.First(session, "id = ? AND user_id = ?", streamTicket.SessionID, streamTicket.UserID).RecordNotFound() ||
+		!now.Before(session.ExpiresAt) {
+		return nil, nil, errInvalidStreamTicket
+	}
+	user := &User{}
+	if err := db.First(user, streamTicket.UserID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, errInvalidStreamTicket
+		}
+		return nil, nil, err
+	}
+	return user, session, nil
+}
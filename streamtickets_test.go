@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedeemStreamTicket(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	session, err := createSession(user, "", "", time.Hour, now, db)
+	require.NoError(t, err)
+	ticket, expire, err := createStreamTicket(session, now, db)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(streamTicketLifetime), expire)
+	found, foundSession, err := redeemStreamTicket(ticket, now, db)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+	assert.Equal(t, session.ID, foundSession.ID)
+	// ticket can be used once
+	_, _, err = redeemStreamTicket(ticket, now, db)
+	assert.Equal(t, errInvalidStreamTicket, err)
+}
+
+func TestRedeemStreamTicketFail(t *testing.T) {
+	db := openDBConnection(t)
+	defer db.Close()
+	now := time.Now()
+	user := &User{UserName: "user1", AreaCode: "999"}
+	require.NoError(t, db.Create(user).Error)
+	session, err := createSession(user, "", "", time.Hour, now, db)
+	require.NoError(t, err)
+	_, _, err = redeemStreamTicket("", now, db)
+	assert.Equal(t, errInvalidStreamTicket, err)
+	_, _, err = redeemStreamTicket("unknown", now, db)
+	assert.Equal(t, errInvalidStreamTicket, err)
+	ticket, _, err := createStreamTicket(session, now, db)
+	require.NoError(t, err)
+	_, _, err = redeemStreamTicket(ticket, now.Add(streamTicketLifetime), db)
+	assert.Equal(t, errInvalidStreamTicket, err)
+	// tickets of closed sessions are invalid
+	ticket, _, err = createStreamTicket(session, now, db)
+	require.NoError(t, err)
+	require.NoError(t, closeSessions(user, 0, db))
+	_, _, err = redeemStreamTicket(ticket, now, db)
+	assert.Equal(t, errInvalidStreamTicket, err)
+}
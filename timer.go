@@ -9,11 +9,11 @@ import (
 type timer struct{}
 
 type timerInterface interface {
-	Sleep(d time.Duration)
+	Now() time.Time
 }
 
-func (t *timer) Sleep(d time.Duration) {
-	time.Sleep(d)
+func (t *timer) Now() time.Time {
+	return time.Now()
 }
 
 func timerMiddleware(c *gin.Context) {